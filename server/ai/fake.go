@@ -0,0 +1,104 @@
+package ai
+
+import (
+	"context"
+	"strings"
+	"sync"
+)
+
+// FakeProvider is an in-memory provider for tests and local development.
+// It returns canned responses and records every request it receives.
+type FakeProvider struct {
+	mu sync.Mutex
+
+	// Response is returned when the queue of responses is empty
+	Response string
+	// Err, when set, is returned by every call
+	Err error
+
+	queue          []string
+	calls          []CompletionRequest
+	visionRequests []VisionRequest
+}
+
+// NewFakeProvider creates a fake provider that answers with the given responses in order
+func NewFakeProvider(responses ...string) *FakeProvider {
+	return &FakeProvider{
+		Response: "<داروها>\nپاسخ آزمایشی\n</داروها>",
+		queue:    responses,
+	}
+}
+
+// Complete records the request and returns the next canned response
+func (f *FakeProvider) Complete(ctx context.Context, req CompletionRequest) (*CompletionResponse, error) {
+	f.mu.Lock()
+	f.calls = append(f.calls, req)
+	f.mu.Unlock()
+
+	return f.next(ctx)
+}
+
+// CompleteVision records the request and returns the next canned response
+func (f *FakeProvider) CompleteVision(ctx context.Context, req VisionRequest) (*CompletionResponse, error) {
+	f.mu.Lock()
+	f.visionRequests = append(f.visionRequests, req)
+	f.mu.Unlock()
+
+	return f.next(ctx)
+}
+
+// Stream records the request and emits the next canned response word by word
+func (f *FakeProvider) Stream(ctx context.Context, req CompletionRequest, onDelta DeltaFunc) (*CompletionResponse, error) {
+	f.mu.Lock()
+	f.calls = append(f.calls, req)
+	f.mu.Unlock()
+
+	resp, err := f.next(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if onDelta != nil {
+		for _, word := range strings.SplitAfter(resp.Content, " ") {
+			onDelta(word)
+		}
+	}
+
+	return resp, nil
+}
+
+// Calls returns a copy of all text completion requests received so far
+func (f *FakeProvider) Calls() []CompletionRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]CompletionRequest(nil), f.calls...)
+}
+
+// VisionCalls returns a copy of all vision requests received so far
+func (f *FakeProvider) VisionCalls() []VisionRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]VisionRequest(nil), f.visionRequests...)
+}
+
+// next pops the next queued response or falls back to the default one
+func (f *FakeProvider) next(ctx context.Context) (*CompletionResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.Err != nil {
+		return nil, f.Err
+	}
+
+	content := f.Response
+	if len(f.queue) > 0 {
+		content = f.queue[0]
+		f.queue = f.queue[1:]
+	}
+
+	return &CompletionResponse{Content: content, Model: "fake"}, nil
+}
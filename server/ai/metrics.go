@@ -0,0 +1,68 @@
+package ai
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/darooyar/server/metrics"
+)
+
+// Endpoints of a provider, as labelled in the metrics
+const (
+	endpointComplete = "complete"
+	endpointVision   = "vision"
+	endpointStream   = "stream"
+)
+
+// instrumentedProvider records the latency, errors and token usage of every
+// call to the provider it wraps
+type instrumentedProvider struct {
+	provider Provider
+	model    string
+}
+
+// instrument wraps a provider so that its calls are exported as metrics,
+// labelled with the configured model
+func instrument(provider Provider, model string) Provider {
+	return &instrumentedProvider{provider: provider, model: model}
+}
+
+// Complete runs a text chat completion
+func (p *instrumentedProvider) Complete(ctx context.Context, req CompletionRequest) (*CompletionResponse, error) {
+	start := time.Now()
+	resp, err := p.provider.Complete(ctx, req)
+	p.observe(endpointComplete, start, resp, err)
+	return resp, err
+}
+
+// CompleteVision runs a chat completion over a single image
+func (p *instrumentedProvider) CompleteVision(ctx context.Context, req VisionRequest) (*CompletionResponse, error) {
+	start := time.Now()
+	resp, err := p.provider.CompleteVision(ctx, req)
+	p.observe(endpointVision, start, resp, err)
+	return resp, err
+}
+
+// Stream runs a text chat completion and reports content deltas as they arrive
+func (p *instrumentedProvider) Stream(ctx context.Context, req CompletionRequest, onDelta DeltaFunc) (*CompletionResponse, error) {
+	start := time.Now()
+	resp, err := p.provider.Stream(ctx, req, onDelta)
+	p.observe(endpointStream, start, resp, err)
+	return resp, err
+}
+
+// observe records one call. Calls canceled by the client are not counted as
+// errors of the provider.
+func (p *instrumentedProvider) observe(endpoint string, start time.Time, resp *CompletionResponse, err error) {
+	metrics.AIRequestDuration.WithLabelValues(p.model, endpoint).Observe(time.Since(start).Seconds())
+
+	if err != nil && !errors.Is(err, context.Canceled) {
+		metrics.AIRequestErrors.WithLabelValues(p.model, endpoint).Inc()
+	}
+
+	if resp != nil {
+		metrics.AITokens.WithLabelValues(p.model, endpoint, "prompt").Add(float64(resp.PromptTokens))
+		metrics.AITokens.WithLabelValues(p.model, endpoint, "completion").Add(float64(resp.CompletionTokens))
+	}
+}
@@ -0,0 +1,202 @@
+package ai
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// OpenAIProvider talks to any OpenAI-compatible chat completion API
+type OpenAIProvider struct {
+	client *openai.Client
+	model  string
+}
+
+// NewOpenAIProvider creates a provider for an OpenAI-compatible endpoint
+func NewOpenAIProvider(baseURL, apiKey, model string) *OpenAIProvider {
+	config := openai.DefaultConfig(apiKey)
+	if baseURL != "" {
+		config.BaseURL = baseURL
+	}
+
+	// Configure HTTP client with longer timeouts for image processing
+	transport := &http.Transport{
+		TLSHandshakeTimeout: 20 * time.Second,
+		DisableKeepAlives:   false,
+		MaxIdleConns:        10,
+		MaxIdleConnsPerHost: 5,
+		IdleConnTimeout:     90 * time.Second,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+	}
+
+	// Streaming responses can outlive a fixed client timeout, so only the wait
+	// for response headers is bounded here and callers bound the rest with ctx
+	transport.ResponseHeaderTimeout = 60 * time.Second
+	config.HTTPClient = &http.Client{
+		Transport: transport,
+	}
+
+	slog.Info("AI provider initialized", "base_url", config.BaseURL, "model", model)
+
+	return &OpenAIProvider{
+		client: openai.NewClientWithConfig(config),
+		model:  model,
+	}
+}
+
+// Complete runs a text chat completion
+func (p *OpenAIProvider) Complete(ctx context.Context, req CompletionRequest) (*CompletionResponse, error) {
+	messages := make([]openai.ChatCompletionMessage, 0, len(req.Messages))
+	for _, m := range req.Messages {
+		messages = append(messages, openai.ChatCompletionMessage{
+			Role:    m.Role,
+			Content: m.Content,
+		})
+	}
+
+	return p.createChatCompletion(ctx, messages, req.MaxTokens, req.Temperature)
+}
+
+// CompleteVision runs a chat completion over a single image
+func (p *OpenAIProvider) CompleteVision(ctx context.Context, req VisionRequest) (*CompletionResponse, error) {
+	var messages []openai.ChatCompletionMessage
+	if req.SystemPrompt != "" {
+		messages = append(messages, openai.ChatCompletionMessage{
+			Role:    openai.ChatMessageRoleSystem,
+			Content: req.SystemPrompt,
+		})
+	}
+
+	messages = append(messages, openai.ChatCompletionMessage{
+		Role: openai.ChatMessageRoleUser,
+		MultiContent: []openai.ChatMessagePart{
+			{
+				Type: openai.ChatMessagePartTypeText,
+				Text: req.Prompt,
+			},
+			{
+				Type: openai.ChatMessagePartTypeImageURL,
+				ImageURL: &openai.ChatMessageImageURL{
+					URL: req.ImageURL,
+				},
+			},
+		},
+	})
+
+	return p.createChatCompletion(ctx, messages, req.MaxTokens, req.Temperature)
+}
+
+// Stream runs a text chat completion and reports content deltas as they arrive
+func (p *OpenAIProvider) Stream(ctx context.Context, req CompletionRequest, onDelta DeltaFunc) (*CompletionResponse, error) {
+	maxTokens := req.MaxTokens
+	if maxTokens <= 0 {
+		maxTokens = DefaultMaxTokens
+	}
+
+	messages := make([]openai.ChatCompletionMessage, 0, len(req.Messages))
+	for _, m := range req.Messages {
+		messages = append(messages, openai.ChatCompletionMessage{
+			Role:    m.Role,
+			Content: m.Content,
+		})
+	}
+
+	stream, err := p.client.CreateChatCompletionStream(ctx, openai.ChatCompletionRequest{
+		Model:       p.model,
+		Messages:    messages,
+		MaxTokens:   maxTokens,
+		Temperature: req.Temperature,
+		Stream:      true,
+		// The last chunk then reports the token usage of the completion
+		StreamOptions: &openai.StreamOptions{IncludeUsage: true},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("ai chat completion stream failed: %w", err)
+	}
+	defer stream.Close()
+
+	var content strings.Builder
+	var usage openai.Usage
+	model := p.model
+	for {
+		chunk, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			if ctx.Err() == context.DeadlineExceeded {
+				return nil, fmt.Errorf("ai request timed out: %w", ctx.Err())
+			}
+			return nil, fmt.Errorf("ai chat completion stream interrupted: %w", err)
+		}
+
+		if chunk.Model != "" {
+			model = chunk.Model
+		}
+		if chunk.Usage != nil {
+			usage = *chunk.Usage
+		}
+		if len(chunk.Choices) == 0 || chunk.Choices[0].Delta.Content == "" {
+			continue
+		}
+
+		delta := chunk.Choices[0].Delta.Content
+		content.WriteString(delta)
+		if onDelta != nil {
+			onDelta(delta)
+		}
+	}
+
+	if content.Len() == 0 {
+		return nil, ErrEmptyResponse
+	}
+
+	return &CompletionResponse{
+		Content:          content.String(),
+		Model:            model,
+		PromptTokens:     usage.PromptTokens,
+		CompletionTokens: usage.CompletionTokens,
+	}, nil
+}
+
+// createChatCompletion sends the messages and extracts the first choice
+func (p *OpenAIProvider) createChatCompletion(ctx context.Context, messages []openai.ChatCompletionMessage, maxTokens int, temperature float32) (*CompletionResponse, error) {
+	if maxTokens <= 0 {
+		maxTokens = DefaultMaxTokens
+	}
+
+	resp, err := p.client.CreateChatCompletion(ctx, openai.ChatCompletionRequest{
+		Model:       p.model,
+		Messages:    messages,
+		MaxTokens:   maxTokens,
+		Temperature: temperature,
+	})
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, fmt.Errorf("ai request timed out: %w", ctx.Err())
+		}
+		return nil, fmt.Errorf("ai chat completion failed: %w", err)
+	}
+
+	if len(resp.Choices) == 0 || resp.Choices[0].Message.Content == "" {
+		return nil, ErrEmptyResponse
+	}
+
+	return &CompletionResponse{
+		Content:          resp.Choices[0].Message.Content,
+		Model:            resp.Model,
+		PromptTokens:     resp.Usage.PromptTokens,
+		CompletionTokens: resp.Usage.CompletionTokens,
+	}, nil
+}
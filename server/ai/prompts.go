@@ -0,0 +1,92 @@
+package ai
+
+import "fmt"
+
+// PrescriptionSections lists the tagged sections every prescription analysis must contain
+const PrescriptionSections = `<داروها>
+لیست کامل داروها را بنویس و برای هر دارو یک توضیح کامل بنویس که شامل دسته دارویی، مکانیسم اثر و کاربرد اصلی آن باشد. حتما همه داروهای موجود در نسخه را بررسی کن و هیچ دارویی را از قلم نینداز.
+</داروها>
+
+<تشخیص>
+با توجه به ترکیب داروها، تشخیص احتمالی را با جزئیات کامل توضیح بده و دلیل استفاده از هر دارو را در درمان این عارضه شرح بده.
+</تشخیص>
+
+<تداخلات>
+تمام تداخلات بین داروهای نسخه را با جزئیات بررسی کن. برای هر تداخل، شدت آن، مکانیسم تداخل و راهکارهای مدیریت آن را توضیح بده. اگر تداخل مهمی وجود ندارد، به صراحت ذکر کن.
+</تداخلات>
+
+<عوارض>
+عوارض شایع و مهم هر دارو را به تفکیک بنویس و توضیح بده که بیمار چگونه باید این عوارض را مدیریت کند. عوارض خطرناک که نیاز به مراجعه فوری به پزشک دارند را مشخص کن.
+</عوارض>
+
+<زمان_مصرف>
+برای هر دارو، بهترین زمان مصرف را با دلیل آن توضیح بده. مثلا صبح، شب، قبل از خواب، یا در زمان‌های خاص دیگر.
+</زمان_مصرف>
+
+<مصرف_با_غذا>
+برای هر دارو مشخص کن که آیا باید با غذا، با معده خالی، یا با فاصله از غذا مصرف شود و دلیل این توصیه را توضیح بده.
+</مصرف_با_غذا>
+
+<دوز_مصرف>
+دوز و تعداد دفعات مصرف هر دارو را به صورت دقیق بنویس و در صورت نیاز، توضیح بده که چرا این دوز توصیه شده است.
+</دوز_مصرف>
+
+<مدیریت_عارضه>
+توصیه‌های تکمیلی برای مدیریت بیماری یا عارضه را بنویس، مانند رژیم غذایی خاص، فعالیت‌های فیزیکی توصیه شده یا منع شده، و سایر نکات مهم برای بهبود اثربخشی درمان.
+</مدیریت_عارضه>`
+
+// PrescriptionSystemPrompt is the system prompt for analyzing a prescription given as text
+const PrescriptionSystemPrompt = `من مسئول فنی یک داروخانه شهری هستم
+
+خوب فکر کن و تمام جوانب رو بررسی کن و با استدلال جواب بده
+
+و به این شکل به من در مورد این نسخه جواب بده:
+
+با سلام همکار گرامی،
+
+با بررسی داروهای موجود در نسخه، اطلاعات زیر را خدمت شما ارائه می‌دهم:
+
+` + PrescriptionSections
+
+// ImageSystemPrompt is the system prompt for analyzing a prescription image
+const ImageSystemPrompt = "من مسئول فنی یک داروخانه شهری هستم. لطفا تصویر نسخه ارسالی را تحلیل کن و به صورت ساختار یافته پاسخ بده. پاسخ باید شامل این بخش‌ها باشد:\n\n" + PrescriptionSections
+
+// ImageUserPrompt is the user turn sent alongside a prescription image
+const ImageUserPrompt = "لطفا این نسخه تصویری را تحلیل کنید:"
+
+// ImageURLPrompt builds a text-only prompt pointing the model at an image URL.
+// It is used as a fallback for models that cannot accept inline images.
+func ImageURLPrompt(imageURL string) string {
+	return fmt.Sprintf(`من مسئول فنی یک داروخانه شهری هستم
+
+خوب فکر کن و تمام جوانب رو بررسی کن و با استدلال جواب بده
+
+به این نسخه تصویری نگاه کن و به من کمک کن. تصویر نسخه در این آدرس قابل مشاهده است: %s
+
+با سلام همکار گرامی،
+
+با بررسی داروهای موجود در نسخه، اطلاعات زیر را خدمت شما ارائه می‌دهم:
+
+`, imageURL) + PrescriptionSections
+}
+
+// ChatSystemPrompt is the system prompt for replying to chat messages that are
+// not prescriptions, such as follow-up questions about an earlier analysis
+const ChatSystemPrompt = `من مسئول فنی یک داروخانه شهری هستم و در این گفتگو درباره نسخه‌ها و داروها با تو مشورت می‌کنم.
+
+به پیام آخر من با توجه به کل گفتگو و نسخه‌هایی که قبلا بررسی کرده‌ای پاسخ بده. پاسخ را دقیق، مستدل و در حد نیاز کوتاه بنویس و اگر پاسخ به اطلاعات بیشتری از بیمار نیاز دارد، آن را بپرس.`
+
+// SummarySystemPrompt is the system prompt for summarizing the older turns of
+// a chat that no longer fit in the history sent with a reply
+const SummarySystemPrompt = `گفتگوی زیر بین مسئول فنی یک داروخانه و دستیار دارویی است. آن را به صورت فشرده خلاصه کن.
+
+نام داروها، دوزها، تشخیص‌ها، تداخلات، ویژگی‌های بیمار مانند سن، بارداری یا بیماری‌های زمینه‌ای و سوال‌هایی که هنوز پاسخ داده نشده‌اند را حتما نگه دار. فقط خلاصه را بنویس.`
+
+// ImageMessagePlaceholder stands in for a prescription image in the chat
+// history, which is sent as text. The analysis of the image follows it.
+const ImageMessagePlaceholder = "[تصویر یک نسخه ارسال شد]"
+
+// HistorySummaryPrompt introduces the summary of the turns left out of the history
+func HistorySummaryPrompt(summary string) string {
+	return "خلاصه بخش‌های قبلی این گفتگو:\n\n" + summary
+}
@@ -0,0 +1,89 @@
+package ai
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/darooyar/server/config"
+)
+
+// Message roles understood by every provider
+const (
+	RoleSystem    = "system"
+	RoleUser      = "user"
+	RoleAssistant = "assistant"
+)
+
+// Default generation settings used by the prescription analysis paths
+const (
+	DefaultMaxTokens   = 2000
+	DefaultTemperature = 0.7
+)
+
+// ErrNotConfigured is returned when the selected provider is missing required settings
+var ErrNotConfigured = errors.New("ai provider not configured")
+
+// ErrEmptyResponse is returned when the provider answered without any content
+var ErrEmptyResponse = errors.New("empty response from ai provider")
+
+// Message is a single chat turn sent to a provider
+type Message struct {
+	Role    string
+	Content string
+}
+
+// CompletionRequest is a text-only chat completion request
+type CompletionRequest struct {
+	Messages    []Message
+	MaxTokens   int
+	Temperature float32
+}
+
+// VisionRequest is a chat completion request carrying a single image
+type VisionRequest struct {
+	SystemPrompt string
+	Prompt       string
+	// ImageURL can be a regular URL or a base64 data URI
+	ImageURL    string
+	MaxTokens   int
+	Temperature float32
+}
+
+// CompletionResponse is the provider-independent result of a completion
+type CompletionResponse struct {
+	Content string
+	Model   string
+	// Token usage reported by the provider, zero when it reports none
+	PromptTokens     int
+	CompletionTokens int
+}
+
+// Provider is implemented by every AI backend the server can talk to
+type Provider interface {
+	// Complete runs a text chat completion
+	Complete(ctx context.Context, req CompletionRequest) (*CompletionResponse, error)
+	// CompleteVision runs a chat completion over a single image
+	CompleteVision(ctx context.Context, req VisionRequest) (*CompletionResponse, error)
+	// Stream runs a text chat completion, calling onDelta for every chunk of
+	// content as it arrives and returning the full content once finished
+	Stream(ctx context.Context, req CompletionRequest, onDelta DeltaFunc) (*CompletionResponse, error)
+}
+
+// DeltaFunc receives incremental content while a completion is streamed
+type DeltaFunc func(delta string)
+
+// NewProvider creates the provider selected in the configuration
+func NewProvider(cfg *config.Config) (Provider, error) {
+	switch cfg.AIProvider {
+	case "", "openai":
+		if cfg.AIAPIKey == "" {
+			return nil, fmt.Errorf("%w: AI_API_KEY is not set", ErrNotConfigured)
+		}
+		return instrument(NewOpenAIProvider(cfg.AIBaseURL, cfg.AIAPIKey, cfg.AIModel), cfg.AIModel), nil
+	case "fake":
+		return instrument(NewFakeProvider(), "fake"), nil
+	default:
+		return nil, fmt.Errorf("unknown ai provider %q", cfg.AIProvider)
+	}
+}
@@ -0,0 +1,489 @@
+// Package analysis turns the tagged text produced by the AI prescription
+// analysis into structured data.
+package analysis
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/darooyar/server/models"
+	"github.com/darooyar/server/textnorm"
+)
+
+// Section tags requested by the prescription prompts
+const (
+	SectionDrugs        = "داروها"
+	SectionDiagnosis    = "تشخیص"
+	SectionInteractions = "تداخلات"
+	SectionSideEffects  = "عوارض"
+	SectionTiming       = "زمان_مصرف"
+	SectionFood         = "مصرف_با_غذا"
+	SectionDose         = "دوز_مصرف"
+	SectionManagement   = "مدیریت_عارضه"
+)
+
+var sectionTags = []string{
+	SectionDrugs,
+	SectionDiagnosis,
+	SectionInteractions,
+	SectionSideEffects,
+	SectionTiming,
+	SectionFood,
+	SectionDose,
+	SectionManagement,
+}
+
+var (
+	// listItemPattern matches a list item or markdown heading, capturing its marker
+	listItemPattern = regexp.MustCompile(`^([-*•]|[0-9۰-۹]+[.)\-]|#{1,6})\s+(.*)$`)
+	// boldLinePattern matches a line made of a bold title, optionally followed by text
+	boldLinePattern = regexp.MustCompile(`^\*\*(.+?)\*\*\s*[:：]?\s*(.*)$`)
+	// bulletPrefixPattern strips list markers from nested lines
+	bulletPrefixPattern = regexp.MustCompile(`^\s*(?:[-*•]|[0-9۰-۹]+[.)])\s+`)
+	// pairSeparatorPattern splits an interaction title into its two drugs
+	pairSeparatorPattern = regexp.MustCompile(`\s+و\s+|\s*[+×/]\s*|\s+-\s+|\s+با\s+|\s+and\s+|\s+with\s+`)
+	// severityLabelPattern captures the words after a severity label
+	severityLabelPattern = regexp.MustCompile(`(?:شدت(?:\s+تداخل)?|severity)\s*(?:\*\*)?\s*[:：]?\s*(?:\*\*)?\s*([^\n،,.]{1,30})`)
+)
+
+// Labels used inside drug descriptions
+var (
+	classLabels     = []string{"دسته دارویی", "گروه دارویی", "دسته درمانی", "دسته"}
+	mechanismLabels = []string{"مکانیسم اثر", "مکانیسم عمل", "مکانیسم"}
+	usageLabels     = []string{"کاربرد اصلی", "کاربرد", "موارد مصرف"}
+)
+
+// Words that do not identify a drug on their own
+var genericDrugWords = map[string]bool{
+	"قرص": true, "کپسول": true, "شربت": true, "آمپول": true, "ویال": true,
+	"قطره": true, "پماد": true, "کرم": true, "اسپری": true, "ساشه": true,
+	"mg": true, "میلی": true, "گرم": true, "میلیگرم": true, "tab": true, "cap": true,
+}
+
+// fieldLabels are titles that introduce a field of an entry rather than a new entry
+var fieldLabels = []string{
+	"دسته", "گروه", "مکانیسم", "کاربرد", "موارد مصرف", "شدت", "توضیح", "مدیریت",
+	"راهکار", "توصیه", "عوارض", "دوز", "زمان", "مصرف", "نکته", "علت", "دلیل",
+}
+
+// Kinds of markers that can start an entry
+const (
+	markerNumber  = "number"
+	markerBullet  = "bullet"
+	markerHeading = "heading"
+	markerBold    = "bold"
+)
+
+// entry is a single list item of a section with its nested lines
+type entry struct {
+	title string
+	text  string
+	lines []string
+}
+
+// Parse extracts the structured analysis from the tagged AI response.
+// Sections or fields that cannot be recognized are left empty.
+func Parse(content string) *models.PrescriptionAnalysis {
+	sections := Sections(content)
+
+	result := &models.PrescriptionAnalysis{
+		Drugs:        []models.DrugAnalysis{},
+		Interactions: []models.DrugInteraction{},
+		Diagnosis:    sections[SectionDiagnosis],
+		Management:   sections[SectionManagement],
+	}
+
+	for _, e := range splitEntries(sections[SectionDrugs]) {
+		drug := models.DrugAnalysis{
+			Name:        e.title,
+			Class:       extractLabeled(e.text, classLabels),
+			Mechanism:   extractLabeled(e.text, mechanismLabels),
+			Usage:       extractLabeled(e.text, usageLabels),
+			Description: e.text,
+		}
+		result.Drugs = append(result.Drugs, drug)
+	}
+
+	assignPerDrug(result.Drugs, sections[SectionDose], func(d *models.DrugAnalysis, e entry) {
+		d.Dose = e.text
+	})
+	assignPerDrug(result.Drugs, sections[SectionTiming], func(d *models.DrugAnalysis, e entry) {
+		d.Timing = e.text
+	})
+	assignPerDrug(result.Drugs, sections[SectionFood], func(d *models.DrugAnalysis, e entry) {
+		d.FoodRelation = e.text
+	})
+	assignPerDrug(result.Drugs, sections[SectionSideEffects], func(d *models.DrugAnalysis, e entry) {
+		d.SideEffects = listItems(e)
+	})
+
+	result.Interactions = parseInteractions(sections[SectionInteractions], result.Drugs)
+
+	return result
+}
+
+// Sections returns the trimmed content of every known tag in the response.
+// A section missing its closing tag runs until the next known opening tag.
+func Sections(content string) map[string]string {
+	sections := make(map[string]string)
+
+	for _, tag := range sectionTags {
+		open := "<" + tag + ">"
+		start := strings.Index(content, open)
+		if start < 0 {
+			continue
+		}
+		start += len(open)
+
+		end := len(content)
+		if i := strings.Index(content[start:], "</"+tag+">"); i >= 0 {
+			end = start + i
+		} else {
+			for _, other := range sectionTags {
+				if i := strings.Index(content[start:], "<"+other+">"); i >= 0 && start+i < end {
+					end = start + i
+				}
+			}
+		}
+
+		sections[tag] = strings.TrimSpace(content[start:end])
+	}
+
+	return sections
+}
+
+// splitEntries splits a section into its top-level list items. The marker of
+// the first item (number, bullet, heading or bold title) decides which lines
+// start further items, so nested details using other markers stay with their
+// item. Text before the first item is treated as an introduction and ignored.
+func splitEntries(section string) []entry {
+	var entries []entry
+	var current *entry
+	entryMarker := ""
+
+	for _, line := range strings.Split(section, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" {
+			continue
+		}
+
+		if title, rest, marker, ok := entryTitle(line); ok && (entryMarker == "" || marker == entryMarker) {
+			entryMarker = marker
+			entries = append(entries, entry{title: title})
+			current = &entries[len(entries)-1]
+			if rest != "" {
+				current.lines = append(current.lines, rest)
+			}
+			continue
+		}
+
+		if current != nil {
+			current.lines = append(current.lines, trimmed)
+		}
+	}
+
+	for i := range entries {
+		entries[i].text = strings.TrimSpace(strings.Join(entries[i].lines, "\n"))
+	}
+
+	return entries
+}
+
+// entryTitle reports whether the line can start a new entry and splits it
+// into the entry title, any text following it on the same line and the kind
+// of marker used. Indented lines never start an entry.
+func entryTitle(line string) (string, string, string, bool) {
+	if line != strings.TrimLeft(line, " \t") {
+		return "", "", "", false
+	}
+	line = strings.TrimSpace(line)
+
+	marker := markerBold
+	if m := listItemPattern.FindStringSubmatch(line); m != nil {
+		switch {
+		case strings.HasPrefix(m[1], "#"):
+			marker = markerHeading
+		case strings.ContainsAny(m[1], "-*•") && len([]rune(m[1])) == 1:
+			marker = markerBullet
+		default:
+			marker = markerNumber
+		}
+		line = strings.TrimSpace(m[2])
+	} else if !boldLinePattern.MatchString(line) {
+		return "", "", "", false
+	}
+
+	title, rest := "", ""
+	if m := boldLinePattern.FindStringSubmatch(line); m != nil && cleanText(m[1]) != "" {
+		// A bold title is the most reliable marker of a drug name
+		title, rest = cleanText(m[1]), cleanText(m[2])
+	} else if i := strings.IndexAny(line, ":："); i > 0 {
+		// Otherwise the title ends at the first colon
+		title, rest = cleanText(line[:i]), cleanText(line[i+1:])
+	} else {
+		title = cleanText(line)
+	}
+
+	// Long titles are prose and labelled titles are details of an entry
+	if title == "" || utf8.RuneCountInString(title) > 60 || isFieldLabel(title) {
+		return "", "", "", false
+	}
+	return title, rest, marker, true
+}
+
+// isFieldLabel reports whether the title names a field rather than a drug
+func isFieldLabel(title string) bool {
+	for _, label := range fieldLabels {
+		if strings.HasPrefix(title, label) {
+			return true
+		}
+	}
+	return false
+}
+
+// extractLabeled returns the value following the first of labels found in text.
+// The value ends at the next known label or the end of its line.
+func extractLabeled(text string, labels []string) string {
+	allLabels := append(append(append([]string{}, classLabels...), mechanismLabels...), usageLabels...)
+
+	for _, label := range labels {
+		pattern := regexp.MustCompile(`(?:\*\*)?` + regexp.QuoteMeta(label) + `(?:\*\*)?\s*[:：]\s*(?:\*\*)?`)
+		loc := pattern.FindStringIndex(text)
+		if loc == nil {
+			continue
+		}
+
+		value := text[loc[1]:]
+		if i := strings.Index(value, "\n"); i >= 0 {
+			value = value[:i]
+		}
+		for _, other := range allLabels {
+			otherPattern := regexp.MustCompile(`[،,.;]?\s*(?:\*\*)?` + regexp.QuoteMeta(other) + `(?:\*\*)?\s*[:：]`)
+			if l := otherPattern.FindStringIndex(value); l != nil {
+				value = value[:l[0]]
+			}
+		}
+
+		if value = cleanText(value); value != "" {
+			return value
+		}
+	}
+
+	return ""
+}
+
+// assignPerDrug matches the entries of a per-drug section to the parsed drugs.
+// When the prescription has a single drug and no entry matches, the whole
+// section is assigned to it.
+func assignPerDrug(drugs []models.DrugAnalysis, section string, assign func(*models.DrugAnalysis, entry)) {
+	if section == "" || len(drugs) == 0 {
+		return
+	}
+
+	matched := false
+	for _, e := range splitEntries(section) {
+		if i := matchDrug(drugs, e.title); i >= 0 {
+			if e.text == "" {
+				continue
+			}
+			assign(&drugs[i], e)
+			matched = true
+		}
+	}
+
+	if !matched && len(drugs) == 1 {
+		lines := strings.Split(section, "\n")
+		assign(&drugs[0], entry{title: drugs[0].Name, text: section, lines: lines})
+	}
+}
+
+// matchDrug returns the index of the drug best matching the text, or -1
+func matchDrug(drugs []models.DrugAnalysis, text string) int {
+	textTokens := tokens(text)
+	best, bestScore := -1, 0
+
+	for i, drug := range drugs {
+		score := 0
+		for _, token := range tokens(drug.Name) {
+			for _, candidate := range textTokens {
+				if candidate == token {
+					score++
+					break
+				}
+			}
+		}
+		if score > bestScore {
+			best, bestScore = i, score
+		}
+	}
+
+	return best
+}
+
+// drugsIn returns the indexes of all drugs mentioned in the text, in order of appearance
+func drugsIn(drugs []models.DrugAnalysis, text string) []int {
+	normalized := textnorm.Normalize(text)
+	positions := make(map[int]int)
+
+	for i, drug := range drugs {
+		for _, token := range tokens(drug.Name) {
+			if pos := strings.Index(normalized, token); pos >= 0 {
+				if current, ok := positions[i]; !ok || pos < current {
+					positions[i] = pos
+				}
+			}
+		}
+	}
+
+	found := make([]int, 0, len(positions))
+	for i := range positions {
+		found = append(found, i)
+	}
+	sort.Slice(found, func(a, b int) bool { return positions[found[a]] < positions[found[b]] })
+
+	return found
+}
+
+// parseInteractions extracts drug pairs and their severity from the interactions section
+func parseInteractions(section string, drugs []models.DrugAnalysis) []models.DrugInteraction {
+	interactions := []models.DrugInteraction{}
+	if section == "" {
+		return interactions
+	}
+
+	for _, e := range splitEntries(section) {
+		drugA, drugB := interactionPair(e.title, drugs)
+		if drugA == "" && e.text != "" {
+			// Some answers name the pair on the line after a generic title
+			firstLine := strings.SplitN(e.text, "\n", 2)[0]
+			drugA, drugB = interactionPair(firstLine, drugs)
+		}
+		if drugA == "" {
+			continue
+		}
+
+		interactions = append(interactions, models.DrugInteraction{
+			DrugA:       drugA,
+			DrugB:       drugB,
+			Severity:    parseSeverity(e.title + "\n" + e.text),
+			Description: e.text,
+		})
+	}
+
+	return interactions
+}
+
+// interactionPair finds the two drugs named in an interaction title
+func interactionPair(title string, drugs []models.DrugAnalysis) (string, string) {
+	if found := drugsIn(drugs, title); len(found) >= 2 {
+		return drugs[found[0]].Name, drugs[found[1]].Name
+	}
+
+	parts := pairSeparatorPattern.Split(title, -1)
+	if len(parts) != 2 {
+		return "", ""
+	}
+
+	a, b := cleanText(parts[0]), cleanText(parts[1])
+	if a == "" || b == "" {
+		return "", ""
+	}
+	return a, b
+}
+
+// parseSeverity classifies an interaction by its severity label or, failing
+// that, by unambiguous severity words anywhere in its description
+func parseSeverity(text string) models.InteractionSeverity {
+	if m := severityLabelPattern.FindStringSubmatch(text); m != nil {
+		if severity := classifySeverity(strings.ToLower(m[1]), true); severity != models.InteractionSeverityUnknown {
+			return severity
+		}
+	}
+
+	return classifySeverity(strings.ToLower(text), false)
+}
+
+// classifySeverity maps severity words to a severity. Short, ambiguous words
+// are only trusted when they directly follow a severity label.
+func classifySeverity(text string, labeled bool) models.InteractionSeverity {
+	major := []string{"شدید", "جدی", "خطرناک", "major", "severe", "منع مصرف"}
+	moderate := []string{"متوسط", "moderate", "medium"}
+	minor := []string{"خفیف", "جزئی", "minor", "mild"}
+	if labeled {
+		major = append(major, "بالا", "زیاد", "high")
+		minor = append(minor, "کم", "پایین", "low")
+	}
+
+	for _, group := range []struct {
+		words    []string
+		severity models.InteractionSeverity
+	}{
+		{major, models.InteractionSeverityMajor},
+		{moderate, models.InteractionSeverityModerate},
+		{minor, models.InteractionSeverityMinor},
+	} {
+		for _, word := range group.words {
+			if strings.Contains(text, word) {
+				return group.severity
+			}
+		}
+	}
+
+	return models.InteractionSeverityUnknown
+}
+
+// listItems returns the nested list items of an entry, or its comma separated
+// parts when it has none
+func listItems(e entry) []string {
+	var items []string
+	for _, line := range e.lines {
+		if bulletPrefixPattern.MatchString(line) {
+			if item := cleanText(bulletPrefixPattern.ReplaceAllString(line, "")); item != "" {
+				items = append(items, item)
+			}
+		}
+	}
+	if len(items) > 0 {
+		return items
+	}
+
+	for _, part := range strings.FieldsFunc(e.text, func(r rune) bool {
+		return r == '،' || r == ',' || r == '\n' || r == '؛' || r == ';'
+	}) {
+		if item := cleanText(part); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// tokens returns the normalized words of a drug name that can identify it
+func tokens(text string) []string {
+	var result []string
+	for _, word := range textnorm.Fields(text) {
+		if utf8.RuneCountInString(word) < 3 || genericDrugWords[word] || isNumber(word) {
+			continue
+		}
+		result = append(result, word)
+	}
+	return result
+}
+
+// isNumber reports whether the word consists only of digits
+func isNumber(word string) bool {
+	for _, r := range word {
+		if !(r >= '0' && r <= '9') && !(r >= '۰' && r <= '۹') {
+			return false
+		}
+	}
+	return true
+}
+
+// cleanText strips markdown emphasis and surrounding punctuation
+func cleanText(text string) string {
+	text = strings.ReplaceAll(text, "**", "")
+	text = strings.ReplaceAll(text, "__", "")
+	return strings.Trim(strings.TrimSpace(text), " \t:：-–،,;.*")
+}
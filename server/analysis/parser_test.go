@@ -0,0 +1,230 @@
+package analysis
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/darooyar/server/models"
+)
+
+// fullResponse is an analysis of two drugs with every section the prompts ask for
+const fullResponse = `بررسی نسخه:
+<داروها>
+1. **استامینوفن ۵۰۰**
+   - دسته دارویی: ضد درد
+   - مکانیسم اثر: مهار سنتز پروستاگلاندین
+   - کاربرد: تب و درد
+2. **وارفارین ۵**
+   - دسته دارویی: ضد انعقاد
+   - کاربرد: پیشگیری از لخته
+</داروها>
+<تشخیص>
+درد و پیشگیری از ترومبوز
+</تشخیص>
+<تداخلات>
+1. **استامینوفن و وارفارین**
+   - شدت: متوسط
+   - مصرف طولانی استامینوفن اثر وارفارین را زیاد می‌کند
+</تداخلات>
+<عوارض>
+1. **استامینوفن**
+   - تهوع
+   - آسیب کبدی در دوز بالا
+2. **وارفارین**: خونریزی، کبودی
+</عوارض>
+<دوز_مصرف>
+1. **استامینوفن**: هر ۶ ساعت یک قرص
+2. **وارفارین**: روزی یک قرص
+</دوز_مصرف>
+<مدیریت_عارضه>
+در صورت خونریزی به پزشک مراجعه شود
+</مدیریت_عارضه>`
+
+func TestSections(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    map[string]string
+	}{
+		{name: "closed sections", content: "<تشخیص> سرماخوردگی </تشخیص><عوارض>خواب‌آلودگی</عوارض>", want: map[string]string{
+			SectionDiagnosis:   "سرماخوردگی",
+			SectionSideEffects: "خواب‌آلودگی",
+		}},
+		{name: "missing closing tag before next section", content: "<تشخیص>سرماخوردگی\n<عوارض>خواب‌آلودگی</عوارض>", want: map[string]string{
+			SectionDiagnosis:   "سرماخوردگی",
+			SectionSideEffects: "خواب‌آلودگی",
+		}},
+		{name: "truncated last section", content: "<تشخیص>سرماخوردگی</تشخیص>\n<عوارض>خواب", want: map[string]string{
+			SectionDiagnosis:   "سرماخوردگی",
+			SectionSideEffects: "خواب",
+		}},
+		{name: "closing tag without opening tag", content: "سرماخوردگی</تشخیص>", want: map[string]string{}},
+		{name: "unknown tag", content: "<نتیجه>سالم</نتیجه>", want: map[string]string{}},
+		{name: "no tags", content: "این نسخه مشکلی ندارد", want: map[string]string{}},
+		{name: "empty", content: "", want: map[string]string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Sections(tt.content); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Sections() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseFullResponse(t *testing.T) {
+	result := Parse(fullResponse)
+
+	if len(result.Drugs) != 2 {
+		t.Fatalf("parsed %d drugs, want 2: %+v", len(result.Drugs), result.Drugs)
+	}
+	acetaminophen, warfarin := result.Drugs[0], result.Drugs[1]
+
+	checks := []struct {
+		field string
+		got   string
+		want  string
+	}{
+		{"first drug name", acetaminophen.Name, "استامینوفن ۵۰۰"},
+		{"first drug class", acetaminophen.Class, "ضد درد"},
+		{"first drug mechanism", acetaminophen.Mechanism, "مهار سنتز پروستاگلاندین"},
+		{"first drug usage", acetaminophen.Usage, "تب و درد"},
+		{"first drug dose", acetaminophen.Dose, "هر ۶ ساعت یک قرص"},
+		{"second drug name", warfarin.Name, "وارفارین ۵"},
+		{"second drug class", warfarin.Class, "ضد انعقاد"},
+		{"second drug mechanism", warfarin.Mechanism, ""},
+		{"second drug dose", warfarin.Dose, "روزی یک قرص"},
+		{"diagnosis", result.Diagnosis, "درد و پیشگیری از ترومبوز"},
+		{"management", result.Management, "در صورت خونریزی به پزشک مراجعه شود"},
+	}
+	for _, c := range checks {
+		if c.got != c.want {
+			t.Errorf("%s = %q, want %q", c.field, c.got, c.want)
+		}
+	}
+
+	if want := []string{"تهوع", "آسیب کبدی در دوز بالا"}; !reflect.DeepEqual(acetaminophen.SideEffects, want) {
+		t.Errorf("first drug side effects = %q, want %q", acetaminophen.SideEffects, want)
+	}
+	if want := []string{"خونریزی", "کبودی"}; !reflect.DeepEqual(warfarin.SideEffects, want) {
+		t.Errorf("second drug side effects = %q, want %q", warfarin.SideEffects, want)
+	}
+
+	if len(result.Interactions) != 1 {
+		t.Fatalf("parsed %d interactions, want 1: %+v", len(result.Interactions), result.Interactions)
+	}
+	interaction := result.Interactions[0]
+	if interaction.DrugA != acetaminophen.Name || interaction.DrugB != warfarin.Name {
+		t.Errorf("interaction pair = %q and %q, want the two drugs", interaction.DrugA, interaction.DrugB)
+	}
+	if interaction.Severity != models.InteractionSeverityModerate {
+		t.Errorf("interaction severity = %q, want %q", interaction.Severity, models.InteractionSeverityModerate)
+	}
+}
+
+func TestParsePartialResponse(t *testing.T) {
+	tests := []struct {
+		name             string
+		content          string
+		wantDrugs        []string
+		wantInteractions int
+		wantDiagnosis    string
+		wantDose         string // Dose of the first drug
+	}{
+		{name: "empty", content: ""},
+		{name: "prose without tags", content: "متاسفانه نسخه خوانا نیست."},
+		{name: "drugs only", content: "<داروها>\n1. **آموکسی سیلین**\n</داروها>", wantDrugs: []string{"آموکسی سیلین"}},
+		{name: "diagnosis only", content: "<تشخیص>عفونت گوش</تشخیص>", wantDiagnosis: "عفونت گوش"},
+		{name: "per-drug sections without drugs", content: "<دوز_مصرف>\n1. **آموکسی سیلین**: هر ۸ ساعت\n</دوز_مصرف>"},
+		{name: "truncated in the middle of a drug", content: "<داروها>\n1. **آموکسی سیلین**\n   - دسته دارویی: آنتی\n2. **ایبو", wantDrugs: []string{"آموکسی سیلین", "ایبو"}},
+		{name: "truncated after a tag", content: "<داروها>\n1. **آموکسی سیلین**\n</داروها>\n<تداخلات>", wantDrugs: []string{"آموکسی سیلین"}},
+		{name: "drugs without list markers", content: "<داروها>\nآموکسی سیلین و ایبوپروفن\n</داروها>"},
+		{name: "single drug with untitled dose", content: "<داروها>\n- آموکسی سیلین\n</داروها>\n<دوز_مصرف>هر ۸ ساعت یک کپسول</دوز_مصرف>", wantDrugs: []string{"آموکسی سیلین"}, wantDose: "هر ۸ ساعت یک کپسول"},
+		{name: "dose of an unknown drug", content: "<داروها>\n1. **آموکسی سیلین**\n2. **ایبوپروفن**\n</داروها>\n<دوز_مصرف>\n1. **سرترالین**: روزی یک قرص\n</دوز_مصرف>", wantDrugs: []string{"آموکسی سیلین", "ایبوپروفن"}},
+		{name: "interaction of drugs missing from the list", content: "<تداخلات>\n1. **سرترالین و ترامادول**\n   شدت: شدید\n</تداخلات>", wantInteractions: 1},
+		{name: "interaction without a pair", content: "<تداخلات>\n1. **تداخل مهمی یافت نشد**\n</تداخلات>"},
+		{name: "empty sections", content: "<داروها></داروها><تداخلات></تداخلات><دوز_مصرف></دوز_مصرف>"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := Parse(tt.content)
+
+			if result.Drugs == nil || result.Interactions == nil {
+				t.Fatal("Parse() returned nil lists")
+			}
+			var names []string
+			for _, drug := range result.Drugs {
+				names = append(names, drug.Name)
+			}
+			if !reflect.DeepEqual(names, tt.wantDrugs) {
+				t.Errorf("drugs = %q, want %q", names, tt.wantDrugs)
+			}
+			if len(result.Interactions) != tt.wantInteractions {
+				t.Errorf("parsed %d interactions, want %d: %+v", len(result.Interactions), tt.wantInteractions, result.Interactions)
+			}
+			if result.Diagnosis != tt.wantDiagnosis {
+				t.Errorf("diagnosis = %q, want %q", result.Diagnosis, tt.wantDiagnosis)
+			}
+			if len(result.Drugs) > 0 && result.Drugs[0].Dose != tt.wantDose {
+				t.Errorf("dose = %q, want %q", result.Drugs[0].Dose, tt.wantDose)
+			}
+		})
+	}
+}
+
+func TestParseMalformedResponseDoesNotPanic(t *testing.T) {
+	inputs := []string{
+		"<داروها>",
+		"</داروها><داروها>",
+		"<داروها>**</داروها>",
+		"<داروها>\n1.\n**\n- :\n#\n</داروها>",
+		"<داروها>\n**:**\n1. **\n</داروها>",
+		"<تداخلات>و</تداخلات>",
+		"<تداخلات>\n- + \n- شدت:\n</تداخلات>",
+		"<عوارض>\n- \n1. ،،،\n</عوارض>",
+		"<داروها>\n- a\n</داروها><عوارض>\n- a\n   -\n</عوارض>",
+		"<عوارض><داروها>\n- آسپرین\n</عوارض></داروها>",
+		"<داروها>\xff\xfe\n1. **\xc3**\n</داروها>",
+		"<دوز_مصرف>\n1. **۱۲۳**: ۴۵۶\n</دوز_مصرف><داروها>\n1. **۱۲۳**\n</داروها>",
+	}
+
+	for _, input := range inputs {
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					t.Errorf("Parse(%q) panicked: %v", input, r)
+				}
+			}()
+
+			if result := Parse(input); result == nil || result.Drugs == nil || result.Interactions == nil {
+				t.Errorf("Parse(%q) = %+v, want empty lists rather than nil", input, result)
+			}
+		}()
+	}
+}
+
+func TestParseSeverity(t *testing.T) {
+	tests := []struct {
+		text string
+		want models.InteractionSeverity
+	}{
+		{text: "شدت: شدید", want: models.InteractionSeverityMajor},
+		{text: "**شدت تداخل:** متوسط", want: models.InteractionSeverityModerate},
+		{text: "Severity: minor", want: models.InteractionSeverityMinor},
+		{text: "شدت: بالا", want: models.InteractionSeverityMajor},
+		{text: "شدت: کم", want: models.InteractionSeverityMinor},
+		{text: "این تداخل خطرناک است", want: models.InteractionSeverityMajor},
+		{text: "احتمال کم عارضه", want: models.InteractionSeverityUnknown},
+		{text: "", want: models.InteractionSeverityUnknown},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			if got := parseSeverity(tt.text); got != tt.want {
+				t.Errorf("parseSeverity(%q) = %q, want %q", tt.text, got, tt.want)
+			}
+		})
+	}
+}
@@ -1,39 +1,168 @@
 package auth
 
 import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"math/big"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/darooyar/server/models"
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
 	"golang.org/x/crypto/bcrypt"
 )
 
 var jwtSecret = []byte(os.Getenv("JWT_SECRET"))
 
+const (
+	// AccessTokenTTL is how long an access token is valid. Clients get a new
+	// one from POST /api/auth/refresh before it expires.
+	AccessTokenTTL = time.Hour
+	// RefreshTokenTTL is how long a session stays logged in without being used
+	RefreshTokenTTL = 30 * 24 * time.Hour
+)
+
 // Claims represents the JWT claims
 type Claims struct {
-	UserID  int64  `json:"user_id"`
-	Email   string `json:"email"`
-	IsAdmin bool   `json:"is_admin"`
+	UserID      int64               `json:"user_id"`
+	Email       string              `json:"email"`
+	IsAdmin     bool                `json:"is_admin"`
+	Roles       []string            `json:"roles"`
+	Permissions []models.Permission `json:"permissions"`
+	SessionID   string              `json:"sid,omitempty"`      // Session the token was issued for
+	Verified    bool                `json:"verified,omitempty"` // Whether the user had verified their email or phone
 	jwt.RegisteredClaims
 }
 
-// GenerateToken creates a new JWT token for a user
-func GenerateToken(user *models.User) (string, error) {
+// HasRole reports whether the token was issued to a user with the role
+func (c *Claims) HasRole(role string) bool {
+	for _, r := range c.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// HasPermission reports whether the token grants the permission
+func (c *Claims) HasPermission(permission models.Permission) bool {
+	for _, p := range c.Permissions {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// GenerateToken creates a new JWT access token for a user's session,
+// carrying the user's roles and permissions as they were when the token was
+// issued. Every token gets a unique ID (jti) so that it can be revoked.
+func GenerateToken(user *models.User, sessionID string) (string, time.Time, error) {
+	now := time.Now()
+	expiresAt := now.Add(AccessTokenTTL)
 	claims := Claims{
-		UserID:  user.ID,
-		Email:   user.Email,
-		IsAdmin: user.IsAdmin,
+		UserID:      user.ID,
+		Email:       user.Email,
+		IsAdmin:     user.IsAdmin,
+		Roles:       user.Roles,
+		Permissions: user.Permissions,
+		SessionID:   sessionID,
+		Verified:    user.EmailVerified || user.Phone != "",
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(24 * time.Hour)),
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			ID:        uuid.New().String(),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+			IssuedAt:  jwt.NewNumericDate(now),
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(jwtSecret)
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(jwtSecret)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return token, expiresAt, nil
+}
+
+// GenerateRefreshToken creates a random refresh token and the hash under
+// which it is stored. Only the hash is kept by the server.
+func GenerateRefreshToken() (string, string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", "", err
+	}
+
+	token := base64.RawURLEncoding.EncodeToString(secret)
+	return token, HashRefreshToken(token), nil
+}
+
+// HashRefreshToken returns the hash under which a refresh token is stored
+func HashRefreshToken(token string) string {
+	return hashToken(token)
+}
+
+// ErrInvalidSignedToken is returned for signed tokens that were altered or made for another purpose
+var ErrInvalidSignedToken = errors.New("invalid token signature")
+
+// GenerateSignedToken creates a random token for a purpose, such as a
+// password reset link, and the hash under which it is stored. The token is
+// signed with the JWT secret, so forged tokens are rejected before they are
+// looked up.
+func GenerateSignedToken(purpose string) (string, string, error) {
+	secret := make([]byte, 24)
+	if _, err := rand.Read(secret); err != nil {
+		return "", "", err
+	}
+
+	payload := base64.RawURLEncoding.EncodeToString(secret)
+	token := payload + "." + signToken(purpose, payload)
+	return token, hashToken(token), nil
+}
+
+// VerifySignedToken checks the signature of a token made for the purpose and
+// returns the hash under which it is stored
+func VerifySignedToken(purpose, token string) (string, error) {
+	payload, signature, ok := strings.Cut(token, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(signToken(purpose, payload))) {
+		return "", ErrInvalidSignedToken
+	}
+	return hashToken(token), nil
+}
+
+// signToken returns the signature of a token payload for a purpose
+func signToken(purpose, payload string) string {
+	mac := hmac.New(sha256.New, jwtSecret)
+	mac.Write([]byte(purpose + "." + payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// hashToken returns the SHA-256 hash under which an opaque token is stored
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// GenerateOTPCode creates a random six-digit one-time code
+func GenerateOTPCode() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%06d", n.Int64()), nil
+}
+
+// HashOTPCode returns the hash under which a one-time code for a phone number
+// is stored. The hash is keyed with the JWT secret, because six-digit codes
+// are too few to be safe behind a plain hash.
+func HashOTPCode(phone, code string) string {
+	mac := hmac.New(sha256.New, jwtSecret)
+	mac.Write([]byte(phone + ":" + code))
+	return hex.EncodeToString(mac.Sum(nil))
 }
 
 // ValidateToken validates a JWT token and returns the claims
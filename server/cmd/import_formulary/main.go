@@ -0,0 +1,70 @@
+// Command import_formulary loads a CSV or Excel export of the national drug
+// list into the formulary.
+//
+// Run it from the server directory after the server has applied its migrations:
+//
+//	go run ./cmd/import_formulary -file drugs.xlsx
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/darooyar/server/config"
+	"github.com/darooyar/server/db"
+	"github.com/darooyar/server/formulary"
+	"github.com/joho/godotenv"
+)
+
+func main() {
+	path := flag.String("file", "", "CSV or Excel (.xlsx) export of the national drug list")
+	flag.Parse()
+
+	if *path == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	// Load environment variables from .env file
+	if err := godotenv.Load(); err != nil {
+		log.Println("Warning: No .env file found, using system environment variables")
+	}
+
+	ctx := context.Background()
+	if err := db.InitDB(ctx, config.GetConfig()); err != nil {
+		log.Fatalf("Failed to initialize database: %v", err)
+	}
+	defer db.CloseDB()
+
+	file, err := os.Open(*path)
+	if err != nil {
+		log.Fatalf("Failed to open %s: %v", *path, err)
+	}
+	defer file.Close()
+
+	var result *formulary.ImportResult
+	switch strings.ToLower(filepath.Ext(*path)) {
+	case ".xlsx":
+		info, statErr := file.Stat()
+		if statErr != nil {
+			log.Fatalf("Failed to read %s: %v", *path, statErr)
+		}
+		result, err = formulary.ImportXLSX(ctx, file, info.Size())
+	case ".csv", ".txt":
+		result, err = formulary.ImportCSV(ctx, file)
+	default:
+		log.Fatalf("Unsupported file type %q, expected .csv or .xlsx", filepath.Ext(*path))
+	}
+	if err != nil {
+		log.Fatalf("Failed to import formulary: %v", err)
+	}
+
+	log.Printf("Imported %s: %d drugs created, %d updated", *path, result.Created, result.Updated)
+	for _, reason := range result.Skipped {
+		log.Printf("Skipped %s", reason)
+	}
+}
@@ -0,0 +1,79 @@
+// Command import_interactions loads drugs and drug-drug interactions from CSV
+// files into the local interaction knowledge base.
+//
+// Run it from the server directory after the server has applied its migrations:
+//
+//	go run ./cmd/import_interactions -drugs drugs.csv -interactions interactions.csv
+package main
+
+import (
+	"context"
+	"flag"
+	"io"
+	"log"
+	"os"
+
+	"github.com/darooyar/server/config"
+	"github.com/darooyar/server/db"
+	"github.com/darooyar/server/druginteractions"
+	"github.com/joho/godotenv"
+)
+
+func main() {
+	drugsPath := flag.String("drugs", "", "CSV file with columns generic_name,name_fa,name_en,synonyms")
+	interactionsPath := flag.String("interactions", "", "CSV file with columns drug_a,drug_b,severity,description,management")
+	flag.Parse()
+
+	if *drugsPath == "" && *interactionsPath == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	// Load environment variables from .env file
+	if err := godotenv.Load(); err != nil {
+		log.Println("Warning: No .env file found, using system environment variables")
+	}
+
+	ctx := context.Background()
+	if err := db.InitDB(ctx, config.GetConfig()); err != nil {
+		log.Fatalf("Failed to initialize database: %v", err)
+	}
+	defer db.CloseDB()
+
+	// Drugs go first so that interactions can refer to their synonyms
+	if *drugsPath != "" {
+		result, err := importFile(ctx, *drugsPath, druginteractions.ImportDrugsCSV)
+		if err != nil {
+			log.Fatalf("Failed to import drugs: %v", err)
+		}
+		log.Printf("Imported %d drugs with %d new synonyms from %s", result.Drugs, result.Synonyms, *drugsPath)
+		logSkipped(result)
+	}
+
+	if *interactionsPath != "" {
+		result, err := importFile(ctx, *interactionsPath, druginteractions.ImportInteractionsCSV)
+		if err != nil {
+			log.Fatalf("Failed to import interactions: %v", err)
+		}
+		log.Printf("Imported %d interactions (%d new drugs) from %s", result.Interactions, result.Drugs, *interactionsPath)
+		logSkipped(result)
+	}
+}
+
+// importFile opens a CSV file and runs the importer on it
+func importFile(ctx context.Context, path string, importer func(context.Context, io.Reader) (*druginteractions.ImportResult, error)) (*druginteractions.ImportResult, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return importer(ctx, file)
+}
+
+// logSkipped reports the rows an import could not use
+func logSkipped(result *druginteractions.ImportResult) {
+	for _, reason := range result.Skipped {
+		log.Printf("Skipped %s", reason)
+	}
+}
@@ -0,0 +1,103 @@
+// Command migrate applies and rolls back the database migrations embedded in
+// the server. The server applies pending migrations when it starts, so this is
+// mostly for rolling back and for checking the schema of a database.
+//
+// Run it from the server directory:
+//
+//	go run ./cmd/migrate up        # apply every pending migration
+//	go run ./cmd/migrate down 2    # roll back the 2 migrations applied last
+//	go run ./cmd/migrate status    # list migrations and when they were applied
+//	go run ./cmd/migrate redo      # roll back the last migration and apply it again
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/darooyar/server/config"
+	"github.com/darooyar/server/db"
+	"github.com/darooyar/server/db/migrations"
+	"github.com/joho/godotenv"
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "Usage: migrate up | down N | status | redo")
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	// Load environment variables from .env file
+	if err := godotenv.Load(); err != nil {
+		log.Println("Warning: No .env file found, using system environment variables")
+	}
+
+	ctx := context.Background()
+	if err := db.InitDB(ctx, config.GetConfig()); err != nil {
+		log.Fatalf("Failed to initialize database: %v", err)
+	}
+	defer db.CloseDB()
+
+	if err := run(ctx, flag.Args()); err != nil {
+		db.CloseDB()
+		log.Fatal(err)
+	}
+}
+
+// run runs one command
+func run(ctx context.Context, args []string) error {
+	switch args[0] {
+	case "up":
+		return migrations.Up(ctx)
+
+	case "down":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: migrate down N")
+		}
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n < 1 {
+			return fmt.Errorf("N must be a positive number of migrations, got %q", args[1])
+		}
+		return migrations.Down(ctx, n)
+
+	case "status":
+		statuses, err := migrations.GetStatus(ctx)
+		if err != nil {
+			return err
+		}
+		printStatus(statuses)
+		return nil
+
+	case "redo":
+		return migrations.Redo(ctx)
+
+	default:
+		return fmt.Errorf("unknown command %q, expected up, down N, status or redo", args[0])
+	}
+}
+
+// printStatus lists the migrations with the time each was applied
+func printStatus(statuses []migrations.Status) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "MIGRATION\tAPPLIED AT")
+	pending := 0
+	for _, status := range statuses {
+		appliedAt := "pending"
+		if status.Applied {
+			appliedAt = status.AppliedAt.Local().Format("2006-01-02 15:04:05")
+		} else {
+			pending++
+		}
+		fmt.Fprintf(w, "%s\t%s\n", status.Name, appliedAt)
+	}
+	w.Flush()
+	fmt.Printf("\n%d migrations, %d pending\n", len(statuses), pending)
+}
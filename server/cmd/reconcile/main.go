@@ -0,0 +1,115 @@
+// Command reconcile recomputes each user's and pharmacy's credit from the
+// credit_transactions ledger and reports those whose credit has drifted from it.
+//
+// Run it from the server directory after the server has applied its migrations:
+//
+//	go run ./cmd/reconcile          # report drift only
+//	go run ./cmd/reconcile -repair  # also set each drifted credit to its ledger balance
+//
+// It exits with status 1 when drift was found and not repaired.
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"strconv"
+
+	"github.com/darooyar/server/config"
+	"github.com/darooyar/server/db"
+	"github.com/darooyar/server/models"
+	"github.com/joho/godotenv"
+)
+
+func main() {
+	repair := flag.Bool("repair", false, "set each drifted credit to the sum of its ledger")
+	flag.Parse()
+
+	// Load environment variables from .env file
+	if err := godotenv.Load(); err != nil {
+		log.Println("Warning: No .env file found, using system environment variables")
+	}
+
+	ctx := context.Background()
+	if err := db.InitDB(ctx, config.GetConfig()); err != nil {
+		log.Fatalf("Failed to initialize database: %v", err)
+	}
+	defer db.CloseDB()
+
+	drifts, err := db.GetCreditDrifts(ctx)
+	if err != nil {
+		log.Fatalf("Failed to compare credit with the ledger: %v", err)
+	}
+
+	pharmacyDrifts, err := db.GetPharmacyCreditDrifts(ctx)
+	if err != nil {
+		log.Fatalf("Failed to compare pharmacy credit with the ledger: %v", err)
+	}
+
+	if len(drifts) == 0 && len(pharmacyDrifts) == 0 {
+		log.Println("Every user's and pharmacy's credit matches the ledger")
+		return
+	}
+
+	for _, drift := range drifts {
+		logDrift("User "+strconv.FormatInt(drift.UserID, 10), drift)
+	}
+	for _, drift := range pharmacyDrifts {
+		logDrift("Pharmacy "+strconv.FormatInt(drift.PharmacyID, 10), drift)
+	}
+
+	total := len(drifts) + len(pharmacyDrifts)
+	if !*repair {
+		log.Printf("Found %d balances that do not match the ledger. Run with -repair to fix them.", total)
+		db.CloseDB()
+		os.Exit(1)
+	}
+
+	repaired := 0
+	for _, drift := range drifts {
+		balance, err := db.RepairCreditBalance(ctx, drift.UserID)
+		if err != nil {
+			log.Printf("Failed to repair credit of user %d: %v", drift.UserID, err)
+			continue
+		}
+		log.Printf("User %d: credit set to %s", drift.UserID, formatAmount(balance))
+		repaired++
+	}
+	for _, drift := range pharmacyDrifts {
+		balance, err := db.RepairPharmacyCreditBalance(ctx, drift.PharmacyID)
+		if err != nil {
+			log.Printf("Failed to repair credit of pharmacy %d: %v", drift.PharmacyID, err)
+			continue
+		}
+		log.Printf("Pharmacy %d: credit set to %s", drift.PharmacyID, formatAmount(balance))
+		repaired++
+	}
+
+	log.Printf("Repaired %d of %d balances", repaired, total)
+	if repaired < total {
+		db.CloseDB()
+		os.Exit(1)
+	}
+}
+
+// logDrift reports the drift of one credit owner
+func logDrift(owner string, drift *models.CreditDrift) {
+	lastBalance := "none"
+	if drift.LastBalanceAfter != nil {
+		lastBalance = formatAmount(*drift.LastBalanceAfter)
+	}
+	log.Printf("%s: credit %s, ledger %s over %d transactions (last balance_after %s), drift %s",
+		owner,
+		formatAmount(drift.Credit),
+		formatAmount(drift.LedgerBalance),
+		drift.Transactions,
+		lastBalance,
+		formatAmount(drift.Credit-drift.LedgerBalance),
+	)
+}
+
+// formatAmount formats a credit amount with its two decimal places
+func formatAmount(amount float64) string {
+	return strconv.FormatFloat(amount, 'f', 2, 64)
+}
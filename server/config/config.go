@@ -3,6 +3,7 @@ package config
 import (
 	"os"
 	"sync"
+	"time"
 )
 
 type Config struct {
@@ -14,11 +15,47 @@ type Config struct {
 	DBName       string
 	JWTSecret    string
 	OpenAIAPIKey string
+	// AI Provider Configuration
+	AIProvider string
+	AIBaseURL  string
+	AIModel    string
+	AIAPIKey   string
 	// Liara Storage Configuration
 	LiaraAccessKey  string
 	LiaraSecretKey  string
 	LiaraEndpoint   string
 	LiaraBucketName string
+	// Payment Gateway Configuration
+	PaymentGateway     string
+	ZarinpalMerchantID string
+	ZarinpalSandbox    bool
+	PaymentCallbackURL string
+	PaymentReturnURL   string
+	// SMS Configuration
+	SMSProvider       string
+	KavenegarAPIKey   string
+	KavenegarSender   string
+	KavenegarTemplate string
+	// Mail Configuration
+	MailProvider string
+	MailFrom     string
+	MailDir      string
+	SMTPHost     string
+	SMTPPort     string
+	SMTPUsername string
+	SMTPPassword string
+	// AppURL is where the links in emails lead
+	AppURL string
+	// RateLimitStore is where rate limit buckets are kept: memory, postgres or nats
+	RateLimitStore string
+	// TrustedProxies lists the addresses or CIDR ranges of the proxies whose X-Forwarded-For is believed
+	TrustedProxies string
+	// Observability Configuration
+	LogLevel     string
+	LogFormat    string
+	MetricsToken string
+	// ShutdownTimeout is how long a stopping server waits for requests and AI jobs to finish
+	ShutdownTimeout time.Duration
 }
 
 var (
@@ -37,11 +74,46 @@ func GetConfig() *Config {
 			DBName:       getEnvOrDefault("DB_NAME", "darooyar"),
 			JWTSecret:    getEnvOrDefault("JWT_SECRET", ""),
 			OpenAIAPIKey: getEnvOrDefault("OPENAI_API_KEY", ""),
+			// AI Provider Configuration
+			AIProvider: getEnvOrDefault("AI_PROVIDER", "openai"),
+			AIBaseURL:  getEnvOrDefault("AI_BASE_URL", "https://api.avalai.ir/v1"),
+			AIModel:    getEnvOrDefault("AI_MODEL", "gemini-2.0-flash-thinking-exp-01-21"),
+			AIAPIKey:   getEnvOrDefault("AI_API_KEY", os.Getenv("OPENAI_API_KEY")),
 			// Liara Storage Configuration
 			LiaraAccessKey:  getEnvOrDefault("LIARA_ACCESS_KEY", ""),
 			LiaraSecretKey:  getEnvOrDefault("LIARA_SECRET_KEY", ""),
 			LiaraEndpoint:   getEnvOrDefault("LIARA_ENDPOINT", ""),
 			LiaraBucketName: getEnvOrDefault("LIARA_BUCKET_NAME", ""),
+			// Payment Gateway Configuration
+			PaymentGateway:     getEnvOrDefault("PAYMENT_GATEWAY", "zarinpal"),
+			ZarinpalMerchantID: getEnvOrDefault("ZARINPAL_MERCHANT_ID", ""),
+			ZarinpalSandbox:    getEnvOrDefault("ZARINPAL_SANDBOX", "false") == "true",
+			PaymentCallbackURL: getEnvOrDefault("PAYMENT_CALLBACK_URL",
+				getEnvOrDefault("SERVER_BASE_URL", "http://localhost:8080")+"/api/payments/callback"),
+			PaymentReturnURL: getEnvOrDefault("PAYMENT_RETURN_URL", ""),
+			// SMS Configuration
+			SMSProvider:       getEnvOrDefault("SMS_PROVIDER", "kavenegar"),
+			KavenegarAPIKey:   getEnvOrDefault("KAVENEGAR_API_KEY", ""),
+			KavenegarSender:   getEnvOrDefault("KAVENEGAR_SENDER", ""),
+			KavenegarTemplate: getEnvOrDefault("KAVENEGAR_TEMPLATE", ""),
+			// Mail Configuration
+			MailProvider: getEnvOrDefault("MAIL_PROVIDER", "smtp"),
+			MailFrom:     getEnvOrDefault("MAIL_FROM", ""),
+			MailDir:      getEnvOrDefault("MAIL_DIR", ""),
+			SMTPHost:     getEnvOrDefault("SMTP_HOST", ""),
+			SMTPPort:     getEnvOrDefault("SMTP_PORT", "587"),
+			SMTPUsername: getEnvOrDefault("SMTP_USERNAME", ""),
+			SMTPPassword: getEnvOrDefault("SMTP_PASSWORD", ""),
+			AppURL:       getEnvOrDefault("APP_URL", getEnvOrDefault("SERVER_BASE_URL", "http://localhost:8080")),
+			// Rate Limit Configuration
+			RateLimitStore: getEnvOrDefault("RATE_LIMIT_STORE", "memory"),
+			TrustedProxies: getEnvOrDefault("TRUSTED_PROXIES", ""),
+			// Observability Configuration
+			LogLevel:     getEnvOrDefault("LOG_LEVEL", "info"),
+			LogFormat:    getEnvOrDefault("LOG_FORMAT", "json"),
+			MetricsToken: getEnvOrDefault("METRICS_TOKEN", ""),
+			// Shutdown Configuration
+			ShutdownTimeout: getDurationOrDefault("SHUTDOWN_TIMEOUT", 60*time.Second),
 		}
 	})
 	return config
@@ -53,3 +125,10 @@ func getEnvOrDefault(key, defaultValue string) string {
 	}
 	return defaultValue
 }
+
+func getDurationOrDefault(key string, defaultValue time.Duration) time.Duration {
+	if value, err := time.ParseDuration(os.Getenv(key)); err == nil && value > 0 {
+		return value
+	}
+	return defaultValue
+}
@@ -0,0 +1,60 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/darooyar/server/models"
+)
+
+// SavePrescriptionAnalysis stores the structured analysis of a message,
+// replacing any analysis saved for it before
+func SavePrescriptionAnalysis(ctx context.Context, analysis *models.PrescriptionAnalysis) error {
+	if analysis.CreatedAt.IsZero() {
+		analysis.CreatedAt = time.Now()
+	}
+
+	data, err := json.Marshal(analysis)
+	if err != nil {
+		return fmt.Errorf("error encoding prescription analysis: %v", err)
+	}
+
+	query := `
+		INSERT INTO prescription_analyses (message_id, analysis, created_at)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (message_id) DO UPDATE SET analysis = EXCLUDED.analysis, created_at = EXCLUDED.created_at`
+
+	_, err = DB.ExecContext(ctx, query, analysis.MessageID, data, analysis.CreatedAt)
+	return err
+}
+
+// GetPrescriptionAnalysis retrieves the structured analysis of a message,
+// returning nil if none has been saved
+func GetPrescriptionAnalysis(ctx context.Context, messageID int64) (*models.PrescriptionAnalysis, error) {
+	var data []byte
+	err := DB.QueryRowContext(ctx, `SELECT analysis FROM prescription_analyses WHERE message_id = $1`, messageID).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, nil // No analysis for this message
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var analysis models.PrescriptionAnalysis
+	if err := json.Unmarshal(data, &analysis); err != nil {
+		return nil, fmt.Errorf("error decoding prescription analysis: %v", err)
+	}
+
+	// Analyses saved before the knowledge base existed have no interaction checks
+	if analysis.KnownInteractions == nil {
+		analysis.KnownInteractions = []models.KnownInteraction{}
+	}
+	if analysis.Contradictions == nil {
+		analysis.Contradictions = []models.InteractionContradiction{}
+	}
+
+	return &analysis, nil
+}
@@ -0,0 +1,140 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/darooyar/server/models"
+)
+
+// ErrInvalidAuthToken is returned for unknown, expired or already used tokens
+var ErrInvalidAuthToken = errors.New("invalid or expired token")
+
+// CreateAuthToken stores a token sent to a user by email. Earlier unused
+// tokens for the same purpose stop working, so only the latest link is valid.
+func CreateAuthToken(ctx context.Context, userID int64, purpose, tokenHash string, expiresAt time.Time) error {
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	_, err = tx.ExecContext(ctx, `
+		UPDATE auth_tokens SET used_at = $1
+		WHERE user_id = $2 AND purpose = $3 AND used_at IS NULL`,
+		now, userID, purpose)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO auth_tokens (user_id, purpose, token_hash, created_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5)`,
+		userID, purpose, tokenHash, now, expiresAt)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetLastAuthTokenTime returns when a token for the purpose was last sent to
+// the user, or nil if none was
+func GetLastAuthTokenTime(ctx context.Context, userID int64, purpose string) (*time.Time, error) {
+	var createdAt sql.NullTime
+	err := DB.QueryRowContext(ctx, `SELECT MAX(created_at) FROM auth_tokens WHERE user_id = $1 AND purpose = $2`,
+		userID, purpose).Scan(&createdAt)
+	if err != nil || !createdAt.Valid {
+		return nil, err
+	}
+	return &createdAt.Time, nil
+}
+
+// ResetUserPassword uses a password reset token to set the password of its
+// user and returns the user's ID. Receiving the link proves the user owns
+// their email, so the email is marked as verified as well.
+func ResetUserPassword(ctx context.Context, tokenHash, passwordHash string) (int64, error) {
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	userID, err := consumeAuthToken(ctx, tx, tokenHash, models.AuthTokenPurposePasswordReset)
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	_, err = tx.ExecContext(ctx, `
+		UPDATE users
+		SET password = $1, email_verified_at = COALESCE(email_verified_at, $2), updated_at = $2
+		WHERE id = $3`,
+		passwordHash, now, userID)
+	if err != nil {
+		return 0, err
+	}
+
+	return userID, tx.Commit()
+}
+
+// VerifyUserEmail uses an email verification token to mark the email of its
+// user as verified and returns the user's ID
+func VerifyUserEmail(ctx context.Context, tokenHash string) (int64, error) {
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	userID, err := consumeAuthToken(ctx, tx, tokenHash, models.AuthTokenPurposeEmailVerification)
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	_, err = tx.ExecContext(ctx, `
+		UPDATE users
+		SET email_verified_at = COALESCE(email_verified_at, $1), updated_at = $1
+		WHERE id = $2`,
+		now, userID)
+	if err != nil {
+		return 0, err
+	}
+
+	return userID, tx.Commit()
+}
+
+// IsUserVerified reports whether a user verified their email or registered by phone
+func IsUserVerified(ctx context.Context, userID int64) (bool, error) {
+	var verified bool
+	err := DB.QueryRowContext(ctx, `
+		SELECT email_verified_at IS NOT NULL OR phone IS NOT NULL
+		FROM users
+		WHERE id = $1`,
+		userID).Scan(&verified)
+	if err == sql.ErrNoRows {
+		return false, ErrUserNotFound
+	}
+	return verified, err
+}
+
+// consumeAuthToken marks a valid token as used and returns its user. Only one
+// caller can use a token.
+func consumeAuthToken(ctx context.Context, tx *sql.Tx, tokenHash, purpose string) (int64, error) {
+	now := time.Now()
+
+	var userID int64
+	err := tx.QueryRowContext(ctx, `
+		UPDATE auth_tokens SET used_at = $1
+		WHERE token_hash = $2 AND purpose = $3 AND used_at IS NULL AND expires_at > $1
+		RETURNING user_id`,
+		now, tokenHash, purpose).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return 0, ErrInvalidAuthToken
+	}
+	return userID, err
+}
@@ -1,15 +1,18 @@
 package db
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"time"
 
 	"github.com/darooyar/server/models"
 )
 
 // CreateChat creates a new chat in the database
-func CreateChat(chat *models.ChatCreate, userID int64) (*models.Chat, error) {
+func CreateChat(ctx context.Context, chat *models.ChatCreate, userID int64) (*models.Chat, error) {
 	query := `
 		INSERT INTO chats (user_id, title, folder_id, created_at, updated_at)
 		VALUES ($1, $2, $3, $4, $5)
@@ -23,7 +26,7 @@ func CreateChat(chat *models.ChatCreate, userID int64) (*models.Chat, error) {
 		folderID.Valid = true
 	}
 
-	err := DB.QueryRow(
+	err := DB.QueryRowContext(ctx,
 		query,
 		userID,
 		chat.Title,
@@ -51,21 +54,32 @@ func CreateChat(chat *models.ChatCreate, userID int64) (*models.Chat, error) {
 	return &newChat, nil
 }
 
-// GetChat retrieves a chat by ID with its messages
-func GetChat(chatID int64, userID int64) (*models.ChatResponse, error) {
+// chatAccess matches the chats (c) a user ($2) can see: their own chats and
+// those shared with their pharmacy, directly or through a shared folder of
+// the chat's owner
+const chatAccess = `(c.user_id = $2 OR EXISTS (
+			SELECT 1 FROM pharmacy_members pm
+			WHERE pm.user_id = $2 AND (pm.pharmacy_id = c.pharmacy_id OR pm.pharmacy_id = (
+				SELECT f.pharmacy_id FROM folders f WHERE f.id = c.folder_id AND f.user_id = c.user_id))))`
+
+// GetChat retrieves a chat by ID with its messages if the user owns it or it
+// is shared with their pharmacy. Callers that change the chat must also check
+// its UserID.
+func GetChat(ctx context.Context, chatID int64, userID int64) (*models.ChatResponse, error) {
 	// First get the chat
 	chatQuery := `
-		SELECT id, user_id, title, folder_id, created_at, updated_at
-		FROM chats
-		WHERE id = $1 AND user_id = $2`
+		SELECT c.id, c.user_id, c.title, c.folder_id, c.pharmacy_id, c.created_at, c.updated_at
+		FROM chats c
+		WHERE c.id = $1 AND ` + chatAccess
 
 	var chat models.ChatResponse
 	var folderID sql.NullInt64
-	err := DB.QueryRow(chatQuery, chatID, userID).Scan(
+	err := DB.QueryRowContext(ctx, chatQuery, chatID, userID).Scan(
 		&chat.ID,
 		&chat.UserID,
 		&chat.Title,
 		&folderID,
+		&chat.PharmacyID,
 		&chat.CreatedAt,
 		&chat.UpdatedAt,
 	)
@@ -83,54 +97,23 @@ func GetChat(chatID int64, userID int64) (*models.ChatResponse, error) {
 	}
 
 	// Then get all messages for this chat
-	messagesQuery := `
-		SELECT id, chat_id, role, content, content_type, created_at
-		FROM messages
-		WHERE chat_id = $1
-		ORDER BY created_at ASC`
-
-	rows, err := DB.Query(messagesQuery, chatID)
+	chat.Messages, err = GetChatMessages(ctx, chatID)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
-
-	for rows.Next() {
-		var msg models.Message
-		var contentType sql.NullString // In case NULL values exist in old records
-		err := rows.Scan(
-			&msg.ID,
-			&msg.ChatID,
-			&msg.Role,
-			&msg.Content,
-			&contentType,
-			&msg.CreatedAt,
-		)
-		if err != nil {
-			return nil, err
-		}
-
-		if contentType.Valid {
-			msg.ContentType = contentType.String
-		} else {
-			msg.ContentType = "text" // Default for old records
-		}
-
-		chat.Messages = append(chat.Messages, msg)
-	}
 
 	return &chat, nil
 }
 
 // GetUserChats retrieves all chats for a user
-func GetUserChats(userID int64) ([]models.Chat, error) {
+func GetUserChats(ctx context.Context, userID int64) ([]models.Chat, error) {
 	query := `
-		SELECT id, user_id, title, folder_id, created_at, updated_at
+		SELECT id, user_id, title, folder_id, pharmacy_id, created_at, updated_at
 		FROM chats
 		WHERE user_id = $1
 		ORDER BY updated_at DESC`
 
-	rows, err := DB.Query(query, userID)
+	rows, err := DB.QueryContext(ctx, query, userID)
 	if err != nil {
 		return nil, err
 	}
@@ -145,6 +128,7 @@ func GetUserChats(userID int64) ([]models.Chat, error) {
 			&chat.UserID,
 			&chat.Title,
 			&folderID,
+			&chat.PharmacyID,
 			&chat.CreatedAt,
 			&chat.UpdatedAt,
 		)
@@ -163,42 +147,47 @@ func GetUserChats(userID int64) ([]models.Chat, error) {
 	return chats, nil
 }
 
+// messageColumns lists the columns read by scanMessage
+const messageColumns = `id, chat_id, role, content, content_type, metadata, created_at`
+
 // CreateMessage creates a new message in the database
-func CreateMessage(msg *models.MessageCreate) (*models.Message, error) {
+func CreateMessage(ctx context.Context, msg *models.MessageCreate) (*models.Message, error) {
 	query := `
-		INSERT INTO messages (chat_id, role, content, content_type, created_at)
-		VALUES ($1, $2, $3, $4, $5)
-		RETURNING id, chat_id, role, content, content_type, created_at`
+		INSERT INTO messages (chat_id, role, content, content_type, metadata, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING ` + messageColumns
 
 	contentType := msg.ContentType
 	if contentType == "" {
 		contentType = "text" // Default to text if not specified
 	}
 
+	metadata := []byte("{}")
+	if len(msg.Metadata) > 0 {
+		var err error
+		metadata, err = json.Marshal(msg.Metadata)
+		if err != nil {
+			return nil, fmt.Errorf("error encoding message metadata: %v", err)
+		}
+	}
+
 	now := time.Now()
-	var newMsg models.Message
-	err := DB.QueryRow(
+	newMsg, err := scanMessage(DB.QueryRowContext(ctx,
 		query,
 		msg.ChatID,
 		msg.Role,
 		msg.Content,
 		contentType,
+		metadata,
 		now,
-	).Scan(
-		&newMsg.ID,
-		&newMsg.ChatID,
-		&newMsg.Role,
-		&newMsg.Content,
-		&newMsg.ContentType,
-		&newMsg.CreatedAt,
-	)
+	))
 
 	if err != nil {
 		return nil, err
 	}
 
 	// Update the chat's updated_at timestamp
-	_, err = DB.Exec(`
+	_, err = DB.ExecContext(ctx, `
 		UPDATE chats
 		SET updated_at = $1
 		WHERE id = $2`,
@@ -207,26 +196,26 @@ func CreateMessage(msg *models.MessageCreate) (*models.Message, error) {
 		return nil, err
 	}
 
-	return &newMsg, nil
+	return newMsg, nil
 }
 
 // DeleteChat deletes a chat and all its messages from the database
-func DeleteChat(chatID int64) error {
+func DeleteChat(ctx context.Context, chatID int64) error {
 	// Start a transaction to ensure both operations succeed or fail together
-	tx, err := DB.Begin()
+	tx, err := DB.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
 	defer tx.Rollback()
 
 	// First delete all messages associated with the chat
-	_, err = tx.Exec(`DELETE FROM messages WHERE chat_id = $1`, chatID)
+	_, err = tx.ExecContext(ctx, `DELETE FROM messages WHERE chat_id = $1`, chatID)
 	if err != nil {
 		return err
 	}
 
 	// Then delete the chat itself
-	result, err := tx.Exec(`DELETE FROM chats WHERE id = $1`, chatID)
+	result, err := tx.ExecContext(ctx, `DELETE FROM chats WHERE id = $1`, chatID)
 	if err != nil {
 		return err
 	}
@@ -245,55 +234,123 @@ func DeleteChat(chatID int64) error {
 }
 
 // GetChatMessages retrieves all messages for a specific chat
-func GetChatMessages(chatID int64) ([]models.Message, error) {
+func GetChatMessages(ctx context.Context, chatID int64) ([]models.Message, error) {
 	query := `
-		SELECT id, chat_id, role, content, content_type, created_at
+		SELECT ` + messageColumns + `
 		FROM messages
 		WHERE chat_id = $1
 		ORDER BY created_at ASC`
 
-	rows, err := DB.Query(query, chatID)
+	rows, err := DB.QueryContext(ctx, query, chatID)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
+	return scanMessages(rows)
+}
+
+// FindMessagesByMetadata retrieves the user's messages whose metadata contains
+// every key and value in filter, newest first. chatID limits the search to a
+// single chat when non-zero.
+func FindMessagesByMetadata(ctx context.Context, userID int64, chatID int64, filter map[string]interface{}, limit int) ([]models.Message, error) {
+	filterJSON, err := json.Marshal(filter)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding metadata filter: %v", err)
+	}
+
+	query := `
+		SELECT m.id, m.chat_id, m.role, m.content, m.content_type, m.metadata, m.created_at
+		FROM messages m
+		JOIN chats c ON c.id = m.chat_id
+		WHERE c.user_id = $1 AND m.metadata @> $2 AND ($3 = 0 OR m.chat_id = $3)
+		ORDER BY m.created_at DESC
+		LIMIT $4`
+
+	rows, err := DB.QueryContext(ctx, query, userID, filterJSON, chatID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanMessages(rows)
+}
+
+// GetUserMessage retrieves a message by ID if it belongs to one of the user's chats
+func GetUserMessage(ctx context.Context, messageID int64, userID int64) (*models.Message, error) {
+	query := `
+		SELECT m.id, m.chat_id, m.role, m.content, m.content_type, m.metadata, m.created_at
+		FROM messages m
+		JOIN chats c ON c.id = m.chat_id
+		WHERE m.id = $1 AND c.user_id = $2`
+
+	msg, err := scanMessage(DB.QueryRowContext(ctx, query, messageID, userID))
+	if err == sql.ErrNoRows {
+		return nil, errors.New("message not found or unauthorized")
+	}
+	return msg, err
+}
+
+// rowScanner is implemented by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanMessage scans a single message selected with messageColumns
+func scanMessage(row rowScanner) (*models.Message, error) {
+	var msg models.Message
+	var contentType sql.NullString // In case NULL values exist in old records
+	var metadata []byte
+	err := row.Scan(
+		&msg.ID,
+		&msg.ChatID,
+		&msg.Role,
+		&msg.Content,
+		&contentType,
+		&metadata,
+		&msg.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if contentType.Valid {
+		msg.ContentType = contentType.String
+	} else {
+		msg.ContentType = "text" // Default for old records
+	}
+
+	if len(metadata) > 0 {
+		if err := json.Unmarshal(metadata, &msg.Metadata); err != nil {
+			return nil, fmt.Errorf("error decoding metadata of message %d: %v", msg.ID, err)
+		}
+	}
+
+	return &msg, nil
+}
+
+// scanMessages scans all remaining rows into messages
+func scanMessages(rows *sql.Rows) ([]models.Message, error) {
 	var messages []models.Message
 	for rows.Next() {
-		var msg models.Message
-		var contentType sql.NullString // In case NULL values exist in old records
-		err := rows.Scan(
-			&msg.ID,
-			&msg.ChatID,
-			&msg.Role,
-			&msg.Content,
-			&contentType,
-			&msg.CreatedAt,
-		)
+		msg, err := scanMessage(rows)
 		if err != nil {
 			return nil, err
 		}
-
-		if contentType.Valid {
-			msg.ContentType = contentType.String
-		} else {
-			msg.ContentType = "text" // Default for old records
-		}
-
-		messages = append(messages, msg)
+		messages = append(messages, *msg)
 	}
 
-	return messages, nil
+	return messages, rows.Err()
 }
 
 // UpdateChat updates a chat in the database
-func UpdateChat(chatID int64, userID int64, update *models.ChatUpdate) (*models.Chat, error) {
+func UpdateChat(ctx context.Context, chatID int64, userID int64, update *models.ChatUpdate) (*models.Chat, error) {
 	// First check if the chat exists and belongs to the user
 	checkQuery := `
 		SELECT id FROM chats
 		WHERE id = $1 AND user_id = $2`
 	var id int64
-	err := DB.QueryRow(checkQuery, chatID, userID).Scan(&id)
+	err := DB.QueryRowContext(ctx, checkQuery, chatID, userID).Scan(&id)
 	if err == sql.ErrNoRows {
 		return nil, errors.New("chat not found or unauthorized")
 	}
@@ -308,7 +365,7 @@ func UpdateChat(chatID int64, userID int64, update *models.ChatUpdate) (*models.
 		    folder_id = $2,
 		    updated_at = $3
 		WHERE id = $4
-		RETURNING id, user_id, title, folder_id, created_at, updated_at`
+		RETURNING id, user_id, title, folder_id, pharmacy_id, created_at, updated_at`
 
 	now := time.Now()
 	var chat models.Chat
@@ -318,7 +375,7 @@ func UpdateChat(chatID int64, userID int64, update *models.ChatUpdate) (*models.
 		folderID.Valid = true
 	}
 
-	err = DB.QueryRow(
+	err = DB.QueryRowContext(ctx,
 		updateQuery,
 		update.Title,
 		folderID,
@@ -329,6 +386,7 @@ func UpdateChat(chatID int64, userID int64, update *models.ChatUpdate) (*models.
 		&chat.UserID,
 		&chat.Title,
 		&folderID,
+		&chat.PharmacyID,
 		&chat.CreatedAt,
 		&chat.UpdatedAt,
 	)
@@ -1,9 +1,10 @@
 package db
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
-	"log"
+	"log/slog"
 
 	"github.com/darooyar/server/config"
 	_ "github.com/lib/pq"
@@ -11,7 +12,7 @@ import (
 
 var DB *sql.DB
 
-func InitDB(cfg *config.Config) error {
+func InitDB(ctx context.Context, cfg *config.Config) error {
 	// Construct connection string
 	connStr := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
 		cfg.DBHost, cfg.DBPort, cfg.DBUser, cfg.DBPassword, cfg.DBName)
@@ -24,7 +25,7 @@ func InitDB(cfg *config.Config) error {
 	}
 
 	// Test the connection
-	err = DB.Ping()
+	err = DB.PingContext(ctx)
 	if err != nil {
 		return fmt.Errorf("error connecting to the database: %v", err)
 	}
@@ -33,7 +34,7 @@ func InitDB(cfg *config.Config) error {
 	DB.SetMaxOpenConns(25)
 	DB.SetMaxIdleConns(5)
 
-	log.Println("Successfully connected to database")
+	slog.Info("Connected to database")
 	return nil
 }
 
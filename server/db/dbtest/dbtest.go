@@ -0,0 +1,84 @@
+// Package dbtest connects tests to a Postgres database. Tests that use it
+// are skipped unless TEST_DATABASE_URL names a database they may write to.
+// Each test gets a schema of its own, which is dropped when the test ends.
+package dbtest
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/darooyar/server/db"
+	"github.com/darooyar/server/db/migrations"
+	"github.com/google/uuid"
+)
+
+// Open points db.DB at an empty schema of the test database for the rest of
+// the test and returns it
+func Open(t *testing.T) *sql.DB {
+	t.Helper()
+
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+
+	admin, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatalf("opening test database: %v", err)
+	}
+	t.Cleanup(func() { admin.Close() })
+
+	schema := "test_" + strings.ReplaceAll(uuid.New().String(), "-", "")
+	if _, err := admin.Exec(`CREATE SCHEMA ` + schema); err != nil {
+		t.Fatalf("creating test schema: %v", err)
+	}
+
+	conn, err := sql.Open("postgres", withSearchPath(dsn, schema))
+	if err != nil {
+		t.Fatalf("opening test schema: %v", err)
+	}
+
+	previous := db.DB
+	db.DB = conn
+	t.Cleanup(func() {
+		db.DB = previous
+		conn.Close()
+		if _, err := admin.Exec(`DROP SCHEMA ` + schema + ` CASCADE`); err != nil {
+			t.Errorf("dropping test schema: %v", err)
+		}
+	})
+
+	return conn
+}
+
+// Migrated is Open with every migration applied
+func Migrated(t *testing.T) *sql.DB {
+	t.Helper()
+
+	conn := Open(t)
+	if err := migrations.Up(context.Background()); err != nil {
+		t.Fatalf("migrating test schema: %v", err)
+	}
+	return conn
+}
+
+// withSearchPath makes the connections of a data source name create and find
+// tables in schema. Extensions stay reachable in public.
+func withSearchPath(dsn, schema string) string {
+	searchPath := schema + ",public"
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		u, err := url.Parse(dsn)
+		if err == nil {
+			query := u.Query()
+			query.Set("search_path", searchPath)
+			u.RawQuery = query.Encode()
+			return u.String()
+		}
+	}
+	return fmt.Sprintf("%s search_path='%s'", dsn, searchPath)
+}
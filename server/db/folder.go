@@ -1,6 +1,7 @@
 package db
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"time"
@@ -9,7 +10,7 @@ import (
 )
 
 // CreateFolder creates a new folder in the database
-func CreateFolder(folder *models.FolderCreate, userID int64) (*models.Folder, error) {
+func CreateFolder(ctx context.Context, folder *models.FolderCreate, userID int64) (*models.Folder, error) {
 	query := `
 		INSERT INTO folders (user_id, name, color, created_at, updated_at)
 		VALUES ($1, $2, $3, $4, $5)
@@ -17,7 +18,7 @@ func CreateFolder(folder *models.FolderCreate, userID int64) (*models.Folder, er
 
 	now := time.Now()
 	var newFolder models.Folder
-	err := DB.QueryRow(
+	err := DB.QueryRowContext(ctx,
 		query,
 		userID,
 		folder.Name,
@@ -40,20 +41,23 @@ func CreateFolder(folder *models.FolderCreate, userID int64) (*models.Folder, er
 	return &newFolder, nil
 }
 
-// GetFolder retrieves a folder by ID with its chats
-func GetFolder(folderID int64, userID int64) (*models.FolderResponse, error) {
+// GetFolder retrieves a folder by ID with its owner's chats if the user owns
+// the folder or it is shared with their pharmacy
+func GetFolder(ctx context.Context, folderID int64, userID int64) (*models.FolderResponse, error) {
 	// First get the folder
 	folderQuery := `
-		SELECT id, user_id, name, color, created_at, updated_at
+		SELECT id, user_id, name, color, pharmacy_id, created_at, updated_at
 		FROM folders
-		WHERE id = $1 AND user_id = $2`
+		WHERE id = $1 AND (user_id = $2
+			OR pharmacy_id = (SELECT pharmacy_id FROM pharmacy_members WHERE user_id = $2))`
 
 	var folder models.FolderResponse
-	err := DB.QueryRow(folderQuery, folderID, userID).Scan(
+	err := DB.QueryRowContext(ctx, folderQuery, folderID, userID).Scan(
 		&folder.ID,
 		&folder.UserID,
 		&folder.Name,
 		&folder.Color,
+		&folder.PharmacyID,
 		&folder.CreatedAt,
 		&folder.UpdatedAt,
 	)
@@ -67,12 +71,12 @@ func GetFolder(folderID int64, userID int64) (*models.FolderResponse, error) {
 
 	// Then get all chats for this folder
 	chatsQuery := `
-		SELECT id, user_id, title, folder_id, created_at, updated_at
+		SELECT id, user_id, title, folder_id, pharmacy_id, created_at, updated_at
 		FROM chats
-		WHERE folder_id = $1
+		WHERE folder_id = $1 AND user_id = $2
 		ORDER BY updated_at DESC`
 
-	rows, err := DB.Query(chatsQuery, folderID)
+	rows, err := DB.QueryContext(ctx, chatsQuery, folderID, folder.UserID)
 	if err != nil {
 		return nil, err
 	}
@@ -88,6 +92,7 @@ func GetFolder(folderID int64, userID int64) (*models.FolderResponse, error) {
 			&chat.UserID,
 			&chat.Title,
 			&folderID,
+			&chat.PharmacyID,
 			&chat.CreatedAt,
 			&chat.UpdatedAt,
 		)
@@ -105,8 +110,8 @@ func GetFolder(folderID int64, userID int64) (*models.FolderResponse, error) {
 
 	// Get chat count
 	countQuery := `
-		SELECT COUNT(*) FROM chats WHERE folder_id = $1`
-	err = DB.QueryRow(countQuery, folderID).Scan(&folder.ChatCount)
+		SELECT COUNT(*) FROM chats WHERE folder_id = $1 AND user_id = $2`
+	err = DB.QueryRowContext(ctx, countQuery, folderID, folder.UserID).Scan(&folder.ChatCount)
 	if err != nil {
 		return nil, err
 	}
@@ -115,9 +120,9 @@ func GetFolder(folderID int64, userID int64) (*models.FolderResponse, error) {
 }
 
 // GetUserFolders retrieves all folders for a user
-func GetUserFolders(userID int64) ([]models.Folder, error) {
+func GetUserFolders(ctx context.Context, userID int64) ([]models.Folder, error) {
 	query := `
-		SELECT f.id, f.user_id, f.name, f.color, f.created_at, f.updated_at, 
+		SELECT f.id, f.user_id, f.name, f.color, f.pharmacy_id, f.created_at, f.updated_at, 
 		       COUNT(c.id) as chat_count
 		FROM folders f
 		LEFT JOIN chats c ON f.id = c.folder_id
@@ -125,7 +130,7 @@ func GetUserFolders(userID int64) ([]models.Folder, error) {
 		GROUP BY f.id
 		ORDER BY f.name ASC`
 
-	rows, err := DB.Query(query, userID)
+	rows, err := DB.QueryContext(ctx, query, userID)
 	if err != nil {
 		return nil, err
 	}
@@ -139,6 +144,7 @@ func GetUserFolders(userID int64) ([]models.Folder, error) {
 			&folder.UserID,
 			&folder.Name,
 			&folder.Color,
+			&folder.PharmacyID,
 			&folder.CreatedAt,
 			&folder.UpdatedAt,
 			&folder.ChatCount,
@@ -153,13 +159,13 @@ func GetUserFolders(userID int64) ([]models.Folder, error) {
 }
 
 // UpdateFolder updates a folder in the database
-func UpdateFolder(folderID int64, userID int64, update *models.FolderUpdate) (*models.Folder, error) {
+func UpdateFolder(ctx context.Context, folderID int64, userID int64, update *models.FolderUpdate) (*models.Folder, error) {
 	// First check if the folder exists and belongs to the user
 	checkQuery := `
 		SELECT id FROM folders
 		WHERE id = $1 AND user_id = $2`
 	var id int64
-	err := DB.QueryRow(checkQuery, folderID, userID).Scan(&id)
+	err := DB.QueryRowContext(ctx, checkQuery, folderID, userID).Scan(&id)
 	if err == sql.ErrNoRows {
 		return nil, errors.New("folder not found or unauthorized")
 	}
@@ -178,7 +184,7 @@ func UpdateFolder(folderID int64, userID int64, update *models.FolderUpdate) (*m
 
 	now := time.Now()
 	var folder models.Folder
-	err = DB.QueryRow(
+	err = DB.QueryRowContext(ctx,
 		updateQuery,
 		update.Name,
 		update.Color,
@@ -201,13 +207,13 @@ func UpdateFolder(folderID int64, userID int64, update *models.FolderUpdate) (*m
 }
 
 // DeleteFolder deletes a folder from the database
-func DeleteFolder(folderID int64, userID int64) error {
+func DeleteFolder(ctx context.Context, folderID int64, userID int64) error {
 	// First check if the folder exists and belongs to the user
 	checkQuery := `
 		SELECT id FROM folders
 		WHERE id = $1 AND user_id = $2`
 	var id int64
-	err := DB.QueryRow(checkQuery, folderID, userID).Scan(&id)
+	err := DB.QueryRowContext(ctx, checkQuery, folderID, userID).Scan(&id)
 	if err == sql.ErrNoRows {
 		return errors.New("folder not found or unauthorized")
 	}
@@ -216,14 +222,14 @@ func DeleteFolder(folderID int64, userID int64) error {
 	}
 
 	// Start a transaction
-	tx, err := DB.Begin()
+	tx, err := DB.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
 	defer tx.Rollback()
 
 	// Update chats to remove folder_id
-	_, err = tx.Exec(`
+	_, err = tx.ExecContext(ctx, `
 		UPDATE chats
 		SET folder_id = NULL
 		WHERE folder_id = $1`,
@@ -233,7 +239,7 @@ func DeleteFolder(folderID int64, userID int64) error {
 	}
 
 	// Delete the folder
-	_, err = tx.Exec(`
+	_, err = tx.ExecContext(ctx, `
 		DELETE FROM folders
 		WHERE id = $1`,
 		folderID)
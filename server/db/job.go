@@ -0,0 +1,215 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/darooyar/server/models"
+)
+
+const aiJobColumns = `id, chat_id, user_id, kind, input, status, attempts, last_error,
+		result_message_id, created_at, updated_at, started_at, finished_at, interrupted_at`
+
+// CreateAIJob queues a new AI job for a chat under the given ID
+func CreateAIJob(ctx context.Context, jobID string, chatID int64, userID int64, kind models.AIJobKind, input string) (*models.AIJob, error) {
+	query := `
+		INSERT INTO ai_jobs (id, chat_id, user_id, kind, input, status, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $7)
+		RETURNING ` + aiJobColumns
+
+	return scanAIJob(DB.QueryRowContext(ctx, query, jobID, chatID, userID, kind, input,
+		models.AIJobStatusQueued, time.Now()))
+}
+
+// GetAIJob retrieves an AI job by ID, returning nil if it does not exist
+func GetAIJob(ctx context.Context, jobID string) (*models.AIJob, error) {
+	query := `SELECT ` + aiJobColumns + ` FROM ai_jobs WHERE id = $1`
+
+	job, err := scanAIJob(DB.QueryRowContext(ctx, query, jobID))
+	if err == sql.ErrNoRows {
+		return nil, nil // Job not found, e.g. its chat was deleted
+	}
+	return job, err
+}
+
+// GetUserAIJob retrieves an AI job by ID if it belongs to the user
+func GetUserAIJob(ctx context.Context, jobID string, userID int64) (*models.AIJob, error) {
+	query := `SELECT ` + aiJobColumns + ` FROM ai_jobs WHERE id = $1 AND user_id = $2`
+
+	job, err := scanAIJob(DB.QueryRowContext(ctx, query, jobID, userID))
+	if err == sql.ErrNoRows {
+		return nil, errors.New("job not found or unauthorized")
+	}
+	return job, err
+}
+
+// GetActiveAIJob returns the queued or running job of a chat, if any.
+// Jobs that have not been updated within staleAfter are ignored so that a
+// worker that died mid-job never blocks the chat. Interrupted jobs wait for a
+// server to resume them and stay active however long that takes.
+func GetActiveAIJob(ctx context.Context, chatID int64, staleAfter time.Duration) (*models.AIJob, error) {
+	query := `
+		SELECT ` + aiJobColumns + `
+		FROM ai_jobs
+		WHERE chat_id = $1 AND status IN ($2, $3) AND (updated_at > $4 OR interrupted_at IS NOT NULL)
+		ORDER BY created_at DESC
+		LIMIT 1`
+
+	job, err := scanAIJob(DB.QueryRowContext(ctx, query, chatID, models.AIJobStatusQueued,
+		models.AIJobStatusRunning, time.Now().Add(-staleAfter)))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return job, err
+}
+
+// StartAIJobAttempt marks a job as running and counts the attempt. A job
+// interrupted by a shutdown is no longer waiting to be resumed once another
+// server starts it.
+func StartAIJobAttempt(ctx context.Context, jobID string) error {
+	query := `
+		UPDATE ai_jobs
+		SET status = $1, attempts = attempts + 1, started_at = COALESCE(started_at, $2), updated_at = $2,
+			interrupted_at = NULL
+		WHERE id = $3`
+
+	_, err := DB.ExecContext(ctx, query, models.AIJobStatusRunning, time.Now(), jobID)
+	return err
+}
+
+// TouchAIJob records that a worker is still processing the job
+func TouchAIJob(ctx context.Context, jobID string) error {
+	_, err := DB.ExecContext(ctx, `UPDATE ai_jobs SET updated_at = $1 WHERE id = $2`, time.Now(), jobID)
+	return err
+}
+
+// CompleteAIJob marks a job as succeeded with the message it produced
+func CompleteAIJob(ctx context.Context, jobID string, messageID int64) error {
+	query := `
+		UPDATE ai_jobs
+		SET status = $1, result_message_id = $2, last_error = NULL, updated_at = $3, finished_at = $3
+		WHERE id = $4`
+
+	_, err := DB.ExecContext(ctx, query, models.AIJobStatusSucceeded, messageID, time.Now(), jobID)
+	return err
+}
+
+// FailAIJobAttempt records a failed attempt. The job goes back to queued
+// for a retry unless this was the final attempt, in which case it fails.
+// messageID, when non-zero, is the fallback message shown to the user.
+func FailAIJobAttempt(ctx context.Context, jobID string, attemptErr error, final bool, messageID int64) error {
+	status := models.AIJobStatusQueued
+	var finishedAt *time.Time
+	now := time.Now()
+	if final {
+		status = models.AIJobStatusFailed
+		finishedAt = &now
+	}
+
+	var resultMessageID *int64
+	if messageID != 0 {
+		resultMessageID = &messageID
+	}
+
+	query := `
+		UPDATE ai_jobs
+		SET status = $1, last_error = $2, result_message_id = COALESCE($3, result_message_id),
+			updated_at = $4, finished_at = $5
+		WHERE id = $6`
+
+	_, err := DB.ExecContext(ctx, query, status, attemptErr.Error(), resultMessageID, now, finishedAt, jobID)
+	return err
+}
+
+// InterruptAIJob puts an unfinished job back in the queue because the server
+// is stopping, and marks it to be resumed by the next server that starts
+func InterruptAIJob(ctx context.Context, jobID string) error {
+	query := `
+		UPDATE ai_jobs
+		SET status = $1, interrupted_at = $2, updated_at = $2
+		WHERE id = $3 AND status IN ($1, $4)`
+
+	_, err := DB.ExecContext(ctx, query, models.AIJobStatusQueued, time.Now(), jobID, models.AIJobStatusRunning)
+	return err
+}
+
+// ClaimInterruptedAIJobs clears the mark of every interrupted job and returns
+// the jobs, oldest first. Claiming is atomic, so each job is resumed by a
+// single server even when several start together.
+func ClaimInterruptedAIJobs(ctx context.Context) ([]*models.AIJob, error) {
+	query := `
+		UPDATE ai_jobs
+		SET interrupted_at = NULL, updated_at = $1
+		WHERE interrupted_at IS NOT NULL AND status = $2
+		RETURNING ` + aiJobColumns
+
+	rows, err := DB.QueryContext(ctx, query, time.Now(), models.AIJobStatusQueued)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var jobs []*models.AIJob
+	for rows.Next() {
+		job, err := scanAIJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].CreatedAt.Before(jobs[j].CreatedAt) })
+	return jobs, nil
+}
+
+// scanAIJob scans a single ai_jobs row
+func scanAIJob(row rowScanner) (*models.AIJob, error) {
+	var job models.AIJob
+	var lastError sql.NullString
+	var resultMessageID sql.NullInt64
+	var startedAt, finishedAt, interruptedAt sql.NullTime
+
+	err := row.Scan(
+		&job.ID,
+		&job.ChatID,
+		&job.UserID,
+		&job.Kind,
+		&job.Input,
+		&job.Status,
+		&job.Attempts,
+		&lastError,
+		&resultMessageID,
+		&job.CreatedAt,
+		&job.UpdatedAt,
+		&startedAt,
+		&finishedAt,
+		&interruptedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if lastError.Valid {
+		job.LastError = &lastError.String
+	}
+	if resultMessageID.Valid {
+		job.ResultMessageID = &resultMessageID.Int64
+	}
+	if startedAt.Valid {
+		job.StartedAt = &startedAt.Time
+	}
+	if finishedAt.Valid {
+		job.FinishedAt = &finishedAt.Time
+	}
+	if interruptedAt.Valid {
+		job.InterruptedAt = &interruptedAt.Time
+	}
+
+	return &job, nil
+}
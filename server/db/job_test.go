@@ -0,0 +1,64 @@
+package db_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/darooyar/server/db"
+	"github.com/darooyar/server/db/dbtest"
+	"github.com/darooyar/server/models"
+	"github.com/google/uuid"
+)
+
+func TestGetActiveAIJobKeepsInterruptedJobs(t *testing.T) {
+	conn := dbtest.Migrated(t)
+	ctx := context.Background()
+	user, _ := subscribeTestUser(t, 1)
+
+	chat, err := db.CreateChat(ctx, &models.ChatCreate{Title: "chat"}, user.ID)
+	if err != nil {
+		t.Fatalf("creating chat: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		interrupt bool
+		want      bool
+	}{
+		{name: "abandoned job", want: false},
+		{name: "interrupted job", interrupt: true, want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jobID := uuid.New().String()
+			if _, err := db.CreateAIJob(ctx, jobID, chat.ID, user.ID, models.AIJobKindChat, "hello"); err != nil {
+				t.Fatalf("creating job: %v", err)
+			}
+			if tt.interrupt {
+				if err := db.InterruptAIJob(ctx, jobID); err != nil {
+					t.Fatalf("interrupting job: %v", err)
+				}
+			}
+
+			// No heartbeat for longer than the jobs may go without one
+			if _, err := conn.Exec(`UPDATE ai_jobs SET updated_at = $1 WHERE id = $2`, time.Now().Add(-time.Hour), jobID); err != nil {
+				t.Fatalf("aging job: %v", err)
+			}
+
+			job, err := db.GetActiveAIJob(ctx, chat.ID, time.Minute)
+			if err != nil {
+				t.Fatalf("getting active job: %v", err)
+			}
+			if got := job != nil && job.ID == jobID; got != tt.want {
+				t.Errorf("job active = %v, want %v", got, tt.want)
+			}
+
+			// Only one job of the chat is looked at a time
+			if _, err := conn.Exec(`UPDATE ai_jobs SET status = $1 WHERE id = $2`, models.AIJobStatusFailed, jobID); err != nil {
+				t.Fatalf("finishing job: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,234 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/darooyar/server/models"
+)
+
+// ErrInsufficientCredit is returned when a user has less credit than is subtracted
+var ErrInsufficientCredit = errors.New("insufficient credit")
+
+const creditTransactionColumns = `id, user_id, pharmacy_id, amount, balance_after, COALESCE(description, ''), transaction_type,
+		related_subscription_id, actor_id, created_at`
+
+// RecordCreditTransaction changes a user's credit and appends the change to
+// the ledger in one database transaction. Every change of users.credit goes
+// through here. It returns ErrInsufficientCredit when a reduction would make
+// the balance negative.
+func RecordCreditTransaction(ctx context.Context, entry models.CreditEntry) (*models.CreditTransaction, error) {
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	txn, err := recordCreditTransaction(ctx, tx, entry)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return txn, nil
+}
+
+// recordCreditTransaction records a credit change as part of a larger database transaction
+func recordCreditTransaction(ctx context.Context, tx *sql.Tx, entry models.CreditEntry) (*models.CreditTransaction, error) {
+	if entry.Amount == 0 {
+		return nil, errors.New("amount must not be zero")
+	}
+
+	// Lock the owner of the credit so that concurrent changes see each other's balance
+	table, ownerID := "users", entry.UserID
+	if entry.PharmacyID != nil {
+		table, ownerID = "pharmacies", *entry.PharmacyID
+	}
+
+	var credit float64
+	err := tx.QueryRowContext(ctx, `SELECT credit FROM `+table+` WHERE id = $1 FOR UPDATE`, ownerID).Scan(&credit)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%s %d not found", strings.TrimSuffix(table, "s"), ownerID)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if entry.Amount < 0 && credit+entry.Amount < 0 {
+		return nil, ErrInsufficientCredit
+	}
+
+	now := time.Now()
+
+	// The new balance is computed by the database to keep its decimal precision
+	var balanceAfter float64
+	err = tx.QueryRowContext(ctx, `
+		UPDATE `+table+`
+		SET credit = credit + $1, updated_at = $2
+		WHERE id = $3
+		RETURNING credit`,
+		entry.Amount, now, ownerID).Scan(&balanceAfter)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `
+		INSERT INTO credit_transactions (
+			user_id, pharmacy_id, amount, balance_after, description, transaction_type,
+			related_subscription_id, actor_id, created_at
+		)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		RETURNING ` + creditTransactionColumns
+
+	return scanCreditTransaction(tx.QueryRowContext(ctx, query,
+		entry.UserID,
+		entry.PharmacyID,
+		entry.Amount,
+		balanceAfter,
+		entry.Description,
+		entry.TransactionType,
+		entry.RelatedSubscriptionID,
+		entry.ActorID,
+		now,
+	))
+}
+
+// GetCreditDrifts compares every user's credit with their ledger and returns
+// the users whose credit differs from the sum of their transactions or from
+// the balance after their last transaction. Transactions of pharmacies are
+// left out, see GetPharmacyCreditDrifts.
+func GetCreditDrifts(ctx context.Context) ([]*models.CreditDrift, error) {
+	query := `
+		SELECT u.id, u.credit, COALESCE(l.total, 0), l.last_balance, COALESCE(l.count, 0)
+		FROM users u
+		LEFT JOIN (
+			SELECT user_id, SUM(amount) AS total, COUNT(*) AS count,
+				(ARRAY_AGG(balance_after ORDER BY id DESC))[1] AS last_balance
+			FROM credit_transactions
+			WHERE pharmacy_id IS NULL
+			GROUP BY user_id
+		) l ON l.user_id = u.id
+		WHERE u.credit <> COALESCE(l.total, 0)
+			OR (l.last_balance IS NOT NULL AND l.last_balance <> u.credit)
+		ORDER BY u.id`
+
+	return queryCreditDrifts(ctx, query, func(drift *models.CreditDrift) interface{} { return &drift.UserID })
+}
+
+// GetPharmacyCreditDrifts compares every pharmacy's credit with its ledger
+// and returns the pharmacies whose credit differs from it
+func GetPharmacyCreditDrifts(ctx context.Context) ([]*models.CreditDrift, error) {
+	query := `
+		SELECT p.id, p.credit, COALESCE(l.total, 0), l.last_balance, COALESCE(l.count, 0)
+		FROM pharmacies p
+		LEFT JOIN (
+			SELECT pharmacy_id, SUM(amount) AS total, COUNT(*) AS count,
+				(ARRAY_AGG(balance_after ORDER BY id DESC))[1] AS last_balance
+			FROM credit_transactions
+			WHERE pharmacy_id IS NOT NULL
+			GROUP BY pharmacy_id
+		) l ON l.pharmacy_id = p.id
+		WHERE p.credit <> COALESCE(l.total, 0)
+			OR (l.last_balance IS NOT NULL AND l.last_balance <> p.credit)
+		ORDER BY p.id`
+
+	return queryCreditDrifts(ctx, query, func(drift *models.CreditDrift) interface{} { return &drift.PharmacyID })
+}
+
+// queryCreditDrifts runs a drift query whose first column is read into the field returned by owner
+func queryCreditDrifts(ctx context.Context, query string, owner func(*models.CreditDrift) interface{}) ([]*models.CreditDrift, error) {
+	rows, err := DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	drifts := []*models.CreditDrift{}
+	for rows.Next() {
+		var drift models.CreditDrift
+		var lastBalance sql.NullFloat64
+		if err := rows.Scan(owner(&drift), &drift.Credit, &drift.LedgerBalance, &lastBalance, &drift.Transactions); err != nil {
+			return nil, err
+		}
+		if lastBalance.Valid {
+			drift.LastBalanceAfter = &lastBalance.Float64
+		}
+		drifts = append(drifts, &drift)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return drifts, nil
+}
+
+// RepairCreditBalance sets a user's credit to the sum of their ledger and
+// returns the repaired balance. The ledger is the source of truth, so it is
+// left unchanged.
+func RepairCreditBalance(ctx context.Context, userID int64) (float64, error) {
+	return repairCreditBalance(ctx, "users",
+		`SELECT COALESCE(SUM(amount), 0) FROM credit_transactions WHERE user_id = $1 AND pharmacy_id IS NULL`, userID)
+}
+
+// RepairPharmacyCreditBalance sets a pharmacy's credit to the sum of its ledger
+// and returns the repaired balance
+func RepairPharmacyCreditBalance(ctx context.Context, pharmacyID int64) (float64, error) {
+	return repairCreditBalance(ctx, "pharmacies",
+		`SELECT COALESCE(SUM(amount), 0) FROM credit_transactions WHERE pharmacy_id = $1`, pharmacyID)
+}
+
+// repairCreditBalance sets the credit of a row of the table to the ledger sum selected by sumQuery
+func repairCreditBalance(ctx context.Context, table, sumQuery string, id int64) (float64, error) {
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// Lock the owner first so that no credit change runs while the sum is taken
+	if _, err := tx.ExecContext(ctx, `SELECT 1 FROM `+table+` WHERE id = $1 FOR UPDATE`, id); err != nil {
+		return 0, err
+	}
+
+	var balance float64
+	err = tx.QueryRowContext(ctx, `
+		UPDATE `+table+`
+		SET credit = (`+sumQuery+`),
+			updated_at = $2
+		WHERE id = $1
+		RETURNING credit`,
+		id, time.Now()).Scan(&balance)
+	if err != nil {
+		return 0, err
+	}
+
+	return balance, tx.Commit()
+}
+
+// scanCreditTransaction reads a transaction selected with creditTransactionColumns
+func scanCreditTransaction(row rowScanner) (*models.CreditTransaction, error) {
+	var txn models.CreditTransaction
+	err := row.Scan(
+		&txn.ID,
+		&txn.UserID,
+		&txn.PharmacyID,
+		&txn.Amount,
+		&txn.BalanceAfter,
+		&txn.Description,
+		&txn.TransactionType,
+		&txn.RelatedSubscriptionID,
+		&txn.ActorID,
+		&txn.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &txn, nil
+}
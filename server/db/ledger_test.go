@@ -0,0 +1,59 @@
+package db_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/darooyar/server/db"
+	"github.com/darooyar/server/db/dbtest"
+	"github.com/darooyar/server/models"
+)
+
+func TestCreditLedgerIsAppendOnly(t *testing.T) {
+	conn := dbtest.Migrated(t)
+	ctx := context.Background()
+
+	user, err := db.CreateUser(ctx, &models.UserCreate{Username: "user", Email: "user@example.com", Password: "hash"})
+	if err != nil {
+		t.Fatalf("creating user: %v", err)
+	}
+	if err := db.AddUserCredit(ctx, user.ID, 1000, user.ID, "top-up"); err != nil {
+		t.Fatalf("adding credit: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		query     string
+		wantError bool
+	}{
+		{name: "change amount", query: `UPDATE credit_transactions SET amount = amount + 1`, wantError: true},
+		{name: "move to a pharmacy", query: `UPDATE credit_transactions SET pharmacy_id = 1`, wantError: true},
+		{name: "delete transaction", query: `DELETE FROM credit_transactions`, wantError: true},
+		{name: "delete user", query: `DELETE FROM users`, wantError: true},
+		{name: "change description", query: `UPDATE credit_transactions SET description = 'corrected'`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := conn.ExecContext(ctx, tt.query)
+			if !tt.wantError {
+				if err != nil {
+					t.Fatalf("%s: %v", tt.query, err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), "append-only") {
+				t.Fatalf("%s: error = %v, want the ledger to refuse it", tt.query, err)
+			}
+		})
+	}
+
+	transactions, err := db.GetCreditTransactions(ctx, user.ID, 10, 0)
+	if err != nil {
+		t.Fatalf("getting transactions: %v", err)
+	}
+	if len(transactions) != 1 || transactions[0].Amount != 1000 {
+		t.Errorf("transactions = %+v, want the top-up unchanged", transactions)
+	}
+}
@@ -0,0 +1,355 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/darooyar/server/models"
+)
+
+// CreateChat creates a chat owned by the user
+func (s *Store) CreateChat(ctx context.Context, create *models.ChatCreate, userID int64) (*models.Chat, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[userID]; !ok {
+		return nil, fmt.Errorf("user %d not found", userID)
+	}
+	if create.FolderID != nil {
+		if _, ok := s.folders[*create.FolderID]; !ok {
+			return nil, fmt.Errorf("folder %d not found", *create.FolderID)
+		}
+	}
+
+	created := now()
+	chat := &models.Chat{
+		ID:        s.nextID("chats"),
+		UserID:    userID,
+		Title:     create.Title,
+		FolderID:  copyID(create.FolderID),
+		CreatedAt: created,
+		UpdatedAt: created,
+	}
+	s.chats[chat.ID] = chat
+
+	return copyChat(chat), nil
+}
+
+// GetChat retrieves a chat owned by the user with its messages
+func (s *Store) GetChat(ctx context.Context, chatID int64, userID int64) (*models.ChatResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	chat, ok := s.chats[chatID]
+	if !ok || chat.UserID != userID {
+		return nil, errors.New("chat not found")
+	}
+
+	return &models.ChatResponse{
+		ID:         chat.ID,
+		UserID:     chat.UserID,
+		Title:      chat.Title,
+		FolderID:   copyID(chat.FolderID),
+		PharmacyID: copyID(chat.PharmacyID),
+		CreatedAt:  chat.CreatedAt,
+		UpdatedAt:  chat.UpdatedAt,
+		Messages:   s.chatMessages(chatID),
+	}, nil
+}
+
+// GetUserChats retrieves the chats of a user, most recently updated first
+func (s *Store) GetUserChats(ctx context.Context, userID int64) ([]models.Chat, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.userChats(userID, nil), nil
+}
+
+// UpdateChat sets the title and folder of a chat owned by the user
+func (s *Store) UpdateChat(ctx context.Context, chatID int64, userID int64, update *models.ChatUpdate) (*models.Chat, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	chat, ok := s.chats[chatID]
+	if !ok || chat.UserID != userID {
+		return nil, errors.New("chat not found or unauthorized")
+	}
+	if update.FolderID != nil {
+		if _, ok := s.folders[*update.FolderID]; !ok {
+			return nil, fmt.Errorf("folder %d not found", *update.FolderID)
+		}
+	}
+
+	chat.Title = update.Title
+	chat.FolderID = copyID(update.FolderID)
+	chat.UpdatedAt = now()
+
+	return copyChat(chat), nil
+}
+
+// DeleteChat deletes a chat and all its messages
+func (s *Store) DeleteChat(ctx context.Context, chatID int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.chats[chatID]; !ok {
+		return errors.New("chat not found")
+	}
+
+	// Follow the foreign keys of the tables that reference the chat
+	for id, msg := range s.messages {
+		if msg.ChatID == chatID {
+			delete(s.messages, id)
+			delete(s.analyses, id)
+		}
+	}
+	for id, job := range s.aiJobs {
+		if job.ChatID == chatID {
+			delete(s.aiJobs, id)
+		}
+	}
+	for _, prescription := range s.prescriptions {
+		if prescription.ChatID != nil && *prescription.ChatID == chatID {
+			prescription.ChatID = nil
+			prescription.MessageID = nil
+		}
+	}
+	delete(s.chats, chatID)
+	return nil
+}
+
+// CreateMessage adds a message to a chat and marks the chat as updated
+func (s *Store) CreateMessage(ctx context.Context, create *models.MessageCreate) (*models.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	chat, ok := s.chats[create.ChatID]
+	if !ok {
+		return nil, fmt.Errorf("chat %d not found", create.ChatID)
+	}
+
+	contentType := create.ContentType
+	if contentType == "" {
+		contentType = "text" // Default to text if not specified
+	}
+
+	metadata := map[string]interface{}{}
+	if len(create.Metadata) > 0 {
+		if err := roundTrip(create.Metadata, &metadata); err != nil {
+			return nil, fmt.Errorf("error encoding message metadata: %v", err)
+		}
+	}
+
+	created := now()
+	msg := &models.Message{
+		ID:          s.nextID("messages"),
+		ChatID:      create.ChatID,
+		Role:        create.Role,
+		Content:     create.Content,
+		ContentType: contentType,
+		Metadata:    metadata,
+		CreatedAt:   created,
+	}
+	s.messages[msg.ID] = msg
+	chat.UpdatedAt = created
+
+	return copyMessage(msg), nil
+}
+
+// GetChatMessages retrieves the messages of a chat, oldest first
+func (s *Store) GetChatMessages(ctx context.Context, chatID int64) ([]models.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.chatMessages(chatID), nil
+}
+
+// GetUserMessage retrieves a message if it belongs to one of the user's chats
+func (s *Store) GetUserMessage(ctx context.Context, messageID int64, userID int64) (*models.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	msg, ok := s.messages[messageID]
+	if !ok || s.chats[msg.ChatID].UserID != userID {
+		return nil, errors.New("message not found or unauthorized")
+	}
+	return copyMessage(msg), nil
+}
+
+// FindMessagesByMetadata retrieves the user's messages whose metadata contains
+// every key and value in filter, newest first. chatID limits the search to a
+// single chat when non-zero.
+func (s *Store) FindMessagesByMetadata(ctx context.Context, userID int64, chatID int64, filter map[string]interface{}, limit int) ([]models.Message, error) {
+	var want map[string]interface{}
+	if err := roundTrip(filter, &want); err != nil {
+		return nil, fmt.Errorf("error encoding metadata filter: %v", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var found []models.Message
+	for _, msg := range s.messages {
+		if s.chats[msg.ChatID].UserID != userID || (chatID != 0 && msg.ChatID != chatID) {
+			continue
+		}
+		if contains(msg.Metadata, want) {
+			found = append(found, *copyMessage(msg))
+		}
+	}
+
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].ID > found[j].ID
+	})
+	if len(found) > limit {
+		found = found[:limit]
+	}
+	return found, nil
+}
+
+// SavePrescriptionAnalysis stores the structured analysis of a message,
+// replacing any analysis saved for it before
+func (s *Store) SavePrescriptionAnalysis(ctx context.Context, analysis *models.PrescriptionAnalysis) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.messages[analysis.MessageID]; !ok {
+		return fmt.Errorf("message %d not found", analysis.MessageID)
+	}
+	if analysis.CreatedAt.IsZero() {
+		analysis.CreatedAt = now()
+	}
+
+	var stored models.PrescriptionAnalysis
+	if err := roundTrip(analysis, &stored); err != nil {
+		return fmt.Errorf("error encoding prescription analysis: %v", err)
+	}
+	s.analyses[analysis.MessageID] = &stored
+	return nil
+}
+
+// GetPrescriptionAnalysis retrieves the structured analysis of a message,
+// returning nil if none has been saved
+func (s *Store) GetPrescriptionAnalysis(ctx context.Context, messageID int64) (*models.PrescriptionAnalysis, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.analyses[messageID]
+	if !ok {
+		return nil, nil // No analysis for this message
+	}
+
+	var analysis models.PrescriptionAnalysis
+	if err := roundTrip(stored, &analysis); err != nil {
+		return nil, fmt.Errorf("error decoding prescription analysis: %v", err)
+	}
+	return &analysis, nil
+}
+
+// chatMessages returns the messages of a chat in the order they were created
+func (s *Store) chatMessages(chatID int64) []models.Message {
+	var messages []models.Message
+	for _, msg := range s.messages {
+		if msg.ChatID == chatID {
+			messages = append(messages, *copyMessage(msg))
+		}
+	}
+
+	sort.Slice(messages, func(i, j int) bool {
+		return messages[i].ID < messages[j].ID
+	})
+	return messages
+}
+
+// userChats returns the chats of a user, optionally only those in a folder,
+// most recently updated first
+func (s *Store) userChats(userID int64, folderID *int64) []models.Chat {
+	var chats []models.Chat
+	for _, chat := range s.chats {
+		if chat.UserID != userID {
+			continue
+		}
+		if folderID != nil && (chat.FolderID == nil || *chat.FolderID != *folderID) {
+			continue
+		}
+		chats = append(chats, *copyChat(chat))
+	}
+
+	sort.Slice(chats, func(i, j int) bool {
+		if !chats[i].UpdatedAt.Equal(chats[j].UpdatedAt) {
+			return chats[i].UpdatedAt.After(chats[j].UpdatedAt)
+		}
+		return chats[i].ID > chats[j].ID
+	})
+	return chats
+}
+
+// contains reports whether a JSON value contains another, like the @>
+// operator of JSONB: objects contain the keys of the other with values that
+// contain its values, and arrays contain every element of the other
+func contains(have, want interface{}) bool {
+	switch want := want.(type) {
+	case map[string]interface{}:
+		have, ok := have.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		for key, value := range want {
+			element, ok := have[key]
+			if !ok || !contains(element, value) {
+				return false
+			}
+		}
+		return true
+
+	case []interface{}:
+		have, ok := have.([]interface{})
+		if !ok {
+			return false
+		}
+		for _, value := range want {
+			found := false
+			for _, element := range have {
+				if contains(element, value) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return false
+			}
+		}
+		return true
+
+	default:
+		return reflect.DeepEqual(have, want)
+	}
+}
+
+// copyChat copies a chat together with its IDs
+func copyChat(chat *models.Chat) *models.Chat {
+	c := *chat
+	c.FolderID = copyID(chat.FolderID)
+	c.PharmacyID = copyID(chat.PharmacyID)
+	return &c
+}
+
+// copyMessage copies a message together with its metadata
+func copyMessage(msg *models.Message) *models.Message {
+	c := *msg
+	c.Metadata = map[string]interface{}{}
+	roundTrip(msg.Metadata, &c.Metadata)
+	return &c
+}
+
+// copyID copies an optional ID so that the store never shares it with callers
+func copyID(id *int64) *int64 {
+	if id == nil {
+		return nil
+	}
+	c := *id
+	return &c
+}
@@ -0,0 +1,207 @@
+package memory
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/darooyar/server/db"
+	"github.com/darooyar/server/models"
+)
+
+// AddUserCredit adds to a user's credit and records the change as an adjustment
+func (s *Store) AddUserCredit(ctx context.Context, userID int64, amount float64, actorID int64, description string) error {
+	if amount <= 0 {
+		return errors.New("amount must be positive")
+	}
+	return s.adjustUserCredit(userID, amount, actorID, description)
+}
+
+// SubtractUserCredit subtracts from a user's credit and records the change as
+// an adjustment. It returns db.ErrInsufficientCredit when the user has less
+// credit than the amount.
+func (s *Store) SubtractUserCredit(ctx context.Context, userID int64, amount float64, actorID int64, description string) error {
+	if amount <= 0 {
+		return errors.New("amount must be positive")
+	}
+	return s.adjustUserCredit(userID, -amount, actorID, description)
+}
+
+// GetCreditTransactions retrieves a page of a user's credit transactions,
+// newest first
+func (s *Store) GetCreditTransactions(ctx context.Context, userID int64, limit, offset int) ([]*models.CreditTransaction, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var transactions []*models.CreditTransaction
+	for _, txn := range s.transactions {
+		if txn.UserID == userID && txn.PharmacyID == nil {
+			transactions = append(transactions, copyTransaction(txn))
+		}
+	}
+
+	sort.Slice(transactions, func(i, j int) bool {
+		if !transactions[i].CreatedAt.Equal(transactions[j].CreatedAt) {
+			return transactions[i].CreatedAt.After(transactions[j].CreatedAt)
+		}
+		return transactions[i].ID > transactions[j].ID
+	})
+
+	if offset >= len(transactions) {
+		return nil, nil
+	}
+	transactions = transactions[offset:]
+	if len(transactions) > limit {
+		transactions = transactions[:limit]
+	}
+	return transactions, nil
+}
+
+// GiftPlanToUser subscribes a user to a plan free of charge on behalf of an admin
+func (s *Store) GiftPlanToUser(ctx context.Context, adminID, userID, planID int64, message string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	plan, ok := s.plans[planID]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	if _, ok := s.users[userID]; !ok {
+		return fmt.Errorf("user %d not found", userID)
+	}
+
+	sub := s.subscribe(userID, plan)
+	s.gifts = append(s.gifts, &models.GiftTransaction{
+		ID:        s.nextID("gift_transactions"),
+		AdminID:   adminID,
+		UserID:    userID,
+		GiftType:  models.GiftTypePlan,
+		PlanID:    &planID,
+		Message:   message,
+		CreatedAt: sub.CreatedAt,
+	})
+	return nil
+}
+
+// GiftCreditToUser adds credit to a user on behalf of an admin
+func (s *Store) GiftCreditToUser(ctx context.Context, adminID, userID int64, amount float64, message string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	txn, err := s.recordCreditTransaction(models.CreditEntry{
+		UserID:          userID,
+		Amount:          amount,
+		TransactionType: models.CreditTransactionTypeGift,
+		Description:     "Gift from admin: " + message,
+		ActorID:         &adminID,
+	})
+	if err != nil {
+		return err
+	}
+
+	s.gifts = append(s.gifts, &models.GiftTransaction{
+		ID:           s.nextID("gift_transactions"),
+		AdminID:      adminID,
+		UserID:       userID,
+		GiftType:     models.GiftTypeCredit,
+		CreditAmount: &amount,
+		Message:      message,
+		CreatedAt:    txn.CreatedAt,
+	})
+	return nil
+}
+
+// GetUserGiftTransactions retrieves the gifts a user received, newest first
+func (s *Store) GetUserGiftTransactions(ctx context.Context, userID int64) ([]*models.GiftTransaction, error) {
+	return s.findGifts(func(gift *models.GiftTransaction) bool { return gift.UserID == userID }), nil
+}
+
+// GetAdminGiftTransactions retrieves the gifts an admin made, newest first
+func (s *Store) GetAdminGiftTransactions(ctx context.Context, adminID int64) ([]*models.GiftTransaction, error) {
+	return s.findGifts(func(gift *models.GiftTransaction) bool { return gift.AdminID == adminID }), nil
+}
+
+// adjustUserCredit records a manual change of a user's credit
+func (s *Store) adjustUserCredit(userID int64, amount float64, actorID int64, description string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := s.recordCreditTransaction(models.CreditEntry{
+		UserID:          userID,
+		Amount:          amount,
+		TransactionType: models.CreditTransactionTypeAdjustment,
+		Description:     description,
+		ActorID:         &actorID,
+	})
+	return err
+}
+
+// recordCreditTransaction changes a user's credit and appends the change to
+// the ledger, like db.RecordCreditTransaction. The caller holds the lock.
+func (s *Store) recordCreditTransaction(entry models.CreditEntry) (*models.CreditTransaction, error) {
+	if entry.Amount == 0 {
+		return nil, errors.New("amount must not be zero")
+	}
+	if entry.PharmacyID != nil {
+		return nil, errPharmacies
+	}
+
+	u, ok := s.users[entry.UserID]
+	if !ok {
+		return nil, fmt.Errorf("user %d not found", entry.UserID)
+	}
+	if entry.Amount < 0 && roundCredit(u.Credit+entry.Amount) < 0 {
+		return nil, db.ErrInsufficientCredit
+	}
+
+	created := now()
+	u.Credit = roundCredit(u.Credit + entry.Amount)
+	u.UpdatedAt = created
+
+	txn := &models.CreditTransaction{
+		ID:                    s.nextID("credit_transactions"),
+		UserID:                entry.UserID,
+		Amount:                roundCredit(entry.Amount),
+		BalanceAfter:          u.Credit,
+		Description:           entry.Description,
+		TransactionType:       entry.TransactionType,
+		RelatedSubscriptionID: copyID(entry.RelatedSubscriptionID),
+		ActorID:               copyID(entry.ActorID),
+		CreatedAt:             created,
+	}
+	s.transactions = append(s.transactions, txn)
+
+	return copyTransaction(txn), nil
+}
+
+// findGifts returns the gifts that match, newest first
+func (s *Store) findGifts(match func(*models.GiftTransaction) bool) []*models.GiftTransaction {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var gifts []*models.GiftTransaction
+	for i := len(s.gifts) - 1; i >= 0; i-- {
+		if !match(s.gifts[i]) {
+			continue
+		}
+		gift := *s.gifts[i]
+		gift.PlanID = copyID(gift.PlanID)
+		if gift.CreditAmount != nil {
+			amount := *gift.CreditAmount
+			gift.CreditAmount = &amount
+		}
+		gifts = append(gifts, &gift)
+	}
+	return gifts
+}
+
+// copyTransaction copies a credit transaction together with its IDs
+func copyTransaction(txn *models.CreditTransaction) *models.CreditTransaction {
+	c := *txn
+	c.PharmacyID = copyID(txn.PharmacyID)
+	c.RelatedSubscriptionID = copyID(txn.RelatedSubscriptionID)
+	c.ActorID = copyID(txn.ActorID)
+	return &c
+}
@@ -0,0 +1,136 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/darooyar/server/models"
+)
+
+// CreateFolder creates a folder owned by the user
+func (s *Store) CreateFolder(ctx context.Context, create *models.FolderCreate, userID int64) (*models.Folder, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[userID]; !ok {
+		return nil, fmt.Errorf("user %d not found", userID)
+	}
+
+	created := now()
+	folder := &models.Folder{
+		ID:        s.nextID("folders"),
+		UserID:    userID,
+		Name:      create.Name,
+		Color:     create.Color,
+		CreatedAt: created,
+		UpdatedAt: created,
+	}
+	s.folders[folder.ID] = folder
+
+	return copyFolder(folder), nil
+}
+
+// GetFolder retrieves a folder owned by the user with its chats
+func (s *Store) GetFolder(ctx context.Context, folderID int64, userID int64) (*models.FolderResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	folder, ok := s.folders[folderID]
+	if !ok || folder.UserID != userID {
+		return nil, errors.New("folder not found")
+	}
+
+	chats := s.userChats(folder.UserID, &folderID)
+	if chats == nil {
+		chats = []models.Chat{}
+	}
+
+	return &models.FolderResponse{
+		ID:         folder.ID,
+		Name:       folder.Name,
+		Color:      folder.Color,
+		UserID:     folder.UserID,
+		PharmacyID: copyID(folder.PharmacyID),
+		CreatedAt:  folder.CreatedAt,
+		UpdatedAt:  folder.UpdatedAt,
+		ChatCount:  len(chats),
+		Chats:      chats,
+	}, nil
+}
+
+// GetUserFolders retrieves the folders of a user with their number of chats,
+// ordered by name
+func (s *Store) GetUserFolders(ctx context.Context, userID int64) ([]models.Folder, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var folders []models.Folder
+	for _, folder := range s.folders {
+		if folder.UserID != userID {
+			continue
+		}
+		c := copyFolder(folder)
+		for _, chat := range s.chats {
+			if chat.FolderID != nil && *chat.FolderID == folder.ID {
+				c.ChatCount++
+			}
+		}
+		folders = append(folders, *c)
+	}
+
+	sort.Slice(folders, func(i, j int) bool {
+		if folders[i].Name != folders[j].Name {
+			return folders[i].Name < folders[j].Name
+		}
+		return folders[i].ID < folders[j].ID
+	})
+	return folders, nil
+}
+
+// UpdateFolder sets the name and color of a folder owned by the user
+func (s *Store) UpdateFolder(ctx context.Context, folderID int64, userID int64, update *models.FolderUpdate) (*models.Folder, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	folder, ok := s.folders[folderID]
+	if !ok || folder.UserID != userID {
+		return nil, errors.New("folder not found or unauthorized")
+	}
+
+	folder.Name = update.Name
+	folder.Color = update.Color
+	folder.UpdatedAt = now()
+
+	updated := copyFolder(folder)
+	updated.PharmacyID = nil // Not returned by the Postgres store either
+	return updated, nil
+}
+
+// DeleteFolder deletes a folder owned by the user, keeping its chats
+func (s *Store) DeleteFolder(ctx context.Context, folderID int64, userID int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	folder, ok := s.folders[folderID]
+	if !ok || folder.UserID != userID {
+		return errors.New("folder not found or unauthorized")
+	}
+
+	for _, chat := range s.chats {
+		if chat.FolderID != nil && *chat.FolderID == folderID {
+			chat.FolderID = nil
+		}
+	}
+	delete(s.folders, folderID)
+	return nil
+}
+
+// copyFolder copies a folder without its chats
+func copyFolder(folder *models.Folder) *models.Folder {
+	c := *folder
+	c.PharmacyID = copyID(folder.PharmacyID)
+	c.Chats = nil
+	return &c
+}
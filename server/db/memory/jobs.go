@@ -0,0 +1,221 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/darooyar/server/models"
+)
+
+// CreateAIJob queues a new AI job for a chat under the given ID
+func (s *Store) CreateAIJob(ctx context.Context, jobID string, chatID int64, userID int64, kind models.AIJobKind, input string) (*models.AIJob, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.aiJobs[jobID]; ok {
+		return nil, fmt.Errorf("job %s already exists", jobID)
+	}
+	if _, ok := s.chats[chatID]; !ok {
+		return nil, fmt.Errorf("chat %d not found", chatID)
+	}
+	if _, ok := s.users[userID]; !ok {
+		return nil, fmt.Errorf("user %d not found", userID)
+	}
+
+	created := now()
+	job := &models.AIJob{
+		ID:        jobID,
+		ChatID:    chatID,
+		UserID:    userID,
+		Kind:      kind,
+		Input:     input,
+		Status:    models.AIJobStatusQueued,
+		CreatedAt: created,
+		UpdatedAt: created,
+	}
+	s.aiJobs[jobID] = job
+
+	return copyAIJob(job), nil
+}
+
+// GetAIJob retrieves an AI job by ID, returning nil if it does not exist
+func (s *Store) GetAIJob(ctx context.Context, jobID string) (*models.AIJob, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job, ok := s.aiJobs[jobID]
+	if !ok {
+		return nil, nil // Job not found, e.g. its chat was deleted
+	}
+	return copyAIJob(job), nil
+}
+
+// GetUserAIJob retrieves an AI job by ID if it belongs to the user
+func (s *Store) GetUserAIJob(ctx context.Context, jobID string, userID int64) (*models.AIJob, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job, ok := s.aiJobs[jobID]
+	if !ok || job.UserID != userID {
+		return nil, errors.New("job not found or unauthorized")
+	}
+	return copyAIJob(job), nil
+}
+
+// GetActiveAIJob returns the queued or running job of a chat, if any. Jobs
+// that have not been updated within staleAfter are ignored, unless they were
+// interrupted and wait to be resumed.
+func (s *Store) GetActiveAIJob(ctx context.Context, chatID int64, staleAfter time.Duration) (*models.AIJob, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	freshSince := time.Now().Add(-staleAfter)
+
+	var active *models.AIJob
+	for _, job := range s.aiJobs {
+		if job.ChatID != chatID || (job.InterruptedAt == nil && !job.UpdatedAt.After(freshSince)) {
+			continue
+		}
+		if job.Status != models.AIJobStatusQueued && job.Status != models.AIJobStatusRunning {
+			continue
+		}
+		if active == nil || job.CreatedAt.After(active.CreatedAt) {
+			active = job
+		}
+	}
+
+	if active == nil {
+		return nil, nil
+	}
+	return copyAIJob(active), nil
+}
+
+// StartAIJobAttempt marks a job as running and counts the attempt, ending the
+// wait of an interrupted job
+func (s *Store) StartAIJobAttempt(ctx context.Context, jobID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if job, ok := s.aiJobs[jobID]; ok {
+		updated := now()
+		job.Status = models.AIJobStatusRunning
+		job.Attempts++
+		if job.StartedAt == nil {
+			job.StartedAt = &updated
+		}
+		job.UpdatedAt = updated
+		job.InterruptedAt = nil
+	}
+	return nil
+}
+
+// TouchAIJob records that a worker is still processing the job
+func (s *Store) TouchAIJob(ctx context.Context, jobID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if job, ok := s.aiJobs[jobID]; ok {
+		job.UpdatedAt = now()
+	}
+	return nil
+}
+
+// CompleteAIJob marks a job as succeeded with the message it produced
+func (s *Store) CompleteAIJob(ctx context.Context, jobID string, messageID int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if job, ok := s.aiJobs[jobID]; ok {
+		finished := now()
+		job.Status = models.AIJobStatusSucceeded
+		job.ResultMessageID = &messageID
+		job.LastError = nil
+		job.UpdatedAt = finished
+		job.FinishedAt = &finished
+	}
+	return nil
+}
+
+// FailAIJobAttempt records a failed attempt. The job goes back to queued
+// for a retry unless this was the final attempt, in which case it fails.
+// messageID, when non-zero, is the fallback message shown to the user.
+func (s *Store) FailAIJobAttempt(ctx context.Context, jobID string, attemptErr error, final bool, messageID int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job, ok := s.aiJobs[jobID]
+	if !ok {
+		return nil
+	}
+
+	updated := now()
+	lastError := attemptErr.Error()
+	job.Status = models.AIJobStatusQueued
+	job.FinishedAt = nil
+	if final {
+		job.Status = models.AIJobStatusFailed
+		job.FinishedAt = &updated
+	}
+	job.LastError = &lastError
+	if messageID != 0 {
+		job.ResultMessageID = &messageID
+	}
+	job.UpdatedAt = updated
+	return nil
+}
+
+// InterruptAIJob puts an unfinished job back in the queue and marks it to be
+// resumed by the next server that starts
+func (s *Store) InterruptAIJob(ctx context.Context, jobID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job, ok := s.aiJobs[jobID]
+	if !ok || (job.Status != models.AIJobStatusQueued && job.Status != models.AIJobStatusRunning) {
+		return nil
+	}
+
+	interrupted := now()
+	job.Status = models.AIJobStatusQueued
+	job.InterruptedAt = &interrupted
+	job.UpdatedAt = interrupted
+	return nil
+}
+
+// ClaimInterruptedAIJobs clears the mark of every interrupted job and returns
+// the jobs, oldest first
+func (s *Store) ClaimInterruptedAIJobs(ctx context.Context) ([]*models.AIJob, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	updated := now()
+	var jobs []*models.AIJob
+	for _, job := range s.aiJobs {
+		if job.InterruptedAt == nil || job.Status != models.AIJobStatusQueued {
+			continue
+		}
+		job.InterruptedAt = nil
+		job.UpdatedAt = updated
+		jobs = append(jobs, copyAIJob(job))
+	}
+
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].CreatedAt.Before(jobs[j].CreatedAt) })
+	return jobs, nil
+}
+
+// copyAIJob copies a job so that the store never shares it with callers
+func copyAIJob(job *models.AIJob) *models.AIJob {
+	c := *job
+	if job.LastError != nil {
+		lastError := *job.LastError
+		c.LastError = &lastError
+	}
+	c.ResultMessageID = copyID(job.ResultMessageID)
+	c.StartedAt = copyTime(job.StartedAt)
+	c.FinishedAt = copyTime(job.FinishedAt)
+	c.InterruptedAt = copyTime(job.InterruptedAt)
+	return &c
+}
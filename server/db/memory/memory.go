@@ -0,0 +1,118 @@
+// Package memory implements the stores of the db package in memory, so that
+// handlers can be tested without a database. It follows the behavior of the
+// Postgres stores, including their errors, with one exception: pharmacies are
+// not modeled, so every user only sees their own chats, folders,
+// subscriptions and credit. For the same reason, payments, roles and
+// pharmacies have no memory store.
+package memory
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/darooyar/server/db"
+	"github.com/darooyar/server/models"
+)
+
+// errPharmacies is returned for operations on the credit of a pharmacy
+var errPharmacies = errors.New("pharmacies are not supported by the memory store")
+
+// Store keeps users, chats, AI jobs, sessions, folders, plans, credit and
+// payments in maps. It is safe for concurrent use.
+type Store struct {
+	mu  sync.Mutex
+	ids map[string]int64
+
+	users         map[int64]*user
+	chats         map[int64]*models.Chat
+	messages      map[int64]*models.Message
+	analyses      map[int64]*models.PrescriptionAnalysis
+	aiJobs        map[string]*models.AIJob
+	sessions      map[string]*models.Session
+	refreshTokens map[string]*refreshToken
+	revokedTokens map[string]time.Time
+	authTokens    []*authToken
+	otpCodes      map[int64]*otpCode
+	prescriptions map[string]*models.Prescription
+	folders       map[int64]*models.Folder
+	plans         map[int64]*models.Plan
+	subscriptions map[int64]*models.UserSubscription
+	usages        map[string]*usage
+	transactions  []*models.CreditTransaction
+	gifts         []*models.GiftTransaction
+	payments      map[int64]*models.Payment
+}
+
+var (
+	_ db.UserStore         = (*Store)(nil)
+	_ db.ChatStore         = (*Store)(nil)
+	_ db.AIJobStore        = (*Store)(nil)
+	_ db.SessionStore      = (*Store)(nil)
+	_ db.TokenStore        = (*Store)(nil)
+	_ db.PrescriptionStore = (*Store)(nil)
+	_ db.FolderStore       = (*Store)(nil)
+	_ db.PlanStore         = (*Store)(nil)
+	_ db.CreditStore       = (*Store)(nil)
+	_ db.GiftStore         = (*Store)(nil)
+	_ db.PaymentStore      = (*Store)(nil)
+)
+
+// New creates an empty store
+func New() *Store {
+	return &Store{
+		ids:           make(map[string]int64),
+		users:         make(map[int64]*user),
+		chats:         make(map[int64]*models.Chat),
+		messages:      make(map[int64]*models.Message),
+		analyses:      make(map[int64]*models.PrescriptionAnalysis),
+		aiJobs:        make(map[string]*models.AIJob),
+		sessions:      make(map[string]*models.Session),
+		refreshTokens: make(map[string]*refreshToken),
+		revokedTokens: make(map[string]time.Time),
+		otpCodes:      make(map[int64]*otpCode),
+		prescriptions: make(map[string]*models.Prescription),
+		folders:       make(map[int64]*models.Folder),
+		plans:         make(map[int64]*models.Plan),
+		subscriptions: make(map[int64]*models.UserSubscription),
+		usages:        make(map[string]*usage),
+		payments:      make(map[int64]*models.Payment),
+	}
+}
+
+// nextID returns the next ID of a table, starting at 1 like a BIGSERIAL
+func (s *Store) nextID(table string) int64 {
+	s.ids[table]++
+	return s.ids[table]
+}
+
+// now returns the current time at the microsecond precision of Postgres
+func now() time.Time {
+	return time.Now().Truncate(time.Microsecond)
+}
+
+// copyTime copies an optional time so that the store never shares it with callers
+func copyTime(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	c := *t
+	return &c
+}
+
+// roundCredit rounds an amount to the two decimal places of a DECIMAL(10, 2)
+func roundCredit(amount float64) float64 {
+	return math.Round(amount*100) / 100
+}
+
+// roundTrip copies a JSON value the way storing it in a JSONB column and
+// reading it back would, so that numbers become float64
+func roundTrip(value interface{}, dest interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, dest)
+}
@@ -0,0 +1,174 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/darooyar/server/models"
+)
+
+// CreatePayment stores a pending payment created with a gateway
+func (s *Store) CreatePayment(ctx context.Context, payment *models.Payment) (*models.Payment, error) {
+	if payment.PharmacyID != nil {
+		return nil, errPharmacies
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, p := range s.payments {
+		if p.Authority == payment.Authority {
+			return nil, fmt.Errorf("payment with authority %s already exists", payment.Authority)
+		}
+	}
+
+	created := now()
+	p := &models.Payment{
+		ID:          s.nextID("payments"),
+		UserID:      payment.UserID,
+		Gateway:     payment.Gateway,
+		Authority:   payment.Authority,
+		Amount:      payment.Amount,
+		Description: payment.Description,
+		Status:      models.PaymentStatusPending,
+		CreatedAt:   created,
+		UpdatedAt:   created,
+	}
+	s.payments[p.ID] = p
+
+	return copyPayment(p), nil
+}
+
+// GetPaymentByAuthority retrieves a payment by the authority its gateway assigned
+func (s *Store) GetPaymentByAuthority(ctx context.Context, authority string) (*models.Payment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, err := s.paymentByAuthority(authority)
+	if err != nil {
+		return nil, err
+	}
+	return copyPayment(p), nil
+}
+
+// GetUserPayment retrieves a payment if it belongs to the user
+func (s *Store) GetUserPayment(ctx context.Context, id int64, userID int64) (*models.Payment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.payments[id]
+	if !ok || p.UserID != userID {
+		return nil, errors.New("payment not found or unauthorized")
+	}
+	return copyPayment(p), nil
+}
+
+// GetUserPayments retrieves a user's payments, newest first
+func (s *Store) GetUserPayments(ctx context.Context, userID int64, limit, offset int) ([]*models.Payment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	payments := []*models.Payment{}
+	for _, p := range s.payments {
+		if p.UserID == userID {
+			payments = append(payments, copyPayment(p))
+		}
+	}
+
+	sort.Slice(payments, func(i, j int) bool {
+		if !payments[i].CreatedAt.Equal(payments[j].CreatedAt) {
+			return payments[i].CreatedAt.After(payments[j].CreatedAt)
+		}
+		return payments[i].ID > payments[j].ID
+	})
+
+	if offset >= len(payments) {
+		return []*models.Payment{}, nil
+	}
+	payments = payments[offset:]
+	if len(payments) > limit {
+		payments = payments[:limit]
+	}
+	return payments, nil
+}
+
+// CompletePayment marks a pending payment as verified and credits its amount
+// to the user with a topup credit transaction. A payment that was already
+// settled is returned unchanged and not credited again.
+func (s *Store) CompletePayment(ctx context.Context, authority, refID, cardPAN string) (*models.Payment, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, err := s.paymentByAuthority(authority)
+	if err != nil {
+		return nil, false, err
+	}
+	if p.Status != models.PaymentStatusPending {
+		return copyPayment(p), false, nil
+	}
+
+	_, err = s.recordCreditTransaction(models.CreditEntry{
+		UserID:          p.UserID,
+		Amount:          float64(p.Amount),
+		TransactionType: models.CreditTransactionTypeTopup,
+		Description:     fmt.Sprintf("Top-up via %s, ref %s", p.Gateway, refID),
+		ActorID:         &p.UserID,
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	verified := now()
+	p.Status = models.PaymentStatusVerified
+	p.RefID = &refID
+	if cardPAN != "" {
+		p.CardPAN = &cardPAN
+	}
+	p.VerifiedAt = &verified
+	p.UpdatedAt = verified
+
+	return copyPayment(p), true, nil
+}
+
+// FailPayment marks a pending payment as failed. Settled payments are left as they are.
+func (s *Store) FailPayment(ctx context.Context, authority string) (*models.Payment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, err := s.paymentByAuthority(authority)
+	if err != nil {
+		return nil, err
+	}
+	if p.Status == models.PaymentStatusPending {
+		p.Status = models.PaymentStatusFailed
+		p.UpdatedAt = now()
+	}
+	return copyPayment(p), nil
+}
+
+// paymentByAuthority finds a payment by its authority. The caller holds the lock.
+func (s *Store) paymentByAuthority(authority string) (*models.Payment, error) {
+	for _, p := range s.payments {
+		if p.Authority == authority {
+			return p, nil
+		}
+	}
+	return nil, errors.New("payment not found")
+}
+
+// copyPayment copies a payment so that the store never shares it with callers
+func copyPayment(payment *models.Payment) *models.Payment {
+	c := *payment
+	if payment.RefID != nil {
+		refID := *payment.RefID
+		c.RefID = &refID
+	}
+	if payment.CardPAN != nil {
+		cardPAN := *payment.CardPAN
+		c.CardPAN = &cardPAN
+	}
+	c.VerifiedAt = copyTime(payment.VerifiedAt)
+	return &c
+}
@@ -0,0 +1,383 @@
+package memory
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/darooyar/server/db"
+	"github.com/darooyar/server/models"
+)
+
+// usage is an entry of the subscription usage ledger
+type usage struct {
+	subscriptionID int64
+	userID         int64
+	count          int
+	status         models.UsageStatus
+}
+
+// CreatePlan creates a plan
+func (s *Store) CreatePlan(ctx context.Context, create *models.PlanCreate) (*models.Plan, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	created := now()
+	plan := &models.Plan{
+		ID:           s.nextID("plans"),
+		Title:        create.Title,
+		Description:  create.Description,
+		Price:        roundCredit(create.Price),
+		DurationDays: copyInt(create.DurationDays),
+		MaxUses:      copyInt(create.MaxUses),
+		PlanType:     create.PlanType,
+		CreatedAt:    created,
+		UpdatedAt:    created,
+	}
+	s.plans[plan.ID] = plan
+
+	return copyPlan(plan), nil
+}
+
+// GetPlanByID retrieves a plan, or nil if there is none with the ID
+func (s *Store) GetPlanByID(ctx context.Context, id int64) (*models.Plan, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	plan, ok := s.plans[id]
+	if !ok {
+		return nil, nil // Plan not found
+	}
+	return copyPlan(plan), nil
+}
+
+// GetAllPlans retrieves every plan, cheapest first
+func (s *Store) GetAllPlans(ctx context.Context) ([]*models.Plan, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var plans []*models.Plan
+	for _, plan := range s.plans {
+		plans = append(plans, copyPlan(plan))
+	}
+
+	sort.Slice(plans, func(i, j int) bool {
+		if plans[i].Price != plans[j].Price {
+			return plans[i].Price < plans[j].Price
+		}
+		return plans[i].ID < plans[j].ID
+	})
+	return plans, nil
+}
+
+// CreateUserSubscription subscribes a user to a plan, paid with their credit
+func (s *Store) CreateUserSubscription(ctx context.Context, userID int64, planID int64, pharmacyID *int64) (*models.UserSubscription, error) {
+	if pharmacyID != nil {
+		return nil, errPharmacies
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	plan, ok := s.plans[planID]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	u, ok := s.users[userID]
+	if !ok {
+		return nil, fmt.Errorf("user %d not found", userID)
+	}
+	if plan.Price > 0 && roundCredit(u.Credit-plan.Price) < 0 {
+		return nil, db.ErrInsufficientCredit
+	}
+
+	sub := s.subscribe(userID, plan)
+
+	// Deduct credit from the account of the user
+	if plan.Price > 0 {
+		_, err := s.recordCreditTransaction(models.CreditEntry{
+			UserID:                userID,
+			Amount:                -plan.Price,
+			TransactionType:       models.CreditTransactionTypeSubscription,
+			Description:           "Purchase of plan: " + plan.Title,
+			ActorID:               &userID,
+			RelatedSubscriptionID: &sub.ID,
+		})
+		if err != nil {
+			delete(s.subscriptions, sub.ID)
+			return nil, err
+		}
+	}
+
+	created := copySubscription(sub)
+	created.Plan = copyPlan(plan)
+	return created, nil
+}
+
+// GetUserSubscriptions retrieves every subscription of a user, newest first,
+// expiring those whose time or uses ran out
+func (s *Store) GetUserSubscriptions(ctx context.Context, userID int64) ([]*models.UserSubscription, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var subscriptions []*models.UserSubscription
+	for _, sub := range s.userSubscriptions(userID) {
+		if sub.CheckAndUpdateStatus() {
+			sub.UpdatedAt = now()
+		}
+		subscriptions = append(subscriptions, s.withPlan(sub))
+	}
+	return subscriptions, nil
+}
+
+// GetActiveUserSubscriptions retrieves the active subscriptions of a user,
+// newest first, expiring those whose time or uses ran out
+func (s *Store) GetActiveUserSubscriptions(ctx context.Context, userID int64) ([]*models.UserSubscription, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var subscriptions []*models.UserSubscription
+	for _, sub := range s.userSubscriptions(userID) {
+		if sub.Status != models.SubscriptionStatusActive || s.expire(sub) {
+			continue
+		}
+		subscriptions = append(subscriptions, s.withPlan(sub))
+	}
+	return subscriptions, nil
+}
+
+// GetCurrentUserSubscription retrieves the most recent active subscription of
+// a user, or nil if it has run out or there is none
+func (s *Store) GetCurrentUserSubscription(ctx context.Context, userID int64) (*models.UserSubscription, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, sub := range s.userSubscriptions(userID) {
+		if sub.Status != models.SubscriptionStatusActive {
+			continue
+		}
+		if s.expire(sub) {
+			return nil, nil
+		}
+		return s.withPlan(sub), nil
+	}
+	return nil, nil // No active subscription found
+}
+
+// RecordSubscriptionUsage records a user's usage of one of their
+// subscriptions, returning sql.ErrNoRows for any other subscription
+func (s *Store) RecordSubscriptionUsage(ctx context.Context, subscriptionID, userID int64, count int, idempotencyKey string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sub, ok := s.subscriptions[subscriptionID]
+	if !ok || sub.UserID != userID || sub.PharmacyID != nil {
+		return sql.ErrNoRows
+	}
+	return s.recordUsage(sub, userID, count, idempotencyKey, models.UsageStatusCommitted)
+}
+
+// RecordUserUsage records usage on the user's most recent active subscription
+// that has enough uses left
+func (s *Store) RecordUserUsage(ctx context.Context, userID int64, count int, idempotencyKey string) (int64, error) {
+	return s.chargeUser(userID, count, idempotencyKey, models.UsageStatusCommitted)
+}
+
+// ReserveUsage takes uses from the user's current subscription before an
+// analysis runs, until they are committed or released
+func (s *Store) ReserveUsage(ctx context.Context, userID int64, count int, idempotencyKey string) (int64, error) {
+	return s.chargeUser(userID, count, idempotencyKey, models.UsageStatusReserved)
+}
+
+// CommitUsage confirms a reservation once the analysis succeeded
+func (s *Store) CommitUsage(ctx context.Context, idempotencyKey string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.usages[idempotencyKey]
+	if !ok {
+		return db.ErrUsageNotFound
+	}
+	if u.status == models.UsageStatusReserved {
+		u.status = models.UsageStatusCommitted
+	}
+	return nil
+}
+
+// ReleaseUsage gives the uses of a reservation back to the subscription after
+// the analysis failed, reactivating a subscription the reservation exhausted
+func (s *Store) ReleaseUsage(ctx context.Context, idempotencyKey string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.usages[idempotencyKey]
+	if !ok {
+		return db.ErrUsageNotFound
+	}
+	if u.status != models.UsageStatusReserved {
+		return nil // Already committed or released
+	}
+	u.status = models.UsageStatusReleased
+
+	sub := s.subscriptions[u.subscriptionID]
+	sub.UsesCount = max(sub.UsesCount-u.count, 0)
+	if sub.RemainingUses != nil {
+		remaining := *sub.RemainingUses + u.count
+		sub.RemainingUses = &remaining
+		if sub.Status == models.SubscriptionStatusExpired && remaining > 0 &&
+			(sub.ExpiryDate == nil || sub.ExpiryDate.After(time.Now())) {
+			sub.Status = models.SubscriptionStatusActive
+		}
+	}
+	sub.UpdatedAt = now()
+	return nil
+}
+
+// chargeUser records usage with the given ledger status on the user's current
+// subscription, returning the subscription ID
+func (s *Store) chargeUser(userID int64, count int, idempotencyKey string, status models.UsageStatus) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// An earlier call with the same key already charged a subscription,
+	// unless its uses were given back, in which case it is charged again
+	if u, ok := s.usages[idempotencyKey]; ok && u.status != models.UsageStatusReleased {
+		return u.subscriptionID, nil
+	}
+
+	for _, sub := range s.userSubscriptions(userID) {
+		if sub.Status != models.SubscriptionStatusActive ||
+			(sub.RemainingUses != nil && *sub.RemainingUses < count) ||
+			(sub.ExpiryDate != nil && !sub.ExpiryDate.After(time.Now())) {
+			continue
+		}
+		if err := s.recordUsage(sub, userID, count, idempotencyKey, status); err != nil {
+			return 0, err
+		}
+		return sub.ID, nil
+	}
+	return 0, db.ErrNoActiveSubscription
+}
+
+// recordUsage charges a subscription and writes the ledger entry for the user
+// who used it. A usage already recorded under the key is left as it is, while
+// a released one is replaced by the new charge.
+func (s *Store) recordUsage(sub *models.UserSubscription, userID int64, count int, idempotencyKey string, status models.UsageStatus) error {
+	// Retrying a usage succeeds even when it used up the subscription
+	if u, ok := s.usages[idempotencyKey]; ok && u.status != models.UsageStatusReleased {
+		return nil // Already recorded
+	}
+	if sub.Status != models.SubscriptionStatusActive || (sub.ExpiryDate != nil && time.Now().After(*sub.ExpiryDate)) {
+		return db.ErrSubscriptionInactive
+	}
+	if sub.RemainingUses != nil && *sub.RemainingUses < count {
+		return db.ErrNotEnoughUses
+	}
+
+	s.usages[idempotencyKey] = &usage{subscriptionID: sub.ID, userID: userID, count: count, status: status}
+
+	// Update usage counts, expiring the subscription once its uses run out
+	sub.UsesCount += count
+	if sub.RemainingUses != nil {
+		remaining := *sub.RemainingUses - count
+		sub.RemainingUses = &remaining
+		if remaining <= 0 {
+			sub.Status = models.SubscriptionStatusExpired
+		}
+	}
+	sub.UpdatedAt = now()
+	return nil
+}
+
+// subscribe creates an active subscription of a user to a plan
+func (s *Store) subscribe(userID int64, plan *models.Plan) *models.UserSubscription {
+	created := now()
+
+	var expiryDate *time.Time
+	if plan.DurationDays != nil {
+		expiry := created.AddDate(0, 0, *plan.DurationDays)
+		expiryDate = &expiry
+	}
+
+	sub := &models.UserSubscription{
+		ID:            s.nextID("user_subscriptions"),
+		UserID:        userID,
+		PlanID:        plan.ID,
+		PurchaseDate:  created,
+		ExpiryDate:    expiryDate,
+		Status:        models.SubscriptionStatusActive,
+		RemainingUses: copyInt(plan.MaxUses),
+		CreatedAt:     created,
+		UpdatedAt:     created,
+	}
+	s.subscriptions[sub.ID] = sub
+	return sub
+}
+
+// userSubscriptions returns the subscriptions of a user, newest first
+func (s *Store) userSubscriptions(userID int64) []*models.UserSubscription {
+	var subscriptions []*models.UserSubscription
+	for _, sub := range s.subscriptions {
+		if sub.UserID == userID && sub.PharmacyID == nil {
+			subscriptions = append(subscriptions, sub)
+		}
+	}
+
+	sort.Slice(subscriptions, func(i, j int) bool {
+		if !subscriptions[i].PurchaseDate.Equal(subscriptions[j].PurchaseDate) {
+			return subscriptions[i].PurchaseDate.After(subscriptions[j].PurchaseDate)
+		}
+		return subscriptions[i].ID > subscriptions[j].ID
+	})
+	return subscriptions
+}
+
+// expire marks an active subscription as expired if its time or its uses ran
+// out and reports whether it did
+func (s *Store) expire(sub *models.UserSubscription) bool {
+	if !sub.IsExpired() && (sub.RemainingUses == nil || *sub.RemainingUses > 0) {
+		return false
+	}
+	sub.Status = models.SubscriptionStatusExpired
+	sub.UpdatedAt = now()
+	return true
+}
+
+// withPlan copies a subscription together with its plan
+func (s *Store) withPlan(sub *models.UserSubscription) *models.UserSubscription {
+	c := copySubscription(sub)
+	c.Plan = copyPlan(s.plans[sub.PlanID])
+	return c
+}
+
+// copyPlan copies a plan together with its limits
+func copyPlan(plan *models.Plan) *models.Plan {
+	c := *plan
+	c.DurationDays = copyInt(plan.DurationDays)
+	c.MaxUses = copyInt(plan.MaxUses)
+	return &c
+}
+
+// copySubscription copies a subscription without its plan
+func copySubscription(sub *models.UserSubscription) *models.UserSubscription {
+	c := *sub
+	c.PharmacyID = copyID(sub.PharmacyID)
+	c.RemainingUses = copyInt(sub.RemainingUses)
+	if sub.ExpiryDate != nil {
+		expiry := *sub.ExpiryDate
+		c.ExpiryDate = &expiry
+	}
+	c.Plan = nil
+	return &c
+}
+
+// copyInt copies an optional number
+func copyInt(n *int) *int {
+	if n == nil {
+		return nil
+	}
+	c := *n
+	return &c
+}
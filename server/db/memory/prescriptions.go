@@ -0,0 +1,142 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/darooyar/server/models"
+	"github.com/darooyar/server/textnorm"
+	"github.com/google/uuid"
+)
+
+// CreatePrescription stores an analyzed prescription
+func (s *Store) CreatePrescription(ctx context.Context, create *models.Prescription) (*models.Prescription, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[create.UserID]; !ok {
+		return nil, fmt.Errorf("user %d not found", create.UserID)
+	}
+
+	prescription := &models.Prescription{
+		ID:        uuid.New().String(),
+		UserID:    create.UserID,
+		Title:     create.Title,
+		Text:      create.Text,
+		ImagePath: create.ImagePath,
+		Analysis:  create.Analysis,
+		ChatID:    copyID(create.ChatID),
+		MessageID: copyID(create.MessageID),
+		CreatedAt: now(),
+	}
+	s.prescriptions[prescription.ID] = prescription
+
+	return copyPrescription(prescription), nil
+}
+
+// GetPrescription retrieves a prescription if it belongs to the user
+func (s *Store) GetPrescription(ctx context.Context, id string, userID int64) (*models.Prescription, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prescription, ok := s.prescriptions[id]
+	if !ok || prescription.UserID != userID {
+		return nil, errors.New("prescription not found or unauthorized")
+	}
+	return copyPrescription(prescription), nil
+}
+
+// ListPrescriptions retrieves a page of a user's prescription history, newest
+// first, together with the number of prescriptions matching the filter. A
+// query matches prescriptions containing each of its normalized words.
+func (s *Store) ListPrescriptions(ctx context.Context, filter models.PrescriptionFilter) ([]models.Prescription, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	queryWords := strings.Fields(textnorm.Normalize(filter.Query))
+
+	var matches []*models.Prescription
+	for _, prescription := range s.prescriptions {
+		switch {
+		case prescription.UserID != filter.UserID:
+		case filter.From != nil && prescription.CreatedAt.Before(*filter.From):
+		case filter.To != nil && !prescription.CreatedAt.Before(*filter.To):
+		case filter.ChatID != nil && (prescription.ChatID == nil || *prescription.ChatID != *filter.ChatID):
+		case !containsWords(prescriptionSearchText(prescription), queryWords):
+		default:
+			matches = append(matches, prescription)
+		}
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		if !matches[i].CreatedAt.Equal(matches[j].CreatedAt) {
+			return matches[i].CreatedAt.After(matches[j].CreatedAt)
+		}
+		return matches[i].ID < matches[j].ID
+	})
+
+	prescriptions := []models.Prescription{}
+	for i := filter.Offset; i < len(matches) && len(prescriptions) < filter.Limit; i++ {
+		prescriptions = append(prescriptions, *copyPrescription(matches[i]))
+	}
+	return prescriptions, len(matches), nil
+}
+
+// UpdatePrescription updates the title of a prescription if it belongs to the user
+func (s *Store) UpdatePrescription(ctx context.Context, id string, userID int64, update *models.PrescriptionUpdate) (*models.Prescription, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prescription, ok := s.prescriptions[id]
+	if !ok || prescription.UserID != userID {
+		return nil, errors.New("prescription not found or unauthorized")
+	}
+
+	prescription.Title = update.Title
+	return copyPrescription(prescription), nil
+}
+
+// DeletePrescription deletes a prescription if it belongs to the user
+func (s *Store) DeletePrescription(ctx context.Context, id string, userID int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prescription, ok := s.prescriptions[id]
+	if !ok || prescription.UserID != userID {
+		return errors.New("prescription not found or unauthorized")
+	}
+
+	delete(s.prescriptions, id)
+	return nil
+}
+
+// prescriptionSearchText is the normalized text searched by queries
+func prescriptionSearchText(prescription *models.Prescription) string {
+	return textnorm.Normalize(prescription.Title + " " + prescription.Text + " " + prescription.Analysis)
+}
+
+// containsWords reports whether text has every one of the words
+func containsWords(text string, words []string) bool {
+	have := make(map[string]bool)
+	for _, word := range strings.Fields(text) {
+		have[word] = true
+	}
+
+	for _, word := range words {
+		if !have[word] {
+			return false
+		}
+	}
+	return true
+}
+
+// copyPrescription copies a prescription so that the store never shares it with callers
+func copyPrescription(prescription *models.Prescription) *models.Prescription {
+	c := *prescription
+	c.ChatID = copyID(prescription.ChatID)
+	c.MessageID = copyID(prescription.MessageID)
+	return &c
+}
@@ -0,0 +1,167 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/darooyar/server/db"
+	"github.com/darooyar/server/models"
+	"github.com/google/uuid"
+)
+
+// refreshToken is a refresh token of a session, known by its hash
+type refreshToken struct {
+	sessionID string
+	used      bool
+}
+
+// CreateSession starts a session for a user with its first refresh token
+func (s *Store) CreateSession(ctx context.Context, userID int64, userAgent, ipAddress, tokenHash string, expiresAt time.Time) (*models.Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[userID]; !ok {
+		return nil, fmt.Errorf("user %d not found", userID)
+	}
+	if _, ok := s.refreshTokens[tokenHash]; ok {
+		return nil, errors.New("refresh token already exists")
+	}
+
+	created := now()
+	session := &models.Session{
+		ID:         uuid.New().String(),
+		UserID:     userID,
+		UserAgent:  userAgent,
+		IPAddress:  ipAddress,
+		CreatedAt:  created,
+		LastUsedAt: created,
+		ExpiresAt:  expiresAt,
+	}
+	s.sessions[session.ID] = session
+	s.refreshTokens[tokenHash] = &refreshToken{sessionID: session.ID}
+
+	return copySession(session), nil
+}
+
+// RotateRefreshToken exchanges a refresh token for a new one and extends its
+// session until expiresAt. Presenting a used token revokes the session and
+// returns db.ErrRefreshTokenReused.
+func (s *Store) RotateRefreshToken(ctx context.Context, tokenHash, newTokenHash string, expiresAt time.Time) (*models.Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	token, ok := s.refreshTokens[tokenHash]
+	if !ok {
+		return nil, db.ErrInvalidRefreshToken
+	}
+
+	session := s.sessions[token.sessionID]
+	updated := now()
+	if session.RevokedAt != nil || updated.After(session.ExpiresAt) {
+		return nil, db.ErrInvalidRefreshToken
+	}
+
+	if token.used {
+		session.RevokedAt = &updated
+		return nil, db.ErrRefreshTokenReused
+	}
+
+	token.used = true
+	s.refreshTokens[newTokenHash] = &refreshToken{sessionID: session.ID}
+	session.LastUsedAt = updated
+	session.ExpiresAt = expiresAt
+
+	return copySession(session), nil
+}
+
+// GetUserSessions retrieves the active sessions of a user, most recently used first
+func (s *Store) GetUserSessions(ctx context.Context, userID int64) ([]*models.Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current := time.Now()
+	sessions := []*models.Session{}
+	for _, session := range s.sessions {
+		if session.UserID == userID && session.RevokedAt == nil && session.ExpiresAt.After(current) {
+			sessions = append(sessions, copySession(session))
+		}
+	}
+
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].LastUsedAt.After(sessions[j].LastUsedAt) })
+	return sessions, nil
+}
+
+// RevokeSession ends a session if it belongs to the user
+func (s *Store) RevokeSession(ctx context.Context, id string, userID int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, ok := s.sessions[id]
+	if !ok || session.UserID != userID || session.RevokedAt != nil {
+		return errors.New("session not found or unauthorized")
+	}
+
+	revoked := now()
+	session.RevokedAt = &revoked
+	return nil
+}
+
+// RevokeUserSessions ends every session of a user and returns how many were ended
+func (s *Store) RevokeUserSessions(ctx context.Context, userID int64) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	revoked := now()
+	var count int64
+	for _, session := range s.sessions {
+		if session.UserID == userID && session.RevokedAt == nil {
+			session.RevokedAt = &revoked
+			count++
+		}
+	}
+	return count, nil
+}
+
+// RevokeToken adds an access token ID to the denylist until the token expires
+func (s *Store) RevokeToken(ctx context.Context, jti string, userID int64, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.revokedTokens[jti]; !ok {
+		s.revokedTokens[jti] = expiresAt
+	}
+
+	// Entries of expired tokens are no longer needed
+	current := time.Now()
+	for id, expiry := range s.revokedTokens {
+		if expiry.Before(current) {
+			delete(s.revokedTokens, id)
+		}
+	}
+	return nil
+}
+
+// IsTokenRevoked reports whether an access token was revoked, either by its
+// ID or because its session was ended
+func (s *Store) IsTokenRevoked(ctx context.Context, jti, sessionID string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.revokedTokens[jti]; ok {
+		return true, nil
+	}
+	if session, ok := s.sessions[sessionID]; ok && session.RevokedAt != nil {
+		return true, nil
+	}
+	return false, nil
+}
+
+// copySession copies a session so that the store never shares it with callers
+func copySession(session *models.Session) *models.Session {
+	c := *session
+	c.RevokedAt = copyTime(session.RevokedAt)
+	return &c
+}
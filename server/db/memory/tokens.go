@@ -0,0 +1,217 @@
+package memory
+
+import (
+	"context"
+	"time"
+
+	"github.com/darooyar/server/db"
+	"github.com/darooyar/server/models"
+)
+
+// authToken is a token sent to a user by email, known by its hash
+type authToken struct {
+	userID    int64
+	purpose   string
+	tokenHash string
+	createdAt time.Time
+	expiresAt time.Time
+	used      bool
+}
+
+// otpCode is a stored login code with its hash and the address it was requested from
+type otpCode struct {
+	models.OTPCode
+	codeHash  string
+	ipAddress string
+}
+
+// CreateAuthToken stores a token sent to a user by email. Earlier unused
+// tokens for the same purpose stop working.
+func (s *Store) CreateAuthToken(ctx context.Context, userID int64, purpose, tokenHash string, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, token := range s.authTokens {
+		if token.userID == userID && token.purpose == purpose {
+			token.used = true
+		}
+	}
+
+	s.authTokens = append(s.authTokens, &authToken{
+		userID:    userID,
+		purpose:   purpose,
+		tokenHash: tokenHash,
+		createdAt: now(),
+		expiresAt: expiresAt,
+	})
+	return nil
+}
+
+// GetLastAuthTokenTime returns when a token for the purpose was last sent to
+// the user, or nil if none was
+func (s *Store) GetLastAuthTokenTime(ctx context.Context, userID int64, purpose string) (*time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var last *time.Time
+	for _, token := range s.authTokens {
+		if token.userID == userID && token.purpose == purpose && (last == nil || token.createdAt.After(*last)) {
+			last = copyTime(&token.createdAt)
+		}
+	}
+	return last, nil
+}
+
+// ResetUserPassword uses a password reset token to set the password of its
+// user, marks their email as verified and returns the user's ID
+func (s *Store) ResetUserPassword(ctx context.Context, tokenHash, passwordHash string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, err := s.consumeAuthToken(tokenHash, models.AuthTokenPurposePasswordReset)
+	if err != nil {
+		return 0, err
+	}
+
+	u.password = passwordHash
+	u.EmailVerified = true
+	u.UpdatedAt = now()
+	return u.ID, nil
+}
+
+// VerifyUserEmail uses an email verification token to mark the email of its
+// user as verified and returns the user's ID
+func (s *Store) VerifyUserEmail(ctx context.Context, tokenHash string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, err := s.consumeAuthToken(tokenHash, models.AuthTokenPurposeEmailVerification)
+	if err != nil {
+		return 0, err
+	}
+
+	u.EmailVerified = true
+	u.UpdatedAt = now()
+	return u.ID, nil
+}
+
+// CreateOTPCode stores a code for a phone number if the limits allow another
+// one. When they do not, it returns db.ErrOTPRateLimited and how long to wait.
+func (s *Store) CreateOTPCode(ctx context.Context, phone, codeHash, ipAddress string, expiresAt time.Time, limits db.OTPLimits) (*models.OTPCode, time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	created := now()
+	since := created.Add(-limits.Window)
+
+	var phoneCount, ipCount int
+	var lastSentAt, oldestSentAt time.Time
+	for _, code := range s.otpCodes {
+		if !code.CreatedAt.After(since) {
+			continue
+		}
+		if code.Phone == phone {
+			phoneCount++
+			if code.CreatedAt.After(lastSentAt) {
+				lastSentAt = code.CreatedAt
+			}
+			if oldestSentAt.IsZero() || code.CreatedAt.Before(oldestSentAt) {
+				oldestSentAt = code.CreatedAt
+			}
+		}
+		if ipAddress != "" && code.ipAddress == ipAddress {
+			ipCount++
+		}
+	}
+
+	if phoneCount > 0 && created.Sub(lastSentAt) < limits.Cooldown {
+		return nil, limits.Cooldown - created.Sub(lastSentAt), db.ErrOTPRateLimited
+	}
+	if phoneCount >= limits.PerPhone {
+		return nil, oldestSentAt.Add(limits.Window).Sub(created), db.ErrOTPRateLimited
+	}
+	if ipAddress != "" && ipCount >= limits.PerIP {
+		return nil, limits.Window, db.ErrOTPRateLimited
+	}
+
+	code := &otpCode{
+		OTPCode: models.OTPCode{
+			ID:        s.nextID("otp_codes"),
+			Phone:     phone,
+			CreatedAt: created,
+			ExpiresAt: expiresAt,
+		},
+		codeHash:  codeHash,
+		ipAddress: ipAddress,
+	}
+	s.otpCodes[code.ID] = code
+
+	c := code.OTPCode
+	return &c, 0, nil
+}
+
+// VerifyOTPCode checks a code against the latest unused code of a phone and
+// returns its ID. Wrong guesses are counted, and once maxAttempts were made
+// the code can no longer be used.
+func (s *Store) VerifyOTPCode(ctx context.Context, phone, codeHash string, maxAttempts int) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var latest *otpCode
+	for _, code := range s.otpCodes {
+		if code.Phone != phone || code.ConsumedAt != nil {
+			continue
+		}
+		if latest == nil || code.CreatedAt.After(latest.CreatedAt) ||
+			(code.CreatedAt.Equal(latest.CreatedAt) && code.ID > latest.ID) {
+			latest = code
+		}
+	}
+
+	if latest == nil || time.Now().After(latest.ExpiresAt) {
+		return 0, db.ErrInvalidOTPCode
+	}
+	if latest.Attempts >= maxAttempts {
+		return 0, db.ErrOTPAttemptsExceeded
+	}
+	if latest.codeHash != codeHash {
+		latest.Attempts++
+		return 0, db.ErrInvalidOTPCode
+	}
+
+	return latest.ID, nil
+}
+
+// ConsumeOTPCode marks a verified code as used. It returns
+// db.ErrInvalidOTPCode when the code was already used.
+func (s *Store) ConsumeOTPCode(ctx context.Context, id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	code, ok := s.otpCodes[id]
+	if !ok || code.ConsumedAt != nil {
+		return db.ErrInvalidOTPCode
+	}
+
+	consumed := now()
+	code.ConsumedAt = &consumed
+	return nil
+}
+
+// consumeAuthToken marks a valid token as used and returns its user
+func (s *Store) consumeAuthToken(tokenHash, purpose string) (*user, error) {
+	current := time.Now()
+	for _, token := range s.authTokens {
+		if token.tokenHash != tokenHash || token.purpose != purpose || token.used || !token.expiresAt.After(current) {
+			continue
+		}
+
+		u, ok := s.users[token.userID]
+		if !ok {
+			break
+		}
+		token.used = true
+		return u, nil
+	}
+	return nil, db.ErrInvalidAuthToken
+}
@@ -0,0 +1,150 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/darooyar/server/db"
+	"github.com/darooyar/server/models"
+)
+
+// user is a stored user with their password hash
+type user struct {
+	models.User
+	password string
+}
+
+// CreateUser creates a user who logs in with an email and password
+func (s *Store) CreateUser(ctx context.Context, create *models.UserCreate) (*models.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkUnique(create.Username, create.Email, ""); err != nil {
+		return nil, err
+	}
+
+	created := now()
+	u := &user{
+		User: models.User{
+			ID:        s.nextID("users"),
+			Username:  create.Username,
+			Email:     create.Email,
+			FirstName: create.FirstName,
+			LastName:  create.LastName,
+			CreatedAt: created,
+			UpdatedAt: created,
+		},
+		password: create.Password,
+	}
+	s.users[u.ID] = u
+
+	return u.copy(), nil
+}
+
+// CreatePhoneUser creates a user who logs in with a phone number and has no
+// email or password
+func (s *Store) CreatePhoneUser(ctx context.Context, create *models.OTPVerify) (*models.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkUnique(create.Username, "", create.Phone); err != nil {
+		return nil, err
+	}
+
+	created := now()
+	u := &user{
+		User: models.User{
+			ID:        s.nextID("users"),
+			Username:  create.Username,
+			Phone:     create.Phone,
+			FirstName: create.FirstName,
+			LastName:  create.LastName,
+			CreatedAt: created,
+			UpdatedAt: created,
+		},
+	}
+	s.users[u.ID] = u
+
+	return u.copy(), nil
+}
+
+// GetUserByID retrieves a user by ID
+func (s *Store) GetUserByID(ctx context.Context, id int64) (*models.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[id]
+	if !ok {
+		return nil, db.ErrUserNotFound
+	}
+	return u.copy(), nil
+}
+
+// GetUserByEmail retrieves a user by email, together with their password hash
+func (s *Store) GetUserByEmail(ctx context.Context, email string) (*models.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, u := range s.users {
+		if u.Email != "" && u.Email == email {
+			found := u.copy()
+			found.Password = u.password
+			return found, nil
+		}
+	}
+	return nil, db.ErrUserNotFound
+}
+
+// GetUserByPhone retrieves a user by phone number
+func (s *Store) GetUserByPhone(ctx context.Context, phone string) (*models.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, u := range s.users {
+		if u.Phone != "" && u.Phone == phone {
+			return u.copy(), nil
+		}
+	}
+	return nil, db.ErrUserNotFound
+}
+
+// GetUserPharmacy returns nil, since no user belongs to a pharmacy
+func (s *Store) GetUserPharmacy(ctx context.Context, userID int64) (*models.Pharmacy, error) {
+	return nil, nil
+}
+
+// IsUserVerified reports whether a user verified their email or registered by phone
+func (s *Store) IsUserVerified(ctx context.Context, userID int64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[userID]
+	if !ok {
+		return false, db.ErrUserNotFound
+	}
+	return u.EmailVerified || u.Phone != "", nil
+}
+
+// checkUnique fails like the unique indexes of the users table would
+func (s *Store) checkUnique(username, email, phone string) error {
+	for _, u := range s.users {
+		switch {
+		case u.Username == username:
+			return fmt.Errorf("%w: username %q is taken", db.ErrUserExists, username)
+		case email != "" && u.Email == email:
+			return fmt.Errorf("%w: email %q is taken", db.ErrUserExists, email)
+		case phone != "" && u.Phone == phone:
+			return fmt.Errorf("%w: phone %q is taken", db.ErrUserExists, phone)
+		}
+	}
+	return nil
+}
+
+// copy returns the user as read from the database, without their password
+func (u *user) copy() *models.User {
+	c := u.User
+	c.Roles = append([]string{}, u.Roles...)
+	c.Permissions = append([]models.Permission{}, u.Permissions...)
+	c.IsAdmin = c.HasRole(models.RoleAdmin)
+	return &c
+}
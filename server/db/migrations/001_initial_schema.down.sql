@@ -0,0 +1,4 @@
+-- Drop the tables of the initial schema
+DROP TABLE IF EXISTS messages;
+DROP TABLE IF EXISTS chats;
+DROP TABLE IF EXISTS users;
@@ -0,0 +1,4 @@
+-- Remove folders from chats and drop the folders table
+DROP INDEX IF EXISTS idx_chats_folder_id;
+ALTER TABLE chats DROP COLUMN IF EXISTS folder_id;
+DROP TABLE IF EXISTS folders;
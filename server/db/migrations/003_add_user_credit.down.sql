@@ -0,0 +1,3 @@
+-- Remove the credit field from users table
+DROP INDEX IF EXISTS idx_users_credit;
+ALTER TABLE users DROP COLUMN IF EXISTS credit;
@@ -0,0 +1,4 @@
+-- Drop the plan, subscription and transaction tables
+DROP TABLE IF EXISTS credit_transactions;
+DROP TABLE IF EXISTS user_subscriptions;
+DROP TABLE IF EXISTS plans;
@@ -0,0 +1,3 @@
+-- Drop gift_transactions table and the is_admin field of users
+DROP TABLE IF EXISTS gift_transactions;
+ALTER TABLE users DROP COLUMN IF EXISTS is_admin;
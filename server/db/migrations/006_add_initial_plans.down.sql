@@ -0,0 +1,4 @@
+-- Remove the initial plans and the subscriptions to them, as the up
+-- migration did before inserting them
+DELETE FROM user_subscriptions WHERE plan_id IN (1, 2, 3);
+DELETE FROM plans WHERE id IN (1, 2, 3);
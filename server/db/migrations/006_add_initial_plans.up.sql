@@ -53,8 +53,3 @@ VALUES (
 
 -- Reset the sequence to the next value after our manually inserted IDs
 SELECT setval('plans_id_seq', (SELECT MAX(id) FROM plans));
-
--- Log the migration
-INSERT INTO migration_logs (migration_name, description, executed_at)
-VALUES ('006_add_initial_plans', 'Added initial subscription plans with correct pricing', NOW())
-ON CONFLICT (migration_name) DO NOTHING;
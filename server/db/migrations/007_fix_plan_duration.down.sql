@@ -0,0 +1 @@
+-- Nothing to undo: a duration of 0 and NULL both meant an unlimited duration
@@ -0,0 +1,2 @@
+-- Drop ai_jobs table
+DROP TABLE IF EXISTS ai_jobs;
@@ -0,0 +1,22 @@
+-- Create ai_jobs table to track background AI analysis jobs
+CREATE TABLE IF NOT EXISTS ai_jobs (
+    id VARCHAR(36) PRIMARY KEY,
+    chat_id BIGINT NOT NULL REFERENCES chats(id) ON DELETE CASCADE,
+    user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    kind VARCHAR(50) NOT NULL,
+    input TEXT NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'queued',
+    attempts INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT,
+    result_message_id BIGINT REFERENCES messages(id) ON DELETE SET NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    started_at TIMESTAMP,
+    finished_at TIMESTAMP
+);
+
+-- Create index on chat_id and status for the active job lookup
+CREATE INDEX IF NOT EXISTS idx_ai_jobs_chat_id_status ON ai_jobs(chat_id, status);
+
+-- Create index on user_id for faster lookups
+CREATE INDEX IF NOT EXISTS idx_ai_jobs_user_id ON ai_jobs(user_id);
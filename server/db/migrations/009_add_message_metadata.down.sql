@@ -0,0 +1,3 @@
+-- Remove metadata column from messages table
+DROP INDEX IF EXISTS idx_messages_metadata;
+ALTER TABLE messages DROP COLUMN IF EXISTS metadata;
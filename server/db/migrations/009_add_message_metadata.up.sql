@@ -0,0 +1,5 @@
+-- Add metadata column to messages table
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS metadata JSONB NOT NULL DEFAULT '{}'::jsonb;
+
+-- Create GIN index on metadata for containment queries
+CREATE INDEX IF NOT EXISTS idx_messages_metadata ON messages USING GIN (metadata jsonb_path_ops);
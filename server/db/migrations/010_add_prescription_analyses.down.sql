@@ -0,0 +1,2 @@
+-- Drop prescription_analyses table
+DROP TABLE IF EXISTS prescription_analyses;
@@ -0,0 +1,9 @@
+-- Create prescription_analyses table for structured AI analyses of messages
+CREATE TABLE IF NOT EXISTS prescription_analyses (
+    message_id BIGINT PRIMARY KEY REFERENCES messages(id) ON DELETE CASCADE,
+    analysis JSONB NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+-- Create GIN index on analysis for querying drugs and interactions
+CREATE INDEX IF NOT EXISTS idx_prescription_analyses_analysis ON prescription_analyses USING GIN (analysis jsonb_path_ops);
@@ -0,0 +1,4 @@
+-- Drop the interaction knowledge base
+DROP TABLE IF EXISTS drug_interactions;
+DROP TABLE IF EXISTS drug_synonyms;
+DROP TABLE IF EXISTS drugs;
@@ -0,0 +1,38 @@
+-- Create drugs table for the local interaction knowledge base
+CREATE TABLE IF NOT EXISTS drugs (
+    id SERIAL PRIMARY KEY,
+    generic_name VARCHAR(255) NOT NULL,
+    name_fa VARCHAR(255),
+    name_en VARCHAR(255),
+    normalized_name VARCHAR(255) NOT NULL UNIQUE,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+-- Create drug_synonyms table mapping every known spelling to a drug
+CREATE TABLE IF NOT EXISTS drug_synonyms (
+    id SERIAL PRIMARY KEY,
+    drug_id INTEGER NOT NULL REFERENCES drugs(id) ON DELETE CASCADE,
+    synonym VARCHAR(255) NOT NULL,
+    normalized_synonym VARCHAR(255) NOT NULL UNIQUE
+);
+
+-- Create index on drug_id for faster lookups
+CREATE INDEX IF NOT EXISTS idx_drug_synonyms_drug_id ON drug_synonyms(drug_id);
+
+-- Create drug_interactions table, storing each pair once with the lower drug ID first
+CREATE TABLE IF NOT EXISTS drug_interactions (
+    id SERIAL PRIMARY KEY,
+    drug_a_id INTEGER NOT NULL REFERENCES drugs(id) ON DELETE CASCADE,
+    drug_b_id INTEGER NOT NULL REFERENCES drugs(id) ON DELETE CASCADE,
+    severity VARCHAR(20) NOT NULL,
+    description TEXT,
+    management TEXT,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    CONSTRAINT drug_interactions_ordered_pair CHECK (drug_a_id < drug_b_id),
+    CONSTRAINT drug_interactions_unique_pair UNIQUE (drug_a_id, drug_b_id)
+);
+
+-- Create index on drug_b_id for lookups from either side of a pair
+CREATE INDEX IF NOT EXISTS idx_drug_interactions_drug_b_id ON drug_interactions(drug_b_id);
@@ -0,0 +1,2 @@
+-- Drop formulary_drugs table
+DROP TABLE IF EXISTS formulary_drugs;
@@ -0,0 +1,16 @@
+-- Create formulary_drugs table holding the national drug list
+CREATE TABLE IF NOT EXISTS formulary_drugs (
+    id SERIAL PRIMARY KEY,
+    code VARCHAR(64),
+    generic_name VARCHAR(255) NOT NULL,
+    generic_name_fa VARCHAR(255),
+    brand_name VARCHAR(255),
+    dosage_form VARCHAR(100),
+    strength VARCHAR(100),
+    normalized_key VARCHAR(800) NOT NULL UNIQUE,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+-- Create index on generic_name for listing the products of a drug
+CREATE INDEX IF NOT EXISTS idx_formulary_drugs_generic_name ON formulary_drugs(generic_name);
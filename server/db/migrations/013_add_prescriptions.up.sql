@@ -0,0 +1,13 @@
+-- Create prescriptions table for analyses requested outside of chats
+CREATE TABLE IF NOT EXISTS prescriptions (
+    id VARCHAR(36) PRIMARY KEY,
+    user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    title VARCHAR(255) NOT NULL,
+    text TEXT,
+    image_path VARCHAR(1024),
+    analysis TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+-- Create index on user_id and created_at for listing a user's history
+CREATE INDEX IF NOT EXISTS idx_prescriptions_user_id_created_at ON prescriptions(user_id, created_at DESC);
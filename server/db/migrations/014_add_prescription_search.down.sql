@@ -0,0 +1,9 @@
+-- Remove full-text search from prescriptions
+DROP INDEX IF EXISTS idx_prescriptions_search_vector;
+ALTER TABLE prescriptions DROP COLUMN IF EXISTS search_vector;
+
+-- Unlink prescriptions from chats and messages
+DROP INDEX IF EXISTS idx_prescriptions_chat_id;
+DROP INDEX IF EXISTS idx_prescriptions_message_id;
+ALTER TABLE prescriptions DROP COLUMN IF EXISTS message_id;
+ALTER TABLE prescriptions DROP COLUMN IF EXISTS chat_id;
@@ -0,0 +1,21 @@
+-- Link prescriptions analyzed in a chat back to the chat and the reply message
+ALTER TABLE prescriptions ADD COLUMN IF NOT EXISTS chat_id BIGINT REFERENCES chats(id) ON DELETE SET NULL;
+ALTER TABLE prescriptions ADD COLUMN IF NOT EXISTS message_id BIGINT REFERENCES messages(id) ON DELETE SET NULL;
+
+-- Create unique index on message_id so a reply is recorded only once
+CREATE UNIQUE INDEX IF NOT EXISTS idx_prescriptions_message_id ON prescriptions(message_id);
+
+-- Create index on chat_id for listing the prescriptions of a chat
+CREATE INDEX IF NOT EXISTS idx_prescriptions_chat_id ON prescriptions(chat_id);
+
+-- Add full-text search over the title, text and analysis. The server stores
+-- normalized text so that Persian spelling variants match; existing rows are
+-- indexed as written.
+ALTER TABLE prescriptions ADD COLUMN IF NOT EXISTS search_vector TSVECTOR;
+
+UPDATE prescriptions
+SET search_vector = to_tsvector('simple', title || ' ' || COALESCE(text, '') || ' ' || analysis)
+WHERE search_vector IS NULL;
+
+-- Create GIN index on search_vector for full-text search
+CREATE INDEX IF NOT EXISTS idx_prescriptions_search_vector ON prescriptions USING GIN (search_vector);
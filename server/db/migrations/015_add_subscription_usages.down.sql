@@ -0,0 +1,2 @@
+-- Drop subscription_usages ledger
+DROP TABLE IF EXISTS subscription_usages;
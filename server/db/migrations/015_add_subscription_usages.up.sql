@@ -0,0 +1,12 @@
+-- Create subscription_usages ledger so that every analysis is billed exactly once
+CREATE TABLE IF NOT EXISTS subscription_usages (
+    id SERIAL PRIMARY KEY,
+    subscription_id BIGINT NOT NULL REFERENCES user_subscriptions(id) ON DELETE CASCADE,
+    user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    idempotency_key VARCHAR(100) NOT NULL UNIQUE,
+    count INTEGER NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+-- Create index on subscription_id for faster lookups
+CREATE INDEX IF NOT EXISTS idx_subscription_usages_subscription_id ON subscription_usages(subscription_id);
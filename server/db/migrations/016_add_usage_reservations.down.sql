@@ -0,0 +1,4 @@
+-- Remove reservation status from subscription_usages
+DROP INDEX IF EXISTS idx_subscription_usages_status;
+ALTER TABLE subscription_usages DROP COLUMN IF EXISTS updated_at;
+ALTER TABLE subscription_usages DROP COLUMN IF EXISTS status;
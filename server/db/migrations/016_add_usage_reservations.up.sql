@@ -0,0 +1,6 @@
+-- Track whether a usage is reserved for a running analysis, charged or given back
+ALTER TABLE subscription_usages ADD COLUMN IF NOT EXISTS status VARCHAR(20) NOT NULL DEFAULT 'committed';
+ALTER TABLE subscription_usages ADD COLUMN IF NOT EXISTS updated_at TIMESTAMP NOT NULL DEFAULT NOW();
+
+-- Create index on status for finding reservations that were never settled
+CREATE INDEX IF NOT EXISTS idx_subscription_usages_status ON subscription_usages(status);
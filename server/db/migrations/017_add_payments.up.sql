@@ -0,0 +1,19 @@
+-- Create payments table to track credit top-ups paid through a payment gateway
+CREATE TABLE IF NOT EXISTS payments (
+    id SERIAL PRIMARY KEY,
+    user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    gateway VARCHAR(50) NOT NULL,
+    authority VARCHAR(100) NOT NULL UNIQUE,
+    amount BIGINT NOT NULL,
+    description TEXT,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending', -- 'pending', 'verified' or 'failed'
+    ref_id VARCHAR(100),
+    card_pan VARCHAR(50),
+    credit_transaction_id INTEGER REFERENCES credit_transactions(id) ON DELETE SET NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    verified_at TIMESTAMP
+);
+
+-- Create index on user_id for listing a user's payments
+CREATE INDEX IF NOT EXISTS idx_payments_user_id ON payments(user_id);
@@ -0,0 +1,8 @@
+-- Stop recording who made each credit change
+ALTER TABLE credit_transactions DROP COLUMN IF EXISTS actor_id;
+
+-- Drop roles and permissions. Admins keep their access through users.is_admin.
+DROP TABLE IF EXISTS user_roles;
+DROP TABLE IF EXISTS role_permissions;
+DROP TABLE IF EXISTS permissions;
+DROP TABLE IF EXISTS roles;
@@ -0,0 +1,67 @@
+-- Create roles and permissions to replace the single users.is_admin flag
+CREATE TABLE IF NOT EXISTS roles (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(50) NOT NULL UNIQUE,
+    description TEXT,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS permissions (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(100) NOT NULL UNIQUE,
+    description TEXT
+);
+
+CREATE TABLE IF NOT EXISTS role_permissions (
+    role_id INTEGER NOT NULL REFERENCES roles(id) ON DELETE CASCADE,
+    permission_id INTEGER NOT NULL REFERENCES permissions(id) ON DELETE CASCADE,
+    PRIMARY KEY (role_id, permission_id)
+);
+
+CREATE TABLE IF NOT EXISTS user_roles (
+    user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    role_id INTEGER NOT NULL REFERENCES roles(id) ON DELETE CASCADE,
+    granted_by BIGINT REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (user_id, role_id)
+);
+
+-- Create index on role_id for listing the users of a role
+CREATE INDEX IF NOT EXISTS idx_user_roles_role_id ON user_roles(role_id);
+
+-- Seed the built-in roles and permissions
+INSERT INTO roles (name, description) VALUES
+    ('admin', 'Full access to every administrative endpoint'),
+    ('support', 'Looks up users, their credit and their gifts'),
+    ('finance', 'Manages user credit and plans')
+ON CONFLICT (name) DO NOTHING;
+
+INSERT INTO permissions (name, description) VALUES
+    ('credit:read', 'View the credit of any user'),
+    ('credit:write', 'Add credit to or subtract credit from any user'),
+    ('plans:write', 'Create subscription plans'),
+    ('gifts:read', 'View gift transactions'),
+    ('gifts:write', 'Gift plans and credit to users'),
+    ('roles:read', 'View roles and the roles of users'),
+    ('roles:write', 'Grant and revoke roles')
+ON CONFLICT (name) DO NOTHING;
+
+INSERT INTO role_permissions (role_id, permission_id)
+SELECT r.id, p.id
+FROM roles r
+JOIN permissions p ON
+    r.name = 'admin'
+    OR (r.name = 'support' AND p.name IN ('credit:read', 'gifts:read'))
+    OR (r.name = 'finance' AND p.name IN ('credit:read', 'credit:write', 'plans:write', 'gifts:read'))
+ON CONFLICT DO NOTHING;
+
+-- Existing admins keep their access through the admin role
+INSERT INTO user_roles (user_id, role_id)
+SELECT u.id, r.id
+FROM users u
+JOIN roles r ON r.name = 'admin'
+WHERE u.is_admin = TRUE
+ON CONFLICT DO NOTHING;
+
+-- Record who made each credit change
+ALTER TABLE credit_transactions ADD COLUMN IF NOT EXISTS actor_id BIGINT REFERENCES users(id) ON DELETE SET NULL;
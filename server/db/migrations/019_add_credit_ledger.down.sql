@@ -0,0 +1,10 @@
+-- Let credit_transactions be updated again
+DROP TRIGGER IF EXISTS credit_transactions_append_only ON credit_transactions;
+DROP FUNCTION IF EXISTS prevent_credit_transaction_update();
+
+-- Remove the running balance
+DROP INDEX IF EXISTS idx_credit_transactions_user_id_id;
+ALTER TABLE credit_transactions DROP COLUMN IF EXISTS balance_after;
+
+-- Remove the opening balances recorded when the ledger was introduced
+DELETE FROM credit_transactions WHERE transaction_type = 'opening_balance';
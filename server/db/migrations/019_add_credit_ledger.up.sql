@@ -0,0 +1,45 @@
+-- Make credit_transactions the ledger of every change of users.credit
+
+-- Record credit that was changed without a transaction as an opening balance,
+-- so that each user's transactions add up to their current credit
+INSERT INTO credit_transactions (user_id, amount, description, transaction_type, created_at)
+SELECT u.id, u.credit - COALESCE(SUM(t.amount), 0), 'Opening balance', 'opening_balance', NOW()
+FROM users u
+LEFT JOIN credit_transactions t ON t.user_id = u.id
+GROUP BY u.id, u.credit
+HAVING u.credit <> COALESCE(SUM(t.amount), 0);
+
+-- Store the balance after each transaction, computed as a running total
+ALTER TABLE credit_transactions ADD COLUMN IF NOT EXISTS balance_after DECIMAL(10, 2);
+
+UPDATE credit_transactions t
+SET balance_after = running.balance
+FROM (
+    SELECT id, SUM(amount) OVER (PARTITION BY user_id ORDER BY created_at, id) AS balance
+    FROM credit_transactions
+) running
+WHERE running.id = t.id AND t.balance_after IS NULL;
+
+ALTER TABLE credit_transactions ALTER COLUMN balance_after SET NOT NULL;
+
+-- Create index for reading a user's ledger in order
+CREATE INDEX IF NOT EXISTS idx_credit_transactions_user_id_id ON credit_transactions(user_id, id);
+
+-- Keep the ledger append-only: the amounts of recorded transactions never change
+CREATE OR REPLACE FUNCTION prevent_credit_transaction_update() RETURNS trigger AS $$
+BEGIN
+    IF NEW.user_id IS DISTINCT FROM OLD.user_id
+        OR NEW.amount IS DISTINCT FROM OLD.amount
+        OR NEW.balance_after IS DISTINCT FROM OLD.balance_after
+        OR NEW.transaction_type IS DISTINCT FROM OLD.transaction_type
+        OR NEW.created_at IS DISTINCT FROM OLD.created_at THEN
+        RAISE EXCEPTION 'credit_transactions is append-only';
+    END IF;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS credit_transactions_append_only ON credit_transactions;
+CREATE TRIGGER credit_transactions_append_only
+    BEFORE UPDATE ON credit_transactions
+    FOR EACH ROW EXECUTE FUNCTION prevent_credit_transaction_update();
@@ -0,0 +1,4 @@
+-- Drop the session, refresh token and revoked token tables
+DROP TABLE IF EXISTS revoked_tokens;
+DROP TABLE IF EXISTS refresh_tokens;
+DROP TABLE IF EXISTS sessions;
@@ -0,0 +1,11 @@
+-- Drop otp_codes table
+DROP TABLE IF EXISTS otp_codes;
+
+-- Require an email and password again. This fails while users who registered
+-- by phone remain, as they have neither.
+ALTER TABLE users ALTER COLUMN password SET NOT NULL;
+ALTER TABLE users ALTER COLUMN email SET NOT NULL;
+
+-- Remove phone numbers from users
+DROP INDEX IF EXISTS idx_users_phone;
+ALTER TABLE users DROP COLUMN IF EXISTS phone;
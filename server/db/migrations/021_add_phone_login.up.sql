@@ -0,0 +1,24 @@
+-- Let users register and log in with a phone number instead of an email
+ALTER TABLE users ADD COLUMN IF NOT EXISTS phone VARCHAR(20);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_users_phone ON users(phone);
+
+-- Users who registered by phone have no email or password
+ALTER TABLE users ALTER COLUMN email DROP NOT NULL;
+ALTER TABLE users ALTER COLUMN password DROP NOT NULL;
+
+-- Create otp_codes table for one-time login codes sent by SMS. Codes are
+-- stored as hashes and count the wrong guesses made against them.
+CREATE TABLE IF NOT EXISTS otp_codes (
+    id BIGSERIAL PRIMARY KEY,
+    phone VARCHAR(20) NOT NULL,
+    code_hash VARCHAR(64) NOT NULL,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    ip_address VARCHAR(64),
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMP NOT NULL,
+    consumed_at TIMESTAMP
+);
+
+-- Create indexes for finding the latest code of a phone and for rate limits
+CREATE INDEX IF NOT EXISTS idx_otp_codes_phone_created_at ON otp_codes(phone, created_at);
+CREATE INDEX IF NOT EXISTS idx_otp_codes_ip_address_created_at ON otp_codes(ip_address, created_at);
@@ -0,0 +1,5 @@
+-- Drop auth_tokens table
+DROP TABLE IF EXISTS auth_tokens;
+
+-- Stop recording when users verified their email address
+ALTER TABLE users DROP COLUMN IF EXISTS email_verified_at;
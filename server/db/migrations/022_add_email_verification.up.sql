@@ -0,0 +1,20 @@
+-- Record when a user proved they own their email address
+ALTER TABLE users ADD COLUMN IF NOT EXISTS email_verified_at TIMESTAMP;
+
+-- Accounts that existed before verification keep their access
+UPDATE users SET email_verified_at = created_at WHERE email_verified_at IS NULL AND email IS NOT NULL;
+
+-- Create auth_tokens table for the single-use links sent by email to reset a
+-- password or verify an email address. Tokens are stored as SHA-256 hashes.
+CREATE TABLE IF NOT EXISTS auth_tokens (
+    id BIGSERIAL PRIMARY KEY,
+    user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    purpose VARCHAR(30) NOT NULL,
+    token_hash VARCHAR(64) NOT NULL UNIQUE,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP
+);
+
+-- Create index for finding the tokens of a user
+CREATE INDEX IF NOT EXISTS idx_auth_tokens_user_id_purpose ON auth_tokens(user_id, purpose);
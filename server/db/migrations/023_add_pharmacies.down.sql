@@ -0,0 +1,17 @@
+-- Unshare chats and folders
+DROP INDEX IF EXISTS idx_folders_pharmacy_id;
+DROP INDEX IF EXISTS idx_chats_pharmacy_id;
+ALTER TABLE folders DROP COLUMN IF EXISTS pharmacy_id;
+ALTER TABLE chats DROP COLUMN IF EXISTS pharmacy_id;
+
+-- Give payments, credit transactions and subscriptions back to their users
+ALTER TABLE payments DROP COLUMN IF EXISTS pharmacy_id;
+DROP INDEX IF EXISTS idx_credit_transactions_pharmacy_id;
+ALTER TABLE credit_transactions DROP COLUMN IF EXISTS pharmacy_id;
+DROP INDEX IF EXISTS idx_user_subscriptions_pharmacy_id;
+ALTER TABLE user_subscriptions DROP COLUMN IF EXISTS pharmacy_id;
+
+-- Drop the pharmacy tables
+DROP TABLE IF EXISTS pharmacy_invitations;
+DROP TABLE IF EXISTS pharmacy_members;
+DROP TABLE IF EXISTS pharmacies;
@@ -0,0 +1,57 @@
+-- Create pharmacies table. A pharmacy is a team of users who share its
+-- credit, subscriptions and the cases its members share with it.
+CREATE TABLE IF NOT EXISTS pharmacies (
+    id BIGSERIAL PRIMARY KEY,
+    name VARCHAR(255) NOT NULL,
+    credit DECIMAL(10, 2) NOT NULL DEFAULT 0.00,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+-- Create pharmacy_members table. A user belongs to at most one pharmacy.
+CREATE TABLE IF NOT EXISTS pharmacy_members (
+    pharmacy_id BIGINT NOT NULL REFERENCES pharmacies(id) ON DELETE CASCADE,
+    user_id BIGINT NOT NULL UNIQUE REFERENCES users(id) ON DELETE CASCADE,
+    role VARCHAR(20) NOT NULL,
+    joined_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (pharmacy_id, user_id)
+);
+
+-- Create pharmacy_invitations table. Invitations are addressed to the email
+-- or phone number of the invitee, who accepts them after logging in.
+CREATE TABLE IF NOT EXISTS pharmacy_invitations (
+    id BIGSERIAL PRIMARY KEY,
+    pharmacy_id BIGINT NOT NULL REFERENCES pharmacies(id) ON DELETE CASCADE,
+    email VARCHAR(255),
+    phone VARCHAR(20),
+    role VARCHAR(20) NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending',
+    invited_by BIGINT NOT NULL REFERENCES users(id),
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMP NOT NULL,
+    responded_at TIMESTAMP,
+    CHECK (email IS NOT NULL OR phone IS NOT NULL)
+);
+
+CREATE INDEX IF NOT EXISTS idx_pharmacy_invitations_pharmacy_id ON pharmacy_invitations(pharmacy_id);
+CREATE INDEX IF NOT EXISTS idx_pharmacy_invitations_email ON pharmacy_invitations(email);
+CREATE INDEX IF NOT EXISTS idx_pharmacy_invitations_phone ON pharmacy_invitations(phone);
+
+-- Subscriptions bought by a member of a pharmacy belong to the pharmacy and
+-- are used by all of its members
+ALTER TABLE user_subscriptions ADD COLUMN IF NOT EXISTS pharmacy_id BIGINT REFERENCES pharmacies(id);
+CREATE INDEX IF NOT EXISTS idx_user_subscriptions_pharmacy_id ON user_subscriptions(pharmacy_id);
+
+-- Credit transactions of a pharmacy change pharmacies.credit instead of the
+-- credit of their user, who is the member that made them
+ALTER TABLE credit_transactions ADD COLUMN IF NOT EXISTS pharmacy_id BIGINT REFERENCES pharmacies(id);
+CREATE INDEX IF NOT EXISTS idx_credit_transactions_pharmacy_id ON credit_transactions(pharmacy_id);
+
+-- Top-ups paid by a member are credited to their pharmacy
+ALTER TABLE payments ADD COLUMN IF NOT EXISTS pharmacy_id BIGINT REFERENCES pharmacies(id);
+
+-- Chats and folders shared with a pharmacy can be seen by all of its members
+ALTER TABLE chats ADD COLUMN IF NOT EXISTS pharmacy_id BIGINT REFERENCES pharmacies(id) ON DELETE SET NULL;
+ALTER TABLE folders ADD COLUMN IF NOT EXISTS pharmacy_id BIGINT REFERENCES pharmacies(id) ON DELETE SET NULL;
+CREATE INDEX IF NOT EXISTS idx_chats_pharmacy_id ON chats(pharmacy_id);
+CREATE INDEX IF NOT EXISTS idx_folders_pharmacy_id ON folders(pharmacy_id);
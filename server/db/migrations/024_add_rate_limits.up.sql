@@ -0,0 +1,9 @@
+-- Create rate_limits table. Each row is the token bucket of one client under
+-- one rate limit policy, stored as the time at which the bucket is full again.
+CREATE TABLE IF NOT EXISTS rate_limits (
+    key VARCHAR(255) PRIMARY KEY,
+    full_at TIMESTAMPTZ NOT NULL
+);
+
+-- Create index for forgetting buckets that are full again
+CREATE INDEX IF NOT EXISTS idx_rate_limits_full_at ON rate_limits(full_at);
@@ -0,0 +1,2 @@
+-- Remove content_type column from messages table
+ALTER TABLE messages DROP COLUMN IF EXISTS content_type;
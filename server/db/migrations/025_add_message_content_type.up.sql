@@ -0,0 +1,3 @@
+-- Add content_type column to messages table, which used to be added by Go
+-- code at startup rather than by a migration
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS content_type VARCHAR(50) DEFAULT 'text';
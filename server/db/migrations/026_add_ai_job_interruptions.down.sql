@@ -0,0 +1,3 @@
+-- Remove interrupted_at column from ai_jobs table
+DROP INDEX IF EXISTS idx_ai_jobs_interrupted_at;
+ALTER TABLE ai_jobs DROP COLUMN IF EXISTS interrupted_at;
@@ -0,0 +1,6 @@
+-- Add interrupted_at column to ai_jobs table. It is set when a server stops
+-- before a job finished, and cleared by the server that resumes the job.
+ALTER TABLE ai_jobs ADD COLUMN IF NOT EXISTS interrupted_at TIMESTAMP;
+
+-- Create index for finding the interrupted jobs at startup
+CREATE INDEX IF NOT EXISTS idx_ai_jobs_interrupted_at ON ai_jobs(interrupted_at) WHERE interrupted_at IS NOT NULL;
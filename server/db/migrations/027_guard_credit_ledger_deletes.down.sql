@@ -0,0 +1,18 @@
+-- Let credit transactions be deleted again and only guard their columns from 019
+CREATE OR REPLACE FUNCTION prevent_credit_transaction_update() RETURNS trigger AS $$
+BEGIN
+    IF NEW.user_id IS DISTINCT FROM OLD.user_id
+        OR NEW.amount IS DISTINCT FROM OLD.amount
+        OR NEW.balance_after IS DISTINCT FROM OLD.balance_after
+        OR NEW.transaction_type IS DISTINCT FROM OLD.transaction_type
+        OR NEW.created_at IS DISTINCT FROM OLD.created_at THEN
+        RAISE EXCEPTION 'credit_transactions is append-only';
+    END IF;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS credit_transactions_append_only ON credit_transactions;
+CREATE TRIGGER credit_transactions_append_only
+    BEFORE UPDATE ON credit_transactions
+    FOR EACH ROW EXECUTE FUNCTION prevent_credit_transaction_update();
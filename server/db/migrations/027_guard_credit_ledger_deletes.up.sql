@@ -0,0 +1,25 @@
+-- Keep the ledger append-only: transactions are never deleted, and the
+-- pharmacy_id added with pharmacies can no more be changed than the user.
+-- Users and pharmacies with transactions can therefore no longer be deleted.
+CREATE OR REPLACE FUNCTION prevent_credit_transaction_update() RETURNS trigger AS $$
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        RAISE EXCEPTION 'credit_transactions is append-only';
+    END IF;
+
+    IF NEW.user_id IS DISTINCT FROM OLD.user_id
+        OR NEW.pharmacy_id IS DISTINCT FROM OLD.pharmacy_id
+        OR NEW.amount IS DISTINCT FROM OLD.amount
+        OR NEW.balance_after IS DISTINCT FROM OLD.balance_after
+        OR NEW.transaction_type IS DISTINCT FROM OLD.transaction_type
+        OR NEW.created_at IS DISTINCT FROM OLD.created_at THEN
+        RAISE EXCEPTION 'credit_transactions is append-only';
+    END IF;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS credit_transactions_append_only ON credit_transactions;
+CREATE TRIGGER credit_transactions_append_only
+    BEFORE UPDATE OR DELETE ON credit_transactions
+    FOR EACH ROW EXECUTE FUNCTION prevent_credit_transaction_update();
@@ -0,0 +1,13 @@
+package migrations
+
+import (
+	"io/fs"
+	"testing"
+)
+
+// UseSource makes the migrations be read from fsys for the rest of a test
+func UseSource(t *testing.T, fsys fs.FS) {
+	previous := source
+	source = fsys
+	t.Cleanup(func() { source = previous })
+}
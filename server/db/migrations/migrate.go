@@ -1,92 +1,325 @@
 package migrations
 
 import (
+	"context"
+	"database/sql"
 	"fmt"
-	"log"
-	"os"
-	"path/filepath"
-	"sort"
+	"log/slog"
 	"strings"
+	"time"
 
 	"github.com/darooyar/server/db"
 )
 
-// RunMigrations executes all SQL migration files in order
-func RunMigrations() error {
-	// Get the directory where migration files are stored
-	migrationDir, err := getMigrationsDir()
+// lockKey is the key of the Postgres advisory lock held while migrating, so
+// that servers starting at the same time do not apply a migration twice
+const lockKey = 7_211_019_025
+
+// Status is a migration and whether it has been applied
+type Status struct {
+	*Migration
+	Applied   bool
+	AppliedAt time.Time
+}
+
+// applied is the record of a migration in schema_migrations
+type applied struct {
+	checksum  string
+	appliedAt time.Time
+}
+
+// Up applies every migration that has not been applied yet, in order
+func Up(ctx context.Context) error {
+	return withLock(ctx, func(conn *sql.Conn, migrations []*Migration, done map[int64]applied) error {
+		count := 0
+		for _, migration := range migrations {
+			if _, ok := done[migration.Version]; ok {
+				continue
+			}
+			if err := up(ctx, conn, migration); err != nil {
+				return err
+			}
+			count++
+		}
+
+		if count == 0 {
+			slog.InfoContext(ctx, "Database schema is up to date")
+		} else {
+			slog.InfoContext(ctx, "Applied migrations", "count", count)
+		}
+		return nil
+	})
+}
+
+// Down rolls back the n migrations applied last, latest first
+func Down(ctx context.Context, n int) error {
+	return withLock(ctx, func(conn *sql.Conn, migrations []*Migration, done map[int64]applied) error {
+		rollback, err := latest(migrations, done, n)
+		if err != nil {
+			return err
+		}
+		for _, migration := range rollback {
+			if err := down(ctx, conn, migration); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Redo rolls back the migration applied last and applies it again
+func Redo(ctx context.Context) error {
+	return withLock(ctx, func(conn *sql.Conn, migrations []*Migration, done map[int64]applied) error {
+		rollback, err := latest(migrations, done, 1)
+		if err != nil {
+			return err
+		}
+		if len(rollback) == 0 {
+			return fmt.Errorf("no migration has been applied")
+		}
+		if err := down(ctx, conn, rollback[0]); err != nil {
+			return err
+		}
+		return up(ctx, conn, rollback[0])
+	})
+}
+
+// GetStatus lists every migration and whether it has been applied
+func GetStatus(ctx context.Context) ([]Status, error) {
+	var statuses []Status
+	err := withLock(ctx, func(conn *sql.Conn, migrations []*Migration, done map[int64]applied) error {
+		for _, migration := range migrations {
+			record, ok := done[migration.Version]
+			statuses = append(statuses, Status{
+				Migration: migration,
+				Applied:   ok,
+				AppliedAt: record.appliedAt,
+			})
+		}
+		return nil
+	})
+	return statuses, err
+}
+
+// withLock loads the migrations, takes the advisory lock on a connection of
+// its own and calls fn with the migrations applied so far. Applied migrations
+// whose up script has changed since are refused.
+func withLock(ctx context.Context, fn func(conn *sql.Conn, migrations []*Migration, done map[int64]applied) error) error {
+	migrations, err := load()
 	if err != nil {
-		return fmt.Errorf("error getting migrations directory: %v", err)
+		return err
 	}
 
-	// Read all SQL files in the migrations directory
-	files, err := os.ReadDir(migrationDir)
+	// Advisory locks belong to a session, so the lock is taken, used and
+	// released on the same connection
+	conn, err := db.DB.Conn(ctx)
 	if err != nil {
-		return fmt.Errorf("error reading migrations directory: %v", err)
+		return fmt.Errorf("error getting database connection: %v", err)
 	}
+	defer conn.Close()
 
-	// Filter and sort SQL files
-	var sqlFiles []string
-	for _, file := range files {
-		if strings.HasSuffix(file.Name(), ".sql") {
-			sqlFiles = append(sqlFiles, file.Name())
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, lockKey); err != nil {
+		return fmt.Errorf("error taking migration lock: %v", err)
+	}
+	defer func() {
+		// The context may be done already; the lock must be released anyway
+		if _, err := conn.ExecContext(context.WithoutCancel(ctx), `SELECT pg_advisory_unlock($1)`, lockKey); err != nil {
+			slog.ErrorContext(ctx, "Failed to release migration lock", "error", err)
 		}
+	}()
+
+	if err := createTable(ctx, conn); err != nil {
+		return err
+	}
+	if err := baseline(ctx, conn, migrations); err != nil {
+		return err
 	}
-	sort.Strings(sqlFiles)
 
-	// Execute each migration file
-	for _, file := range sqlFiles {
-		log.Printf("Running migration: %s", file)
+	done, err := getApplied(ctx, conn)
+	if err != nil {
+		return err
+	}
 
-		// Read the SQL file
-		content, err := os.ReadFile(filepath.Join(migrationDir, file))
-		if err != nil {
-			return fmt.Errorf("error reading migration file %s: %v", file, err)
+	known := make(map[int64]bool, len(migrations))
+	for _, migration := range migrations {
+		known[migration.Version] = true
+		record, ok := done[migration.Version]
+		if ok && record.checksum != migration.Checksum {
+			return fmt.Errorf("migration %s was changed after it was applied", migration.Name)
+		}
+	}
+	for version := range done {
+		if !known[version] {
+			// A newer server has migrated the database further
+			slog.WarnContext(ctx, "Database has a migration this server does not know", "version", version)
 		}
+	}
 
-		// Execute the SQL
-		_, err = db.DB.Exec(string(content))
-		if err != nil {
-			return fmt.Errorf("error executing migration %s: %v", file, err)
+	return fn(conn, migrations, done)
+}
+
+// createTable creates schema_migrations if it doesn't exist
+func createTable(ctx context.Context, conn *sql.Conn) error {
+	_, err := conn.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version BIGINT PRIMARY KEY,
+			name VARCHAR(255) NOT NULL,
+			checksum VARCHAR(64) NOT NULL,
+			applied_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("error creating schema_migrations table: %v", err)
+	}
+	return nil
+}
+
+// baseline records the migrations that servers from before schema_migrations
+// logged in migration_logs as applied, so that they are not run again
+func baseline(ctx context.Context, conn *sql.Conn, migrations []*Migration) error {
+	var empty, hasLogs bool
+	err := conn.QueryRowContext(ctx, `
+		SELECT NOT EXISTS (SELECT 1 FROM schema_migrations),
+			to_regclass('migration_logs') IS NOT NULL
+	`).Scan(&empty, &hasLogs)
+	if err != nil {
+		return fmt.Errorf("error checking for migration logs: %v", err)
+	}
+	if !empty || !hasLogs {
+		return nil
+	}
+
+	rows, err := conn.QueryContext(ctx, `SELECT migration_name, executed_at FROM migration_logs`)
+	if err != nil {
+		return fmt.Errorf("error reading migration logs: %v", err)
+	}
+	defer rows.Close()
+
+	logged := make(map[string]time.Time)
+	for rows.Next() {
+		var name string
+		var executedAt time.Time
+		if err := rows.Scan(&name, &executedAt); err != nil {
+			return fmt.Errorf("error scanning migration log: %v", err)
 		}
+		logged[strings.TrimSuffix(name, ".sql")] = executedAt
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error reading migration logs: %v", err)
+	}
+	rows.Close()
 
-		log.Printf("Successfully executed migration: %s", file)
+	count := 0
+	for _, migration := range migrations {
+		executedAt, ok := logged[migration.Name]
+		if !ok {
+			continue
+		}
+		_, err := conn.ExecContext(ctx, `
+			INSERT INTO schema_migrations (version, name, checksum, applied_at)
+			VALUES ($1, $2, $3, $4)
+		`, migration.Version, migration.Name, migration.Checksum, executedAt)
+		if err != nil {
+			return fmt.Errorf("error recording migration %s: %v", migration.Name, err)
+		}
+		count++
 	}
 
+	slog.InfoContext(ctx, "Recorded migrations from migration_logs as applied", "count", count)
 	return nil
 }
 
-// getMigrationsDir returns the absolute path to the migrations directory
-func getMigrationsDir() (string, error) {
-	// Try relative path from binary location
-	exePath, err := os.Executable()
+// getApplied returns the applied migrations by version
+func getApplied(ctx context.Context, conn *sql.Conn) (map[int64]applied, error) {
+	rows, err := conn.QueryContext(ctx, `SELECT version, checksum, applied_at FROM schema_migrations`)
 	if err != nil {
-		return "", fmt.Errorf("error getting executable path: %v", err)
+		return nil, fmt.Errorf("error reading schema_migrations: %v", err)
 	}
+	defer rows.Close()
 
-	exeDir := filepath.Dir(exePath)
+	done := make(map[int64]applied)
+	for rows.Next() {
+		var version int64
+		var record applied
+		if err := rows.Scan(&version, &record.checksum, &record.appliedAt); err != nil {
+			return nil, fmt.Errorf("error scanning schema_migrations: %v", err)
+		}
+		done[version] = record
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading schema_migrations: %v", err)
+	}
+	return done, nil
+}
 
-	// Define possible paths where migration files might be located
-	possiblePaths := []string{
-		filepath.Join(exeDir, "db", "migrations"),
-		filepath.Join(exeDir, "server", "db", "migrations"),
-		filepath.Join(exeDir, "..", "db", "migrations"),
-		filepath.Join(exeDir, "..", "server", "db", "migrations"),
+// latest returns the n applied migrations with the highest versions, highest
+// first
+func latest(migrations []*Migration, done map[int64]applied, n int) ([]*Migration, error) {
+	var rollback []*Migration
+	for i := len(migrations) - 1; i >= 0 && len(rollback) < n; i-- {
+		if _, ok := done[migrations[i].Version]; ok {
+			rollback = append(rollback, migrations[i])
+		}
 	}
 
-	// Also check current directory and server/db/migrations from current directory
-	cwd, err := os.Getwd()
-	if err == nil {
-		possiblePaths = append(possiblePaths, filepath.Join(cwd, "db", "migrations"))
-		possiblePaths = append(possiblePaths, filepath.Join(cwd, "server", "db", "migrations"))
+	// A migration this server does not know cannot be rolled back by it
+	for version := range done {
+		if len(rollback) > 0 && version > rollback[0].Version {
+			return nil, fmt.Errorf("migration %d was applied by a newer server and must be rolled back by it", version)
+		}
 	}
+	return rollback, nil
+}
+
+// up applies one migration and records it, in a single transaction
+func up(ctx context.Context, conn *sql.Conn, migration *Migration) error {
+	start := time.Now()
+	err := inTx(ctx, conn, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, migration.Up); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO schema_migrations (version, name, checksum)
+			VALUES ($1, $2, $3)
+		`, migration.Version, migration.Name, migration.Checksum)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("error applying migration %s: %v", migration.Name, err)
+	}
+
+	slog.InfoContext(ctx, "Applied migration", "migration", migration.Name, "duration_ms", time.Since(start).Milliseconds())
+	return nil
+}
 
-	// Try each path
-	for _, path := range possiblePaths {
-		if _, err := os.Stat(path); err == nil {
-			return path, nil
+// down rolls back one migration and forgets it, in a single transaction
+func down(ctx context.Context, conn *sql.Conn, migration *Migration) error {
+	start := time.Now()
+	err := inTx(ctx, conn, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, migration.Down); err != nil {
+			return err
 		}
+		_, err := tx.ExecContext(ctx, `DELETE FROM schema_migrations WHERE version = $1`, migration.Version)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("error rolling back migration %s: %v", migration.Name, err)
 	}
 
-	return "", fmt.Errorf("migrations directory not found in any of the expected locations")
+	slog.InfoContext(ctx, "Rolled back migration", "migration", migration.Name, "duration_ms", time.Since(start).Milliseconds())
+	return nil
+}
+
+// inTx runs fn in a transaction on conn, committing it if fn succeeds
+func inTx(ctx context.Context, conn *sql.Conn, fn func(tx *sql.Tx) error) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
@@ -0,0 +1,163 @@
+package migrations_test
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/darooyar/server/db/dbtest"
+	"github.com/darooyar/server/db/migrations"
+)
+
+// testMigrations creates table a in version 1 and table b in version 2
+func testMigrations() fstest.MapFS {
+	return fstest.MapFS{
+		"001_create_a.up.sql":   {Data: []byte("CREATE TABLE a (id INT);")},
+		"001_create_a.down.sql": {Data: []byte("DROP TABLE a;")},
+		"002_create_b.up.sql":   {Data: []byte("CREATE TABLE b (id INT);")},
+		"002_create_b.down.sql": {Data: []byte("DROP TABLE b;")},
+	}
+}
+
+// tableExists reports whether the test schema has the table
+func tableExists(t *testing.T, conn *sql.DB, table string) bool {
+	t.Helper()
+
+	var exists bool
+	if err := conn.QueryRow(`SELECT to_regclass($1) IS NOT NULL`, table).Scan(&exists); err != nil {
+		t.Fatalf("checking for table %s: %v", table, err)
+	}
+	return exists
+}
+
+// appliedVersions returns the versions GetStatus reports as applied
+func appliedVersions(t *testing.T) []int64 {
+	t.Helper()
+
+	statuses, err := migrations.GetStatus(context.Background())
+	if err != nil {
+		t.Fatalf("getting status: %v", err)
+	}
+	var versions []int64
+	for _, status := range statuses {
+		if status.Applied {
+			versions = append(versions, status.Version)
+		}
+	}
+	return versions
+}
+
+func TestUpAndDown(t *testing.T) {
+	ctx := context.Background()
+	conn := dbtest.Open(t)
+	migrations.UseSource(t, testMigrations())
+
+	steps := []struct {
+		name        string
+		run         func() error
+		wantApplied []int64
+		wantTables  map[string]bool
+	}{
+		{name: "up", run: func() error { return migrations.Up(ctx) }, wantApplied: []int64{1, 2}, wantTables: map[string]bool{"a": true, "b": true}},
+		{name: "up again", run: func() error { return migrations.Up(ctx) }, wantApplied: []int64{1, 2}, wantTables: map[string]bool{"a": true, "b": true}},
+		{name: "down one", run: func() error { return migrations.Down(ctx, 1) }, wantApplied: []int64{1}, wantTables: map[string]bool{"a": true, "b": false}},
+		{name: "redo", run: func() error { return migrations.Redo(ctx) }, wantApplied: []int64{1}, wantTables: map[string]bool{"a": true, "b": false}},
+		{name: "down all", run: func() error { return migrations.Down(ctx, 5) }, wantApplied: nil, wantTables: map[string]bool{"a": false, "b": false}},
+		{name: "up from empty", run: func() error { return migrations.Up(ctx) }, wantApplied: []int64{1, 2}, wantTables: map[string]bool{"a": true, "b": true}},
+	}
+
+	for _, step := range steps {
+		if err := step.run(); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+
+		applied := appliedVersions(t)
+		if len(applied) != len(step.wantApplied) {
+			t.Fatalf("%s: applied = %v, want %v", step.name, applied, step.wantApplied)
+		}
+		for i := range applied {
+			if applied[i] != step.wantApplied[i] {
+				t.Fatalf("%s: applied = %v, want %v", step.name, applied, step.wantApplied)
+			}
+		}
+		for table, want := range step.wantTables {
+			if got := tableExists(t, conn, table); got != want {
+				t.Errorf("%s: table %s exists = %v, want %v", step.name, table, got, want)
+			}
+		}
+	}
+}
+
+func TestUpRefusesChangedMigration(t *testing.T) {
+	ctx := context.Background()
+	conn := dbtest.Open(t)
+
+	files := testMigrations()
+	delete(files, "002_create_b.up.sql")
+	delete(files, "002_create_b.down.sql")
+	migrations.UseSource(t, files)
+	if err := migrations.Up(ctx); err != nil {
+		t.Fatalf("applying first migration: %v", err)
+	}
+
+	// The applied migration is edited while a new one is added
+	files = testMigrations()
+	files["001_create_a.up.sql"] = &fstest.MapFile{Data: []byte("CREATE TABLE a (id BIGINT);")}
+	migrations.UseSource(t, files)
+
+	err := migrations.Up(ctx)
+	if err == nil || !strings.Contains(err.Error(), "was changed after it was applied") {
+		t.Fatalf("Up() error = %v, want a changed migration to be refused", err)
+	}
+	if tableExists(t, conn, "b") {
+		t.Error("a migration was applied after the changed one was refused")
+	}
+	if err := migrations.Down(ctx, 1); err == nil {
+		t.Error("Down() succeeded with a changed migration")
+	}
+}
+
+func TestUpBaselinesFromMigrationLogs(t *testing.T) {
+	ctx := context.Background()
+	conn := dbtest.Open(t)
+	migrations.UseSource(t, testMigrations())
+
+	// A database migrated by a server from before schema_migrations has the
+	// table of the first migration and its entry in migration_logs
+	executedAt := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	_, err := conn.Exec(`
+		CREATE TABLE a (id INT);
+		CREATE TABLE migration_logs (
+			id SERIAL PRIMARY KEY,
+			migration_name VARCHAR(255) NOT NULL,
+			executed_at TIMESTAMPTZ NOT NULL
+		)`)
+	if err != nil {
+		t.Fatalf("creating old schema: %v", err)
+	}
+	if _, err := conn.Exec(`INSERT INTO migration_logs (migration_name, executed_at) VALUES ($1, $2)`, "001_create_a.sql", executedAt); err != nil {
+		t.Fatalf("logging migration: %v", err)
+	}
+
+	// Running the first migration again would fail, since table a exists
+	if err := migrations.Up(ctx); err != nil {
+		t.Fatalf("Up() error = %v", err)
+	}
+
+	statuses, err := migrations.GetStatus(ctx)
+	if err != nil {
+		t.Fatalf("getting status: %v", err)
+	}
+	if len(statuses) != 2 || !statuses[0].Applied || !statuses[1].Applied {
+		t.Fatalf("statuses = %+v, want both migrations applied", statuses)
+	}
+	if !statuses[0].AppliedAt.Equal(executedAt) {
+		t.Errorf("first migration applied at %v, want %v from migration_logs", statuses[0].AppliedAt, executedAt)
+	}
+	if !tableExists(t, conn, "b") {
+		t.Error("the migration missing from migration_logs was not applied")
+	}
+}
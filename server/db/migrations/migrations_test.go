@@ -0,0 +1,119 @@
+package migrations
+
+import (
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+// script is a migration script in a test file system
+func script(content string) *fstest.MapFile {
+	return &fstest.MapFile{Data: []byte(content)}
+}
+
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		name         string
+		files        fstest.MapFS
+		wantVersions []int64
+		wantErr      string
+	}{
+		{name: "ordered by version", files: fstest.MapFS{
+			"010_second.up.sql":   script("CREATE TABLE b (id INT);"),
+			"010_second.down.sql": script("DROP TABLE b;"),
+			"002_first.up.sql":    script("CREATE TABLE a (id INT);"),
+			"002_first.down.sql":  script("DROP TABLE a;"),
+		}, wantVersions: []int64{2, 10}},
+		{name: "missing down script", files: fstest.MapFS{
+			"001_first.up.sql": script("CREATE TABLE a (id INT);"),
+		}, wantErr: "has no down script"},
+		{name: "missing up script", files: fstest.MapFS{
+			"001_first.down.sql": script("DROP TABLE a;"),
+		}, wantErr: "has no up script"},
+		{name: "badly named file", files: fstest.MapFS{
+			"first.sql": script("CREATE TABLE a (id INT);"),
+		}, wantErr: "is not named"},
+		{name: "repeated version", files: fstest.MapFS{
+			"001_first.up.sql":    script("CREATE TABLE a (id INT);"),
+			"001_first.down.sql":  script("DROP TABLE a;"),
+			"001_second.up.sql":   script("CREATE TABLE b (id INT);"),
+			"001_second.down.sql": script("DROP TABLE b;"),
+		}, wantErr: "have the same version"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			UseSource(t, tt.files)
+
+			migrations, err := load()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("load() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("load() error = %v", err)
+			}
+
+			var versions []int64
+			for _, migration := range migrations {
+				versions = append(versions, migration.Version)
+			}
+			if len(versions) != len(tt.wantVersions) {
+				t.Fatalf("versions = %v, want %v", versions, tt.wantVersions)
+			}
+			for i := range versions {
+				if versions[i] != tt.wantVersions[i] {
+					t.Fatalf("versions = %v, want %v", versions, tt.wantVersions)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadChecksumsUpScript(t *testing.T) {
+	UseSource(t, fstest.MapFS{
+		"001_first.up.sql":   script("CREATE TABLE a (id INT);"),
+		"001_first.down.sql": script("DROP TABLE a;"),
+	})
+	before, err := load()
+	if err != nil {
+		t.Fatalf("load() error = %v", err)
+	}
+
+	// Only a changed up script changes the checksum
+	UseSource(t, fstest.MapFS{
+		"001_first.up.sql":   script("CREATE TABLE a (id INT);"),
+		"001_first.down.sql": script("DROP TABLE IF EXISTS a;"),
+	})
+	downChanged, err := load()
+	if err != nil {
+		t.Fatalf("load() error = %v", err)
+	}
+	UseSource(t, fstest.MapFS{
+		"001_first.up.sql":   script("CREATE TABLE a (id BIGINT);"),
+		"001_first.down.sql": script("DROP TABLE a;"),
+	})
+	upChanged, err := load()
+	if err != nil {
+		t.Fatalf("load() error = %v", err)
+	}
+
+	if downChanged[0].Checksum != before[0].Checksum {
+		t.Error("changing the down script changed the checksum")
+	}
+	if upChanged[0].Checksum == before[0].Checksum {
+		t.Error("changing the up script kept the checksum")
+	}
+}
+
+func TestEmbeddedMigrationsLoad(t *testing.T) {
+	migrations, err := load()
+	if err != nil {
+		t.Fatalf("load() error = %v", err)
+	}
+	if len(migrations) == 0 {
+		t.Fatal("no migrations are embedded")
+	}
+}
@@ -0,0 +1,161 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/darooyar/server/models"
+)
+
+// ErrInvalidOTPCode is returned for wrong, expired or already used codes
+var ErrInvalidOTPCode = errors.New("invalid or expired code")
+
+// ErrOTPAttemptsExceeded is returned when a code was guessed wrong too often
+var ErrOTPAttemptsExceeded = errors.New("too many wrong attempts")
+
+// ErrOTPRateLimited is returned when too many codes were requested
+var ErrOTPRateLimited = errors.New("too many codes requested")
+
+// OTPLimits bounds how often codes can be sent
+type OTPLimits struct {
+	Cooldown time.Duration // Minimum time between two codes for a phone
+	Window   time.Duration // Period over which PerPhone and PerIP are counted
+	PerPhone int           // Maximum codes per phone within the window
+	PerIP    int           // Maximum codes per IP address within the window
+}
+
+// CreateOTPCode stores a code for a phone number if the limits allow another
+// one. When they do not, it returns ErrOTPRateLimited and how long to wait.
+func CreateOTPCode(ctx context.Context, phone, codeHash, ipAddress string, expiresAt time.Time, limits OTPLimits) (*models.OTPCode, time.Duration, error) {
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer tx.Rollback()
+
+	// Serialize requests for the same phone so that they see each other's codes
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtext($1))`, phone); err != nil {
+		return nil, 0, err
+	}
+
+	now := time.Now()
+	since := now.Add(-limits.Window)
+
+	var phoneCount int
+	var lastSentAt, oldestSentAt sql.NullTime
+	err = tx.QueryRowContext(ctx, `
+		SELECT COUNT(*), MAX(created_at), MIN(created_at)
+		FROM otp_codes
+		WHERE phone = $1 AND created_at > $2`,
+		phone, since).Scan(&phoneCount, &lastSentAt, &oldestSentAt)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if lastSentAt.Valid && now.Sub(lastSentAt.Time) < limits.Cooldown {
+		return nil, limits.Cooldown - now.Sub(lastSentAt.Time), ErrOTPRateLimited
+	}
+	if phoneCount >= limits.PerPhone {
+		return nil, oldestSentAt.Time.Add(limits.Window).Sub(now), ErrOTPRateLimited
+	}
+
+	if ipAddress != "" {
+		var ipCount int
+		err = tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM otp_codes WHERE ip_address = $1 AND created_at > $2`,
+			ipAddress, since).Scan(&ipCount)
+		if err != nil {
+			return nil, 0, err
+		}
+		if ipCount >= limits.PerIP {
+			return nil, limits.Window, ErrOTPRateLimited
+		}
+	}
+
+	var code models.OTPCode
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO otp_codes (phone, code_hash, ip_address, created_at, expires_at)
+		VALUES ($1, $2, NULLIF($3, ''), $4, $5)
+		RETURNING id, phone, attempts, created_at, expires_at`,
+		phone, codeHash, ipAddress, now, expiresAt,
+	).Scan(&code.ID, &code.Phone, &code.Attempts, &code.CreatedAt, &code.ExpiresAt)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, 0, err
+	}
+	return &code, 0, nil
+}
+
+// VerifyOTPCode checks a code against the latest unused code of a phone and
+// returns its ID. A wrong guess is counted, and once maxAttempts wrong
+// guesses were made the code can no longer be used. The code stays valid
+// until it is consumed with ConsumeOTPCode.
+func VerifyOTPCode(ctx context.Context, phone, codeHash string, maxAttempts int) (int64, error) {
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var id int64
+	var storedHash string
+	var attempts int
+	var expiresAt time.Time
+	err = tx.QueryRowContext(ctx, `
+		SELECT id, code_hash, attempts, expires_at
+		FROM otp_codes
+		WHERE phone = $1 AND consumed_at IS NULL
+		ORDER BY created_at DESC, id DESC
+		LIMIT 1
+		FOR UPDATE`,
+		phone).Scan(&id, &storedHash, &attempts, &expiresAt)
+	if err == sql.ErrNoRows {
+		return 0, ErrInvalidOTPCode
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if time.Now().After(expiresAt) {
+		return 0, ErrInvalidOTPCode
+	}
+	if attempts >= maxAttempts {
+		return 0, ErrOTPAttemptsExceeded
+	}
+
+	if storedHash != codeHash {
+		if _, err := tx.ExecContext(ctx, `UPDATE otp_codes SET attempts = attempts + 1 WHERE id = $1`, id); err != nil {
+			return 0, err
+		}
+		if err := tx.Commit(); err != nil {
+			return 0, err
+		}
+		return 0, ErrInvalidOTPCode
+	}
+
+	return id, tx.Commit()
+}
+
+// ConsumeOTPCode marks a verified code as used. It returns ErrInvalidOTPCode
+// when the code was already used, so each code logs in only once.
+func ConsumeOTPCode(ctx context.Context, id int64) error {
+	result, err := DB.ExecContext(ctx, `UPDATE otp_codes SET consumed_at = $1 WHERE id = $2 AND consumed_at IS NULL`,
+		time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrInvalidOTPCode
+	}
+
+	return nil
+}
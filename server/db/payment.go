@@ -0,0 +1,194 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/darooyar/server/models"
+)
+
+const paymentColumns = `id, user_id, gateway, authority, amount, COALESCE(description, ''), status,
+		ref_id, card_pan, created_at, updated_at, verified_at, pharmacy_id`
+
+// CreatePayment stores a pending payment created with a gateway. A payment
+// with a pharmacy is credited to the pharmacy instead of its user.
+func CreatePayment(ctx context.Context, payment *models.Payment) (*models.Payment, error) {
+	query := `
+		INSERT INTO payments (user_id, gateway, authority, amount, description, status, created_at, updated_at, pharmacy_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $7, $8)
+		RETURNING ` + paymentColumns
+
+	return scanPayment(DB.QueryRowContext(ctx, query,
+		payment.UserID,
+		payment.Gateway,
+		payment.Authority,
+		payment.Amount,
+		payment.Description,
+		models.PaymentStatusPending,
+		time.Now(),
+		payment.PharmacyID,
+	))
+}
+
+// GetPaymentByAuthority retrieves a payment by the authority its gateway assigned
+func GetPaymentByAuthority(ctx context.Context, authority string) (*models.Payment, error) {
+	query := `SELECT ` + paymentColumns + ` FROM payments WHERE authority = $1`
+
+	payment, err := scanPayment(DB.QueryRowContext(ctx, query, authority))
+	if err == sql.ErrNoRows {
+		return nil, errors.New("payment not found")
+	}
+	return payment, err
+}
+
+// GetUserPayment retrieves a payment if it belongs to the user
+func GetUserPayment(ctx context.Context, id int64, userID int64) (*models.Payment, error) {
+	query := `SELECT ` + paymentColumns + ` FROM payments WHERE id = $1 AND user_id = $2`
+
+	payment, err := scanPayment(DB.QueryRowContext(ctx, query, id, userID))
+	if err == sql.ErrNoRows {
+		return nil, errors.New("payment not found or unauthorized")
+	}
+	return payment, err
+}
+
+// GetUserPayments retrieves a user's payments, newest first
+func GetUserPayments(ctx context.Context, userID int64, limit, offset int) ([]*models.Payment, error) {
+	query := `
+		SELECT ` + paymentColumns + `
+		FROM payments
+		WHERE user_id = $1
+		ORDER BY created_at DESC, id DESC
+		LIMIT $2 OFFSET $3`
+
+	rows, err := DB.QueryContext(ctx, query, userID, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	payments := []*models.Payment{}
+	for rows.Next() {
+		payment, err := scanPayment(rows)
+		if err != nil {
+			return nil, err
+		}
+		payments = append(payments, payment)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return payments, nil
+}
+
+// CompletePayment marks a pending payment as verified and credits its amount
+// to the user, or to their pharmacy, with a topup credit transaction. It returns the payment and
+// whether it was credited by this call; a payment that was already settled is
+// returned unchanged, so a repeated callback never credits twice.
+func CompletePayment(ctx context.Context, authority, refID, cardPAN string) (*models.Payment, bool, error) {
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+
+	// Only one caller can move the payment out of pending
+	query := `
+		UPDATE payments
+		SET status = $1, ref_id = $2, card_pan = NULLIF($3, ''), verified_at = $4, updated_at = $4
+		WHERE authority = $5 AND status = $6
+		RETURNING ` + paymentColumns
+
+	payment, err := scanPayment(tx.QueryRowContext(ctx, query,
+		models.PaymentStatusVerified, refID, cardPAN, now, authority, models.PaymentStatusPending))
+	if err == sql.ErrNoRows {
+		payment, err := GetPaymentByAuthority(ctx, authority)
+		return payment, false, err
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	// Add credit to the user or their pharmacy
+	txn, err := recordCreditTransaction(ctx, tx, models.CreditEntry{
+		UserID:          payment.UserID,
+		PharmacyID:      payment.PharmacyID,
+		Amount:          float64(payment.Amount),
+		TransactionType: models.CreditTransactionTypeTopup,
+		Description:     fmt.Sprintf("Top-up via %s, ref %s", payment.Gateway, refID),
+		ActorID:         &payment.UserID,
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE payments SET credit_transaction_id = $1 WHERE id = $2`, txn.ID, payment.ID)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, false, err
+	}
+	return payment, true, nil
+}
+
+// FailPayment marks a pending payment as failed. Settled payments are left as they are.
+func FailPayment(ctx context.Context, authority string) (*models.Payment, error) {
+	query := `
+		UPDATE payments
+		SET status = $1, updated_at = $2
+		WHERE authority = $3 AND status = $4
+		RETURNING ` + paymentColumns
+
+	payment, err := scanPayment(DB.QueryRowContext(ctx, query,
+		models.PaymentStatusFailed, time.Now(), authority, models.PaymentStatusPending))
+	if err == sql.ErrNoRows {
+		return GetPaymentByAuthority(ctx, authority)
+	}
+	return payment, err
+}
+
+// scanPayment reads a payment selected with paymentColumns
+func scanPayment(row rowScanner) (*models.Payment, error) {
+	var payment models.Payment
+	var refID, cardPAN sql.NullString
+	var verifiedAt sql.NullTime
+	err := row.Scan(
+		&payment.ID,
+		&payment.UserID,
+		&payment.Gateway,
+		&payment.Authority,
+		&payment.Amount,
+		&payment.Description,
+		&payment.Status,
+		&refID,
+		&cardPAN,
+		&payment.CreatedAt,
+		&payment.UpdatedAt,
+		&verifiedAt,
+		&payment.PharmacyID,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if refID.Valid {
+		payment.RefID = &refID.String
+	}
+	if cardPAN.Valid {
+		payment.CardPAN = &cardPAN.String
+	}
+	if verifiedAt.Valid {
+		payment.VerifiedAt = &verifiedAt.Time
+	}
+
+	return &payment, nil
+}
@@ -0,0 +1,611 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/darooyar/server/models"
+)
+
+var (
+	// ErrAlreadyPharmacyMember is returned when a user who belongs to a pharmacy creates or joins another
+	ErrAlreadyPharmacyMember = errors.New("user already belongs to a pharmacy")
+	// ErrPharmacyMemberNotFound is returned when a user is not a member of the pharmacy
+	ErrPharmacyMemberNotFound = errors.New("pharmacy member not found")
+	// ErrLastPharmacyOwner is returned when a change would leave a pharmacy without an owner
+	ErrLastPharmacyOwner = errors.New("pharmacy must keep at least one owner")
+	// ErrInvitationNotFound is returned for unknown, expired or already answered invitations
+	ErrInvitationNotFound = errors.New("invitation not found")
+)
+
+const invitationColumns = `i.id, i.pharmacy_id, p.name, i.email, i.phone, i.role, i.status, i.invited_by,
+		i.created_at, i.expires_at, i.responded_at`
+
+// invitationRecipient matches the pending invitations (i) addressed to the
+// verified email or the phone number of a user ($1)
+const invitationRecipient = `i.status = 'pending' AND i.expires_at > NOW() AND EXISTS (
+			SELECT 1 FROM users u
+			WHERE u.id = $1 AND (
+				(u.email_verified_at IS NOT NULL AND LOWER(u.email) = LOWER(i.email))
+				OR u.phone = i.phone))`
+
+// sharedWithPharmacy matches the chats (c) shared with a pharmacy ($1),
+// directly or through a shared folder of the chat's owner
+const sharedWithPharmacy = `(c.pharmacy_id = $1 OR EXISTS (
+			SELECT 1 FROM folders f
+			WHERE f.id = c.folder_id AND f.user_id = c.user_id AND f.pharmacy_id = $1))`
+
+// CreatePharmacy creates a pharmacy with the user as its owner
+func CreatePharmacy(ctx context.Context, userID int64, name string) (*models.Pharmacy, error) {
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var member bool
+	err = tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM pharmacy_members WHERE user_id = $1)`, userID).Scan(&member)
+	if err != nil {
+		return nil, err
+	}
+	if member {
+		return nil, ErrAlreadyPharmacyMember
+	}
+
+	now := time.Now()
+	pharmacy := models.Pharmacy{Role: models.PharmacyRoleOwner}
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO pharmacies (name, credit, created_at, updated_at)
+		VALUES ($1, 0, $2, $2)
+		RETURNING id, name, credit, created_at, updated_at`,
+		name, now).Scan(
+		&pharmacy.ID,
+		&pharmacy.Name,
+		&pharmacy.Credit,
+		&pharmacy.CreatedAt,
+		&pharmacy.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO pharmacy_members (pharmacy_id, user_id, role, joined_at)
+		VALUES ($1, $2, $3, $4)`,
+		pharmacy.ID, userID, models.PharmacyRoleOwner, now)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return &pharmacy, nil
+}
+
+// GetUserPharmacy retrieves the pharmacy a user belongs to, with their role in
+// it, or nil when they are not a member of any pharmacy
+func GetUserPharmacy(ctx context.Context, userID int64) (*models.Pharmacy, error) {
+	query := `
+		SELECT p.id, p.name, p.credit, m.role, p.created_at, p.updated_at
+		FROM pharmacy_members m
+		JOIN pharmacies p ON p.id = m.pharmacy_id
+		WHERE m.user_id = $1`
+
+	var pharmacy models.Pharmacy
+	err := DB.QueryRowContext(ctx, query, userID).Scan(
+		&pharmacy.ID,
+		&pharmacy.Name,
+		&pharmacy.Credit,
+		&pharmacy.Role,
+		&pharmacy.CreatedAt,
+		&pharmacy.UpdatedAt,
+	)
+	if err == sql.ErrNoRows {
+		return nil, nil // Not a member of any pharmacy
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &pharmacy, nil
+}
+
+// GetPharmacyMembers retrieves the members of a pharmacy in the order they joined
+func GetPharmacyMembers(ctx context.Context, pharmacyID int64) ([]*models.PharmacyMember, error) {
+	query := `
+		SELECT u.id, u.username, u.first_name, u.last_name, m.role, m.joined_at
+		FROM pharmacy_members m
+		JOIN users u ON u.id = m.user_id
+		WHERE m.pharmacy_id = $1
+		ORDER BY m.joined_at ASC`
+
+	rows, err := DB.QueryContext(ctx, query, pharmacyID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []*models.PharmacyMember{}
+	for rows.Next() {
+		var member models.PharmacyMember
+		if err := rows.Scan(
+			&member.UserID,
+			&member.Username,
+			&member.FirstName,
+			&member.LastName,
+			&member.Role,
+			&member.JoinedAt,
+		); err != nil {
+			return nil, err
+		}
+		members = append(members, &member)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return members, nil
+}
+
+// UpdatePharmacyMemberRole changes the role of a member. The last owner of a
+// pharmacy cannot be given another role.
+func UpdatePharmacyMemberRole(ctx context.Context, pharmacyID, userID int64, role models.PharmacyRole) error {
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	current, err := lockPharmacyMember(ctx, tx, pharmacyID, userID)
+	if err != nil {
+		return err
+	}
+
+	if current == models.PharmacyRoleOwner && role != models.PharmacyRoleOwner {
+		if err := checkOtherOwner(ctx, tx, pharmacyID, userID); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE pharmacy_members SET role = $1 WHERE pharmacy_id = $2 AND user_id = $3`,
+		role, pharmacyID, userID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// RemovePharmacyMember removes a user from a pharmacy and stops sharing their
+// chats and folders with it. The last owner of a pharmacy cannot be removed.
+// Subscriptions and credit stay with the pharmacy.
+func RemovePharmacyMember(ctx context.Context, pharmacyID, userID int64) error {
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	role, err := lockPharmacyMember(ctx, tx, pharmacyID, userID)
+	if err != nil {
+		return err
+	}
+
+	if role == models.PharmacyRoleOwner {
+		if err := checkOtherOwner(ctx, tx, pharmacyID, userID); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM pharmacy_members WHERE pharmacy_id = $1 AND user_id = $2`, pharmacyID, userID); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, `UPDATE chats SET pharmacy_id = NULL WHERE user_id = $1 AND pharmacy_id = $2`, userID, pharmacyID); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, `UPDATE folders SET pharmacy_id = NULL WHERE user_id = $1 AND pharmacy_id = $2`, userID, pharmacyID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// lockPharmacyMember locks the pharmacy so that membership changes run one at
+// a time and returns the member's role
+func lockPharmacyMember(ctx context.Context, tx *sql.Tx, pharmacyID, userID int64) (models.PharmacyRole, error) {
+	if _, err := tx.ExecContext(ctx, `SELECT 1 FROM pharmacies WHERE id = $1 FOR UPDATE`, pharmacyID); err != nil {
+		return "", err
+	}
+
+	var role models.PharmacyRole
+	err := tx.QueryRowContext(ctx, `SELECT role FROM pharmacy_members WHERE pharmacy_id = $1 AND user_id = $2`,
+		pharmacyID, userID).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", ErrPharmacyMemberNotFound
+	}
+	return role, err
+}
+
+// checkOtherOwner returns ErrLastPharmacyOwner unless the pharmacy has an owner other than the user
+func checkOtherOwner(ctx context.Context, tx *sql.Tx, pharmacyID, userID int64) error {
+	var owners int
+	err := tx.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM pharmacy_members
+		WHERE pharmacy_id = $1 AND role = $2 AND user_id <> $3`,
+		pharmacyID, models.PharmacyRoleOwner, userID).Scan(&owners)
+	if err != nil {
+		return err
+	}
+	if owners == 0 {
+		return ErrLastPharmacyOwner
+	}
+	return nil
+}
+
+// CreatePharmacyInvitation stores an invitation to a pharmacy. An earlier
+// pending invitation to the same email or phone number is revoked.
+func CreatePharmacyInvitation(ctx context.Context, invitation *models.PharmacyInvitation) (*models.PharmacyInvitation, error) {
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	_, err = tx.ExecContext(ctx, `
+		UPDATE pharmacy_invitations
+		SET status = $1, responded_at = $2
+		WHERE pharmacy_id = $3 AND status = $4
+			AND (LOWER(email) = LOWER($5::text) OR phone = $6)`,
+		models.InvitationStatusRevoked, now, invitation.PharmacyID, models.InvitationStatusPending,
+		invitation.Email, invitation.Phone)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `
+		WITH i AS (
+			INSERT INTO pharmacy_invitations (pharmacy_id, email, phone, role, status, invited_by, created_at, expires_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+			RETURNING *
+		)
+		SELECT ` + invitationColumns + `
+		FROM i
+		JOIN pharmacies p ON p.id = i.pharmacy_id`
+
+	created, err := scanInvitation(tx.QueryRowContext(ctx, query,
+		invitation.PharmacyID,
+		invitation.Email,
+		invitation.Phone,
+		invitation.Role,
+		models.InvitationStatusPending,
+		invitation.InvitedBy,
+		now,
+		invitation.ExpiresAt,
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return created, nil
+}
+
+// GetPharmacyInvitations retrieves the pending invitations of a pharmacy, newest first
+func GetPharmacyInvitations(ctx context.Context, pharmacyID int64) ([]*models.PharmacyInvitation, error) {
+	query := `
+		SELECT ` + invitationColumns + `
+		FROM pharmacy_invitations i
+		JOIN pharmacies p ON p.id = i.pharmacy_id
+		WHERE i.pharmacy_id = $1 AND i.status = 'pending' AND i.expires_at > NOW()
+		ORDER BY i.created_at DESC`
+
+	return queryInvitations(ctx, query, pharmacyID)
+}
+
+// GetUserInvitations retrieves the pending invitations addressed to a user's
+// verified email or phone number, newest first
+func GetUserInvitations(ctx context.Context, userID int64) ([]*models.PharmacyInvitation, error) {
+	query := `
+		SELECT ` + invitationColumns + `
+		FROM pharmacy_invitations i
+		JOIN pharmacies p ON p.id = i.pharmacy_id
+		WHERE ` + invitationRecipient + `
+		ORDER BY i.created_at DESC`
+
+	return queryInvitations(ctx, query, userID)
+}
+
+// RevokePharmacyInvitation withdraws a pending invitation of a pharmacy
+func RevokePharmacyInvitation(ctx context.Context, id, pharmacyID int64) error {
+	result, err := DB.ExecContext(ctx, `
+		UPDATE pharmacy_invitations
+		SET status = $1, responded_at = $2
+		WHERE id = $3 AND pharmacy_id = $4 AND status = $5`,
+		models.InvitationStatusRevoked, time.Now(), id, pharmacyID, models.InvitationStatusPending)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrInvitationNotFound
+	}
+
+	return nil
+}
+
+// RespondToInvitation accepts or declines an invitation addressed to the user.
+// Accepting adds the user to the pharmacy with the invited role, unless they
+// already belong to a pharmacy.
+func RespondToInvitation(ctx context.Context, id, userID int64, accept bool) (*models.PharmacyInvitation, error) {
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	query := `
+		SELECT ` + invitationColumns + `
+		FROM pharmacy_invitations i
+		JOIN pharmacies p ON p.id = i.pharmacy_id
+		WHERE i.id = $2 AND ` + invitationRecipient + `
+		FOR UPDATE OF i`
+
+	invitation, err := scanInvitation(tx.QueryRowContext(ctx, query, userID, id))
+	if err == sql.ErrNoRows {
+		return nil, ErrInvitationNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	invitation.Status = models.InvitationStatusDeclined
+	if accept {
+		invitation.Status = models.InvitationStatusAccepted
+
+		// The unique user_id also catches a membership made by a concurrent request
+		result, err := tx.ExecContext(ctx, `
+			INSERT INTO pharmacy_members (pharmacy_id, user_id, role, joined_at)
+			VALUES ($1, $2, $3, $4)
+			ON CONFLICT (user_id) DO NOTHING`,
+			invitation.PharmacyID, userID, invitation.Role, now)
+		if err != nil {
+			return nil, err
+		}
+		if inserted, err := result.RowsAffected(); err != nil {
+			return nil, err
+		} else if inserted == 0 {
+			return nil, ErrAlreadyPharmacyMember
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE pharmacy_invitations SET status = $1, responded_at = $2 WHERE id = $3`,
+		invitation.Status, now, invitation.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	invitation.RespondedAt = &now
+	return invitation, nil
+}
+
+// queryInvitations runs a query selecting invitationColumns
+func queryInvitations(ctx context.Context, query string, args ...interface{}) ([]*models.PharmacyInvitation, error) {
+	rows, err := DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	invitations := []*models.PharmacyInvitation{}
+	for rows.Next() {
+		invitation, err := scanInvitation(rows)
+		if err != nil {
+			return nil, err
+		}
+		invitations = append(invitations, invitation)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return invitations, nil
+}
+
+// scanInvitation reads an invitation selected with invitationColumns
+func scanInvitation(row rowScanner) (*models.PharmacyInvitation, error) {
+	var invitation models.PharmacyInvitation
+	var email, phone sql.NullString
+	var respondedAt sql.NullTime
+	err := row.Scan(
+		&invitation.ID,
+		&invitation.PharmacyID,
+		&invitation.PharmacyName,
+		&email,
+		&phone,
+		&invitation.Role,
+		&invitation.Status,
+		&invitation.InvitedBy,
+		&invitation.CreatedAt,
+		&invitation.ExpiresAt,
+		&respondedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if email.Valid {
+		invitation.Email = &email.String
+	}
+	if phone.Valid {
+		invitation.Phone = &phone.String
+	}
+	if respondedAt.Valid {
+		invitation.RespondedAt = &respondedAt.Time
+	}
+
+	return &invitation, nil
+}
+
+// ShareChat shares one of the user's chats with a pharmacy, or stops sharing
+// it when pharmacyID is nil
+func ShareChat(ctx context.Context, chatID, userID int64, pharmacyID *int64) error {
+	return shareWithPharmacy(ctx, "chats", chatID, userID, pharmacyID, errors.New("chat not found or unauthorized"))
+}
+
+// ShareFolder shares one of the user's folders, and the user's chats in it,
+// with a pharmacy, or stops sharing it when pharmacyID is nil
+func ShareFolder(ctx context.Context, folderID, userID int64, pharmacyID *int64) error {
+	return shareWithPharmacy(ctx, "folders", folderID, userID, pharmacyID, errors.New("folder not found or unauthorized"))
+}
+
+// shareWithPharmacy sets the pharmacy of a row of the table the user owns
+func shareWithPharmacy(ctx context.Context, table string, id, userID int64, pharmacyID *int64, notFound error) error {
+	result, err := DB.ExecContext(ctx, `
+		UPDATE `+table+`
+		SET pharmacy_id = $1, updated_at = $2
+		WHERE id = $3 AND user_id = $4`,
+		pharmacyID, time.Now(), id, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return notFound
+	}
+
+	return nil
+}
+
+// GetPharmacyChats retrieves the chats shared with a pharmacy, most recently updated first
+func GetPharmacyChats(ctx context.Context, pharmacyID int64) ([]models.Chat, error) {
+	query := `
+		SELECT c.id, c.user_id, c.title, c.folder_id, c.pharmacy_id, c.created_at, c.updated_at
+		FROM chats c
+		WHERE ` + sharedWithPharmacy + `
+		ORDER BY c.updated_at DESC`
+
+	rows, err := DB.QueryContext(ctx, query, pharmacyID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	chats := []models.Chat{}
+	for rows.Next() {
+		var chat models.Chat
+		if err := rows.Scan(
+			&chat.ID,
+			&chat.UserID,
+			&chat.Title,
+			&chat.FolderID,
+			&chat.PharmacyID,
+			&chat.CreatedAt,
+			&chat.UpdatedAt,
+		); err != nil {
+			return nil, err
+		}
+		chats = append(chats, chat)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return chats, nil
+}
+
+// GetPharmacyFolders retrieves the folders shared with a pharmacy with the number of their owner's chats
+func GetPharmacyFolders(ctx context.Context, pharmacyID int64) ([]models.Folder, error) {
+	query := `
+		SELECT f.id, f.user_id, f.name, f.color, f.pharmacy_id, f.created_at, f.updated_at,
+		       COUNT(c.id) as chat_count
+		FROM folders f
+		LEFT JOIN chats c ON f.id = c.folder_id AND c.user_id = f.user_id
+		WHERE f.pharmacy_id = $1
+		GROUP BY f.id
+		ORDER BY f.name ASC`
+
+	rows, err := DB.QueryContext(ctx, query, pharmacyID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	folders := []models.Folder{}
+	for rows.Next() {
+		var folder models.Folder
+		if err := rows.Scan(
+			&folder.ID,
+			&folder.UserID,
+			&folder.Name,
+			&folder.Color,
+			&folder.PharmacyID,
+			&folder.CreatedAt,
+			&folder.UpdatedAt,
+			&folder.ChatCount,
+		); err != nil {
+			return nil, err
+		}
+		folders = append(folders, folder)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return folders, nil
+}
+
+// GetPharmacyCreditTransactions retrieves the transactions of a pharmacy's credit, newest first
+func GetPharmacyCreditTransactions(ctx context.Context, pharmacyID int64, limit, offset int) ([]*models.CreditTransaction, error) {
+	query := `
+		SELECT ` + creditTransactionColumns + `
+		FROM credit_transactions
+		WHERE pharmacy_id = $1
+		ORDER BY created_at DESC, id DESC
+		LIMIT $2 OFFSET $3`
+
+	rows, err := DB.QueryContext(ctx, query, pharmacyID, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	transactions := []*models.CreditTransaction{}
+	for rows.Next() {
+		txn, err := scanCreditTransaction(rows)
+		if err != nil {
+			return nil, err
+		}
+		transactions = append(transactions, txn)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return transactions, nil
+}
@@ -1,14 +1,16 @@
 package db
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"time"
 
 	"github.com/darooyar/server/models"
 )
 
 // CreatePlan creates a new plan in the database
-func CreatePlan(plan *models.PlanCreate) (*models.Plan, error) {
+func CreatePlan(ctx context.Context, plan *models.PlanCreate) (*models.Plan, error) {
 	query := `
 		INSERT INTO plans (title, description, price, duration_days, max_uses, plan_type, created_at, updated_at)
 		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
@@ -16,7 +18,7 @@ func CreatePlan(plan *models.PlanCreate) (*models.Plan, error) {
 
 	now := time.Now()
 	var newPlan models.Plan
-	err := DB.QueryRow(
+	err := DB.QueryRowContext(ctx,
 		query,
 		plan.Title,
 		plan.Description,
@@ -46,14 +48,14 @@ func CreatePlan(plan *models.PlanCreate) (*models.Plan, error) {
 }
 
 // GetPlanByID retrieves a plan by ID
-func GetPlanByID(id int64) (*models.Plan, error) {
+func GetPlanByID(ctx context.Context, id int64) (*models.Plan, error) {
 	query := `
 		SELECT id, title, description, price, duration_days, max_uses, plan_type, created_at, updated_at
 		FROM plans
 		WHERE id = $1`
 
 	var plan models.Plan
-	err := DB.QueryRow(query, id).Scan(
+	err := DB.QueryRowContext(ctx, query, id).Scan(
 		&plan.ID,
 		&plan.Title,
 		&plan.Description,
@@ -76,13 +78,13 @@ func GetPlanByID(id int64) (*models.Plan, error) {
 }
 
 // GetAllPlans retrieves all plans
-func GetAllPlans() ([]*models.Plan, error) {
+func GetAllPlans(ctx context.Context) ([]*models.Plan, error) {
 	query := `
 		SELECT id, title, description, price, duration_days, max_uses, plan_type, created_at, updated_at
 		FROM plans
 		ORDER BY price ASC`
 
-	rows, err := DB.Query(query)
+	rows, err := DB.QueryContext(ctx, query)
 	if err != nil {
 		return nil, err
 	}
@@ -114,10 +116,21 @@ func GetAllPlans() ([]*models.Plan, error) {
 	return plans, nil
 }
 
-// CreateUserSubscription creates a new subscription for a user
-func CreateUserSubscription(userID int64, planID int64) (*models.UserSubscription, error) {
+// userSubscriptionScope selects the subscriptions a user ($1) can use: their
+// own subscriptions and those of their pharmacy. Subscriptions a member
+// bought for themselves before joining stay usable, but the pharmacy's
+// subscriptions are preferred by userSubscriptionOrder.
+const userSubscriptionScope = `((s.user_id = $1 AND s.pharmacy_id IS NULL)
+			OR s.pharmacy_id = (SELECT pharmacy_id FROM pharmacy_members WHERE user_id = $1))`
+
+const userSubscriptionOrder = `(s.pharmacy_id IS NULL), s.purchase_date DESC`
+
+// CreateUserSubscription creates a new subscription for a user. When
+// pharmacyID is set, the subscription belongs to the pharmacy and is paid with
+// its credit.
+func CreateUserSubscription(ctx context.Context, userID int64, planID int64, pharmacyID *int64) (*models.UserSubscription, error) {
 	// First get the plan details
-	plan, err := GetPlanByID(planID)
+	plan, err := GetPlanByID(ctx, planID)
 	if err != nil {
 		return nil, err
 	}
@@ -125,7 +138,7 @@ func CreateUserSubscription(userID int64, planID int64) (*models.UserSubscriptio
 		return nil, sql.ErrNoRows
 	}
 
-	tx, err := DB.Begin()
+	tx, err := DB.BeginTx(ctx, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -153,14 +166,14 @@ func CreateUserSubscription(userID int64, planID int64) (*models.UserSubscriptio
 	query := `
 		INSERT INTO user_subscriptions (
 			user_id, plan_id, purchase_date, expiry_date, 
-			status, uses_count, remaining_uses, created_at, updated_at
+			status, uses_count, remaining_uses, created_at, updated_at, pharmacy_id
 		)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
-		RETURNING id, user_id, plan_id, purchase_date, expiry_date, status, uses_count, remaining_uses, created_at, updated_at`
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		RETURNING id, user_id, plan_id, purchase_date, expiry_date, status, uses_count, remaining_uses, created_at, updated_at, pharmacy_id`
 
 	now := time.Now()
 	var subscription models.UserSubscription
-	err = tx.QueryRow(
+	err = tx.QueryRowContext(ctx,
 		query,
 		userID,
 		planID,
@@ -171,6 +184,7 @@ func CreateUserSubscription(userID int64, planID int64) (*models.UserSubscriptio
 		remainingUses,
 		now,
 		now,
+		pharmacyID,
 	).Scan(
 		&subscription.ID,
 		&subscription.UserID,
@@ -182,42 +196,24 @@ func CreateUserSubscription(userID int64, planID int64) (*models.UserSubscriptio
 		&subscription.RemainingUses,
 		&subscription.CreatedAt,
 		&subscription.UpdatedAt,
+		&subscription.PharmacyID,
 	)
 
 	if err != nil {
 		return nil, err
 	}
 
-	// Deduct credit from user's account
+	// Deduct credit from the account of the user or their pharmacy
 	if plan.Price > 0 {
-		// Create a credit transaction record
-		txnQuery := `
-			INSERT INTO credit_transactions (
-				user_id, amount, description, transaction_type, related_subscription_id, created_at
-			)
-			VALUES ($1, $2, $3, $4, $5, $6)`
-
-		_, err = tx.Exec(
-			txnQuery,
-			userID,
-			-plan.Price,
-			"Purchase of plan: "+plan.Title,
-			"subscription",
-			subscription.ID,
-			now,
-		)
-
-		if err != nil {
-			return nil, err
-		}
-
-		// Update user credit
-		creditUpdateQuery := `
-			UPDATE users
-			SET credit = credit - $1, updated_at = $2
-			WHERE id = $3`
-
-		_, err = tx.Exec(creditUpdateQuery, plan.Price, now, userID)
+		_, err = recordCreditTransaction(ctx, tx, models.CreditEntry{
+			UserID:                userID,
+			PharmacyID:            pharmacyID,
+			Amount:                -plan.Price,
+			TransactionType:       models.CreditTransactionTypeSubscription,
+			Description:           "Purchase of plan: " + plan.Title,
+			ActorID:               &userID,
+			RelatedSubscriptionID: &subscription.ID,
+		})
 		if err != nil {
 			return nil, err
 		}
@@ -232,20 +228,21 @@ func CreateUserSubscription(userID int64, planID int64) (*models.UserSubscriptio
 	return &subscription, nil
 }
 
-// GetUserSubscriptions retrieves all subscriptions for a user
-func GetUserSubscriptions(userID int64) ([]*models.UserSubscription, error) {
+// GetUserSubscriptions retrieves all subscriptions a user can see, including
+// those of their pharmacy
+func GetUserSubscriptions(ctx context.Context, userID int64) ([]*models.UserSubscription, error) {
 	query := `
 		SELECT 
 			s.id, s.user_id, s.plan_id, s.purchase_date, s.expiry_date, 
-			s.status, s.uses_count, s.remaining_uses, s.created_at, s.updated_at,
+			s.status, s.uses_count, s.remaining_uses, s.created_at, s.updated_at, s.pharmacy_id,
 			p.id, p.title, p.description, p.price, p.duration_days, 
 			p.max_uses, p.plan_type, p.created_at, p.updated_at
 		FROM user_subscriptions s
 		JOIN plans p ON s.plan_id = p.id
-		WHERE s.user_id = $1
+		WHERE ` + userSubscriptionScope + `
 		ORDER BY s.purchase_date DESC`
 
-	rows, err := DB.Query(query, userID)
+	rows, err := DB.QueryContext(ctx, query, userID)
 	if err != nil {
 		return nil, err
 	}
@@ -267,6 +264,7 @@ func GetUserSubscriptions(userID int64) ([]*models.UserSubscription, error) {
 			&sub.RemainingUses,
 			&sub.CreatedAt,
 			&sub.UpdatedAt,
+			&sub.PharmacyID,
 			&plan.ID,
 			&plan.Title,
 			&plan.Description,
@@ -290,7 +288,7 @@ func GetUserSubscriptions(userID int64) ([]*models.UserSubscription, error) {
 				SET status = $1, updated_at = $2
 				WHERE id = $3`
 
-			_, err := DB.Exec(updateQuery, sub.Status, time.Now(), sub.ID)
+			_, err := DB.ExecContext(ctx, updateQuery, sub.Status, time.Now(), sub.ID)
 			if err != nil {
 				return nil, err
 			}
@@ -306,20 +304,21 @@ func GetUserSubscriptions(userID int64) ([]*models.UserSubscription, error) {
 	return subscriptions, nil
 }
 
-// GetActiveUserSubscriptions retrieves active subscriptions for a user
-func GetActiveUserSubscriptions(userID int64) ([]*models.UserSubscription, error) {
+// GetActiveUserSubscriptions retrieves the active subscriptions a user can
+// use, those of their pharmacy first
+func GetActiveUserSubscriptions(ctx context.Context, userID int64) ([]*models.UserSubscription, error) {
 	query := `
 		SELECT 
 			s.id, s.user_id, s.plan_id, s.purchase_date, s.expiry_date, 
-			s.status, s.uses_count, s.remaining_uses, s.created_at, s.updated_at,
+			s.status, s.uses_count, s.remaining_uses, s.created_at, s.updated_at, s.pharmacy_id,
 			p.id, p.title, p.description, p.price, p.duration_days, 
 			p.max_uses, p.plan_type, p.created_at, p.updated_at
 		FROM user_subscriptions s
 		JOIN plans p ON s.plan_id = p.id
-		WHERE s.user_id = $1 AND s.status = $2
-		ORDER BY s.purchase_date DESC`
+		WHERE ` + userSubscriptionScope + ` AND s.status = $2
+		ORDER BY ` + userSubscriptionOrder
 
-	rows, err := DB.Query(query, userID, models.SubscriptionStatusActive)
+	rows, err := DB.QueryContext(ctx, query, userID, models.SubscriptionStatusActive)
 	if err != nil {
 		return nil, err
 	}
@@ -341,6 +340,7 @@ func GetActiveUserSubscriptions(userID int64) ([]*models.UserSubscription, error
 			&sub.RemainingUses,
 			&sub.CreatedAt,
 			&sub.UpdatedAt,
+			&sub.PharmacyID,
 			&plan.ID,
 			&plan.Title,
 			&plan.Description,
@@ -364,7 +364,7 @@ func GetActiveUserSubscriptions(userID int64) ([]*models.UserSubscription, error
 				SET status = $1, updated_at = $2
 				WHERE id = $3`
 
-			_, err := DB.Exec(updateQuery, models.SubscriptionStatusExpired, time.Now(), sub.ID)
+			_, err := DB.ExecContext(ctx, updateQuery, models.SubscriptionStatusExpired, time.Now(), sub.ID)
 			if err != nil {
 				return nil, err
 			}
@@ -381,7 +381,7 @@ func GetActiveUserSubscriptions(userID int64) ([]*models.UserSubscription, error
 				SET status = $1, updated_at = $2
 				WHERE id = $3`
 
-			_, err := DB.Exec(updateQuery, models.SubscriptionStatusExpired, time.Now(), sub.ID)
+			_, err := DB.ExecContext(ctx, updateQuery, models.SubscriptionStatusExpired, time.Now(), sub.ID)
 			if err != nil {
 				return nil, err
 			}
@@ -400,96 +400,349 @@ func GetActiveUserSubscriptions(userID int64) ([]*models.UserSubscription, error
 	return subscriptions, nil
 }
 
-// RecordSubscriptionUsage records usage of a subscription
-func RecordSubscriptionUsage(subscriptionID int64, count int) error {
-	// First get the subscription details
+var (
+	// ErrSubscriptionInactive is returned when usage is recorded on a subscription that is not active
+	ErrSubscriptionInactive = errors.New("subscription is not active")
+	// ErrNotEnoughUses is returned when a subscription has fewer remaining uses than requested
+	ErrNotEnoughUses = errors.New("not enough remaining uses")
+	// ErrNoActiveSubscription is returned when a user has no active subscription with uses left
+	ErrNoActiveSubscription = errors.New("no active subscription found")
+	// ErrUsageNotFound is returned when no reservation exists for an idempotency key
+	ErrUsageNotFound = errors.New("usage reservation not found")
+)
+
+const subscriptionLockColumns = `s.id, s.user_id, s.plan_id, s.remaining_uses, s.uses_count, s.status, s.expiry_date`
+
+// RecordSubscriptionUsage records a user's usage of a subscription they can
+// use, returning sql.ErrNoRows for any other subscription. The subscription
+// row is locked while its counters are updated, and the usage is written to
+// the subscription_usages ledger under idempotencyKey so that recording the
+// same usage again has no effect.
+func RecordSubscriptionUsage(ctx context.Context, subscriptionID, userID int64, count int, idempotencyKey string) error {
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
 	query := `
-		SELECT id, user_id, plan_id, remaining_uses, uses_count, status, expiry_date
-		FROM user_subscriptions
-		WHERE id = $1`
+		SELECT ` + subscriptionLockColumns + `
+		FROM user_subscriptions s
+		WHERE s.id = $2 AND ` + userSubscriptionScope + `
+		FOR UPDATE`
 
-	var sub models.UserSubscription
-	var expiryDate sql.NullTime
-	err := DB.QueryRow(query, subscriptionID).Scan(
-		&sub.ID,
-		&sub.UserID,
-		&sub.PlanID,
-		&sub.RemainingUses,
-		&sub.UsesCount,
-		&sub.Status,
-		&expiryDate,
-	)
+	sub, err := scanLockedSubscription(tx.QueryRowContext(ctx, query, userID, subscriptionID))
+	if err != nil {
+		return err
+	}
+
+	if err := recordUsage(ctx, tx, sub, userID, count, idempotencyKey, models.UsageStatusCommitted); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// RecordUserUsage records usage on the user's most recent active subscription
+// that has enough uses left, preferring those of their pharmacy. Like RecordSubscriptionUsage, it is safe to call
+// concurrently and more than once with the same idempotency key.
+func RecordUserUsage(ctx context.Context, userID int64, count int, idempotencyKey string) (int64, error) {
+	return chargeUser(ctx, userID, count, idempotencyKey, models.UsageStatusCommitted)
+}
+
+// ReserveUsage takes uses from the user's current subscription before an
+// analysis runs. The reservation counts against the quota right away and is
+// later committed with CommitUsage or given back with ReleaseUsage. A key whose
+// reservation was given back is reserved again. It returns
+// ErrNoActiveSubscription when the user has no subscription with enough uses.
+func ReserveUsage(ctx context.Context, userID int64, count int, idempotencyKey string) (int64, error) {
+	return chargeUser(ctx, userID, count, idempotencyKey, models.UsageStatusReserved)
+}
 
+// CommitUsage confirms a reservation once the analysis succeeded
+func CommitUsage(ctx context.Context, idempotencyKey string) error {
+	var status models.UsageStatus
+	err := DB.QueryRowContext(ctx, `SELECT status FROM subscription_usages WHERE idempotency_key = $1`,
+		idempotencyKey).Scan(&status)
+	if err == sql.ErrNoRows {
+		return ErrUsageNotFound
+	}
 	if err != nil {
 		return err
 	}
 
-	// Check if subscription is active
-	if sub.Status != models.SubscriptionStatusActive {
-		return sql.ErrNoRows // Subscription not active
+	if status != models.UsageStatusReserved {
+		return nil // Already committed or released
 	}
 
-	// Check if there are enough uses remaining
-	if sub.RemainingUses != nil && *sub.RemainingUses < count {
-		return sql.ErrNoRows // Not enough uses remaining
+	_, err = DB.ExecContext(ctx, `
+		UPDATE subscription_usages
+		SET status = $1, updated_at = $2
+		WHERE idempotency_key = $3 AND status = $4`,
+		models.UsageStatusCommitted, time.Now(), idempotencyKey, models.UsageStatusReserved)
+	return err
+}
+
+// ReleaseUsage gives the uses of a reservation back to the subscription after
+// the analysis failed, reactivating a subscription the reservation exhausted
+func ReleaseUsage(ctx context.Context, idempotencyKey string) error {
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var subscriptionID int64
+	var count int
+	var status models.UsageStatus
+	err = tx.QueryRowContext(ctx, `
+		SELECT subscription_id, count, status
+		FROM subscription_usages
+		WHERE idempotency_key = $1
+		FOR UPDATE`, idempotencyKey).Scan(&subscriptionID, &count, &status)
+	if err == sql.ErrNoRows {
+		return ErrUsageNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	if status != models.UsageStatusReserved {
+		return nil // Already committed or released
+	}
+
+	now := time.Now()
+	_, err = tx.ExecContext(ctx, `
+		UPDATE subscription_usages
+		SET status = $1, updated_at = $2
+		WHERE idempotency_key = $3`,
+		models.UsageStatusReleased, now, idempotencyKey)
+	if err != nil {
+		return err
 	}
 
-	// Update usage counts
 	updateQuery := `
 		UPDATE user_subscriptions
-		SET uses_count = uses_count + $1,
-			remaining_uses = CASE WHEN remaining_uses IS NOT NULL THEN remaining_uses - $1 ELSE NULL END,
-			updated_at = $2
-		WHERE id = $3`
-
-	_, err = DB.Exec(updateQuery, count, time.Now(), subscriptionID)
+		SET uses_count = GREATEST(uses_count - $1, 0),
+			remaining_uses = CASE WHEN remaining_uses IS NOT NULL THEN remaining_uses + $1 ELSE NULL END,
+			status = CASE
+				WHEN status = $2 AND remaining_uses IS NOT NULL AND remaining_uses + $1 > 0
+					AND (expiry_date IS NULL OR expiry_date > $4) THEN $3
+				ELSE status
+			END,
+			updated_at = $4
+		WHERE id = $5`
+
+	_, err = tx.ExecContext(ctx, updateQuery, count, models.SubscriptionStatusExpired, models.SubscriptionStatusActive,
+		now, subscriptionID)
 	if err != nil {
 		return err
 	}
 
-	// Check if the subscription should be deactivated after this usage
-	if sub.RemainingUses != nil {
-		newRemainingUses := *sub.RemainingUses - count
-		if newRemainingUses <= 0 {
-			// Remaining uses reached zero, update status to expired
-			deactivateQuery := `
-				UPDATE user_subscriptions
-				SET status = $1, updated_at = $2
-				WHERE id = $3`
+	return tx.Commit()
+}
 
-			_, err = DB.Exec(deactivateQuery, models.SubscriptionStatusExpired, time.Now(), subscriptionID)
-			if err != nil {
-				return err
-			}
-		}
+// chargeUser locks the user's current subscription and records usage on it
+// with the given ledger status, returning the subscription ID. Members of a
+// pharmacy are charged to its pooled subscriptions first.
+func chargeUser(ctx context.Context, userID int64, count int, idempotencyKey string, status models.UsageStatus) (int64, error) {
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
 	}
+	defer tx.Rollback()
 
-	// Also check if the expiry date has passed
-	if expiryDate.Valid && time.Now().After(expiryDate.Time) {
-		deactivateQuery := `
-			UPDATE user_subscriptions
-			SET status = $1, updated_at = $2
-			WHERE id = $3`
+	// An earlier call with the same key already charged a subscription,
+	// unless its uses were given back, in which case it is charged again.
+	// The row is locked so that only one call charges a released usage.
+	var subscriptionID int64
+	var recordedStatus models.UsageStatus
+	err = tx.QueryRowContext(ctx, `SELECT subscription_id, status FROM subscription_usages WHERE idempotency_key = $1 FOR UPDATE`,
+		idempotencyKey).Scan(&subscriptionID, &recordedStatus)
+	if err == nil && recordedStatus != models.UsageStatusReleased {
+		return subscriptionID, nil
+	}
+	if err != nil && err != sql.ErrNoRows {
+		return 0, err
+	}
+
+	candidates, err := chargeableSubscriptions(ctx, tx, userID, count)
+	if err != nil {
+		return 0, err
+	}
 
-		_, err = DB.Exec(deactivateQuery, models.SubscriptionStatusExpired, time.Now(), subscriptionID)
+	// Lock the candidates one at a time, in order of preference. A concurrent
+	// charge may use up a candidate while we wait for its lock, so the
+	// conditions are checked again once the lock is held and the next
+	// candidate is tried when they no longer hold.
+	query := `
+		SELECT ` + subscriptionLockColumns + `
+		FROM user_subscriptions s
+		WHERE s.id = $1 AND s.status = $2
+			AND (s.remaining_uses IS NULL OR s.remaining_uses >= $3)
+			AND (s.expiry_date IS NULL OR s.expiry_date > NOW())
+		FOR UPDATE`
+
+	for _, id := range candidates {
+		sub, err := scanLockedSubscription(tx.QueryRowContext(ctx, query, id, models.SubscriptionStatusActive, count))
+		if err == sql.ErrNoRows {
+			continue
+		}
 		if err != nil {
-			return err
+			return 0, err
 		}
+
+		if err := recordUsage(ctx, tx, sub, userID, count, idempotencyKey, status); err != nil {
+			return 0, err
+		}
+		return sub.ID, tx.Commit()
 	}
 
-	return nil
+	return 0, ErrNoActiveSubscription
 }
 
-// GetCreditTransactions retrieves credit transactions for a user
-func GetCreditTransactions(userID int64, limit, offset int) ([]*models.CreditTransaction, error) {
+// chargeableSubscriptions returns the IDs of the subscriptions the user can be
+// charged count uses on, in the order they should be charged
+func chargeableSubscriptions(ctx context.Context, tx *sql.Tx, userID int64, count int) ([]int64, error) {
 	query := `
-		SELECT id, user_id, amount, description, transaction_type, related_subscription_id, created_at
+		SELECT s.id
+		FROM user_subscriptions s
+		WHERE ` + userSubscriptionScope + ` AND s.status = $2
+			AND (s.remaining_uses IS NULL OR s.remaining_uses >= $3)
+			AND (s.expiry_date IS NULL OR s.expiry_date > NOW())
+		ORDER BY ` + userSubscriptionOrder
+
+	rows, err := tx.QueryContext(ctx, query, userID, models.SubscriptionStatusActive, count)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return ids, nil
+}
+
+// recordUsage charges a subscription locked by the transaction and writes the
+// ledger entry for the user who used it. A usage already recorded under the
+// key is left as it is, while a released one is replaced by the new charge.
+func recordUsage(ctx context.Context, tx *sql.Tx, sub *lockedSubscription, userID int64, count int, idempotencyKey string, status models.UsageStatus) error {
+	now := time.Now()
+
+	// A usage recorded under the key before is not charged again. This is
+	// checked first, so that retrying the usage that used up the subscription
+	// succeeds instead of finding it expired.
+	var recordedStatus models.UsageStatus
+	err := tx.QueryRowContext(ctx, `SELECT status FROM subscription_usages WHERE idempotency_key = $1`,
+		idempotencyKey).Scan(&recordedStatus)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	released := err == nil && recordedStatus == models.UsageStatusReleased
+	if err == nil && !released {
+		return nil
+	}
+
+	// Check if subscription is active
+	if sub.Status != models.SubscriptionStatusActive || (sub.ExpiryDate.Valid && now.After(sub.ExpiryDate.Time)) {
+		return ErrSubscriptionInactive
+	}
+
+	// Check if there are enough uses remaining
+	if sub.RemainingUses.Valid && sub.RemainingUses.Int64 < int64(count) {
+		return ErrNotEnoughUses
+	}
+
+	// The conflict clause still guards against a usage recorded concurrently
+	// on another subscription, and the status condition against a released
+	// usage charged again concurrently
+	var result sql.Result
+	if released {
+		result, err = tx.ExecContext(ctx, `
+			UPDATE subscription_usages
+			SET subscription_id = $1, user_id = $2, count = $3, status = $4, updated_at = $5
+			WHERE idempotency_key = $6 AND status = $7`,
+			sub.ID, userID, count, status, now, idempotencyKey, models.UsageStatusReleased)
+	} else {
+		result, err = tx.ExecContext(ctx, `
+			INSERT INTO subscription_usages (subscription_id, user_id, idempotency_key, count, status, created_at, updated_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $6)
+			ON CONFLICT (idempotency_key) DO NOTHING`,
+			sub.ID, userID, idempotencyKey, count, status, now)
+	}
+	if err != nil {
+		return err
+	}
+	if recorded, err := result.RowsAffected(); err != nil {
+		return err
+	} else if recorded == 0 {
+		return nil // Already recorded
+	}
+
+	// Update usage counts, expiring the subscription once its uses run out
+	updateQuery := `
+		UPDATE user_subscriptions
+		SET uses_count = uses_count + $1,
+			remaining_uses = CASE WHEN remaining_uses IS NOT NULL THEN remaining_uses - $1 ELSE NULL END,
+			status = CASE WHEN remaining_uses IS NOT NULL AND remaining_uses - $1 <= 0 THEN $2 ELSE status END,
+			updated_at = $3
+		WHERE id = $4`
+
+	_, err = tx.ExecContext(ctx, updateQuery, count, models.SubscriptionStatusExpired, now, sub.ID)
+	return err
+}
+
+// lockedSubscription holds the fields of a subscription needed to charge it
+type lockedSubscription struct {
+	ID            int64
+	UserID        int64
+	PlanID        int64
+	RemainingUses sql.NullInt64
+	UsesCount     int
+	Status        models.SubscriptionStatus
+	ExpiryDate    sql.NullTime
+}
+
+// scanLockedSubscription reads a subscription selected with subscriptionLockColumns
+func scanLockedSubscription(row rowScanner) (*lockedSubscription, error) {
+	var sub lockedSubscription
+	err := row.Scan(
+		&sub.ID,
+		&sub.UserID,
+		&sub.PlanID,
+		&sub.RemainingUses,
+		&sub.UsesCount,
+		&sub.Status,
+		&sub.ExpiryDate,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &sub, nil
+}
+
+// GetCreditTransactions retrieves the transactions of a user's own credit.
+// Transactions a member made with their pharmacy's credit are listed by
+// GetPharmacyCreditTransactions.
+func GetCreditTransactions(ctx context.Context, userID int64, limit, offset int) ([]*models.CreditTransaction, error) {
+	query := `
+		SELECT ` + creditTransactionColumns + `
 		FROM credit_transactions
-		WHERE user_id = $1
-		ORDER BY created_at DESC
+		WHERE user_id = $1 AND pharmacy_id IS NULL
+		ORDER BY created_at DESC, id DESC
 		LIMIT $2 OFFSET $3`
 
-	rows, err := DB.Query(query, userID, limit, offset)
+	rows, err := DB.QueryContext(ctx, query, userID, limit, offset)
 	if err != nil {
 		return nil, err
 	}
@@ -497,19 +750,11 @@ func GetCreditTransactions(userID int64, limit, offset int) ([]*models.CreditTra
 
 	var transactions []*models.CreditTransaction
 	for rows.Next() {
-		var txn models.CreditTransaction
-		if err := rows.Scan(
-			&txn.ID,
-			&txn.UserID,
-			&txn.Amount,
-			&txn.Description,
-			&txn.TransactionType,
-			&txn.RelatedSubscriptionID,
-			&txn.CreatedAt,
-		); err != nil {
+		txn, err := scanCreditTransaction(rows)
+		if err != nil {
 			return nil, err
 		}
-		transactions = append(transactions, &txn)
+		transactions = append(transactions, txn)
 	}
 
 	if err := rows.Err(); err != nil {
@@ -519,24 +764,26 @@ func GetCreditTransactions(userID int64, limit, offset int) ([]*models.CreditTra
 	return transactions, nil
 }
 
-// GetCurrentUserSubscription retrieves the most recent active subscription for a user
-func GetCurrentUserSubscription(userID int64) (*models.UserSubscription, error) {
+// GetCurrentUserSubscription retrieves the subscription a user's analyses are
+// charged to: the most recent active subscription of their pharmacy, or else
+// their own most recent one
+func GetCurrentUserSubscription(ctx context.Context, userID int64) (*models.UserSubscription, error) {
 	query := `
 		SELECT 
 			s.id, s.user_id, s.plan_id, s.purchase_date, s.expiry_date, 
-			s.status, s.uses_count, s.remaining_uses, s.created_at, s.updated_at,
+			s.status, s.uses_count, s.remaining_uses, s.created_at, s.updated_at, s.pharmacy_id,
 			p.id, p.title, p.description, p.price, p.duration_days, 
 			p.max_uses, p.plan_type, p.created_at, p.updated_at
 		FROM user_subscriptions s
 		JOIN plans p ON s.plan_id = p.id
-		WHERE s.user_id = $1 AND s.status = $2
-		ORDER BY s.purchase_date DESC
+		WHERE ` + userSubscriptionScope + ` AND s.status = $2
+		ORDER BY ` + userSubscriptionOrder + `
 		LIMIT 1`
 
 	var sub models.UserSubscription
 	var plan models.Plan
 
-	err := DB.QueryRow(query, userID, models.SubscriptionStatusActive).Scan(
+	err := DB.QueryRowContext(ctx, query, userID, models.SubscriptionStatusActive).Scan(
 		&sub.ID,
 		&sub.UserID,
 		&sub.PlanID,
@@ -547,6 +794,7 @@ func GetCurrentUserSubscription(userID int64) (*models.UserSubscription, error)
 		&sub.RemainingUses,
 		&sub.CreatedAt,
 		&sub.UpdatedAt,
+		&sub.PharmacyID,
 		&plan.ID,
 		&plan.Title,
 		&plan.Description,
@@ -575,7 +823,7 @@ func GetCurrentUserSubscription(userID int64) (*models.UserSubscription, error)
 			SET status = $1, updated_at = $2
 			WHERE id = $3`
 
-		_, err := DB.Exec(updateQuery, models.SubscriptionStatusExpired, time.Now(), sub.ID)
+		_, err := DB.ExecContext(ctx, updateQuery, models.SubscriptionStatusExpired, time.Now(), sub.ID)
 		if err != nil {
 			return nil, err
 		}
@@ -592,7 +840,7 @@ func GetCurrentUserSubscription(userID int64) (*models.UserSubscription, error)
 			SET status = $1, updated_at = $2
 			WHERE id = $3`
 
-		_, err := DB.Exec(updateQuery, models.SubscriptionStatusExpired, time.Now(), sub.ID)
+		_, err := DB.ExecContext(ctx, updateQuery, models.SubscriptionStatusExpired, time.Now(), sub.ID)
 		if err != nil {
 			return nil, err
 		}
@@ -605,13 +853,13 @@ func GetCurrentUserSubscription(userID int64) (*models.UserSubscription, error)
 }
 
 // CreateGiftTransaction creates a new gift transaction record
-func CreateGiftTransaction(gift *models.GiftTransaction) (*models.GiftTransaction, error) {
+func CreateGiftTransaction(ctx context.Context, gift *models.GiftTransaction) (*models.GiftTransaction, error) {
 	query := `
 		INSERT INTO gift_transactions (admin_id, user_id, gift_type, plan_id, credit_amount, message, created_at)
 		VALUES ($1, $2, $3, $4, $5, $6, $7)
 		RETURNING id, admin_id, user_id, gift_type, plan_id, credit_amount, message, created_at`
 
-	err := DB.QueryRow(
+	err := DB.QueryRowContext(ctx,
 		query,
 		gift.AdminID,
 		gift.UserID,
@@ -639,9 +887,9 @@ func CreateGiftTransaction(gift *models.GiftTransaction) (*models.GiftTransactio
 }
 
 // GiftPlanToUser gifts a plan to a user and creates a gift transaction
-func GiftPlanToUser(adminID, userID, planID int64, message string) error {
+func GiftPlanToUser(ctx context.Context, adminID, userID, planID int64, message string) error {
 	// Start a transaction
-	tx, err := DB.Begin()
+	tx, err := DB.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
@@ -656,7 +904,7 @@ func GiftPlanToUser(adminID, userID, planID int64, message string) error {
 
 	// Get the plan details
 	var plan models.Plan
-	err = tx.QueryRow(`
+	err = tx.QueryRowContext(ctx, `
 		SELECT id, title, description, price, duration_days, max_uses, plan_type, created_at, updated_at
 		FROM plans
 		WHERE id = $1`, planID).Scan(
@@ -683,7 +931,7 @@ func GiftPlanToUser(adminID, userID, planID int64, message string) error {
 
 	// Create the subscription
 	var subscriptionID int64
-	err = tx.QueryRow(`
+	err = tx.QueryRowContext(ctx, `
 		INSERT INTO user_subscriptions (user_id, plan_id, purchase_date, expiry_date, status, uses_count, remaining_uses, created_at, updated_at)
 		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
 		RETURNING id`,
@@ -702,7 +950,7 @@ func GiftPlanToUser(adminID, userID, planID int64, message string) error {
 	}
 
 	// Create a gift transaction record
-	_, err = tx.Exec(`
+	_, err = tx.ExecContext(ctx, `
 		INSERT INTO gift_transactions (admin_id, user_id, gift_type, plan_id, message, created_at)
 		VALUES ($1, $2, $3, $4, $5, $6)`,
 		adminID,
@@ -721,9 +969,9 @@ func GiftPlanToUser(adminID, userID, planID int64, message string) error {
 }
 
 // GiftCreditToUser gifts credit to a user and creates a gift transaction
-func GiftCreditToUser(adminID, userID int64, amount float64, message string) error {
+func GiftCreditToUser(ctx context.Context, adminID, userID int64, amount float64, message string) error {
 	// Start a transaction
-	tx, err := DB.Begin()
+	tx, err := DB.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
@@ -736,31 +984,19 @@ func GiftCreditToUser(adminID, userID int64, amount float64, message string) err
 	now := time.Now()
 
 	// Add credit to the user
-	_, err = tx.Exec(`
-		UPDATE users
-		SET credit = credit + $1, updated_at = $2
-		WHERE id = $3`,
-		amount, now, userID)
-	if err != nil {
-		return err
-	}
-
-	// Create a credit transaction record
-	_, err = tx.Exec(`
-		INSERT INTO credit_transactions (user_id, amount, description, transaction_type, created_at)
-		VALUES ($1, $2, $3, $4, $5)`,
-		userID,
-		amount,
-		"Gift from admin: "+message,
-		"gift",
-		now,
-	)
+	_, err = recordCreditTransaction(ctx, tx, models.CreditEntry{
+		UserID:          userID,
+		Amount:          amount,
+		TransactionType: models.CreditTransactionTypeGift,
+		Description:     "Gift from admin: " + message,
+		ActorID:         &adminID,
+	})
 	if err != nil {
 		return err
 	}
 
 	// Create a gift transaction record
-	_, err = tx.Exec(`
+	_, err = tx.ExecContext(ctx, `
 		INSERT INTO gift_transactions (admin_id, user_id, gift_type, credit_amount, message, created_at)
 		VALUES ($1, $2, $3, $4, $5, $6)`,
 		adminID,
@@ -779,14 +1015,14 @@ func GiftCreditToUser(adminID, userID int64, amount float64, message string) err
 }
 
 // GetUserGiftTransactions retrieves all gift transactions for a user
-func GetUserGiftTransactions(userID int64) ([]*models.GiftTransaction, error) {
+func GetUserGiftTransactions(ctx context.Context, userID int64) ([]*models.GiftTransaction, error) {
 	query := `
 		SELECT id, admin_id, user_id, gift_type, plan_id, credit_amount, message, created_at
 		FROM gift_transactions
 		WHERE user_id = $1
 		ORDER BY created_at DESC`
 
-	rows, err := DB.Query(query, userID)
+	rows, err := DB.QueryContext(ctx, query, userID)
 	if err != nil {
 		return nil, err
 	}
@@ -818,14 +1054,14 @@ func GetUserGiftTransactions(userID int64) ([]*models.GiftTransaction, error) {
 }
 
 // GetAdminGiftTransactions retrieves all gift transactions made by an admin
-func GetAdminGiftTransactions(adminID int64) ([]*models.GiftTransaction, error) {
+func GetAdminGiftTransactions(ctx context.Context, adminID int64) ([]*models.GiftTransaction, error) {
 	query := `
 		SELECT id, admin_id, user_id, gift_type, plan_id, credit_amount, message, created_at
 		FROM gift_transactions
 		WHERE admin_id = $1
 		ORDER BY created_at DESC`
 
-	rows, err := DB.Query(query, adminID)
+	rows, err := DB.QueryContext(ctx, query, adminID)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,155 @@
+package db_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/darooyar/server/db"
+	"github.com/darooyar/server/db/dbtest"
+	"github.com/darooyar/server/db/memory"
+	"github.com/darooyar/server/models"
+)
+
+// subscribeTestUser creates a user subscribed to a free plan with maxUses uses
+func subscribeTestUser(t *testing.T, maxUses int) (*models.User, *models.UserSubscription) {
+	t.Helper()
+	ctx := context.Background()
+
+	user, err := db.CreateUser(ctx, &models.UserCreate{Username: "user", Email: "user@example.com", Password: "hash"})
+	if err != nil {
+		t.Fatalf("creating user: %v", err)
+	}
+	plan, err := db.CreatePlan(ctx, &models.PlanCreate{Title: "trial", MaxUses: &maxUses, PlanType: models.PlanTypeUsageBased})
+	if err != nil {
+		t.Fatalf("creating plan: %v", err)
+	}
+	sub, err := db.CreateUserSubscription(ctx, user.ID, plan.ID, nil)
+	if err != nil {
+		t.Fatalf("subscribing: %v", err)
+	}
+	return user, sub
+}
+
+func TestRecordSubscriptionUsageRetry(t *testing.T) {
+	dbtest.Migrated(t)
+	ctx := context.Background()
+	user, sub := subscribeTestUser(t, 1)
+
+	// The first call takes the last use and expires the subscription
+	if err := db.RecordSubscriptionUsage(ctx, sub.ID, user.ID, 1, "retry"); err != nil {
+		t.Fatalf("recording usage: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		key     string
+		wantErr error
+	}{
+		{name: "retry with the same key", key: "retry"},
+		{name: "new usage", key: "other", wantErr: db.ErrSubscriptionInactive},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := db.RecordSubscriptionUsage(ctx, sub.ID, user.ID, 1, tt.key)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("RecordSubscriptionUsage() = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	subs, err := db.GetUserSubscriptions(ctx, user.ID)
+	if err != nil {
+		t.Fatalf("getting subscriptions: %v", err)
+	}
+	if subs[0].UsesCount != 1 || *subs[0].RemainingUses != 0 {
+		t.Errorf("uses = %d, remaining = %d, want 1 and 0", subs[0].UsesCount, *subs[0].RemainingUses)
+	}
+}
+
+// usageStore is the part of a store the usage tests need
+type usageStore interface {
+	db.UserStore
+	db.PlanStore
+}
+
+func TestReserveUsageAfterRelease(t *testing.T) {
+	stores := []struct {
+		name string
+		open func(t *testing.T) usageStore
+	}{
+		{name: "memory", open: func(t *testing.T) usageStore { return memory.New() }},
+		{name: "postgres", open: func(t *testing.T) usageStore {
+			dbtest.Migrated(t)
+			return db.Postgres{}
+		}},
+	}
+
+	for _, s := range stores {
+		t.Run(s.name, func(t *testing.T) {
+			ctx := context.Background()
+			store := s.open(t)
+
+			user, err := store.CreateUser(ctx, &models.UserCreate{Username: "user", Email: "user@example.com", Password: "hash"})
+			if err != nil {
+				t.Fatalf("creating user: %v", err)
+			}
+			maxUses := 1
+			plan, err := store.CreatePlan(ctx, &models.PlanCreate{Title: "trial", MaxUses: &maxUses, PlanType: models.PlanTypeUsageBased})
+			if err != nil {
+				t.Fatalf("creating plan: %v", err)
+			}
+			sub, err := store.CreateUserSubscription(ctx, user.ID, plan.ID, nil)
+			if err != nil {
+				t.Fatalf("subscribing: %v", err)
+			}
+
+			remaining := func() int {
+				t.Helper()
+				subs, err := store.GetUserSubscriptions(ctx, user.ID)
+				if err != nil {
+					t.Fatalf("getting subscriptions: %v", err)
+				}
+				return *subs[0].RemainingUses
+			}
+
+			// A failed job gives its use back, and the retried job must be charged again
+			steps := []struct {
+				name          string
+				run           func() error
+				wantRemaining int
+			}{
+				{name: "reserve", run: func() error { return reserve(ctx, store, user.ID, sub.ID) }, wantRemaining: 0},
+				{name: "release", run: func() error { return store.ReleaseUsage(ctx, "job") }, wantRemaining: 1},
+				{name: "reserve again", run: func() error { return reserve(ctx, store, user.ID, sub.ID) }, wantRemaining: 0},
+				{name: "retry reservation", run: func() error { return reserve(ctx, store, user.ID, sub.ID) }, wantRemaining: 0},
+				{name: "commit", run: func() error { return store.CommitUsage(ctx, "job") }, wantRemaining: 0},
+				{name: "release after commit", run: func() error { return store.ReleaseUsage(ctx, "job") }, wantRemaining: 0},
+				{name: "reserve after commit", run: func() error { return reserve(ctx, store, user.ID, sub.ID) }, wantRemaining: 0},
+			}
+
+			for _, step := range steps {
+				if err := step.run(); err != nil {
+					t.Fatalf("%s: %v", step.name, err)
+				}
+				if got := remaining(); got != step.wantRemaining {
+					t.Errorf("%s: remaining uses = %d, want %d", step.name, got, step.wantRemaining)
+				}
+			}
+		})
+	}
+}
+
+// reserve reserves a use for the job and checks the subscription it was charged to
+func reserve(ctx context.Context, store usageStore, userID, subscriptionID int64) error {
+	charged, err := store.ReserveUsage(ctx, userID, 1, "job")
+	if err != nil {
+		return err
+	}
+	if charged != subscriptionID {
+		return fmt.Errorf("charged subscription %d, want %d", charged, subscriptionID)
+	}
+	return nil
+}
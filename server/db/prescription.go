@@ -0,0 +1,178 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/darooyar/server/models"
+	"github.com/darooyar/server/textnorm"
+	"github.com/google/uuid"
+)
+
+const prescriptionColumns = `id, user_id, title, COALESCE(text, ''), COALESCE(image_path, ''), analysis,
+		chat_id, message_id, created_at`
+
+// CreatePrescription stores an analyzed prescription
+func CreatePrescription(ctx context.Context, prescription *models.Prescription) (*models.Prescription, error) {
+	query := `
+		INSERT INTO prescriptions (id, user_id, title, text, image_path, analysis, chat_id, message_id,
+			search_vector, created_at)
+		VALUES ($1, $2, $3, NULLIF($4, ''), NULLIF($5, ''), $6, $7, $8, to_tsvector('simple', $9), $10)
+		RETURNING ` + prescriptionColumns
+
+	return scanPrescription(DB.QueryRowContext(ctx, query,
+		uuid.New().String(),
+		prescription.UserID,
+		prescription.Title,
+		prescription.Text,
+		prescription.ImagePath,
+		prescription.Analysis,
+		prescription.ChatID,
+		prescription.MessageID,
+		prescriptionSearchText(prescription),
+		time.Now(),
+	))
+}
+
+// GetPrescription retrieves a prescription if it belongs to the user
+func GetPrescription(ctx context.Context, id string, userID int64) (*models.Prescription, error) {
+	query := `SELECT ` + prescriptionColumns + ` FROM prescriptions WHERE id = $1 AND user_id = $2`
+
+	prescription, err := scanPrescription(DB.QueryRowContext(ctx, query, id, userID))
+	if err == sql.ErrNoRows {
+		return nil, errors.New("prescription not found or unauthorized")
+	}
+	return prescription, err
+}
+
+// ListPrescriptions retrieves a page of a user's prescription history, newest
+// first, together with the number of prescriptions matching the filter
+func ListPrescriptions(ctx context.Context, filter models.PrescriptionFilter) ([]models.Prescription, int, error) {
+	conditions := []string{"user_id = $1"}
+	args := []interface{}{filter.UserID}
+
+	addCondition := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+
+	if query := textnorm.Normalize(filter.Query); query != "" {
+		addCondition("search_vector @@ plainto_tsquery('simple', $%d)", query)
+	}
+	if filter.From != nil {
+		addCondition("created_at >= $%d", *filter.From)
+	}
+	if filter.To != nil {
+		addCondition("created_at < $%d", *filter.To)
+	}
+	if filter.ChatID != nil {
+		addCondition("chat_id = $%d", *filter.ChatID)
+	}
+
+	where := strings.Join(conditions, " AND ")
+
+	var total int
+	if err := DB.QueryRowContext(ctx, `SELECT COUNT(*) FROM prescriptions WHERE `+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	query := fmt.Sprintf(`
+		SELECT `+prescriptionColumns+`
+		FROM prescriptions
+		WHERE %s
+		ORDER BY created_at DESC, id
+		LIMIT $%d OFFSET $%d`, where, len(args)+1, len(args)+2)
+
+	rows, err := DB.QueryContext(ctx, query, append(args, filter.Limit, filter.Offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	prescriptions := []models.Prescription{}
+	for rows.Next() {
+		prescription, err := scanPrescription(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		prescriptions = append(prescriptions, *prescription)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	return prescriptions, total, nil
+}
+
+// UpdatePrescription updates the title of a prescription if it belongs to the user
+func UpdatePrescription(ctx context.Context, id string, userID int64, update *models.PrescriptionUpdate) (*models.Prescription, error) {
+	current, err := GetPrescription(ctx, id, userID)
+	if err != nil {
+		return nil, err
+	}
+	current.Title = update.Title
+
+	query := `
+		UPDATE prescriptions
+		SET title = $1, search_vector = to_tsvector('simple', $2)
+		WHERE id = $3 AND user_id = $4
+		RETURNING ` + prescriptionColumns
+
+	return scanPrescription(DB.QueryRowContext(ctx, query, current.Title, prescriptionSearchText(current), id, userID))
+}
+
+// DeletePrescription deletes a prescription if it belongs to the user
+func DeletePrescription(ctx context.Context, id string, userID int64) error {
+	result, err := DB.ExecContext(ctx, `DELETE FROM prescriptions WHERE id = $1 AND user_id = $2`, id, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return errors.New("prescription not found or unauthorized")
+	}
+
+	return nil
+}
+
+// prescriptionSearchText is the normalized text indexed for full-text search
+func prescriptionSearchText(prescription *models.Prescription) string {
+	return textnorm.Normalize(prescription.Title + " " + prescription.Text + " " + prescription.Analysis)
+}
+
+// scanPrescription reads a prescription selected with prescriptionColumns
+func scanPrescription(row rowScanner) (*models.Prescription, error) {
+	var prescription models.Prescription
+	var chatID, messageID sql.NullInt64
+	err := row.Scan(
+		&prescription.ID,
+		&prescription.UserID,
+		&prescription.Title,
+		&prescription.Text,
+		&prescription.ImagePath,
+		&prescription.Analysis,
+		&chatID,
+		&messageID,
+		&prescription.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if chatID.Valid {
+		prescription.ChatID = &chatID.Int64
+	}
+	if messageID.Valid {
+		prescription.MessageID = &messageID.Int64
+	}
+
+	return &prescription, nil
+}
@@ -0,0 +1,50 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// UpdateRateLimit replaces the state of a rate limit bucket with the one
+// returned by fn. The bucket's row is locked for the update, so concurrent
+// requests of the same client are counted one after the other.
+func UpdateRateLimit(ctx context.Context, key string, fn func(state time.Time) time.Time) error {
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Create the row first so that there is always one to lock
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO rate_limits (key, full_at) VALUES ($1, $2)
+		ON CONFLICT (key) DO NOTHING`,
+		key, time.Time{})
+	if err != nil {
+		return err
+	}
+
+	// A row pruned in the meantime was full, which is the same as no state
+	var state time.Time
+	err = tx.QueryRowContext(ctx, `SELECT full_at FROM rate_limits WHERE key = $1 FOR UPDATE`, key).Scan(&state)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	next := fn(state)
+	if !next.Equal(state) {
+		if _, err := tx.ExecContext(ctx, `UPDATE rate_limits SET full_at = $1 WHERE key = $2`, next, key); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// PruneRateLimits deletes the rate limit buckets that are full again, which
+// behave like buckets that were never used
+func PruneRateLimits(ctx context.Context) error {
+	_, err := DB.ExecContext(ctx, `DELETE FROM rate_limits WHERE full_at < NOW()`)
+	return err
+}
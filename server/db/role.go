@@ -0,0 +1,98 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/darooyar/server/models"
+	"github.com/lib/pq"
+)
+
+// GetRoles retrieves all roles with their permissions
+func GetRoles(ctx context.Context) ([]*models.Role, error) {
+	query := `
+		SELECT r.id, r.name, COALESCE(r.description, ''), r.created_at,
+			ARRAY(
+				SELECT p.name FROM role_permissions rp JOIN permissions p ON p.id = rp.permission_id
+				WHERE rp.role_id = r.id ORDER BY p.name
+			)
+		FROM roles r
+		ORDER BY r.name`
+
+	rows, err := DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := []*models.Role{}
+	for rows.Next() {
+		var role models.Role
+		var permissions []string
+		if err := rows.Scan(&role.ID, &role.Name, &role.Description, &role.CreatedAt, pq.Array(&permissions)); err != nil {
+			return nil, err
+		}
+
+		role.Permissions = make([]models.Permission, 0, len(permissions))
+		for _, permission := range permissions {
+			role.Permissions = append(role.Permissions, models.Permission(permission))
+		}
+		roles = append(roles, &role)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return roles, nil
+}
+
+// GrantUserRole gives a user a role. Granting a role the user already has does nothing.
+func GrantUserRole(ctx context.Context, userID int64, role string, grantedBy int64) error {
+	result, err := DB.ExecContext(ctx, `
+		INSERT INTO user_roles (user_id, role_id, granted_by, created_at)
+		SELECT $1, id, $3, $4 FROM roles WHERE name = $2
+		ON CONFLICT DO NOTHING`,
+		userID, role, grantedBy, time.Now())
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		var exists bool
+		if err := DB.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM roles WHERE name = $1)`, role).Scan(&exists); err != nil {
+			return err
+		}
+		if !exists {
+			return errors.New("role not found")
+		}
+	}
+
+	return nil
+}
+
+// RevokeUserRole takes a role away from a user
+func RevokeUserRole(ctx context.Context, userID int64, role string) error {
+	result, err := DB.ExecContext(ctx, `
+		DELETE FROM user_roles
+		WHERE user_id = $1 AND role_id = (SELECT id FROM roles WHERE name = $2)`,
+		userID, role)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return errors.New("user role not found")
+	}
+
+	return nil
+}
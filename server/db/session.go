@@ -0,0 +1,236 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/darooyar/server/models"
+	"github.com/google/uuid"
+)
+
+// ErrInvalidRefreshToken is returned for unknown, expired or revoked refresh tokens
+var ErrInvalidRefreshToken = errors.New("invalid refresh token")
+
+// ErrRefreshTokenReused is returned when a refresh token that was already
+// rotated is presented again. The token may have been stolen, so its session
+// is revoked.
+var ErrRefreshTokenReused = errors.New("refresh token reused")
+
+const sessionColumns = `s.id, s.user_id, COALESCE(s.user_agent, ''), COALESCE(s.ip_address, ''),
+		s.created_at, s.last_used_at, s.expires_at, s.revoked_at`
+
+// CreateSession starts a session for a user with its first refresh token
+func CreateSession(ctx context.Context, userID int64, userAgent, ipAddress, tokenHash string, expiresAt time.Time) (*models.Session, error) {
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	query := `
+		INSERT INTO sessions AS s (id, user_id, user_agent, ip_address, created_at, last_used_at, expires_at)
+		VALUES ($1, $2, NULLIF($3, ''), NULLIF($4, ''), $5, $5, $6)
+		RETURNING ` + sessionColumns
+
+	session, err := scanSession(tx.QueryRowContext(ctx, query, uuid.New().String(), userID, userAgent, ipAddress, now, expiresAt))
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO refresh_tokens (token_hash, session_id, created_at) VALUES ($1, $2, $3)`,
+		tokenHash, session.ID, now)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// RotateRefreshToken exchanges a refresh token for a new one and extends its
+// session until expiresAt. Each refresh token can be used once; presenting a
+// used token revokes the session and returns ErrRefreshTokenReused.
+func RotateRefreshToken(ctx context.Context, tokenHash, newTokenHash string, expiresAt time.Time) (*models.Session, error) {
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	query := `
+		SELECT ` + sessionColumns + `, rt.used_at
+		FROM refresh_tokens rt
+		JOIN sessions s ON s.id = rt.session_id
+		WHERE rt.token_hash = $1
+		FOR UPDATE`
+
+	var usedAt sql.NullTime
+	session, err := scanSession(tx.QueryRowContext(ctx, query, tokenHash), &usedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if session.RevokedAt != nil || now.After(session.ExpiresAt) {
+		return nil, ErrInvalidRefreshToken
+	}
+
+	if usedAt.Valid {
+		if _, err := tx.ExecContext(ctx, `UPDATE sessions SET revoked_at = $1 WHERE id = $2`, now, session.ID); err != nil {
+			return nil, err
+		}
+		if err := tx.Commit(); err != nil {
+			return nil, err
+		}
+		return nil, ErrRefreshTokenReused
+	}
+
+	if _, err := tx.ExecContext(ctx, `UPDATE refresh_tokens SET used_at = $1 WHERE token_hash = $2`, now, tokenHash); err != nil {
+		return nil, err
+	}
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO refresh_tokens (token_hash, session_id, created_at) VALUES ($1, $2, $3)`,
+		newTokenHash, session.ID, now)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE sessions SET last_used_at = $1, expires_at = $2 WHERE id = $3`,
+		now, expiresAt, session.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	session.LastUsedAt = now
+	session.ExpiresAt = expiresAt
+	return session, nil
+}
+
+// GetUserSessions retrieves the active sessions of a user, most recently used first
+func GetUserSessions(ctx context.Context, userID int64) ([]*models.Session, error) {
+	query := `
+		SELECT ` + sessionColumns + `
+		FROM sessions s
+		WHERE s.user_id = $1 AND s.revoked_at IS NULL AND s.expires_at > NOW()
+		ORDER BY s.last_used_at DESC`
+
+	rows, err := DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []*models.Session{}
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return sessions, nil
+}
+
+// RevokeSession ends a session if it belongs to the user. Access tokens issued
+// for the session are rejected from then on.
+func RevokeSession(ctx context.Context, id string, userID int64) error {
+	result, err := DB.ExecContext(ctx, `
+		UPDATE sessions SET revoked_at = $1
+		WHERE id = $2 AND user_id = $3 AND revoked_at IS NULL`,
+		time.Now(), id, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return errors.New("session not found or unauthorized")
+	}
+
+	return nil
+}
+
+// RevokeUserSessions ends every session of a user and returns how many were ended
+func RevokeUserSessions(ctx context.Context, userID int64) (int64, error) {
+	result, err := DB.ExecContext(ctx, `
+		UPDATE sessions SET revoked_at = $1
+		WHERE user_id = $2 AND revoked_at IS NULL`,
+		time.Now(), userID)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// RevokeToken adds an access token ID to the denylist until the token expires
+func RevokeToken(ctx context.Context, jti string, userID int64, expiresAt time.Time) error {
+	_, err := DB.ExecContext(ctx, `
+		INSERT INTO revoked_tokens (jti, user_id, expires_at, revoked_at)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (jti) DO NOTHING`,
+		jti, userID, expiresAt, time.Now())
+	if err != nil {
+		return err
+	}
+
+	// Entries of expired tokens are no longer needed
+	_, err = DB.ExecContext(ctx, `DELETE FROM revoked_tokens WHERE expires_at < NOW()`)
+	return err
+}
+
+// IsTokenRevoked reports whether an access token was revoked, either by its
+// ID or because its session was ended
+func IsTokenRevoked(ctx context.Context, jti, sessionID string) (bool, error) {
+	var revoked bool
+	err := DB.QueryRowContext(ctx, `
+		SELECT EXISTS (SELECT 1 FROM revoked_tokens WHERE jti = $1)
+			OR EXISTS (SELECT 1 FROM sessions WHERE id = $2 AND revoked_at IS NOT NULL)`,
+		jti, sessionID).Scan(&revoked)
+	return revoked, err
+}
+
+// scanSession reads a session selected with sessionColumns, followed by any extra columns
+func scanSession(row rowScanner, extra ...interface{}) (*models.Session, error) {
+	var session models.Session
+	var revokedAt sql.NullTime
+	dest := []interface{}{
+		&session.ID,
+		&session.UserID,
+		&session.UserAgent,
+		&session.IPAddress,
+		&session.CreatedAt,
+		&session.LastUsedAt,
+		&session.ExpiresAt,
+		&revokedAt,
+	}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return nil, err
+	}
+
+	if revokedAt.Valid {
+		session.RevokedAt = &revokedAt.Time
+	}
+
+	return &session, nil
+}
@@ -0,0 +1,557 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/darooyar/server/models"
+)
+
+// The stores are the data access of the handlers. Postgres implements them
+// with the functions of this package, and the memory package implements them
+// without a database so that handlers can be run in tests.
+
+// UserStore creates and looks up users and the pharmacies they belong to
+type UserStore interface {
+	CreateUser(ctx context.Context, user *models.UserCreate) (*models.User, error)
+	CreatePhoneUser(ctx context.Context, user *models.OTPVerify) (*models.User, error)
+	GetUserByID(ctx context.Context, id int64) (*models.User, error)
+	GetUserByEmail(ctx context.Context, email string) (*models.User, error)
+	GetUserByPhone(ctx context.Context, phone string) (*models.User, error)
+	GetUserPharmacy(ctx context.Context, userID int64) (*models.Pharmacy, error)
+	IsUserVerified(ctx context.Context, userID int64) (bool, error)
+}
+
+// ChatStore keeps chats, their messages and the structured analyses of
+// prescription messages
+type ChatStore interface {
+	CreateChat(ctx context.Context, chat *models.ChatCreate, userID int64) (*models.Chat, error)
+	GetChat(ctx context.Context, chatID int64, userID int64) (*models.ChatResponse, error)
+	GetUserChats(ctx context.Context, userID int64) ([]models.Chat, error)
+	UpdateChat(ctx context.Context, chatID int64, userID int64, update *models.ChatUpdate) (*models.Chat, error)
+	DeleteChat(ctx context.Context, chatID int64) error
+	CreateMessage(ctx context.Context, msg *models.MessageCreate) (*models.Message, error)
+	GetChatMessages(ctx context.Context, chatID int64) ([]models.Message, error)
+	GetUserMessage(ctx context.Context, messageID int64, userID int64) (*models.Message, error)
+	FindMessagesByMetadata(ctx context.Context, userID int64, chatID int64, filter map[string]interface{}, limit int) ([]models.Message, error)
+	SavePrescriptionAnalysis(ctx context.Context, analysis *models.PrescriptionAnalysis) error
+	GetPrescriptionAnalysis(ctx context.Context, messageID int64) (*models.PrescriptionAnalysis, error)
+}
+
+// AIJobStore keeps the AI jobs that answer chat messages and their attempts
+type AIJobStore interface {
+	CreateAIJob(ctx context.Context, jobID string, chatID int64, userID int64, kind models.AIJobKind, input string) (*models.AIJob, error)
+	GetAIJob(ctx context.Context, jobID string) (*models.AIJob, error)
+	GetUserAIJob(ctx context.Context, jobID string, userID int64) (*models.AIJob, error)
+	GetActiveAIJob(ctx context.Context, chatID int64, staleAfter time.Duration) (*models.AIJob, error)
+	StartAIJobAttempt(ctx context.Context, jobID string) error
+	TouchAIJob(ctx context.Context, jobID string) error
+	CompleteAIJob(ctx context.Context, jobID string, messageID int64) error
+	FailAIJobAttempt(ctx context.Context, jobID string, attemptErr error, final bool, messageID int64) error
+	InterruptAIJob(ctx context.Context, jobID string) error
+	ClaimInterruptedAIJobs(ctx context.Context) ([]*models.AIJob, error)
+}
+
+// SessionStore keeps the login sessions of users with their refresh tokens,
+// and the access tokens revoked before they expire
+type SessionStore interface {
+	CreateSession(ctx context.Context, userID int64, userAgent, ipAddress, tokenHash string, expiresAt time.Time) (*models.Session, error)
+	RotateRefreshToken(ctx context.Context, tokenHash, newTokenHash string, expiresAt time.Time) (*models.Session, error)
+	GetUserSessions(ctx context.Context, userID int64) ([]*models.Session, error)
+	RevokeSession(ctx context.Context, id string, userID int64) error
+	RevokeUserSessions(ctx context.Context, userID int64) (int64, error)
+	RevokeToken(ctx context.Context, jti string, userID int64, expiresAt time.Time) error
+	IsTokenRevoked(ctx context.Context, jti, sessionID string) (bool, error)
+}
+
+// TokenStore keeps the single-use tokens of emailed links and the codes sent by SMS
+type TokenStore interface {
+	CreateAuthToken(ctx context.Context, userID int64, purpose, tokenHash string, expiresAt time.Time) error
+	GetLastAuthTokenTime(ctx context.Context, userID int64, purpose string) (*time.Time, error)
+	ResetUserPassword(ctx context.Context, tokenHash, passwordHash string) (int64, error)
+	VerifyUserEmail(ctx context.Context, tokenHash string) (int64, error)
+	CreateOTPCode(ctx context.Context, phone, codeHash, ipAddress string, expiresAt time.Time, limits OTPLimits) (*models.OTPCode, time.Duration, error)
+	VerifyOTPCode(ctx context.Context, phone, codeHash string, maxAttempts int) (int64, error)
+	ConsumeOTPCode(ctx context.Context, id int64) error
+}
+
+// PrescriptionStore keeps the prescription history of users
+type PrescriptionStore interface {
+	CreatePrescription(ctx context.Context, prescription *models.Prescription) (*models.Prescription, error)
+	GetPrescription(ctx context.Context, id string, userID int64) (*models.Prescription, error)
+	ListPrescriptions(ctx context.Context, filter models.PrescriptionFilter) ([]models.Prescription, int, error)
+	UpdatePrescription(ctx context.Context, id string, userID int64, update *models.PrescriptionUpdate) (*models.Prescription, error)
+	DeletePrescription(ctx context.Context, id string, userID int64) error
+}
+
+// FolderStore keeps the folders chats are organized in
+type FolderStore interface {
+	CreateFolder(ctx context.Context, folder *models.FolderCreate, userID int64) (*models.Folder, error)
+	GetFolder(ctx context.Context, folderID int64, userID int64) (*models.FolderResponse, error)
+	GetUserFolders(ctx context.Context, userID int64) ([]models.Folder, error)
+	UpdateFolder(ctx context.Context, folderID int64, userID int64, update *models.FolderUpdate) (*models.Folder, error)
+	DeleteFolder(ctx context.Context, folderID int64, userID int64) error
+}
+
+// PlanStore keeps plans, the subscriptions bought with them and the usage
+// charged to those subscriptions
+type PlanStore interface {
+	CreatePlan(ctx context.Context, plan *models.PlanCreate) (*models.Plan, error)
+	GetPlanByID(ctx context.Context, id int64) (*models.Plan, error)
+	GetAllPlans(ctx context.Context) ([]*models.Plan, error)
+	CreateUserSubscription(ctx context.Context, userID int64, planID int64, pharmacyID *int64) (*models.UserSubscription, error)
+	GetUserSubscriptions(ctx context.Context, userID int64) ([]*models.UserSubscription, error)
+	GetActiveUserSubscriptions(ctx context.Context, userID int64) ([]*models.UserSubscription, error)
+	GetCurrentUserSubscription(ctx context.Context, userID int64) (*models.UserSubscription, error)
+	RecordSubscriptionUsage(ctx context.Context, subscriptionID, userID int64, count int, idempotencyKey string) error
+	RecordUserUsage(ctx context.Context, userID int64, count int, idempotencyKey string) (int64, error)
+	ReserveUsage(ctx context.Context, userID int64, count int, idempotencyKey string) (int64, error)
+	CommitUsage(ctx context.Context, idempotencyKey string) error
+	ReleaseUsage(ctx context.Context, idempotencyKey string) error
+}
+
+// CreditStore changes the credit of users and lists their credit transactions
+type CreditStore interface {
+	AddUserCredit(ctx context.Context, userID int64, amount float64, actorID int64, description string) error
+	SubtractUserCredit(ctx context.Context, userID int64, amount float64, actorID int64, description string) error
+	GetCreditTransactions(ctx context.Context, userID int64, limit, offset int) ([]*models.CreditTransaction, error)
+}
+
+// GiftStore gives plans and credit to users and lists the gifts made
+type GiftStore interface {
+	GiftPlanToUser(ctx context.Context, adminID, userID, planID int64, message string) error
+	GiftCreditToUser(ctx context.Context, adminID, userID int64, amount float64, message string) error
+	GetUserGiftTransactions(ctx context.Context, userID int64) ([]*models.GiftTransaction, error)
+	GetAdminGiftTransactions(ctx context.Context, adminID int64) ([]*models.GiftTransaction, error)
+}
+
+// PaymentStore keeps the credit top-ups paid through a payment gateway
+type PaymentStore interface {
+	CreatePayment(ctx context.Context, payment *models.Payment) (*models.Payment, error)
+	GetPaymentByAuthority(ctx context.Context, authority string) (*models.Payment, error)
+	GetUserPayment(ctx context.Context, id int64, userID int64) (*models.Payment, error)
+	GetUserPayments(ctx context.Context, userID int64, limit, offset int) ([]*models.Payment, error)
+	CompletePayment(ctx context.Context, authority, refID, cardPAN string) (*models.Payment, bool, error)
+	FailPayment(ctx context.Context, authority string) (*models.Payment, error)
+}
+
+// RoleStore lists roles and grants them to users
+type RoleStore interface {
+	GetRoles(ctx context.Context) ([]*models.Role, error)
+	GrantUserRole(ctx context.Context, userID int64, role string, grantedBy int64) error
+	RevokeUserRole(ctx context.Context, userID int64, role string) error
+}
+
+// PharmacyStore keeps pharmacies, their members and invitations, and the
+// chats and folders shared with them
+type PharmacyStore interface {
+	CreatePharmacy(ctx context.Context, userID int64, name string) (*models.Pharmacy, error)
+	GetPharmacyMembers(ctx context.Context, pharmacyID int64) ([]*models.PharmacyMember, error)
+	UpdatePharmacyMemberRole(ctx context.Context, pharmacyID, userID int64, role models.PharmacyRole) error
+	RemovePharmacyMember(ctx context.Context, pharmacyID, userID int64) error
+	CreatePharmacyInvitation(ctx context.Context, invitation *models.PharmacyInvitation) (*models.PharmacyInvitation, error)
+	GetPharmacyInvitations(ctx context.Context, pharmacyID int64) ([]*models.PharmacyInvitation, error)
+	GetUserInvitations(ctx context.Context, userID int64) ([]*models.PharmacyInvitation, error)
+	RevokePharmacyInvitation(ctx context.Context, id, pharmacyID int64) error
+	RespondToInvitation(ctx context.Context, id, userID int64, accept bool) (*models.PharmacyInvitation, error)
+	ShareChat(ctx context.Context, chatID, userID int64, pharmacyID *int64) error
+	ShareFolder(ctx context.Context, folderID, userID int64, pharmacyID *int64) error
+	GetPharmacyChats(ctx context.Context, pharmacyID int64) ([]models.Chat, error)
+	GetPharmacyFolders(ctx context.Context, pharmacyID int64) ([]models.Folder, error)
+	GetPharmacyCreditTransactions(ctx context.Context, pharmacyID int64, limit, offset int) ([]*models.CreditTransaction, error)
+}
+
+// Postgres implements every store with the functions of this package on DB
+type Postgres struct{}
+
+var (
+	_ UserStore         = Postgres{}
+	_ ChatStore         = Postgres{}
+	_ AIJobStore        = Postgres{}
+	_ SessionStore      = Postgres{}
+	_ TokenStore        = Postgres{}
+	_ PrescriptionStore = Postgres{}
+	_ FolderStore       = Postgres{}
+	_ PlanStore         = Postgres{}
+	_ CreditStore       = Postgres{}
+	_ GiftStore         = Postgres{}
+	_ PaymentStore      = Postgres{}
+	_ RoleStore         = Postgres{}
+	_ PharmacyStore     = Postgres{}
+)
+
+func (Postgres) CreateUser(ctx context.Context, user *models.UserCreate) (*models.User, error) {
+	return CreateUser(ctx, user)
+}
+
+func (Postgres) CreatePhoneUser(ctx context.Context, user *models.OTPVerify) (*models.User, error) {
+	return CreatePhoneUser(ctx, user)
+}
+
+func (Postgres) GetUserByID(ctx context.Context, id int64) (*models.User, error) {
+	return GetUserByID(ctx, id)
+}
+
+func (Postgres) GetUserByEmail(ctx context.Context, email string) (*models.User, error) {
+	return GetUserByEmail(ctx, email)
+}
+
+func (Postgres) GetUserByPhone(ctx context.Context, phone string) (*models.User, error) {
+	return GetUserByPhone(ctx, phone)
+}
+
+func (Postgres) GetUserPharmacy(ctx context.Context, userID int64) (*models.Pharmacy, error) {
+	return GetUserPharmacy(ctx, userID)
+}
+
+func (Postgres) IsUserVerified(ctx context.Context, userID int64) (bool, error) {
+	return IsUserVerified(ctx, userID)
+}
+
+func (Postgres) CreateChat(ctx context.Context, chat *models.ChatCreate, userID int64) (*models.Chat, error) {
+	return CreateChat(ctx, chat, userID)
+}
+
+func (Postgres) GetChat(ctx context.Context, chatID int64, userID int64) (*models.ChatResponse, error) {
+	return GetChat(ctx, chatID, userID)
+}
+
+func (Postgres) GetUserChats(ctx context.Context, userID int64) ([]models.Chat, error) {
+	return GetUserChats(ctx, userID)
+}
+
+func (Postgres) UpdateChat(ctx context.Context, chatID int64, userID int64, update *models.ChatUpdate) (*models.Chat, error) {
+	return UpdateChat(ctx, chatID, userID, update)
+}
+
+func (Postgres) DeleteChat(ctx context.Context, chatID int64) error {
+	return DeleteChat(ctx, chatID)
+}
+
+func (Postgres) CreateMessage(ctx context.Context, msg *models.MessageCreate) (*models.Message, error) {
+	return CreateMessage(ctx, msg)
+}
+
+func (Postgres) GetChatMessages(ctx context.Context, chatID int64) ([]models.Message, error) {
+	return GetChatMessages(ctx, chatID)
+}
+
+func (Postgres) GetUserMessage(ctx context.Context, messageID int64, userID int64) (*models.Message, error) {
+	return GetUserMessage(ctx, messageID, userID)
+}
+
+func (Postgres) FindMessagesByMetadata(ctx context.Context, userID int64, chatID int64, filter map[string]interface{}, limit int) ([]models.Message, error) {
+	return FindMessagesByMetadata(ctx, userID, chatID, filter, limit)
+}
+
+func (Postgres) SavePrescriptionAnalysis(ctx context.Context, analysis *models.PrescriptionAnalysis) error {
+	return SavePrescriptionAnalysis(ctx, analysis)
+}
+
+func (Postgres) GetPrescriptionAnalysis(ctx context.Context, messageID int64) (*models.PrescriptionAnalysis, error) {
+	return GetPrescriptionAnalysis(ctx, messageID)
+}
+
+func (Postgres) CreateAIJob(ctx context.Context, jobID string, chatID int64, userID int64, kind models.AIJobKind, input string) (*models.AIJob, error) {
+	return CreateAIJob(ctx, jobID, chatID, userID, kind, input)
+}
+
+func (Postgres) GetAIJob(ctx context.Context, jobID string) (*models.AIJob, error) {
+	return GetAIJob(ctx, jobID)
+}
+
+func (Postgres) GetUserAIJob(ctx context.Context, jobID string, userID int64) (*models.AIJob, error) {
+	return GetUserAIJob(ctx, jobID, userID)
+}
+
+func (Postgres) GetActiveAIJob(ctx context.Context, chatID int64, staleAfter time.Duration) (*models.AIJob, error) {
+	return GetActiveAIJob(ctx, chatID, staleAfter)
+}
+
+func (Postgres) StartAIJobAttempt(ctx context.Context, jobID string) error {
+	return StartAIJobAttempt(ctx, jobID)
+}
+
+func (Postgres) TouchAIJob(ctx context.Context, jobID string) error {
+	return TouchAIJob(ctx, jobID)
+}
+
+func (Postgres) CompleteAIJob(ctx context.Context, jobID string, messageID int64) error {
+	return CompleteAIJob(ctx, jobID, messageID)
+}
+
+func (Postgres) FailAIJobAttempt(ctx context.Context, jobID string, attemptErr error, final bool, messageID int64) error {
+	return FailAIJobAttempt(ctx, jobID, attemptErr, final, messageID)
+}
+
+func (Postgres) InterruptAIJob(ctx context.Context, jobID string) error {
+	return InterruptAIJob(ctx, jobID)
+}
+
+func (Postgres) ClaimInterruptedAIJobs(ctx context.Context) ([]*models.AIJob, error) {
+	return ClaimInterruptedAIJobs(ctx)
+}
+
+func (Postgres) CreateSession(ctx context.Context, userID int64, userAgent, ipAddress, tokenHash string, expiresAt time.Time) (*models.Session, error) {
+	return CreateSession(ctx, userID, userAgent, ipAddress, tokenHash, expiresAt)
+}
+
+func (Postgres) RotateRefreshToken(ctx context.Context, tokenHash, newTokenHash string, expiresAt time.Time) (*models.Session, error) {
+	return RotateRefreshToken(ctx, tokenHash, newTokenHash, expiresAt)
+}
+
+func (Postgres) GetUserSessions(ctx context.Context, userID int64) ([]*models.Session, error) {
+	return GetUserSessions(ctx, userID)
+}
+
+func (Postgres) RevokeSession(ctx context.Context, id string, userID int64) error {
+	return RevokeSession(ctx, id, userID)
+}
+
+func (Postgres) RevokeUserSessions(ctx context.Context, userID int64) (int64, error) {
+	return RevokeUserSessions(ctx, userID)
+}
+
+func (Postgres) RevokeToken(ctx context.Context, jti string, userID int64, expiresAt time.Time) error {
+	return RevokeToken(ctx, jti, userID, expiresAt)
+}
+
+func (Postgres) IsTokenRevoked(ctx context.Context, jti, sessionID string) (bool, error) {
+	return IsTokenRevoked(ctx, jti, sessionID)
+}
+
+func (Postgres) CreateAuthToken(ctx context.Context, userID int64, purpose, tokenHash string, expiresAt time.Time) error {
+	return CreateAuthToken(ctx, userID, purpose, tokenHash, expiresAt)
+}
+
+func (Postgres) GetLastAuthTokenTime(ctx context.Context, userID int64, purpose string) (*time.Time, error) {
+	return GetLastAuthTokenTime(ctx, userID, purpose)
+}
+
+func (Postgres) ResetUserPassword(ctx context.Context, tokenHash, passwordHash string) (int64, error) {
+	return ResetUserPassword(ctx, tokenHash, passwordHash)
+}
+
+func (Postgres) VerifyUserEmail(ctx context.Context, tokenHash string) (int64, error) {
+	return VerifyUserEmail(ctx, tokenHash)
+}
+
+func (Postgres) CreateOTPCode(ctx context.Context, phone, codeHash, ipAddress string, expiresAt time.Time, limits OTPLimits) (*models.OTPCode, time.Duration, error) {
+	return CreateOTPCode(ctx, phone, codeHash, ipAddress, expiresAt, limits)
+}
+
+func (Postgres) VerifyOTPCode(ctx context.Context, phone, codeHash string, maxAttempts int) (int64, error) {
+	return VerifyOTPCode(ctx, phone, codeHash, maxAttempts)
+}
+
+func (Postgres) ConsumeOTPCode(ctx context.Context, id int64) error {
+	return ConsumeOTPCode(ctx, id)
+}
+
+func (Postgres) CreatePrescription(ctx context.Context, prescription *models.Prescription) (*models.Prescription, error) {
+	return CreatePrescription(ctx, prescription)
+}
+
+func (Postgres) GetPrescription(ctx context.Context, id string, userID int64) (*models.Prescription, error) {
+	return GetPrescription(ctx, id, userID)
+}
+
+func (Postgres) ListPrescriptions(ctx context.Context, filter models.PrescriptionFilter) ([]models.Prescription, int, error) {
+	return ListPrescriptions(ctx, filter)
+}
+
+func (Postgres) UpdatePrescription(ctx context.Context, id string, userID int64, update *models.PrescriptionUpdate) (*models.Prescription, error) {
+	return UpdatePrescription(ctx, id, userID, update)
+}
+
+func (Postgres) DeletePrescription(ctx context.Context, id string, userID int64) error {
+	return DeletePrescription(ctx, id, userID)
+}
+
+func (Postgres) CreateFolder(ctx context.Context, folder *models.FolderCreate, userID int64) (*models.Folder, error) {
+	return CreateFolder(ctx, folder, userID)
+}
+
+func (Postgres) GetFolder(ctx context.Context, folderID int64, userID int64) (*models.FolderResponse, error) {
+	return GetFolder(ctx, folderID, userID)
+}
+
+func (Postgres) GetUserFolders(ctx context.Context, userID int64) ([]models.Folder, error) {
+	return GetUserFolders(ctx, userID)
+}
+
+func (Postgres) UpdateFolder(ctx context.Context, folderID int64, userID int64, update *models.FolderUpdate) (*models.Folder, error) {
+	return UpdateFolder(ctx, folderID, userID, update)
+}
+
+func (Postgres) DeleteFolder(ctx context.Context, folderID int64, userID int64) error {
+	return DeleteFolder(ctx, folderID, userID)
+}
+
+func (Postgres) CreatePlan(ctx context.Context, plan *models.PlanCreate) (*models.Plan, error) {
+	return CreatePlan(ctx, plan)
+}
+
+func (Postgres) GetPlanByID(ctx context.Context, id int64) (*models.Plan, error) {
+	return GetPlanByID(ctx, id)
+}
+
+func (Postgres) GetAllPlans(ctx context.Context) ([]*models.Plan, error) {
+	return GetAllPlans(ctx)
+}
+
+func (Postgres) CreateUserSubscription(ctx context.Context, userID int64, planID int64, pharmacyID *int64) (*models.UserSubscription, error) {
+	return CreateUserSubscription(ctx, userID, planID, pharmacyID)
+}
+
+func (Postgres) GetUserSubscriptions(ctx context.Context, userID int64) ([]*models.UserSubscription, error) {
+	return GetUserSubscriptions(ctx, userID)
+}
+
+func (Postgres) GetActiveUserSubscriptions(ctx context.Context, userID int64) ([]*models.UserSubscription, error) {
+	return GetActiveUserSubscriptions(ctx, userID)
+}
+
+func (Postgres) GetCurrentUserSubscription(ctx context.Context, userID int64) (*models.UserSubscription, error) {
+	return GetCurrentUserSubscription(ctx, userID)
+}
+
+func (Postgres) RecordSubscriptionUsage(ctx context.Context, subscriptionID, userID int64, count int, idempotencyKey string) error {
+	return RecordSubscriptionUsage(ctx, subscriptionID, userID, count, idempotencyKey)
+}
+
+func (Postgres) RecordUserUsage(ctx context.Context, userID int64, count int, idempotencyKey string) (int64, error) {
+	return RecordUserUsage(ctx, userID, count, idempotencyKey)
+}
+
+func (Postgres) ReserveUsage(ctx context.Context, userID int64, count int, idempotencyKey string) (int64, error) {
+	return ReserveUsage(ctx, userID, count, idempotencyKey)
+}
+
+func (Postgres) CommitUsage(ctx context.Context, idempotencyKey string) error {
+	return CommitUsage(ctx, idempotencyKey)
+}
+
+func (Postgres) ReleaseUsage(ctx context.Context, idempotencyKey string) error {
+	return ReleaseUsage(ctx, idempotencyKey)
+}
+
+func (Postgres) AddUserCredit(ctx context.Context, userID int64, amount float64, actorID int64, description string) error {
+	return AddUserCredit(ctx, userID, amount, actorID, description)
+}
+
+func (Postgres) SubtractUserCredit(ctx context.Context, userID int64, amount float64, actorID int64, description string) error {
+	return SubtractUserCredit(ctx, userID, amount, actorID, description)
+}
+
+func (Postgres) GetCreditTransactions(ctx context.Context, userID int64, limit, offset int) ([]*models.CreditTransaction, error) {
+	return GetCreditTransactions(ctx, userID, limit, offset)
+}
+
+func (Postgres) GiftPlanToUser(ctx context.Context, adminID, userID, planID int64, message string) error {
+	return GiftPlanToUser(ctx, adminID, userID, planID, message)
+}
+
+func (Postgres) GiftCreditToUser(ctx context.Context, adminID, userID int64, amount float64, message string) error {
+	return GiftCreditToUser(ctx, adminID, userID, amount, message)
+}
+
+func (Postgres) GetUserGiftTransactions(ctx context.Context, userID int64) ([]*models.GiftTransaction, error) {
+	return GetUserGiftTransactions(ctx, userID)
+}
+
+func (Postgres) GetAdminGiftTransactions(ctx context.Context, adminID int64) ([]*models.GiftTransaction, error) {
+	return GetAdminGiftTransactions(ctx, adminID)
+}
+
+func (Postgres) CreatePayment(ctx context.Context, payment *models.Payment) (*models.Payment, error) {
+	return CreatePayment(ctx, payment)
+}
+
+func (Postgres) GetPaymentByAuthority(ctx context.Context, authority string) (*models.Payment, error) {
+	return GetPaymentByAuthority(ctx, authority)
+}
+
+func (Postgres) GetUserPayment(ctx context.Context, id int64, userID int64) (*models.Payment, error) {
+	return GetUserPayment(ctx, id, userID)
+}
+
+func (Postgres) GetUserPayments(ctx context.Context, userID int64, limit, offset int) ([]*models.Payment, error) {
+	return GetUserPayments(ctx, userID, limit, offset)
+}
+
+func (Postgres) CompletePayment(ctx context.Context, authority, refID, cardPAN string) (*models.Payment, bool, error) {
+	return CompletePayment(ctx, authority, refID, cardPAN)
+}
+
+func (Postgres) FailPayment(ctx context.Context, authority string) (*models.Payment, error) {
+	return FailPayment(ctx, authority)
+}
+
+func (Postgres) GetRoles(ctx context.Context) ([]*models.Role, error) {
+	return GetRoles(ctx)
+}
+
+func (Postgres) GrantUserRole(ctx context.Context, userID int64, role string, grantedBy int64) error {
+	return GrantUserRole(ctx, userID, role, grantedBy)
+}
+
+func (Postgres) RevokeUserRole(ctx context.Context, userID int64, role string) error {
+	return RevokeUserRole(ctx, userID, role)
+}
+
+func (Postgres) CreatePharmacy(ctx context.Context, userID int64, name string) (*models.Pharmacy, error) {
+	return CreatePharmacy(ctx, userID, name)
+}
+
+func (Postgres) GetPharmacyMembers(ctx context.Context, pharmacyID int64) ([]*models.PharmacyMember, error) {
+	return GetPharmacyMembers(ctx, pharmacyID)
+}
+
+func (Postgres) UpdatePharmacyMemberRole(ctx context.Context, pharmacyID, userID int64, role models.PharmacyRole) error {
+	return UpdatePharmacyMemberRole(ctx, pharmacyID, userID, role)
+}
+
+func (Postgres) RemovePharmacyMember(ctx context.Context, pharmacyID, userID int64) error {
+	return RemovePharmacyMember(ctx, pharmacyID, userID)
+}
+
+func (Postgres) CreatePharmacyInvitation(ctx context.Context, invitation *models.PharmacyInvitation) (*models.PharmacyInvitation, error) {
+	return CreatePharmacyInvitation(ctx, invitation)
+}
+
+func (Postgres) GetPharmacyInvitations(ctx context.Context, pharmacyID int64) ([]*models.PharmacyInvitation, error) {
+	return GetPharmacyInvitations(ctx, pharmacyID)
+}
+
+func (Postgres) GetUserInvitations(ctx context.Context, userID int64) ([]*models.PharmacyInvitation, error) {
+	return GetUserInvitations(ctx, userID)
+}
+
+func (Postgres) RevokePharmacyInvitation(ctx context.Context, id, pharmacyID int64) error {
+	return RevokePharmacyInvitation(ctx, id, pharmacyID)
+}
+
+func (Postgres) RespondToInvitation(ctx context.Context, id, userID int64, accept bool) (*models.PharmacyInvitation, error) {
+	return RespondToInvitation(ctx, id, userID, accept)
+}
+
+func (Postgres) ShareChat(ctx context.Context, chatID, userID int64, pharmacyID *int64) error {
+	return ShareChat(ctx, chatID, userID, pharmacyID)
+}
+
+func (Postgres) ShareFolder(ctx context.Context, folderID, userID int64, pharmacyID *int64) error {
+	return ShareFolder(ctx, folderID, userID, pharmacyID)
+}
+
+func (Postgres) GetPharmacyChats(ctx context.Context, pharmacyID int64) ([]models.Chat, error) {
+	return GetPharmacyChats(ctx, pharmacyID)
+}
+
+func (Postgres) GetPharmacyFolders(ctx context.Context, pharmacyID int64) ([]models.Folder, error) {
+	return GetPharmacyFolders(ctx, pharmacyID)
+}
+
+func (Postgres) GetPharmacyCreditTransactions(ctx context.Context, pharmacyID int64, limit, offset int) ([]*models.CreditTransaction, error) {
+	return GetPharmacyCreditTransactions(ctx, pharmacyID, limit, offset)
+}
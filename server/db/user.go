@@ -1,31 +1,57 @@
 package db
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"time"
 
 	"github.com/darooyar/server/models"
+	"github.com/lib/pq"
 )
 
+// ErrUserNotFound is returned when no user matches a lookup
+var ErrUserNotFound = errors.New("user not found")
+
+// ErrUserExists is returned when the username, email or phone of a new user
+// already belongs to another user
+var ErrUserExists = errors.New("user already exists")
+
+// uniqueViolation is the Postgres error code of a broken unique constraint
+const uniqueViolation = "23505"
+
+// userColumns selects a user together with the names of their roles and permissions
+const userColumns = `u.id, u.username, COALESCE(u.email, ''), COALESCE(u.phone, ''), u.first_name, u.last_name, u.credit,
+		u.email_verified_at IS NOT NULL,
+		ARRAY(
+			SELECT r.name FROM user_roles ur JOIN roles r ON r.id = ur.role_id
+			WHERE ur.user_id = u.id ORDER BY r.name
+		),
+		ARRAY(
+			SELECT DISTINCT p.name FROM user_roles ur
+			JOIN role_permissions rp ON rp.role_id = ur.role_id
+			JOIN permissions p ON p.id = rp.permission_id
+			WHERE ur.user_id = u.id ORDER BY p.name
+		),
+		u.created_at, u.updated_at`
+
 // CreateUser creates a new user in the database
-func CreateUser(user *models.UserCreate) (*models.User, error) {
+func CreateUser(ctx context.Context, user *models.UserCreate) (*models.User, error) {
 	query := `
-		INSERT INTO users (username, email, password, first_name, last_name, credit, is_admin, created_at, updated_at)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
-		RETURNING id, username, email, first_name, last_name, credit, is_admin, created_at, updated_at`
+		INSERT INTO users (username, email, password, first_name, last_name, credit, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING id, username, email, first_name, last_name, credit, created_at, updated_at`
 
 	now := time.Now()
-	var newUser models.User
-	err := DB.QueryRow(
+	newUser := models.User{Roles: []string{}, Permissions: []models.Permission{}}
+	err := DB.QueryRowContext(ctx,
 		query,
 		user.Username,
 		user.Email,
 		user.Password, // Note: Password should be hashed before being passed here
 		user.FirstName,
 		user.LastName,
-		0.0,   // Default credit value for new users
-		false, // Default is_admin value for new users
+		0.0, // Default credit value for new users
 		now,
 		now,
 	).Scan(
@@ -35,11 +61,13 @@ func CreateUser(user *models.UserCreate) (*models.User, error) {
 		&newUser.FirstName,
 		&newUser.LastName,
 		&newUser.Credit,
-		&newUser.IsAdmin,
 		&newUser.CreatedAt,
 		&newUser.UpdatedAt,
 	)
 
+	if isUniqueViolation(err) {
+		return nil, ErrUserExists
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -48,125 +76,149 @@ func CreateUser(user *models.UserCreate) (*models.User, error) {
 }
 
 // GetUserByEmail retrieves a user by email
-func GetUserByEmail(email string) (*models.User, error) {
+func GetUserByEmail(ctx context.Context, email string) (*models.User, error) {
 	query := `
-		SELECT id, username, email, password, first_name, last_name, credit, is_admin, created_at, updated_at
-		FROM users
-		WHERE email = $1`
-
-	var user models.User
-	err := DB.QueryRow(query, email).Scan(
-		&user.ID,
-		&user.Username,
-		&user.Email,
-		&user.Password,
-		&user.FirstName,
-		&user.LastName,
-		&user.Credit,
-		&user.IsAdmin,
-		&user.CreatedAt,
-		&user.UpdatedAt,
-	)
+		SELECT ` + userColumns + `, u.password
+		FROM users u
+		WHERE u.email = $1`
 
+	var password string
+	user, err := scanUser(DB.QueryRowContext(ctx, query, email), &password)
 	if err == sql.ErrNoRows {
-		return nil, errors.New("user not found")
+		return nil, ErrUserNotFound
 	}
 	if err != nil {
 		return nil, err
 	}
 
-	return &user, nil
+	user.Password = password
+	return user, nil
 }
 
-// GetUserByID retrieves a user by ID
-func GetUserByID(id int64) (*models.User, error) {
+// GetUserByPhone retrieves a user by phone number
+func GetUserByPhone(ctx context.Context, phone string) (*models.User, error) {
 	query := `
-		SELECT id, username, email, first_name, last_name, credit, is_admin, created_at, updated_at
-		FROM users
-		WHERE id = $1`
-
-	var user models.User
-	err := DB.QueryRow(query, id).Scan(
-		&user.ID,
-		&user.Username,
-		&user.Email,
-		&user.FirstName,
-		&user.LastName,
-		&user.Credit,
-		&user.IsAdmin,
-		&user.CreatedAt,
-		&user.UpdatedAt,
-	)
+		SELECT ` + userColumns + `
+		FROM users u
+		WHERE u.phone = $1`
 
+	user, err := scanUser(DB.QueryRowContext(ctx, query, phone))
 	if err == sql.ErrNoRows {
-		return nil, errors.New("user not found")
+		return nil, ErrUserNotFound
 	}
 	if err != nil {
 		return nil, err
 	}
 
-	return &user, nil
+	return user, nil
 }
 
-// UpdateUserCredit updates a user's credit balance
-func UpdateUserCredit(userID int64, newCredit float64) error {
+// CreatePhoneUser creates a user who logs in with a phone number and has no email or password
+func CreatePhoneUser(ctx context.Context, user *models.OTPVerify) (*models.User, error) {
 	query := `
-		UPDATE users
-		SET credit = $1, updated_at = $2
-		WHERE id = $3`
+		INSERT INTO users (username, phone, first_name, last_name, credit, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, 0, $5, $5)
+		RETURNING id`
+
+	var id int64
+	err := DB.QueryRowContext(ctx, query, user.Username, user.Phone, user.FirstName, user.LastName, time.Now()).Scan(&id)
+	if isUniqueViolation(err) {
+		return nil, ErrUserExists
+	}
+	if err != nil {
+		return nil, err
+	}
 
-	_, err := DB.Exec(query, newCredit, time.Now(), userID)
-	return err
+	return GetUserByID(ctx, id)
 }
 
-// AddUserCredit adds to a user's credit balance
-func AddUserCredit(userID int64, amount float64) error {
-	if amount <= 0 {
-		return errors.New("amount must be positive")
-	}
-
+// GetUserByID retrieves a user by ID
+func GetUserByID(ctx context.Context, id int64) (*models.User, error) {
 	query := `
-		UPDATE users
-		SET credit = credit + $1, updated_at = $2
-		WHERE id = $3`
+		SELECT ` + userColumns + `
+		FROM users u
+		WHERE u.id = $1`
 
-	_, err := DB.Exec(query, amount, time.Now(), userID)
-	return err
+	user, err := scanUser(DB.QueryRowContext(ctx, query, id))
+	if err == sql.ErrNoRows {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
 }
 
-// SubtractUserCredit subtracts from a user's credit balance
-func SubtractUserCredit(userID int64, amount float64) error {
+// AddUserCredit adds to a user's credit balance and records the change,
+// made by the acting user, as a credit transaction
+func AddUserCredit(ctx context.Context, userID int64, amount float64, actorID int64, description string) error {
 	if amount <= 0 {
 		return errors.New("amount must be positive")
 	}
 
-	// First check if the user has enough credit
-	var currentCredit float64
-	err := DB.QueryRow("SELECT credit FROM users WHERE id = $1", userID).Scan(&currentCredit)
-	if err != nil {
-		return err
-	}
+	return adjustUserCredit(ctx, userID, amount, actorID, description)
+}
 
-	if currentCredit < amount {
-		return errors.New("insufficient credit")
+// SubtractUserCredit subtracts from a user's credit balance and records the
+// change, made by the acting user, as a credit transaction. It returns
+// ErrInsufficientCredit when the user has less credit than the amount.
+func SubtractUserCredit(ctx context.Context, userID int64, amount float64, actorID int64, description string) error {
+	if amount <= 0 {
+		return errors.New("amount must be positive")
 	}
 
-	query := `
-		UPDATE users
-		SET credit = credit - $1, updated_at = $2
-		WHERE id = $3`
+	return adjustUserCredit(ctx, userID, -amount, actorID, description)
+}
 
-	_, err = DB.Exec(query, amount, time.Now(), userID)
+// adjustUserCredit records a manual change of a user's credit in the ledger
+func adjustUserCredit(ctx context.Context, userID int64, amount float64, actorID int64, description string) error {
+	_, err := RecordCreditTransaction(ctx, models.CreditEntry{
+		UserID:          userID,
+		Amount:          amount,
+		TransactionType: models.CreditTransactionTypeAdjustment,
+		Description:     description,
+		ActorID:         &actorID,
+	})
 	return err
 }
 
-// SetUserAdmin sets a user's admin status
-func SetUserAdmin(userID int64, isAdmin bool) error {
-	query := `
-		UPDATE users
-		SET is_admin = $1, updated_at = $2
-		WHERE id = $3`
+// scanUser reads a user selected with userColumns, followed by any extra columns
+func scanUser(row rowScanner, extra ...interface{}) (*models.User, error) {
+	var user models.User
+	var permissions []string
+	dest := []interface{}{
+		&user.ID,
+		&user.Username,
+		&user.Email,
+		&user.Phone,
+		&user.FirstName,
+		&user.LastName,
+		&user.Credit,
+		&user.EmailVerified,
+		pq.Array(&user.Roles),
+		pq.Array(&permissions),
+		&user.CreatedAt,
+		&user.UpdatedAt,
+	}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return nil, err
+	}
 
-	_, err := DB.Exec(query, isAdmin, time.Now(), userID)
-	return err
+	if user.Roles == nil {
+		user.Roles = []string{}
+	}
+	user.Permissions = make([]models.Permission, 0, len(permissions))
+	for _, permission := range permissions {
+		user.Permissions = append(user.Permissions, models.Permission(permission))
+	}
+	user.IsAdmin = user.HasRole(models.RoleAdmin)
+
+	return &user, nil
+}
+
+// isUniqueViolation reports whether an insert failed on a unique constraint
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == uniqueViolation
 }
@@ -0,0 +1,247 @@
+package druginteractions
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/darooyar/server/db"
+	"github.com/darooyar/server/models"
+)
+
+// ImportResult summarizes a CSV import
+type ImportResult struct {
+	Drugs        int      `json:"drugs"`
+	Synonyms     int      `json:"synonyms"`
+	Interactions int      `json:"interactions"`
+	Skipped      []string `json:"skipped,omitempty"`
+}
+
+// ImportDrugsCSV imports drugs from a CSV file with the header
+// generic_name,name_fa,name_en,synonyms where synonyms are separated by "|".
+// Existing drugs are updated and new synonyms are added.
+func ImportDrugsCSV(ctx context.Context, r io.Reader) (*ImportResult, error) {
+	records, err := readCSV(r, "generic_name")
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := db.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	result := &ImportResult{}
+	for i, record := range records {
+		genericName := record["generic_name"]
+		if normalizeKey(genericName) == "" {
+			result.Skipped = append(result.Skipped, fmt.Sprintf("line %d: missing generic_name", i+2))
+			continue
+		}
+
+		drugID, err := upsertDrug(ctx, tx, genericName, record["name_fa"], record["name_en"])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", i+2, err)
+		}
+		result.Drugs++
+
+		names := []string{genericName, record["name_fa"], record["name_en"]}
+		names = append(names, strings.Split(record["synonyms"], "|")...)
+		added, err := addSynonyms(ctx, tx, drugID, names)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", i+2, err)
+		}
+		result.Synonyms += added
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// ImportInteractionsCSV imports interactions from a CSV file with the header
+// drug_a,drug_b,severity,description,management. Drugs are looked up by any
+// of their synonyms and created when unknown.
+func ImportInteractionsCSV(ctx context.Context, r io.Reader) (*ImportResult, error) {
+	records, err := readCSV(r, "drug_a", "drug_b", "severity")
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := db.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	result := &ImportResult{}
+	for i, record := range records {
+		line := i + 2
+
+		severity := ParseSeverity(record["severity"])
+		if severity == models.InteractionSeverityUnknown {
+			result.Skipped = append(result.Skipped, fmt.Sprintf("line %d: unknown severity %q", line, record["severity"]))
+			continue
+		}
+
+		drugAID, created, err := findOrCreateDrug(ctx, tx, record["drug_a"])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		result.Drugs += created
+
+		drugBID, created, err := findOrCreateDrug(ctx, tx, record["drug_b"])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		result.Drugs += created
+
+		if drugAID == drugBID {
+			result.Skipped = append(result.Skipped, fmt.Sprintf("line %d: both drugs are the same", line))
+			continue
+		}
+		if drugAID > drugBID {
+			drugAID, drugBID = drugBID, drugAID
+		}
+
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO drug_interactions (drug_a_id, drug_b_id, severity, description, management, created_at, updated_at)
+			VALUES ($1, $2, $3, NULLIF($4, ''), NULLIF($5, ''), NOW(), NOW())
+			ON CONFLICT (drug_a_id, drug_b_id) DO UPDATE
+			SET severity = EXCLUDED.severity, description = EXCLUDED.description,
+				management = EXCLUDED.management, updated_at = NOW()`,
+			drugAID, drugBID, severity, record["description"], record["management"])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: error saving interaction: %v", line, err)
+		}
+		result.Interactions++
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// upsertDrug creates a drug or updates the names of an existing one
+func upsertDrug(ctx context.Context, tx *sql.Tx, genericName, nameFa, nameEn string) (int64, error) {
+	var id int64
+	err := tx.QueryRowContext(ctx, `
+		INSERT INTO drugs (generic_name, name_fa, name_en, normalized_name, created_at, updated_at)
+		VALUES ($1, NULLIF($2, ''), NULLIF($3, ''), $4, NOW(), NOW())
+		ON CONFLICT (normalized_name) DO UPDATE
+		SET name_fa = COALESCE(EXCLUDED.name_fa, drugs.name_fa),
+			name_en = COALESCE(EXCLUDED.name_en, drugs.name_en),
+			updated_at = NOW()
+		RETURNING id`,
+		strings.TrimSpace(genericName), strings.TrimSpace(nameFa), strings.TrimSpace(nameEn), normalizeKey(genericName),
+	).Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("error saving drug %q: %v", genericName, err)
+	}
+	return id, nil
+}
+
+// addSynonyms links the names to the drug, skipping names already used by any drug
+func addSynonyms(ctx context.Context, tx *sql.Tx, drugID int64, names []string) (int, error) {
+	added := 0
+	for _, name := range names {
+		key := normalizeKey(name)
+		if key == "" {
+			continue
+		}
+
+		res, err := tx.ExecContext(ctx, `
+			INSERT INTO drug_synonyms (drug_id, synonym, normalized_synonym)
+			VALUES ($1, $2, $3)
+			ON CONFLICT (normalized_synonym) DO NOTHING`,
+			drugID, strings.TrimSpace(name), key)
+		if err != nil {
+			return added, fmt.Errorf("error saving synonym %q: %v", name, err)
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			added++
+		}
+	}
+	return added, nil
+}
+
+// findOrCreateDrug looks a drug up by synonym, creating it when unknown.
+// It reports 1 when a drug was created.
+func findOrCreateDrug(ctx context.Context, tx *sql.Tx, name string) (int64, int, error) {
+	key := normalizeKey(name)
+	if key == "" {
+		return 0, 0, errors.New("missing drug name")
+	}
+
+	var id int64
+	err := tx.QueryRowContext(ctx, `SELECT drug_id FROM drug_synonyms WHERE normalized_synonym = $1`, key).Scan(&id)
+	if err == nil {
+		return id, 0, nil
+	}
+	if err != sql.ErrNoRows {
+		return 0, 0, err
+	}
+
+	id, err = upsertDrug(ctx, tx, name, "", "")
+	if err != nil {
+		return 0, 0, err
+	}
+	if _, err := addSynonyms(ctx, tx, id, []string{name}); err != nil {
+		return 0, 0, err
+	}
+	return id, 1, nil
+}
+
+// readCSV reads a CSV file with a header row into records keyed by column
+// name, checking that the required columns are present
+func readCSV(r io.Reader, required ...string) ([]map[string]string, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("error reading CSV header: %v", err)
+	}
+
+	columns := make([]string, len(header))
+	present := make(map[string]bool)
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+		columns[i] = name
+		present[name] = true
+	}
+	for _, name := range required {
+		if !present[name] {
+			return nil, fmt.Errorf("CSV is missing required column %q", name)
+		}
+	}
+
+	var records []map[string]string
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading CSV: %v", err)
+		}
+
+		record := make(map[string]string, len(columns))
+		for i, value := range row {
+			if i < len(columns) {
+				record[columns[i]] = strings.TrimSpace(value)
+			}
+		}
+		records = append(records, record)
+	}
+
+	return records, nil
+}
@@ -0,0 +1,28 @@
+package druginteractions
+
+import (
+	"context"
+
+	"github.com/darooyar/server/models"
+)
+
+// KnowledgeBase checks drugs against the known interactions. Postgres
+// implements it with the functions of this package, so that handlers can be
+// given another knowledge base in tests.
+type KnowledgeBase interface {
+	Check(ctx context.Context, names []string) (*models.InteractionCheckResult, error)
+	Reconcile(ctx context.Context, aiInteractions []models.DrugInteraction, drugNames []string) ([]models.KnownInteraction, []models.InteractionContradiction, error)
+}
+
+// Postgres implements KnowledgeBase with the drug tables of the database
+type Postgres struct{}
+
+var _ KnowledgeBase = Postgres{}
+
+func (Postgres) Check(ctx context.Context, names []string) (*models.InteractionCheckResult, error) {
+	return Check(ctx, names)
+}
+
+func (Postgres) Reconcile(ctx context.Context, aiInteractions []models.DrugInteraction, drugNames []string) ([]models.KnownInteraction, []models.InteractionContradiction, error) {
+	return Reconcile(ctx, aiInteractions, drugNames)
+}
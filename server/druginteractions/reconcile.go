@@ -0,0 +1,116 @@
+package druginteractions
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/darooyar/server/models"
+)
+
+// severityLabels are the Persian names of severities used in contradiction messages
+var severityLabels = map[models.InteractionSeverity]string{
+	models.InteractionSeverityMajor:    "شدید",
+	models.InteractionSeverityModerate: "متوسط",
+	models.InteractionSeverityMinor:    "خفیف",
+	models.InteractionSeverityUnknown:  "نامشخص",
+}
+
+// drugPair identifies an unordered pair of drugs of the knowledge base
+type drugPair struct {
+	a, b int64
+}
+
+// newDrugPair orders the IDs so that the pair matches the drug_interactions table
+func newDrugPair(a, b int64) drugPair {
+	if a > b {
+		a, b = b, a
+	}
+	return drugPair{a: a, b: b}
+}
+
+// Reconcile checks the drugs of an AI analysis against the knowledge base and
+// flags where the AI interactions disagree with it: known interactions the AI
+// missed, interactions reported with a different severity, and interactions
+// between known drugs that the knowledge base does not list.
+func Reconcile(ctx context.Context, aiInteractions []models.DrugInteraction, drugNames []string) ([]models.KnownInteraction, []models.InteractionContradiction, error) {
+	// Interactions may mention drugs the parser did not list separately
+	names := append([]string{}, drugNames...)
+	for _, interaction := range aiInteractions {
+		names = append(names, interaction.DrugA, interaction.DrugB)
+	}
+
+	resolved, _, known, err := check(ctx, names)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	drugIDs := make(map[string]int64, len(resolved))
+	for _, drug := range resolved {
+		drugIDs[drug.Input] = drug.DrugID
+	}
+
+	knownByPair := make(map[drugPair]knownInteraction, len(known))
+	knownInteractions := []models.KnownInteraction{}
+	for _, interaction := range known {
+		knownByPair[newDrugPair(interaction.drugAID, interaction.drugBID)] = interaction
+		knownInteractions = append(knownInteractions, interaction.KnownInteraction)
+	}
+
+	contradictions := []models.InteractionContradiction{}
+	mentioned := make(map[drugPair]bool)
+	for _, interaction := range aiInteractions {
+		drugAID, okA := drugIDs[interaction.DrugA]
+		drugBID, okB := drugIDs[interaction.DrugB]
+		if !okA || !okB || drugAID == drugBID {
+			// Nothing to compare against when a drug is not in the knowledge base
+			continue
+		}
+
+		pair := newDrugPair(drugAID, drugBID)
+		if mentioned[pair] {
+			continue
+		}
+		mentioned[pair] = true
+
+		k, ok := knownByPair[pair]
+		if !ok {
+			contradictions = append(contradictions, models.InteractionContradiction{
+				Kind:       models.ContradictionUnconfirmed,
+				DrugA:      interaction.DrugA,
+				DrugB:      interaction.DrugB,
+				AISeverity: interaction.Severity,
+				Message: fmt.Sprintf("تداخل %s و %s در پایگاه داده تداخلات دارویی ثبت نشده است.",
+					interaction.DrugA, interaction.DrugB),
+			})
+			continue
+		}
+
+		if interaction.Severity != models.InteractionSeverityUnknown && interaction.Severity != k.Severity {
+			contradictions = append(contradictions, models.InteractionContradiction{
+				Kind:          models.ContradictionSeverityMismatch,
+				DrugA:         k.DrugA,
+				DrugB:         k.DrugB,
+				AISeverity:    interaction.Severity,
+				KnownSeverity: k.Severity,
+				Message: fmt.Sprintf("شدت تداخل %s و %s در تحلیل %s ذکر شده اما در پایگاه داده %s است.",
+					k.DrugA, k.DrugB, severityLabels[interaction.Severity], severityLabels[k.Severity]),
+			})
+		}
+	}
+
+	for _, interaction := range known {
+		if mentioned[newDrugPair(interaction.drugAID, interaction.drugBID)] {
+			continue
+		}
+		contradictions = append(contradictions, models.InteractionContradiction{
+			Kind:          models.ContradictionMissed,
+			DrugA:         interaction.DrugA,
+			DrugB:         interaction.DrugB,
+			KnownSeverity: interaction.Severity,
+			Message: fmt.Sprintf("تداخل %s بین %s و %s در تحلیل ذکر نشده است.",
+				severityLabels[interaction.Severity], interaction.DrugA, interaction.DrugB),
+		})
+	}
+
+	return knownInteractions, contradictions, nil
+}
@@ -0,0 +1,235 @@
+// Package druginteractions is a local knowledge base of drug-drug
+// interactions used to check prescriptions deterministically, independent of
+// the AI analysis.
+package druginteractions
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/darooyar/server/db"
+	"github.com/darooyar/server/models"
+	"github.com/darooyar/server/textnorm"
+	"github.com/lib/pq"
+)
+
+// severityRank orders severities from least to most serious
+var severityRank = map[models.InteractionSeverity]int{
+	models.InteractionSeverityUnknown:  0,
+	models.InteractionSeverityMinor:    1,
+	models.InteractionSeverityModerate: 2,
+	models.InteractionSeverityMajor:    3,
+}
+
+// knownInteraction is an interaction of the knowledge base with the IDs of its drugs
+type knownInteraction struct {
+	models.KnownInteraction
+	drugAID int64
+	drugBID int64
+}
+
+// Resolve maps drug names as written in a prescription to drugs of the
+// knowledge base. Names are matched on their normalized full text or on any
+// run of up to three words, preferring the longest match, so that strengths
+// and dosage forms around the name do not prevent a match.
+func Resolve(ctx context.Context, names []string) ([]models.ResolvedDrug, []string, error) {
+	candidatesByName := make([][]string, len(names))
+	var allCandidates []string
+	for i, name := range names {
+		candidatesByName[i] = candidateKeys(name)
+		allCandidates = append(allCandidates, candidatesByName[i]...)
+	}
+
+	resolved := []models.ResolvedDrug{}
+	unresolved := []string{}
+	if len(allCandidates) == 0 {
+		return resolved, append(unresolved, names...), nil
+	}
+
+	query := `
+		SELECT s.normalized_synonym, d.id, d.generic_name, COALESCE(d.name_fa, ''), COALESCE(d.name_en, '')
+		FROM drug_synonyms s
+		JOIN drugs d ON d.id = s.drug_id
+		WHERE s.normalized_synonym = ANY($1)`
+
+	rows, err := db.DB.QueryContext(ctx, query, pq.Array(allCandidates))
+	if err != nil {
+		return nil, nil, fmt.Errorf("error resolving drug names: %v", err)
+	}
+	defer rows.Close()
+
+	matches := make(map[string]models.ResolvedDrug)
+	for rows.Next() {
+		var key string
+		var drug models.ResolvedDrug
+		if err := rows.Scan(&key, &drug.DrugID, &drug.GenericName, &drug.NameFa, &drug.NameEn); err != nil {
+			return nil, nil, err
+		}
+		matches[key] = drug
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	for i, name := range names {
+		best := ""
+		for _, candidate := range candidatesByName[i] {
+			if _, ok := matches[candidate]; ok && utf8.RuneCountInString(candidate) > utf8.RuneCountInString(best) {
+				best = candidate
+			}
+		}
+
+		if best == "" {
+			unresolved = append(unresolved, name)
+			continue
+		}
+
+		drug := matches[best]
+		drug.Input = name
+		resolved = append(resolved, drug)
+	}
+
+	return resolved, unresolved, nil
+}
+
+// Check resolves the drug names and returns every known interaction between them
+func Check(ctx context.Context, names []string) (*models.InteractionCheckResult, error) {
+	resolved, unresolved, known, err := check(ctx, names)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &models.InteractionCheckResult{
+		Drugs:        resolved,
+		Unresolved:   unresolved,
+		Interactions: []models.KnownInteraction{},
+	}
+	for _, interaction := range known {
+		result.Interactions = append(result.Interactions, interaction.KnownInteraction)
+	}
+
+	return result, nil
+}
+
+// check resolves the names and loads the interactions between the resolved drugs
+func check(ctx context.Context, names []string) ([]models.ResolvedDrug, []string, []knownInteraction, error) {
+	resolved, unresolved, err := Resolve(ctx, names)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	ids := make([]int64, 0, len(resolved))
+	seen := make(map[int64]bool)
+	for _, drug := range resolved {
+		if !seen[drug.DrugID] {
+			seen[drug.DrugID] = true
+			ids = append(ids, drug.DrugID)
+		}
+	}
+
+	if len(ids) < 2 {
+		return resolved, unresolved, nil, nil
+	}
+
+	known, err := interactionsBetween(ctx, ids)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return resolved, unresolved, known, nil
+}
+
+// interactionsBetween loads all interactions among the given drugs, most severe first
+func interactionsBetween(ctx context.Context, ids []int64) ([]knownInteraction, error) {
+	query := `
+		SELECT i.drug_a_id, i.drug_b_id, a.generic_name, b.generic_name, i.severity,
+			COALESCE(i.description, ''), COALESCE(i.management, '')
+		FROM drug_interactions i
+		JOIN drugs a ON a.id = i.drug_a_id
+		JOIN drugs b ON b.id = i.drug_b_id
+		WHERE i.drug_a_id = ANY($1) AND i.drug_b_id = ANY($1)`
+
+	rows, err := db.DB.QueryContext(ctx, query, pq.Array(ids))
+	if err != nil {
+		return nil, fmt.Errorf("error loading drug interactions: %v", err)
+	}
+	defer rows.Close()
+
+	var known []knownInteraction
+	for rows.Next() {
+		var k knownInteraction
+		err := rows.Scan(
+			&k.drugAID,
+			&k.drugBID,
+			&k.DrugA,
+			&k.DrugB,
+			&k.Severity,
+			&k.Description,
+			&k.Management,
+		)
+		if err != nil {
+			return nil, err
+		}
+		known = append(known, k)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Sort so that the same drugs always produce the same result
+	sort.Slice(known, func(i, j int) bool {
+		if severityRank[known[i].Severity] != severityRank[known[j].Severity] {
+			return severityRank[known[i].Severity] > severityRank[known[j].Severity]
+		}
+		if known[i].DrugA != known[j].DrugA {
+			return known[i].DrugA < known[j].DrugA
+		}
+		return known[i].DrugB < known[j].DrugB
+	})
+
+	return known, nil
+}
+
+// candidateKeys returns the normalized full name and every run of up to
+// three words of it that could be stored as a synonym
+func candidateKeys(name string) []string {
+	keys := []string{}
+	if full := normalizeKey(name); full != "" {
+		keys = append(keys, full)
+	}
+
+	words := textnorm.Fields(name)
+	for size := 3; size >= 1; size-- {
+		for i := 0; i+size <= len(words); i++ {
+			key := strings.Join(words[i:i+size], " ")
+			if size == 1 && utf8.RuneCountInString(key) < 3 {
+				continue
+			}
+			keys = append(keys, key)
+		}
+	}
+
+	return keys
+}
+
+// normalizeKey is the form in which drug names and synonyms are stored and looked up
+func normalizeKey(name string) string {
+	return strings.Join(textnorm.Fields(name), " ")
+}
+
+// ParseSeverity maps a severity written in English or Persian to a severity
+func ParseSeverity(value string) models.InteractionSeverity {
+	switch textnorm.Normalize(strings.TrimSpace(value)) {
+	case "major", "severe", "high", "contraindicated", "شدید", "جدی", "بالا", "خطرناک", "منع مصرف":
+		return models.InteractionSeverityMajor
+	case "moderate", "medium", "متوسط":
+		return models.InteractionSeverityModerate
+	case "minor", "mild", "low", "خفیف", "جزیی", "جزئی", "کم":
+		return models.InteractionSeverityMinor
+	default:
+		return models.InteractionSeverityUnknown
+	}
+}
@@ -0,0 +1,33 @@
+package formulary
+
+import (
+	"context"
+
+	"github.com/darooyar/server/models"
+)
+
+// Catalog looks up drugs of the formulary. Postgres implements it with the
+// functions of this package, so that handlers can be given another catalog in
+// tests.
+type Catalog interface {
+	Available(ctx context.Context) bool
+	Search(ctx context.Context, query string, limit int) ([]models.FormularyMatch, error)
+	FindDrugs(ctx context.Context, text string) ([]models.FormularyMatch, error)
+}
+
+// Postgres implements Catalog with the index of the formulary table
+type Postgres struct{}
+
+var _ Catalog = Postgres{}
+
+func (Postgres) Available(ctx context.Context) bool {
+	return Available(ctx)
+}
+
+func (Postgres) Search(ctx context.Context, query string, limit int) ([]models.FormularyMatch, error) {
+	return Search(ctx, query, limit)
+}
+
+func (Postgres) FindDrugs(ctx context.Context, text string) ([]models.FormularyMatch, error) {
+	return FindDrugs(ctx, text)
+}
@@ -0,0 +1,288 @@
+package formulary
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/csv"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/darooyar/server/db"
+	"github.com/darooyar/server/models"
+	"github.com/darooyar/server/textnorm"
+)
+
+// ImportResult summarizes a formulary import
+type ImportResult struct {
+	Created int      `json:"created"`
+	Updated int      `json:"updated"`
+	Skipped []string `json:"skipped,omitempty"`
+}
+
+// columnAliases maps the column names used by exports of the national drug
+// list, in English and Persian, to formulary fields
+var columnAliases = map[string][]string{
+	"code":            {"code", "generic code", "irc", "کد", "کد ژنریک"},
+	"generic_name":    {"generic name", "generic", "name", "نام ژنریک", "ژنریک"},
+	"generic_name_fa": {"generic name fa", "name fa", "persian name", "نام فارسی", "نام فارسی ژنریک"},
+	"brand_name":      {"brand name", "brand", "trade name", "نام تجاری", "برند"},
+	"dosage_form":     {"dosage form", "form", "شکل دارویی", "شکل"},
+	"strength":        {"strength", "dose", "قدرت", "دوز", "مقدار"},
+}
+
+// ImportCSV imports the formulary from a CSV export of the national drug list
+func ImportCSV(ctx context.Context, r io.Reader) (*ImportResult, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	rows, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("error reading CSV: %v", err)
+	}
+	return importRows(ctx, rows)
+}
+
+// ImportXLSX imports the formulary from the first sheet of an Excel export of
+// the national drug list
+func ImportXLSX(ctx context.Context, r io.ReaderAt, size int64) (*ImportResult, error) {
+	rows, err := readXLSX(r, size)
+	if err != nil {
+		return nil, err
+	}
+	return importRows(ctx, rows)
+}
+
+// importRows stores the rows below the header row in a single transaction
+func importRows(ctx context.Context, rows [][]string) (*ImportResult, error) {
+	if len(rows) == 0 {
+		return nil, errors.New("file is empty")
+	}
+
+	columns, err := mapColumns(rows[0])
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := db.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	result := &ImportResult{}
+	for i, row := range rows[1:] {
+		line := i + 2
+		value := func(field string) string {
+			if col, ok := columns[field]; ok && col < len(row) {
+				return strings.TrimSpace(row[col])
+			}
+			return ""
+		}
+
+		drug := models.FormularyDrug{
+			Code:          value("code"),
+			GenericName:   value("generic_name"),
+			GenericNameFa: value("generic_name_fa"),
+			BrandName:     value("brand_name"),
+			DosageForm:    value("dosage_form"),
+			Strength:      value("strength"),
+		}
+		if normalizeName(drug.GenericName) == "" {
+			result.Skipped = append(result.Skipped, fmt.Sprintf("line %d: missing generic name", line))
+			continue
+		}
+
+		inserted, err := upsertDrug(ctx, tx, &drug)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		if inserted {
+			result.Created++
+		} else {
+			result.Updated++
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	Invalidate()
+	return result, nil
+}
+
+// mapColumns finds the column of every known field in the header row
+func mapColumns(header []string) (map[string]int, error) {
+	aliases := make(map[string]string)
+	for field, names := range columnAliases {
+		aliases[normalizeHeader(field)] = field
+		for _, name := range names {
+			aliases[normalizeHeader(name)] = field
+		}
+	}
+
+	columns := make(map[string]int)
+	for i, name := range header {
+		field, ok := aliases[normalizeHeader(name)]
+		if !ok {
+			continue
+		}
+		if _, seen := columns[field]; !seen {
+			columns[field] = i
+		}
+	}
+
+	if _, ok := columns["generic_name"]; !ok {
+		return nil, errors.New("header has no generic name column")
+	}
+	return columns, nil
+}
+
+// normalizeHeader makes "Generic_Name", "generic name" and "GENERIC-NAME" equal
+func normalizeHeader(name string) string {
+	name = strings.TrimPrefix(name, "\ufeff")
+	return strings.Join(textnorm.Fields(strings.ReplaceAll(name, "_", " ")), " ")
+}
+
+// xlsxCell is a cell of a worksheet
+type xlsxCell struct {
+	Ref    string `xml:"r,attr"`
+	Type   string `xml:"t,attr"`
+	Value  string `xml:"v"`
+	Inline struct {
+		Text string     `xml:"t"`
+		Runs []xlsxText `xml:"r"`
+	} `xml:"is"`
+}
+
+// xlsxText is a run of text in a shared or inline string
+type xlsxText struct {
+	Text string `xml:"t"`
+}
+
+// xlsxWorksheet is the part of a worksheet holding the cell values
+type xlsxWorksheet struct {
+	Rows []struct {
+		Cells []xlsxCell `xml:"c"`
+	} `xml:"sheetData>row"`
+}
+
+// xlsxSharedStrings is the table of strings referenced by cells
+type xlsxSharedStrings struct {
+	Items []struct {
+		Text string     `xml:"t"`
+		Runs []xlsxText `xml:"r"`
+	} `xml:"si"`
+}
+
+// readXLSX reads the cell values of the first worksheet of an Excel file
+func readXLSX(r io.ReaderAt, size int64) ([][]string, error) {
+	archive, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, fmt.Errorf("error opening Excel file: %v", err)
+	}
+
+	files := make(map[string]*zip.File)
+	var sheetName string
+	for _, f := range archive.File {
+		files[f.Name] = f
+		if path.Dir(f.Name) == "xl/worksheets" && strings.HasSuffix(f.Name, ".xml") {
+			if sheetName == "" || f.Name == "xl/worksheets/sheet1.xml" {
+				sheetName = f.Name
+			}
+		}
+	}
+	if sheetName == "" {
+		return nil, errors.New("Excel file has no worksheet")
+	}
+
+	var shared xlsxSharedStrings
+	if f, ok := files["xl/sharedStrings.xml"]; ok {
+		if err := decodeZipXML(f, &shared); err != nil {
+			return nil, fmt.Errorf("error reading shared strings: %v", err)
+		}
+	}
+	strs := make([]string, len(shared.Items))
+	for i, item := range shared.Items {
+		strs[i] = joinText(item.Text, item.Runs)
+	}
+
+	var sheet xlsxWorksheet
+	if err := decodeZipXML(files[sheetName], &sheet); err != nil {
+		return nil, fmt.Errorf("error reading worksheet: %v", err)
+	}
+
+	rows := make([][]string, 0, len(sheet.Rows))
+	for _, xr := range sheet.Rows {
+		var row []string
+		for i, cell := range xr.Cells {
+			col := columnIndex(cell.Ref)
+			if col < 0 {
+				col = i
+			}
+			for len(row) <= col {
+				row = append(row, "")
+			}
+
+			switch cell.Type {
+			case "s":
+				n, err := strconv.Atoi(cell.Value)
+				if err == nil && n >= 0 && n < len(strs) {
+					row[col] = strs[n]
+				}
+			case "inlineStr":
+				row[col] = joinText(cell.Inline.Text, cell.Inline.Runs)
+			default:
+				row[col] = cell.Value
+			}
+		}
+		rows = append(rows, row)
+	}
+
+	return rows, nil
+}
+
+// decodeZipXML decodes an XML file of a zip archive
+func decodeZipXML(f *zip.File, v interface{}) error {
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	return xml.NewDecoder(rc).Decode(v)
+}
+
+// joinText returns the text of a string that is either plain or made of rich text runs
+func joinText(text string, runs []xlsxText) string {
+	if len(runs) == 0 {
+		return text
+	}
+	var b strings.Builder
+	for _, run := range runs {
+		b.WriteString(run.Text)
+	}
+	return b.String()
+}
+
+// columnIndex converts the column letters of a cell reference such as "AB12" to a zero-based index
+func columnIndex(ref string) int {
+	col := 0
+	letters := 0
+	for _, r := range ref {
+		if r < 'A' || r > 'Z' {
+			break
+		}
+		col = col*26 + int(r-'A'+1)
+		letters++
+	}
+	if letters == 0 {
+		return -1
+	}
+	return col - 1
+}
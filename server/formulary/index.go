@@ -0,0 +1,336 @@
+package formulary
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/darooyar/server/models"
+	"github.com/darooyar/server/textnorm"
+)
+
+const (
+	// indexTTL is how long the in-memory index is used before it is reloaded,
+	// so that imports made by another process are picked up
+	indexTTL = 10 * time.Minute
+	// minMatchRunes is the shortest name or phonetic key matched in free text
+	minMatchRunes = 3
+	// minFuzzyKeyLength is the shortest phonetic key matched with a typo in free text
+	minFuzzyKeyLength = 5
+	// minSearchSimilarity is the lowest similarity a fuzzy search result may have
+	minSearchSimilarity = 0.75
+	// maxWordsPerName bounds the number of words of a name matched in free text
+	maxWordsPerName = 3
+)
+
+// indexedName is one name of a drug in the forms used for matching
+type indexedName struct {
+	text       string
+	normalized string
+	phonetic   string
+}
+
+// indexEntry is a drug with all of its names
+type indexEntry struct {
+	drug  models.FormularyDrug
+	names []indexedName
+}
+
+// index is an in-memory copy of the formulary prepared for matching
+type index struct {
+	entries      []indexEntry
+	byNormalized map[string][]int
+	byPhonetic   map[string][]int
+	// wordKeys are the distinct single-word phonetic keys, used for fuzzy lookups
+	wordKeys []string
+}
+
+var (
+	indexMu       sync.Mutex
+	cachedIndex   *index
+	indexLoadedAt time.Time
+)
+
+// newIndex builds an index of the given drugs
+func newIndex(drugs []models.FormularyDrug) *index {
+	idx := &index{
+		entries:      make([]indexEntry, 0, len(drugs)),
+		byNormalized: make(map[string][]int),
+		byPhonetic:   make(map[string][]int),
+	}
+
+	wordKeys := make(map[string]bool)
+	for i, drug := range drugs {
+		entry := indexEntry{drug: drug}
+		for _, name := range []string{drug.GenericName, drug.GenericNameFa, drug.BrandName} {
+			normalized := normalizeName(name)
+			if normalized == "" {
+				continue
+			}
+
+			n := indexedName{text: name, normalized: normalized, phonetic: phoneticKey(name)}
+			entry.names = append(entry.names, n)
+			idx.byNormalized[n.normalized] = appendUnique(idx.byNormalized[n.normalized], i)
+			if n.phonetic != "" {
+				idx.byPhonetic[n.phonetic] = appendUnique(idx.byPhonetic[n.phonetic], i)
+				if !strings.Contains(n.normalized, " ") {
+					wordKeys[n.phonetic] = true
+				}
+			}
+		}
+		idx.entries = append(idx.entries, entry)
+	}
+
+	for key := range wordKeys {
+		idx.wordKeys = append(idx.wordKeys, key)
+	}
+	sort.Strings(idx.wordKeys)
+
+	return idx
+}
+
+// currentIndex returns the cached index, reloading it from the database when
+// it is older than indexTTL. If reloading fails the previous index is kept.
+func currentIndex(ctx context.Context) (*index, error) {
+	indexMu.Lock()
+	defer indexMu.Unlock()
+
+	if cachedIndex != nil && time.Since(indexLoadedAt) < indexTTL {
+		return cachedIndex, nil
+	}
+
+	drugs, err := loadDrugs(ctx)
+	if err != nil {
+		if cachedIndex != nil {
+			slog.Error("Error reloading formulary, using the previous copy", "error", err)
+			return cachedIndex, nil
+		}
+		return nil, err
+	}
+
+	cachedIndex = newIndex(drugs)
+	indexLoadedAt = time.Now()
+	slog.Info("Loaded formulary index", "drugs", len(drugs))
+	return cachedIndex, nil
+}
+
+// Invalidate drops the cached index so that the next lookup reloads it
+func Invalidate() {
+	indexMu.Lock()
+	defer indexMu.Unlock()
+	cachedIndex = nil
+}
+
+// Available reports whether the formulary has been imported
+func Available(ctx context.Context) bool {
+	idx, err := currentIndex(ctx)
+	if err != nil {
+		slog.Error("Error loading formulary", "error", err)
+		return false
+	}
+	return len(idx.entries) > 0
+}
+
+// Search returns the drugs whose generic or brand name best matches the
+// query, for autocomplete. Queries may be partial, written in Persian or
+// Latin letters, and contain small typos.
+func Search(ctx context.Context, query string, limit int) ([]models.FormularyMatch, error) {
+	idx, err := currentIndex(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return idx.search(query, limit), nil
+}
+
+// FindDrugs returns the drugs mentioned in a free text such as a
+// prescription, one match per generic name
+func FindDrugs(ctx context.Context, text string) ([]models.FormularyMatch, error) {
+	idx, err := currentIndex(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return idx.find(text), nil
+}
+
+// search scores every drug against the query
+func (idx *index) search(query string, limit int) []models.FormularyMatch {
+	normalized := normalizeName(query)
+	if normalized == "" {
+		return []models.FormularyMatch{}
+	}
+	phonetic := phoneticKey(query)
+
+	matches := []models.FormularyMatch{}
+	for _, entry := range idx.entries {
+		best := models.FormularyMatch{}
+		for _, name := range entry.names {
+			if score := scoreName(normalized, phonetic, name); score > best.Score {
+				best = models.FormularyMatch{Drug: entry.drug, MatchedName: name.text, Score: score}
+			}
+		}
+		if best.Score > 0 {
+			matches = append(matches, best)
+		}
+	}
+
+	sortMatches(matches)
+	if limit > 0 && len(matches) > limit {
+		matches = matches[:limit]
+	}
+	return matches
+}
+
+// scoreName scores how well a query matches a name, from 0 for no match to 1
+// for an exact match. Exact and prefix matches of the text rank above
+// matches on pronunciation, which rank above fuzzy matches.
+func scoreName(normalized, phonetic string, name indexedName) float64 {
+	queryLength := utf8.RuneCountInString(normalized)
+	nameLength := utf8.RuneCountInString(name.normalized)
+
+	switch {
+	case name.normalized == normalized:
+		return 1
+	case strings.HasPrefix(name.normalized, normalized):
+		return 0.8 + 0.1*float64(queryLength)/float64(nameLength)
+	case phonetic != "" && name.phonetic == phonetic:
+		return 0.75
+	case strings.Contains(" "+name.normalized, " "+normalized):
+		// A later word of the name starts with the query
+		return 0.7
+	case len(phonetic) >= 2 && strings.HasPrefix(name.phonetic, phonetic):
+		return 0.6 + 0.1*float64(len(phonetic))/float64(len(name.phonetic))
+	}
+
+	if queryLength < minMatchRunes {
+		return 0
+	}
+
+	sim := max(
+		similarity(normalized, name.normalized),
+		prefixSimilarity(normalized, name.normalized),
+	)
+	if len(phonetic) >= minMatchRunes {
+		sim = max(sim, similarity(phonetic, name.phonetic), prefixSimilarity(phonetic, name.phonetic))
+	}
+	if sim < minSearchSimilarity {
+		return 0
+	}
+	return 0.5 * sim
+}
+
+// find looks for drug names in the words of a text, preferring longer names
+// and exact spellings over pronunciation and typos
+func (idx *index) find(text string) []models.FormularyMatch {
+	words := textnorm.Fields(text)
+	used := make([]bool, len(words))
+	found := make(map[string]int)
+	matches := []models.FormularyMatch{}
+
+	add := func(entries []int, matchedName string, score float64) {
+		for _, i := range entries {
+			drug := idx.entries[i].drug
+			key := normalizeName(drug.GenericName)
+			if j, ok := found[key]; ok {
+				if score > matches[j].Score {
+					matches[j].Score = score
+					matches[j].MatchedName = matchedName
+				}
+				continue
+			}
+			found[key] = len(matches)
+			matches = append(matches, models.FormularyMatch{Drug: drug, MatchedName: matchedName, Score: score})
+		}
+	}
+
+	for size := maxWordsPerName; size >= 1; size-- {
+		for start := 0; start+size <= len(words); start++ {
+			if anyUsed(used[start : start+size]) {
+				continue
+			}
+
+			phrase := strings.Join(words[start:start+size], " ")
+			if utf8.RuneCountInString(phrase) < minMatchRunes {
+				continue
+			}
+
+			matched := false
+			if entries, ok := idx.byNormalized[phrase]; ok {
+				add(entries, phrase, 1)
+				matched = true
+			} else if key := phoneticKey(phrase); len(key) >= minMatchRunes {
+				if entries, ok := idx.byPhonetic[key]; ok {
+					add(entries, phrase, 0.9)
+					matched = true
+				} else if size == 1 && len(key) >= minFuzzyKeyLength {
+					for _, candidate := range idx.wordKeys {
+						if abs(len(candidate)-len(key)) <= 1 && levenshtein(candidate, key) <= 1 {
+							add(idx.byPhonetic[candidate], phrase, 0.8)
+							matched = true
+						}
+					}
+				}
+			}
+
+			if matched {
+				for i := start; i < start+size; i++ {
+					used[i] = true
+				}
+			}
+		}
+	}
+
+	sortMatches(matches)
+	return matches
+}
+
+// sortMatches orders matches by score, then by name, so results are stable
+func sortMatches(matches []models.FormularyMatch) {
+	sort.SliceStable(matches, func(i, j int) bool {
+		a, b := matches[i], matches[j]
+		if a.Score != b.Score {
+			return a.Score > b.Score
+		}
+		if a.Drug.GenericName != b.Drug.GenericName {
+			return a.Drug.GenericName < b.Drug.GenericName
+		}
+		if a.Drug.BrandName != b.Drug.BrandName {
+			return a.Drug.BrandName < b.Drug.BrandName
+		}
+		if a.Drug.DosageForm != b.Drug.DosageForm {
+			return a.Drug.DosageForm < b.Drug.DosageForm
+		}
+		return a.Drug.Strength < b.Drug.Strength
+	})
+}
+
+// normalizeName is the form in which names are compared
+func normalizeName(name string) string {
+	return strings.Join(textnorm.Fields(name), " ")
+}
+
+func appendUnique(list []int, value int) []int {
+	if len(list) > 0 && list[len(list)-1] == value {
+		return list
+	}
+	return append(list, value)
+}
+
+func anyUsed(used []bool) bool {
+	for _, u := range used {
+		if u {
+			return true
+		}
+	}
+	return false
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
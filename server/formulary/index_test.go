@@ -0,0 +1,182 @@
+package formulary
+
+import (
+	"testing"
+
+	"github.com/darooyar/server/models"
+)
+
+// testIndex indexes a few drugs, with amoxicillin in two dosage forms
+func testIndex() *index {
+	return newIndex([]models.FormularyDrug{
+		{ID: 1, GenericName: "Amoxicillin", GenericNameFa: "آموکسی سیلین", BrandName: "Amoxil", DosageForm: "CAP", Strength: "500mg"},
+		{ID: 2, GenericName: "Amoxicillin", GenericNameFa: "آموکسی سیلین", DosageForm: "SUSP", Strength: "250mg/5ml"},
+		{ID: 3, GenericName: "Acetaminophen", GenericNameFa: "استامینوفن", BrandName: "Tylenol", DosageForm: "TAB", Strength: "500mg"},
+		{ID: 4, GenericName: "Ibuprofen", GenericNameFa: "ایبوپروفن", BrandName: "Brufen", DosageForm: "TAB", Strength: "400mg"},
+		{ID: 5, GenericName: "Warfarin", GenericNameFa: "وارفارین", BrandName: "Coumadin", DosageForm: "TAB", Strength: "5mg"},
+		{ID: 6, GenericName: "Sertraline", GenericNameFa: "سرترالین", BrandName: "Zoloft", DosageForm: "TAB", Strength: "50mg"},
+	})
+}
+
+func TestSearch(t *testing.T) {
+	tests := []struct {
+		name        string
+		query       string
+		wantGeneric string // Generic name of the best match, or empty for no match
+		wantMatched string // Name of the drug that matched
+		wantExact   bool   // Whether the match scores 1
+	}{
+		{name: "generic name", query: "warfarin", wantGeneric: "Warfarin", wantMatched: "Warfarin", wantExact: true},
+		{name: "persian generic name", query: "وارفارین", wantGeneric: "Warfarin", wantMatched: "وارفارین", wantExact: true},
+		{name: "brand name", query: "Coumadin", wantGeneric: "Warfarin", wantMatched: "Coumadin", wantExact: true},
+		{name: "brand name in persian letters", query: "تیلنول", wantGeneric: "Acetaminophen", wantMatched: "Tylenol"},
+		{name: "misspelled brand name", query: "kumadin", wantGeneric: "Warfarin", wantMatched: "Coumadin"},
+		{name: "english misspelling", query: "amoxicilin", wantGeneric: "Amoxicillin"},
+		{name: "english misspelling of vowel", query: "ibuprofin", wantGeneric: "Ibuprofen", wantMatched: "Ibuprofen"},
+		{name: "english phonetic spelling", query: "asetaminofen", wantGeneric: "Acetaminophen", wantMatched: "Acetaminophen"},
+		{name: "persian name without space", query: "آموکسیسیلین", wantGeneric: "Amoxicillin"},
+		{name: "persian name without alef madda", query: "اموکسی سیلین", wantGeneric: "Amoxicillin"},
+		{name: "persian misspelling", query: "سرترالن", wantGeneric: "Sertraline"},
+		{name: "persian prefix", query: "استامی", wantGeneric: "Acetaminophen", wantMatched: "استامینوفن"},
+		{name: "english prefix", query: "amox", wantGeneric: "Amoxicillin", wantMatched: "Amoxil"},
+		{name: "unknown drug", query: "xyz"},
+		{name: "empty query", query: "  "},
+	}
+
+	idx := testIndex()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			matches := idx.search(tt.query, 5)
+			if tt.wantGeneric == "" {
+				if len(matches) != 0 {
+					t.Errorf("search(%q) = %+v, want no matches", tt.query, matches)
+				}
+				return
+			}
+			if len(matches) == 0 {
+				t.Fatalf("search(%q) found nothing, want %s", tt.query, tt.wantGeneric)
+			}
+
+			best := matches[0]
+			if best.Drug.GenericName != tt.wantGeneric {
+				t.Errorf("search(%q) best match = %s, want %s", tt.query, best.Drug.GenericName, tt.wantGeneric)
+			}
+			if tt.wantMatched != "" && best.MatchedName != tt.wantMatched {
+				t.Errorf("search(%q) matched name = %q, want %q", tt.query, best.MatchedName, tt.wantMatched)
+			}
+			if exact := best.Score == 1; exact != tt.wantExact {
+				t.Errorf("search(%q) score = %v, want exact = %v", tt.query, best.Score, tt.wantExact)
+			}
+		})
+	}
+}
+
+func TestSearchRanksExactAboveFuzzy(t *testing.T) {
+	idx := newIndex([]models.FormularyDrug{
+		{ID: 1, GenericName: "Ceftriaxone"},
+		{ID: 2, GenericName: "Cefixime"},
+		{ID: 3, GenericName: "Cefazolin"},
+	})
+
+	matches := idx.search("cefixime", 0)
+	if len(matches) == 0 || matches[0].Drug.GenericName != "Cefixime" || matches[0].Score != 1 {
+		t.Fatalf("search(cefixime) = %+v, want Cefixime first with score 1", matches)
+	}
+	for _, match := range matches[1:] {
+		if match.Score >= matches[0].Score {
+			t.Errorf("%s scored %v, as high as the exact match", match.Drug.GenericName, match.Score)
+		}
+	}
+}
+
+func TestSearchLimit(t *testing.T) {
+	idx := testIndex()
+	if matches := idx.search("آموکسی", 1); len(matches) != 1 {
+		t.Errorf("search with limit 1 returned %d matches", len(matches))
+	}
+	if matches := idx.search("آموکسی", 0); len(matches) != 2 {
+		t.Errorf("search without limit returned %d matches, want both dosage forms", len(matches))
+	}
+}
+
+func TestFind(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want map[string]string // Matched name by generic name
+	}{
+		{name: "persian prescription", text: "قرص استامینوفن ۵۰۰ هر ۸ ساعت و کپسول آموکسی سیلین", want: map[string]string{
+			"Acetaminophen": "استامینوفن",
+			"Amoxicillin":   "آموکسی سیلین",
+		}},
+		{name: "brand names", text: "Tab Tylenol 500, Cap Amoxil 500", want: map[string]string{
+			"Acetaminophen": "tylenol",
+			"Amoxicillin":   "amoxil",
+		}},
+		{name: "persian brand name", text: "زولوفت ۵۰ صبح", want: map[string]string{
+			"Sertraline": "زولوفت",
+		}},
+		{name: "persian misspellings", text: "وارفارن ۵ و سرترالن", want: map[string]string{
+			"Warfarin":   "وارفارن",
+			"Sertraline": "سرترالن",
+		}},
+		{name: "english misspellings", text: "ibuprofin 400 and warfarine", want: map[string]string{
+			"Ibuprofen": "ibuprofin",
+			"Warfarin":  "warfarine",
+		}},
+		{name: "typo in a consonant", text: "sertaline 50", want: map[string]string{
+			"Sertraline": "sertaline",
+		}},
+		{name: "generic and brand of one drug", text: "warfarin (coumadin) 5mg", want: map[string]string{
+			"Warfarin": "warfarin",
+		}},
+		{name: "no drugs", text: "روزی سه بار بعد از غذا", want: map[string]string{}},
+		{name: "empty", text: "", want: map[string]string{}},
+	}
+
+	idx := testIndex()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			matches := idx.find(tt.text)
+
+			got := make(map[string]string)
+			for _, match := range matches {
+				if _, ok := got[match.Drug.GenericName]; ok {
+					t.Errorf("%s was found twice", match.Drug.GenericName)
+				}
+				got[match.Drug.GenericName] = match.MatchedName
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("find(%q) = %v, want %v", tt.text, got, tt.want)
+			}
+			for generic, matched := range tt.want {
+				if got[generic] != matched {
+					t.Errorf("find(%q) matched %s as %q, want %q", tt.text, generic, got[generic], matched)
+				}
+			}
+		})
+	}
+}
+
+func TestFindScores(t *testing.T) {
+	tests := []struct {
+		text string
+		want float64
+	}{
+		{text: "سرترالین", want: 1},
+		{text: "سرترالن", want: 0.9},
+		{text: "sertaline", want: 0.8},
+	}
+
+	idx := testIndex()
+	for _, tt := range tests {
+		matches := idx.find(tt.text)
+		if len(matches) != 1 {
+			t.Errorf("find(%q) = %+v, want one match", tt.text, matches)
+			continue
+		}
+		if matches[0].Score != tt.want {
+			t.Errorf("find(%q) score = %v, want %v", tt.text, matches[0].Score, tt.want)
+		}
+	}
+}
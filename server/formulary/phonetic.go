@@ -0,0 +1,168 @@
+package formulary
+
+import (
+	"github.com/darooyar/server/textnorm"
+)
+
+// persianSounds maps Persian consonants to the letters used in phonetic keys.
+// Letters that usually stand for vowels are missing and therefore dropped.
+var persianSounds = map[rune]byte{
+	'ب': 'b', 'پ': 'p', 'ت': 't', 'ط': 't', 'ث': 's', 'س': 's', 'ص': 's',
+	'ج': 'j', 'ژ': 'j', 'چ': 'c', 'خ': 'k', 'ک': 'k', 'د': 'd', 'ر': 'r',
+	'ذ': 's', 'ز': 's', 'ض': 's', 'ظ': 's', 'ش': 'S', 'غ': 'g', 'ق': 'g',
+	'گ': 'g', 'ف': 'f', 'ل': 'l', 'م': 'm', 'ن': 'n',
+}
+
+// phoneticKey reduces a drug name to its consonant skeleton so that names
+// written in Persian and in Latin letters compare equal: "آموکسی‌سیلین" and
+// "amoxicillin" both become "mksln". Words are joined without spaces since
+// Persian names are often split differently, as in "آموکسی سیلین".
+func phoneticKey(text string) string {
+	var key []byte
+	for _, word := range textnorm.Fields(text) {
+		key = append(key, phoneticWord(word)...)
+	}
+
+	// Doubled letters are written once in Persian
+	collapsed := key[:0]
+	for i, c := range key {
+		if i == 0 || c != key[i-1] {
+			collapsed = append(collapsed, c)
+		}
+	}
+
+	return string(collapsed)
+}
+
+// phoneticWord returns the consonant letters of a single normalized word
+func phoneticWord(word string) string {
+	runes := []rune(word)
+	key := make([]byte, 0, len(runes))
+
+	next := func(i int) rune {
+		if i+1 < len(runes) {
+			return runes[i+1]
+		}
+		return 0
+	}
+
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+
+		if sound, ok := persianSounds[r]; ok {
+			key = append(key, sound)
+			continue
+		}
+
+		switch r {
+		case 'و':
+			// A leading vav is a "v", elsewhere it is mostly a vowel
+			if i == 0 {
+				key = append(key, 'v')
+			}
+		case 'v', 'w':
+			if i == 0 {
+				key = append(key, 'v')
+			}
+		case 'a', 'e', 'i', 'o', 'u', 'y', 'h':
+			// Vowels are not written in Persian and "h" is usually silent
+		case 'p':
+			if next(i) == 'h' {
+				key = append(key, 'f')
+				i++
+			} else {
+				key = append(key, 'p')
+			}
+		case 's':
+			if next(i) == 'h' {
+				key = append(key, 'S')
+				i++
+			} else {
+				key = append(key, 's')
+			}
+		case 'z':
+			key = append(key, 's')
+		case 'c':
+			switch n := next(i); {
+			case n == 'h':
+				key = append(key, 'k')
+				i++
+			case n == 'e' || n == 'i' || n == 'y':
+				key = append(key, 's')
+			default:
+				key = append(key, 'k')
+			}
+		case 'g':
+			if n := next(i); n == 'e' || n == 'i' || n == 'y' {
+				key = append(key, 'j')
+			} else {
+				key = append(key, 'g')
+			}
+		case 'q':
+			key = append(key, 'k')
+		case 'x':
+			if i == 0 {
+				key = append(key, 's')
+			} else {
+				key = append(key, 'k', 's')
+			}
+		default:
+			if r < 128 && (r >= 'a' && r <= 'z' || r >= '0' && r <= '9') {
+				key = append(key, byte(r))
+			}
+			// Anything else, such as alef, ye and he, is a vowel or silent
+		}
+	}
+
+	return string(key)
+}
+
+// levenshtein returns the edit distance between two strings in runes
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	if len(ra) == 0 {
+		return len(rb)
+	}
+	if len(rb) == 0 {
+		return len(ra)
+	}
+
+	prev := make([]int, len(rb)+1)
+	curr := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+
+	return prev[len(rb)]
+}
+
+// similarity scores how alike two strings are, from 0 to 1
+func similarity(a, b string) float64 {
+	longest := max(len([]rune(a)), len([]rune(b)))
+	if longest == 0 {
+		return 0
+	}
+	return 1 - float64(levenshtein(a, b))/float64(longest)
+}
+
+// prefixSimilarity is the similarity of the query to the start of the name,
+// which tolerates typos in a name that is still being typed
+func prefixSimilarity(query, name string) float64 {
+	q, n := []rune(query), []rune(name)
+	if len(n) > len(q) {
+		n = n[:len(q)]
+	}
+	return similarity(string(q), string(n))
+}
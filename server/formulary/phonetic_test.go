@@ -0,0 +1,73 @@
+package formulary
+
+import "testing"
+
+func TestPhoneticKey(t *testing.T) {
+	tests := []struct {
+		names []string // Spellings of the same drug
+		want  string
+	}{
+		{names: []string{"Amoxicillin", "amoxicilin", "آموکسی‌سیلین", "آموکسی سیلین", "اموکسیسیلین"}, want: "mksln"},
+		{names: []string{"Acetaminophen", "asetaminofen", "استامینوفن"}, want: "stmnfn"},
+		{names: []string{"Cephalexin", "سفالکسین"}, want: "sflksn"},
+		{names: []string{"Xylometazoline", "زایلومتازولین"}, want: "slmtsln"},
+		{names: []string{"Tylenol", "تیلنول"}, want: "tlnl"},
+		{names: []string{"Zoloft", "زولوفت"}, want: "slft"},
+		{names: []string{"Coumadin", "Kumadin", "کومادین"}, want: "kmdn"},
+		{names: []string{"Warfarin", "وارفارین"}, want: "vrfrn"},
+		{names: []string{"", "آ", "-"}, want: ""},
+	}
+
+	for _, tt := range tests {
+		for _, name := range tt.names {
+			t.Run(name, func(t *testing.T) {
+				if got := phoneticKey(name); got != tt.want {
+					t.Errorf("phoneticKey(%q) = %q, want %q", name, got, tt.want)
+				}
+			})
+		}
+	}
+}
+
+func TestLevenshtein(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{a: "", b: "", want: 0},
+		{a: "", b: "abc", want: 3},
+		{a: "mksln", b: "mksln", want: 0},
+		{a: "srtln", b: "srtrln", want: 1},
+		{a: "kmdn", b: "kmnd", want: 2},
+		{a: "سرترالین", b: "سرتالین", want: 1},
+	}
+
+	for _, tt := range tests {
+		if got := levenshtein(tt.a, tt.b); got != tt.want {
+			t.Errorf("levenshtein(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+		if got := levenshtein(tt.b, tt.a); got != tt.want {
+			t.Errorf("levenshtein(%q, %q) = %d, want %d", tt.b, tt.a, got, tt.want)
+		}
+	}
+}
+
+func TestSimilarity(t *testing.T) {
+	tests := []struct {
+		name string
+		got  float64
+		want float64
+	}{
+		{name: "same", got: similarity("mksln", "mksln"), want: 1},
+		{name: "empty", got: similarity("", ""), want: 0},
+		{name: "one typo", got: similarity("srtln", "srtrln"), want: 1 - 1.0/6},
+		{name: "prefix of longer name", got: prefixSimilarity("amox", "amoxicillin"), want: 1},
+		{name: "prefix with typo", got: prefixSimilarity("amix", "amoxicillin"), want: 0.75},
+	}
+
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s: similarity = %v, want %v", tt.name, tt.got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+// Package formulary holds the national drug list and matches drug names
+// written in Persian or Latin letters against it.
+package formulary
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/darooyar/server/db"
+	"github.com/darooyar/server/models"
+)
+
+// loadDrugs reads the whole formulary
+func loadDrugs(ctx context.Context) ([]models.FormularyDrug, error) {
+	query := `
+		SELECT id, COALESCE(code, ''), generic_name, COALESCE(generic_name_fa, ''), COALESCE(brand_name, ''),
+			COALESCE(dosage_form, ''), COALESCE(strength, ''), created_at, updated_at
+		FROM formulary_drugs
+		ORDER BY id`
+
+	rows, err := db.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("error loading formulary: %v", err)
+	}
+	defer rows.Close()
+
+	var drugs []models.FormularyDrug
+	for rows.Next() {
+		var drug models.FormularyDrug
+		err := rows.Scan(
+			&drug.ID,
+			&drug.Code,
+			&drug.GenericName,
+			&drug.GenericNameFa,
+			&drug.BrandName,
+			&drug.DosageForm,
+			&drug.Strength,
+			&drug.CreatedAt,
+			&drug.UpdatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		drugs = append(drugs, drug)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return drugs, nil
+}
+
+// upsertDrug stores a product, updating the product with the same names,
+// form and strength if it was imported before. It reports whether the
+// product is new.
+func upsertDrug(ctx context.Context, tx *sql.Tx, drug *models.FormularyDrug) (bool, error) {
+	var inserted bool
+	err := tx.QueryRowContext(ctx, `
+		INSERT INTO formulary_drugs (code, generic_name, generic_name_fa, brand_name, dosage_form, strength,
+			normalized_key, created_at, updated_at)
+		VALUES (NULLIF($1, ''), $2, NULLIF($3, ''), NULLIF($4, ''), NULLIF($5, ''), NULLIF($6, ''), $7, NOW(), NOW())
+		ON CONFLICT (normalized_key) DO UPDATE
+		SET code = COALESCE(EXCLUDED.code, formulary_drugs.code),
+			generic_name_fa = COALESCE(EXCLUDED.generic_name_fa, formulary_drugs.generic_name_fa),
+			updated_at = NOW()
+		RETURNING id, (xmax = 0)`,
+		drug.Code, drug.GenericName, drug.GenericNameFa, drug.BrandName, drug.DosageForm, drug.Strength,
+		productKey(drug),
+	).Scan(&drug.ID, &inserted)
+	if err != nil {
+		return false, fmt.Errorf("error saving drug %q: %v", drug.GenericName, err)
+	}
+	return inserted, nil
+}
+
+// productKey identifies a product by its normalized names, form and strength
+func productKey(drug *models.FormularyDrug) string {
+	parts := []string{
+		normalizeName(drug.GenericName),
+		normalizeName(drug.BrandName),
+		normalizeName(drug.DosageForm),
+		normalizeName(drug.Strength),
+	}
+	return strings.Join(parts, "|")
+}
@@ -0,0 +1,200 @@
+package handlers
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/darooyar/server/ai"
+	"github.com/darooyar/server/analysis"
+	"github.com/darooyar/server/models"
+)
+
+// prescriptionAnalyzer runs prescription analyses against the configured AI provider
+type prescriptionAnalyzer struct {
+	provider ai.Provider
+}
+
+// newPrescriptionAnalyzer creates an analyzer for the given provider
+func newPrescriptionAnalyzer(provider ai.Provider) *prescriptionAnalyzer {
+	return &prescriptionAnalyzer{provider: provider}
+}
+
+// errProviderUnavailable is returned when no AI provider has been configured
+var errProviderUnavailable = errors.New("AI provider not configured")
+
+// analyzeText analyzes a prescription given as plain text
+func (a *prescriptionAnalyzer) analyzeText(ctx context.Context, text string) (string, error) {
+	if a.provider == nil {
+		return "", errProviderUnavailable
+	}
+
+	resp, err := a.provider.Complete(ctx, ai.CompletionRequest{
+		Messages: []ai.Message{
+			{Role: ai.RoleSystem, Content: ai.PrescriptionSystemPrompt},
+			{Role: ai.RoleUser, Content: text},
+		},
+		MaxTokens:   ai.DefaultMaxTokens,
+		Temperature: ai.DefaultTemperature,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	slog.InfoContext(ctx, "Text prescription analysis finished", "length", len(resp.Content))
+	return resp.Content, nil
+}
+
+// streamConversation answers the latest turn of a chat under the system
+// prompt, reporting the generated content through onDelta as it arrives
+func (a *prescriptionAnalyzer) streamConversation(ctx context.Context, systemPrompt string, conv *conversation, onDelta ai.DeltaFunc) (string, error) {
+	if a.provider == nil {
+		return "", errProviderUnavailable
+	}
+
+	resp, err := a.provider.Stream(ctx, ai.CompletionRequest{
+		Messages:    conv.prompt(systemPrompt),
+		MaxTokens:   ai.DefaultMaxTokens,
+		Temperature: ai.DefaultTemperature,
+	}, onDelta)
+	if err != nil {
+		return "", err
+	}
+
+	slog.InfoContext(ctx, "Streamed chat reply finished", "length", len(resp.Content), "turns", len(conv.turns))
+	return resp.Content, nil
+}
+
+// analyzeImage analyzes a prescription image, first by sending the image inline
+// and then, if that fails, by pointing the model at the image URL
+func (a *prescriptionAnalyzer) analyzeImage(ctx context.Context, imageURL string) (string, error) {
+	if a.provider == nil {
+		return "", errProviderUnavailable
+	}
+
+	slog.DebugContext(ctx, "Attempting to analyze image with multimodal approach")
+	content, err := a.analyzeImageInline(ctx, imageURL)
+	if err == nil {
+		return content, nil
+	}
+
+	slog.WarnContext(ctx, "Multimodal approach failed, trying with text prompt approach", "error", err)
+	resp, err := a.provider.Complete(ctx, ai.CompletionRequest{
+		Messages: []ai.Message{
+			{Role: ai.RoleUser, Content: ai.ImageURLPrompt(imageURL)},
+		},
+		MaxTokens:   ai.DefaultMaxTokens,
+		Temperature: ai.DefaultTemperature,
+	})
+	if err != nil {
+		return "", fmt.Errorf("all image analysis approaches failed: %w", err)
+	}
+
+	slog.InfoContext(ctx, "Text prompt image analysis finished", "length", len(resp.Content))
+	return resp.Content, nil
+}
+
+// analyzeImageInline downloads the image and sends it to the provider as a data URI
+func (a *prescriptionAnalyzer) analyzeImageInline(ctx context.Context, imageURL string) (string, error) {
+	dataURI, err := fetchImageDataURI(ctx, imageURL)
+	if err != nil {
+		return "", err
+	}
+
+	return a.analyzeImageData(ctx, dataURI)
+}
+
+// analyzeImageData analyzes a prescription image given as a data URI
+func (a *prescriptionAnalyzer) analyzeImageData(ctx context.Context, dataURI string) (string, error) {
+	if a.provider == nil {
+		return "", errProviderUnavailable
+	}
+
+	resp, err := a.provider.CompleteVision(ctx, ai.VisionRequest{
+		SystemPrompt: ai.ImageSystemPrompt,
+		Prompt:       ai.ImageUserPrompt,
+		ImageURL:     dataURI,
+		MaxTokens:    ai.DefaultMaxTokens,
+		Temperature:  ai.DefaultTemperature,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	slog.InfoContext(ctx, "Multimodal image analysis finished", "length", len(resp.Content))
+	return resp.Content, nil
+}
+
+// saveStructuredAnalysis parses an analysis reply and stores the result for the message
+func (h *ChatHandler) saveStructuredAnalysis(ctx context.Context, messageID int64, content string) *models.PrescriptionAnalysis {
+	parsed := analysis.Parse(content)
+	parsed.MessageID = messageID
+	parsed.KnownInteractions = []models.KnownInteraction{}
+	parsed.Contradictions = []models.InteractionContradiction{}
+
+	// Compare the AI interactions with the local knowledge base
+	drugNames := make([]string, 0, len(parsed.Drugs))
+	for _, drug := range parsed.Drugs {
+		drugNames = append(drugNames, drug.Name)
+	}
+	known, contradictions, err := h.interactions.Reconcile(ctx, parsed.Interactions, drugNames)
+	if err != nil {
+		slog.Error("Error checking interactions of message", "message_id", messageID, "error", err)
+	} else {
+		parsed.KnownInteractions = known
+		parsed.Contradictions = contradictions
+	}
+
+	if err := h.chats.SavePrescriptionAnalysis(ctx, parsed); err != nil {
+		slog.Error("Error saving structured analysis", "message_id", messageID, "error", err)
+		return parsed
+	}
+
+	slog.Info("Saved structured analysis", "message_id", messageID, "drugs", len(parsed.Drugs),
+		"interactions", len(parsed.Interactions), "contradictions", len(parsed.Contradictions))
+	return parsed
+}
+
+// fetchImageDataURI downloads an image and encodes it as a base64 data URI
+func fetchImageDataURI(ctx context.Context, imageURL string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, imageURL, nil)
+	if err != nil {
+		return "", fmt.Errorf("error creating download request: %w", err)
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("error downloading image: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to download image: status code %d", resp.StatusCode)
+	}
+
+	imageData, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("error reading image data: %w", err)
+	}
+
+	slog.DebugContext(ctx, "Downloaded image", "size", len(imageData))
+
+	// Detect MIME type from file content when the server did not send a useful one
+	mimeType := resp.Header.Get("Content-Type")
+	if mimeType == "" || mimeType == "application/octet-stream" {
+		mimeType = detectImageMimeType(imageData)
+	}
+
+	return imageDataURI(imageData, mimeType), nil
+}
+
+// imageDataURI encodes image data as a base64 data URI
+func imageDataURI(imageData []byte, mimeType string) string {
+	return fmt.Sprintf("data:%s;base64,%s", mimeType, base64.StdEncoding.EncodeToString(imageData))
+}
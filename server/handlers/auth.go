@@ -2,18 +2,38 @@ package handlers
 
 import (
 	"encoding/json"
-	"log"
+	"errors"
+	"log/slog"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/darooyar/server/auth"
+	"github.com/darooyar/server/config"
 	"github.com/darooyar/server/db"
+	"github.com/darooyar/server/mailer"
+	"github.com/darooyar/server/middleware"
 	"github.com/darooyar/server/models"
 )
 
-type AuthHandler struct{}
+type AuthHandler struct {
+	users    db.UserStore
+	sessions db.SessionStore
+	tokens   db.TokenStore
+	mailer   mailer.Sender
+	appURL   string
+}
 
-func NewAuthHandler() *AuthHandler {
-	return &AuthHandler{}
+// NewAuthHandler creates a new auth handler. Without a mail sender, users
+// can still register, but no verification or reset emails are sent.
+func NewAuthHandler(users db.UserStore, sessions db.SessionStore, tokens db.TokenStore, mailSender mailer.Sender, cfg *config.Config) *AuthHandler {
+	return &AuthHandler{
+		users:    users,
+		sessions: sessions,
+		tokens:   tokens,
+		mailer:   mailSender,
+		appURL:   strings.TrimRight(cfg.AppURL, "/"),
+	}
 }
 
 // Register handles user registration
@@ -25,59 +45,39 @@ func (h *AuthHandler) Register(w http.ResponseWriter, r *http.Request) {
 
 	var userCreate models.UserCreate
 	if err := json.NewDecoder(r.Body).Decode(&userCreate); err != nil {
-		log.Printf("Error decoding request body: %v", err)
+		slog.ErrorContext(r.Context(), "Error decoding request body", "error", err)
 		sendErrorResponse(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
 
-	log.Printf("Registering user: %v", userCreate)
+	slog.InfoContext(r.Context(), "Registering user")
 
 	// Hash the password
 	hashedPassword, err := auth.HashPassword(userCreate.Password)
 	if err != nil {
-		log.Printf("Error hashing password: %v", err)
+		slog.ErrorContext(r.Context(), "Error hashing password", "error", err)
 		sendErrorResponse(w, "Error processing password", http.StatusInternalServerError)
 		return
 	}
 
 	// Create user with hashed password
 	userCreate.Password = hashedPassword
-	user, err := db.CreateUser(&userCreate)
-	if err != nil {
-		log.Printf("Error creating user: %v", err)
-		sendErrorResponse(w, "Error creating user", http.StatusInternalServerError)
+	user, err := h.users.CreateUser(r.Context(), &userCreate)
+	if errors.Is(err, db.ErrUserExists) {
+		sendErrorResponse(w, "A user with this email or username already exists", http.StatusConflict)
 		return
 	}
-
-	// Generate JWT token
-	token, err := auth.GenerateToken(user)
 	if err != nil {
-		log.Printf("Error generating token: %v", err)
-		sendErrorResponse(w, "Error generating token", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error creating user", "error", err)
+		sendErrorResponse(w, "Error creating user", http.StatusInternalServerError)
 		return
 	}
 
-	// Return user info and token
-	response := struct {
-		User  models.UserResponse `json:"user"`
-		Token string              `json:"token"`
-	}{
-		User: models.UserResponse{
-			ID:        user.ID,
-			Username:  user.Username,
-			Email:     user.Email,
-			FirstName: user.FirstName,
-			LastName:  user.LastName,
-			Credit:    user.Credit,
-			IsAdmin:   user.IsAdmin,
-			CreatedAt: user.CreatedAt,
-		},
-		Token: token,
-	}
+	// Ask the user to verify their email before they can analyze prescriptions
+	h.sendVerificationEmail(r.Context(), user)
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(response)
+	// Start a session and return user info and tokens
+	writeNewSession(w, r, h.sessions, user, http.StatusCreated)
 }
 
 // Login handles user login
@@ -94,7 +94,7 @@ func (h *AuthHandler) Login(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Get user by email
-	user, err := db.GetUserByEmail(login.Email)
+	user, err := h.users.GetUserByEmail(r.Context(), login.Email)
 	if err != nil {
 		sendErrorResponse(w, "Invalid credentials", http.StatusUnauthorized)
 		return
@@ -106,33 +106,8 @@ func (h *AuthHandler) Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Generate JWT token
-	token, err := auth.GenerateToken(user)
-	if err != nil {
-		sendErrorResponse(w, "Error generating token", http.StatusInternalServerError)
-		return
-	}
-
-	// Return user info and token
-	response := struct {
-		User  models.UserResponse `json:"user"`
-		Token string              `json:"token"`
-	}{
-		User: models.UserResponse{
-			ID:        user.ID,
-			Username:  user.Username,
-			Email:     user.Email,
-			FirstName: user.FirstName,
-			LastName:  user.LastName,
-			Credit:    user.Credit,
-			IsAdmin:   user.IsAdmin,
-			CreatedAt: user.CreatedAt,
-		},
-		Token: token,
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+	// Start a session and return user info and tokens
+	writeNewSession(w, r, h.sessions, user, http.StatusOK)
 }
 
 // GetMe gets the current authenticated user
@@ -150,24 +125,15 @@ func (h *AuthHandler) GetMe(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Get user by ID
-	user, err := db.GetUserByID(userID)
+	user, err := h.users.GetUserByID(r.Context(), userID)
 	if err != nil {
-		log.Printf("Error getting user by ID: %v", err)
+		slog.ErrorContext(r.Context(), "Error getting user by ID", "error", err)
 		sendErrorResponse(w, "User not found", http.StatusNotFound)
 		return
 	}
 
 	// Return user info without sensitive data
-	response := models.UserResponse{
-		ID:        user.ID,
-		Username:  user.Username,
-		Email:     user.Email,
-		FirstName: user.FirstName,
-		LastName:  user.LastName,
-		Credit:    user.Credit,
-		IsAdmin:   user.IsAdmin,
-		CreatedAt: user.CreatedAt,
-	}
+	response := newUserResponse(user)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
@@ -183,7 +149,7 @@ func (h *AuthHandler) VerifyToken(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Get additional user info if needed
-	user, err := db.GetUserByID(userID)
+	user, err := h.users.GetUserByID(r.Context(), userID)
 	if err != nil {
 		http.Error(w, "Error retrieving user data", http.StatusInternalServerError)
 		return
@@ -198,6 +164,200 @@ func (h *AuthHandler) VerifyToken(w http.ResponseWriter, r *http.Request) {
 		"username":  user.Username,
 		"credit":    user.Credit,
 		"is_admin":  user.IsAdmin,
+		"roles":     user.Roles,
 		"is_active": true,
 	})
 }
+
+// Refresh exchanges a refresh token for a new access token and refresh token.
+// Refresh tokens are single-use; presenting one twice ends its session.
+func (h *AuthHandler) Refresh(w http.ResponseWriter, r *http.Request) {
+	var req models.RefreshRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendErrorResponse(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.RefreshToken == "" {
+		sendErrorResponse(w, "Refresh token is required", http.StatusBadRequest)
+		return
+	}
+
+	refreshToken, refreshHash, err := auth.GenerateRefreshToken()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error generating refresh token", "error", err)
+		sendErrorResponse(w, "Error generating token", http.StatusInternalServerError)
+		return
+	}
+
+	session, err := h.sessions.RotateRefreshToken(r.Context(), auth.HashRefreshToken(req.RefreshToken), refreshHash,
+		time.Now().Add(auth.RefreshTokenTTL))
+	if err == db.ErrRefreshTokenReused {
+		slog.WarnContext(r.Context(), "Refresh token reused, session revoked")
+		sendErrorResponse(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+	if err == db.ErrInvalidRefreshToken {
+		sendErrorResponse(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error rotating refresh token", "error", err)
+		sendErrorResponse(w, "Error refreshing token", http.StatusInternalServerError)
+		return
+	}
+
+	// Reload the user so that the new token carries their current roles
+	user, err := h.users.GetUserByID(r.Context(), session.UserID)
+	if err != nil {
+		sendErrorResponse(w, "User not found", http.StatusUnauthorized)
+		return
+	}
+
+	writeAuthResponse(w, http.StatusOK, user, session, refreshToken)
+}
+
+// Logout ends the session of the current access token and revokes the token
+func (h *AuthHandler) Logout(w http.ResponseWriter, r *http.Request) {
+	claims, ok := r.Context().Value("claims").(*auth.Claims)
+	if !ok {
+		sendErrorResponse(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if claims.SessionID != "" {
+		if err := h.sessions.RevokeSession(r.Context(), claims.SessionID, claims.UserID); err != nil {
+			slog.ErrorContext(r.Context(), "Error revoking session", "session_id", claims.SessionID, "error", err)
+		}
+	}
+
+	if claims.ID != "" && claims.ExpiresAt != nil {
+		if err := h.sessions.RevokeToken(r.Context(), claims.ID, claims.UserID, claims.ExpiresAt.Time); err != nil {
+			slog.ErrorContext(r.Context(), "Error revoking token", "error", err)
+			sendErrorResponse(w, "Error logging out", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetSessions lists the devices where the current user is logged in
+func (h *AuthHandler) GetSessions(w http.ResponseWriter, r *http.Request) {
+	claims, ok := r.Context().Value("claims").(*auth.Claims)
+	if !ok {
+		sendErrorResponse(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	sessions, err := h.sessions.GetUserSessions(r.Context(), claims.UserID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error getting sessions", "error", err)
+		sendErrorResponse(w, "Error retrieving sessions", http.StatusInternalServerError)
+		return
+	}
+
+	for _, session := range sessions {
+		session.Current = session.ID == claims.SessionID
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"sessions": sessions,
+	})
+}
+
+// RevokeSession logs the current user out of one of their sessions
+func (h *AuthHandler) RevokeSession(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("user_id").(int64)
+	if !ok {
+		sendErrorResponse(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if err := h.sessions.RevokeSession(r.Context(), r.PathValue("id"), userID); err != nil {
+		sendErrorResponse(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// LogoutAll logs the current user out of every session, including this one
+func (h *AuthHandler) LogoutAll(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("user_id").(int64)
+	if !ok {
+		sendErrorResponse(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	revoked, err := h.sessions.RevokeUserSessions(r.Context(), userID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error revoking sessions of user", "user_id", userID, "error", err)
+		sendErrorResponse(w, "Error logging out", http.StatusInternalServerError)
+		return
+	}
+	slog.InfoContext(r.Context(), "User logged out of all sessions", "user_id", userID, "sessions", revoked)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"revoked_sessions": revoked,
+	})
+}
+
+// writeNewSession starts a session for a user who just logged in and writes
+// their info with a new access token and refresh token
+func writeNewSession(w http.ResponseWriter, r *http.Request, sessions db.SessionStore, user *models.User, status int) {
+	refreshToken, refreshHash, err := auth.GenerateRefreshToken()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error generating refresh token", "error", err)
+		sendErrorResponse(w, "Error generating token", http.StatusInternalServerError)
+		return
+	}
+
+	session, err := sessions.CreateSession(r.Context(), user.ID, r.UserAgent(), middleware.ClientIP(r), refreshHash,
+		time.Now().Add(auth.RefreshTokenTTL))
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error creating session", "error", err)
+		sendErrorResponse(w, "Error creating session", http.StatusInternalServerError)
+		return
+	}
+
+	writeAuthResponse(w, status, user, session, refreshToken)
+}
+
+// writeAuthResponse writes user info with a new access token for the session
+func writeAuthResponse(w http.ResponseWriter, status int, user *models.User, session *models.Session, refreshToken string) {
+	token, expiresAt, err := auth.GenerateToken(user, session.ID)
+	if err != nil {
+		slog.Error("Error generating token", "error", err)
+		sendErrorResponse(w, "Error generating token", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(models.AuthResponse{
+		User:         newUserResponse(user),
+		Token:        token,
+		ExpiresAt:    expiresAt,
+		RefreshToken: refreshToken,
+	})
+}
+
+// newUserResponse returns the info of a user without sensitive data
+func newUserResponse(user *models.User) models.UserResponse {
+	return models.UserResponse{
+		ID:            user.ID,
+		Username:      user.Username,
+		Email:         user.Email,
+		Phone:         user.Phone,
+		FirstName:     user.FirstName,
+		LastName:      user.LastName,
+		Credit:        user.Credit,
+		EmailVerified: user.EmailVerified,
+		IsAdmin:       user.IsAdmin,
+		Roles:         user.Roles,
+		Permissions:   user.Permissions,
+		CreatedAt:     user.CreatedAt,
+	}
+}
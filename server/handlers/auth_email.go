@@ -0,0 +1,241 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/darooyar/server/auth"
+	"github.com/darooyar/server/db"
+	"github.com/darooyar/server/mailer"
+	"github.com/darooyar/server/models"
+)
+
+const (
+	// passwordResetTTL is how long a password reset link works
+	passwordResetTTL = time.Hour
+	// emailVerificationTTL is how long an email verification link works
+	emailVerificationTTL = 24 * time.Hour
+	// authEmailCooldown is the minimum time between two emails of the same kind to a user
+	authEmailCooldown = time.Minute
+	// minPasswordLength is the shortest password accepted when resetting one
+	minPasswordLength = 8
+	// mailTimeout bounds how long sending an email may take
+	mailTimeout = 30 * time.Second
+)
+
+// ForgotPassword emails a password reset link. The response is the same
+// whether or not a user has the address, so it cannot be used to find accounts.
+func (h *AuthHandler) ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	var req models.ForgotPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendErrorResponse(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	email := strings.TrimSpace(req.Email)
+	if email == "" {
+		sendErrorResponse(w, "Email is required", http.StatusBadRequest)
+		return
+	}
+
+	user, err := h.users.GetUserByEmail(r.Context(), email)
+	if err != nil && err != db.ErrUserNotFound {
+		slog.ErrorContext(r.Context(), "Error getting user by email", "error", err)
+		sendErrorResponse(w, "Error processing request", http.StatusInternalServerError)
+		return
+	}
+
+	if user != nil {
+		h.sendAuthEmail(r.Context(), user, models.AuthTokenPurposePasswordReset, passwordResetTTL, "/reset-password",
+			"بازیابی رمز عبور دارویار",
+			"برای تعیین رمز عبور جدید روی پیوند زیر بزنید. این پیوند تا یک ساعت معتبر است:\n\n%s\n\nاگر درخواست بازیابی رمز عبور نداده‌اید، این ایمیل را نادیده بگیرید.")
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":  "success",
+		"message": "If an account uses this email, a reset link has been sent",
+	})
+}
+
+// ResetPassword sets a new password with the token from a reset link and
+// logs the user out of every session
+func (h *AuthHandler) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	var req models.ResetPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendErrorResponse(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if len(req.Password) < minPasswordLength {
+		sendErrorResponse(w, fmt.Sprintf("Password must be at least %d characters", minPasswordLength), http.StatusBadRequest)
+		return
+	}
+
+	tokenHash, err := auth.VerifySignedToken(models.AuthTokenPurposePasswordReset, req.Token)
+	if err != nil {
+		sendErrorResponse(w, "Invalid or expired token", http.StatusBadRequest)
+		return
+	}
+
+	hashedPassword, err := auth.HashPassword(req.Password)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error hashing password", "error", err)
+		sendErrorResponse(w, "Error processing password", http.StatusInternalServerError)
+		return
+	}
+
+	userID, err := h.tokens.ResetUserPassword(r.Context(), tokenHash, hashedPassword)
+	if err == db.ErrInvalidAuthToken {
+		sendErrorResponse(w, "Invalid or expired token", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error resetting password", "error", err)
+		sendErrorResponse(w, "Error resetting password", http.StatusInternalServerError)
+		return
+	}
+
+	// Whoever knew the old password must not stay logged in
+	if _, err := h.sessions.RevokeUserSessions(r.Context(), userID); err != nil {
+		slog.ErrorContext(r.Context(), "Error revoking sessions after password reset", "user_id", userID, "error", err)
+	}
+	slog.InfoContext(r.Context(), "User reset their password", "user_id", userID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":  "success",
+		"message": "Password has been reset",
+	})
+}
+
+// VerifyEmail marks the user's email as verified with the token from a verification link
+func (h *AuthHandler) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	var req models.VerifyEmailRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendErrorResponse(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	tokenHash, err := auth.VerifySignedToken(models.AuthTokenPurposeEmailVerification, req.Token)
+	if err != nil {
+		sendErrorResponse(w, "Invalid or expired token", http.StatusBadRequest)
+		return
+	}
+
+	userID, err := h.tokens.VerifyUserEmail(r.Context(), tokenHash)
+	if err == db.ErrInvalidAuthToken {
+		sendErrorResponse(w, "Invalid or expired token", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error verifying email", "error", err)
+		sendErrorResponse(w, "Error verifying email", http.StatusInternalServerError)
+		return
+	}
+	slog.InfoContext(r.Context(), "User verified their email", "user_id", userID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":         "success",
+		"email_verified": true,
+	})
+}
+
+// ResendVerification emails a new verification link to the current user
+func (h *AuthHandler) ResendVerification(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("user_id").(int64)
+	if !ok {
+		sendErrorResponse(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	user, err := h.users.GetUserByID(r.Context(), userID)
+	if err != nil {
+		sendErrorResponse(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	if user.Email == "" {
+		sendErrorResponse(w, "The account has no email address", http.StatusBadRequest)
+		return
+	}
+	if user.EmailVerified {
+		sendErrorResponse(w, "Email is already verified", http.StatusConflict)
+		return
+	}
+
+	h.sendVerificationEmail(r.Context(), user)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":  "success",
+		"message": "A verification link has been sent",
+	})
+}
+
+// sendVerificationEmail emails the user a link to verify their address
+func (h *AuthHandler) sendVerificationEmail(ctx context.Context, user *models.User) {
+	h.sendAuthEmail(ctx, user, models.AuthTokenPurposeEmailVerification, emailVerificationTTL, "/verify-email",
+		"تایید ایمیل دارویار",
+		"برای تایید ایمیل خود و فعال شدن تحلیل نسخه‌ها روی پیوند زیر بزنید:\n\n%s")
+}
+
+// sendAuthEmail creates a single-use token for the purpose and emails the
+// user a link to the app page that uses it. The link is sent in the
+// background, so the response time does not reveal whether an account exists.
+// Emails within the cooldown of the previous one are skipped.
+func (h *AuthHandler) sendAuthEmail(ctx context.Context, user *models.User, purpose string, ttl time.Duration, page, subject, body string) {
+	if h.mailer == nil {
+		slog.Warn("No mail sender configured, email not sent", "purpose", purpose, "user_id", user.ID)
+		return
+	}
+	if user.Email == "" {
+		return
+	}
+
+	lastSentAt, err := h.tokens.GetLastAuthTokenTime(ctx, user.ID, purpose)
+	if err != nil {
+		slog.Error("Error checking last email of user", "purpose", purpose, "user_id", user.ID, "error", err)
+		return
+	}
+	if lastSentAt != nil && time.Since(*lastSentAt) < authEmailCooldown {
+		slog.Info("Skipping email, one was sent recently", "purpose", purpose, "user_id", user.ID, "sent_at", lastSentAt)
+		return
+	}
+
+	token, tokenHash, err := auth.GenerateSignedToken(purpose)
+	if err != nil {
+		slog.Error("Error generating email token", "purpose", purpose, "error", err)
+		return
+	}
+
+	if err := h.tokens.CreateAuthToken(ctx, user.ID, purpose, tokenHash, time.Now().Add(ttl)); err != nil {
+		slog.Error("Error storing email token", "purpose", purpose, "user_id", user.ID, "error", err)
+		return
+	}
+
+	msg := mailer.Message{
+		To:      user.Email,
+		Subject: subject,
+		Body:    fmt.Sprintf(body, h.appURL+page+"?token="+url.QueryEscape(token)),
+	}
+
+	// The email is sent after the response, so it must not end with the request
+	go func() {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), mailTimeout)
+		defer cancel()
+
+		if err := h.mailer.Send(ctx, msg); err != nil {
+			slog.Error("Error sending email", "purpose", purpose, "user_id", user.ID, "sender", h.mailer.Name(), "error", err)
+		}
+	}()
+}
@@ -0,0 +1,99 @@
+package handlers
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/darooyar/server/auth"
+	"github.com/darooyar/server/config"
+	"github.com/darooyar/server/db/memory"
+	"github.com/darooyar/server/models"
+)
+
+func TestRegister(t *testing.T) {
+	tests := []struct {
+		name       string
+		email      string
+		wantStatus int
+	}{
+		{name: "new user", email: "new@example.com", wantStatus: http.StatusCreated},
+		{name: "email taken", email: "taken@example.com", wantStatus: http.StatusConflict},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := memory.New()
+			createTestUser(t, store, "taken@example.com")
+			h := NewAuthHandler(store, store, store, nil, &config.Config{})
+
+			rec := serve(t, "POST /api/auth/register", h.Register, http.MethodPost, "/api/auth/register", 0, models.UserCreate{
+				Username: "someone",
+				Email:    tt.email,
+				Password: "secret123",
+			})
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+			if tt.wantStatus != http.StatusCreated {
+				return
+			}
+
+			var resp models.AuthResponse
+			decode(t, rec, &resp)
+			if resp.User.Email != tt.email {
+				t.Errorf("user email = %q, want %q", resp.User.Email, tt.email)
+			}
+			if resp.RefreshToken == "" {
+				t.Error("response has no refresh token")
+			}
+			claims, err := auth.ValidateToken(resp.Token)
+			if err != nil {
+				t.Fatalf("token is invalid: %v", err)
+			}
+			if claims.UserID != resp.User.ID {
+				t.Errorf("token user = %d, want %d", claims.UserID, resp.User.ID)
+			}
+		})
+	}
+}
+
+func TestLogin(t *testing.T) {
+	tests := []struct {
+		name       string
+		email      string
+		password   string
+		wantStatus int
+	}{
+		{name: "correct password", email: "user@example.com", password: "secret123", wantStatus: http.StatusOK},
+		{name: "wrong password", email: "user@example.com", password: "wrong", wantStatus: http.StatusUnauthorized},
+		{name: "unknown email", email: "nobody@example.com", password: "secret123", wantStatus: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := memory.New()
+			user := createTestUser(t, store, "user@example.com")
+			h := NewAuthHandler(store, store, store, nil, &config.Config{})
+
+			rec := serve(t, "POST /api/auth/login", h.Login, http.MethodPost, "/api/auth/login", 0, models.UserLogin{
+				Email:    tt.email,
+				Password: tt.password,
+			})
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+
+			var resp models.AuthResponse
+			decode(t, rec, &resp)
+			if resp.User.ID != user.ID {
+				t.Errorf("user = %d, want %d", resp.User.ID, user.ID)
+			}
+			if resp.Token == "" || resp.RefreshToken == "" {
+				t.Error("response is missing a token")
+			}
+		})
+	}
+}
@@ -1,39 +1,55 @@
 package handlers
 
 import (
-	"bytes"
 	"context"
-	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"mime/multipart"
-	"net"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
+	"github.com/darooyar/server/ai"
 	"github.com/darooyar/server/db"
+	"github.com/darooyar/server/druginteractions"
+	"github.com/darooyar/server/formulary"
 	"github.com/darooyar/server/models"
 	"github.com/darooyar/server/storage"
 	"github.com/google/uuid"
-	"github.com/sashabaranov/go-openai"
 )
 
 type ChatHandler struct {
-	// نقشه برای پیگیری وضعیت پردازش پیام‌های نسخه
-	processingChats      map[int64]bool
-	processingChatsMutex sync.Mutex
+	chats         db.ChatStore
+	plans         db.PlanStore
+	aiJobs        db.AIJobStore
+	prescriptions db.PrescriptionStore
+	catalog       formulary.Catalog
+	interactions  druginteractions.KnowledgeBase
+	analyzer      *prescriptionAnalyzer
+	streams       *chatStreamHub
+	// jobs is the lifetime of the server; in-process AI jobs run under it
+	jobs context.Context
 }
 
-func NewChatHandler() *ChatHandler {
+// NewChatHandler creates a new chat handler. AI jobs run in-process are
+// canceled when ctx is done.
+func NewChatHandler(ctx context.Context, provider ai.Provider, chats db.ChatStore, plans db.PlanStore, aiJobs db.AIJobStore,
+	prescriptions db.PrescriptionStore, catalog formulary.Catalog, interactions druginteractions.KnowledgeBase) *ChatHandler {
 	return &ChatHandler{
-		processingChats: make(map[int64]bool),
+		jobs:          ctx,
+		chats:         chats,
+		plans:         plans,
+		aiJobs:        aiJobs,
+		prescriptions: prescriptions,
+		catalog:       catalog,
+		interactions:  interactions,
+		analyzer:      newPrescriptionAnalyzer(provider),
+		streams:       newChatStreamHub(),
 	}
 }
 
@@ -57,7 +73,7 @@ func (h *ChatHandler) CreateChat(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	chat, err := db.CreateChat(&chatCreate, userID)
+	chat, err := h.chats.CreateChat(r.Context(), &chatCreate, userID)
 	if err != nil {
 		http.Error(w, "Error creating chat", http.StatusInternalServerError)
 		return
@@ -102,12 +118,15 @@ func (h *ChatHandler) GetChat(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	chat, err := db.GetChat(chatID, userID)
+	chat, err := h.chats.GetChat(r.Context(), chatID, userID)
 	if err != nil {
 		http.Error(w, "Chat not found or unauthorized", http.StatusNotFound)
 		return
 	}
 
+	// Make sure image links are still valid
+	refreshImageURLs(r.Context(), chat.Messages)
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(chat)
 }
@@ -126,7 +145,7 @@ func (h *ChatHandler) GetUserChats(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	chats, err := db.GetUserChats(userID)
+	chats, err := h.chats.GetUserChats(r.Context(), userID)
 	if err != nil {
 		// Return an empty array instead of an error
 		w.Header().Set("Content-Type", "application/json")
@@ -143,8 +162,35 @@ func (h *ChatHandler) GetUserChats(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(chats)
 }
 
-// Helper function to detect prescription messages
-func isPrescriptionMessage(content string) bool {
+// isPrescriptionMessage reports whether a message mentions a drug of the
+// formulary. Until the formulary is imported, it looks for words that
+// usually introduce a prescription instead.
+func (h *ChatHandler) isPrescriptionMessage(ctx context.Context, content string) bool {
+	if h.catalog.Available(ctx) {
+		drugs, err := h.catalog.FindDrugs(ctx, content)
+		if err == nil {
+			if len(drugs) > 0 {
+				slog.Debug("Found formulary drugs in message", "count", len(drugs), "first", drugs[0].Drug.GenericName)
+			}
+			return len(drugs) > 0
+		}
+		slog.Error("Error matching message against formulary", "error", err)
+	}
+
+	return hasPrescriptionMarker(content)
+}
+
+// replyKind decides how a user message is answered: prescriptions get a full
+// analysis and any other message, such as a follow-up question, a chat reply
+func (h *ChatHandler) replyKind(ctx context.Context, content string) models.AIJobKind {
+	if h.isPrescriptionMessage(ctx, content) {
+		return models.AIJobKindText
+	}
+	return models.AIJobKindChat
+}
+
+// hasPrescriptionMarker looks for words that usually introduce a prescription
+func hasPrescriptionMarker(content string) bool {
 	// Common patterns for prescriptions in Persian and English
 	prescriptionMarkers := []string{
 		"نسخه:",
@@ -195,58 +241,55 @@ func (h *ChatHandler) CreateMessage(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Verify chat ownership
-	_, err := db.GetChat(msgCreate.ChatID, userID)
+	_, err := h.chats.GetChat(r.Context(), msgCreate.ChatID, userID)
 	if err != nil {
 		http.Error(w, "Chat not found or unauthorized", http.StatusNotFound)
 		return
 	}
 
 	// بررسی کنید آیا این چت در حال پردازش است
-	h.processingChatsMutex.Lock()
-	isProcessing := h.processingChats[msgCreate.ChatID]
-	h.processingChatsMutex.Unlock()
-
-	if isProcessing {
+	if job := h.activeJob(r.Context(), msgCreate.ChatID); job != nil {
 		// اگر چت در حال پردازش است، یک پیام خطا برگردانید
-		response := map[string]interface{}{
-			"status":  "processing",
-			"message": "پیام قبلی شما در حال پردازش است. لطفا صبر کنید.",
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusAccepted)
-		json.NewEncoder(w).Encode(response)
+		writeProcessingResponse(w, job)
 		return
 	}
 
-	msg, err := db.CreateMessage(&msgCreate)
+	// Every user message gets an AI reply. Prescriptions use up an analysis
+	// of the subscription, which is reserved before anything is saved.
+	jobID, kind := "", models.AIJobKindChat
+	if msgCreate.Role == "user" {
+		jobID = uuid.New().String()
+		kind = h.replyKind(r.Context(), msgCreate.Content)
+		if kind.Billed() {
+			slog.InfoContext(r.Context(), "Detected prescription message", "chat_id", msgCreate.ChatID, "content_length", len(msgCreate.Content))
+			if !reserveAnalysis(r.Context(), w, h.plans, userID, jobUsageKey(jobID)) {
+				return
+			}
+		}
+	}
+
+	msg, err := h.chats.CreateMessage(r.Context(), &msgCreate)
 	if err != nil {
+		if jobID != "" {
+			releaseAnalysis(r.Context(), h.plans, jobUsageKey(jobID))
+		}
 		http.Error(w, "Error creating message", http.StatusInternalServerError)
 		return
 	}
 
+	if jobID != "" {
+		// Queue the reply so it survives restarts and runs on any replica
+		job, err := h.enqueueAnalysisJob(r.Context(), jobID, msgCreate.ChatID, userID, kind, msgCreate.Content)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Error queueing AI reply", "kind", kind, "error", err)
+		} else {
+			w.Header().Set("X-Job-ID", job.ID)
+		}
+	}
+
 	// Return the created message
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(msg)
-
-	// Check if this is a prescription message that needs AI analysis
-	if msgCreate.Role == "user" && isPrescriptionMessage(msgCreate.Content) {
-		log.Printf("Detected prescription message: %s", msgCreate.Content)
-
-		// علامت بزنید که این چت در حال پردازش است
-		h.processingChatsMutex.Lock()
-		h.processingChats[msgCreate.ChatID] = true
-		h.processingChatsMutex.Unlock()
-
-		// Process asynchronously to avoid blocking the response
-		go func() {
-			h.generateAIResponse(msgCreate.ChatID, msgCreate.Content, userID)
-
-			// پس از اتمام پردازش، علامت را بردارید
-			h.processingChatsMutex.Lock()
-			delete(h.processingChats, msgCreate.ChatID)
-			h.processingChatsMutex.Unlock()
-		}()
-	}
 }
 
 // DeleteChat deletes a chat by ID
@@ -271,15 +314,15 @@ func (h *ChatHandler) DeleteChat(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Verify chat ownership before deletion
-	_, err = db.GetChat(chatID, userID)
-	if err != nil {
+	// Verify chat ownership before deletion; colleagues can see a shared chat but not delete it
+	chat, err := h.chats.GetChat(r.Context(), chatID, userID)
+	if err != nil || chat.UserID != userID {
 		http.Error(w, "Chat not found or unauthorized", http.StatusNotFound)
 		return
 	}
 
 	// Delete the chat
-	err = db.DeleteChat(chatID)
+	err = h.chats.DeleteChat(r.Context(), chatID)
 	if err != nil {
 		http.Error(w, "Error deleting chat", http.StatusInternalServerError)
 		return
@@ -317,14 +360,14 @@ func (h *ChatHandler) GetChatMessages(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Verify chat ownership
-	_, err = db.GetChat(chatID, userID)
+	_, err = h.chats.GetChat(r.Context(), chatID, userID)
 	if err != nil {
 		http.Error(w, "Chat not found or unauthorized", http.StatusNotFound)
 		return
 	}
 
 	// Get messages for the chat
-	messages, err := db.GetChatMessages(chatID)
+	messages, err := h.chats.GetChatMessages(r.Context(), chatID)
 	if err != nil {
 		http.Error(w, "Error retrieving messages", http.StatusInternalServerError)
 		return
@@ -335,6 +378,28 @@ func (h *ChatHandler) GetChatMessages(w http.ResponseWriter, r *http.Request) {
 		messages = []models.Message{}
 	}
 
+	// Make sure image links are still valid
+	refreshImageURLs(r.Context(), messages)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(messages)
+}
+
+// refreshImageURLs rewrites the content of image messages so that local images
+// carry the full server URL and S3 images get a fresh pre-signed URL
+func refreshImageURLs(ctx context.Context, messages []models.Message) {
+	// Avoid setting up an S3 client for chats without images
+	hasImages := false
+	for _, msg := range messages {
+		if msg.ContentType == "image" {
+			hasImages = true
+			break
+		}
+	}
+	if !hasImages {
+		return
+	}
+
 	// Get the server base URL for local images
 	serverBaseURL := os.Getenv("SERVER_BASE_URL")
 	if serverBaseURL == "" {
@@ -342,9 +407,9 @@ func (h *ChatHandler) GetChatMessages(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Initialize S3 client
-	s3Client, err := storage.NewS3Client()
+	s3Client, err := storage.NewS3Client(ctx)
 	if err != nil {
-		log.Printf("Error initializing S3 client: %v", err)
+		slog.Error("Error initializing S3 client", "error", err)
 		// Continue without regenerating URLs for S3 objects, but still process local images
 	}
 
@@ -358,28 +423,23 @@ func (h *ChatHandler) GetChatMessages(w http.ResponseWriter, r *http.Request) {
 				// For local images, ensure they have the full server URL
 				if !strings.HasPrefix(msg.Content, "http") {
 					messages[i].Content = serverBaseURL + msg.Content
-					log.Printf("Updated local image URL: %s", messages[i].Content)
 				}
 			} else if s3Client != nil {
 				// For S3 images, generate a fresh pre-signed URL
 				objectKey, ok := msg.Metadata["objectKey"].(string)
 				if ok && objectKey != "" {
 					// Generate a fresh pre-signed URL valid for 24 hours
-					presignedURL, urlErr := s3Client.GetTemporaryURL(objectKey, 24*time.Hour)
+					presignedURL, urlErr := s3Client.GetTemporaryURL(ctx, objectKey, 24*time.Hour)
 					if urlErr == nil {
 						// Update the content with the fresh URL
 						messages[i].Content = presignedURL
-						log.Printf("Regenerated pre-signed URL for image: %s", presignedURL)
 					} else {
-						log.Printf("Error generating pre-signed URL: %v", urlErr)
+						slog.Error("Error generating pre-signed URL", "error", urlErr)
 					}
 				}
 			}
 		}
 	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(messages)
 }
 
 // UpdateChat updates a chat by ID
@@ -404,9 +464,9 @@ func (h *ChatHandler) UpdateChat(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Verify chat ownership before update
-	_, err = db.GetChat(chatID, userID)
-	if err != nil {
+	// Verify chat ownership before update; colleagues can see a shared chat but not change it
+	chat, err := h.chats.GetChat(r.Context(), chatID, userID)
+	if err != nil || chat.UserID != userID {
 		http.Error(w, "Chat not found or unauthorized", http.StatusNotFound)
 		return
 	}
@@ -418,7 +478,7 @@ func (h *ChatHandler) UpdateChat(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Update the chat
-	updatedChat, err := db.UpdateChat(chatID, userID, &chatUpdate)
+	updatedChat, err := h.chats.UpdateChat(r.Context(), chatID, userID, &chatUpdate)
 	if err != nil {
 		http.Error(w, "Error updating chat", http.StatusInternalServerError)
 		return
@@ -471,263 +531,114 @@ func (h *ChatHandler) CreateChatMessage(w http.ResponseWriter, r *http.Request)
 	}
 
 	// Verify chat ownership
-	_, err = db.GetChat(chatID, userID)
+	_, err = h.chats.GetChat(r.Context(), chatID, userID)
 	if err != nil {
 		http.Error(w, "Chat not found or unauthorized", http.StatusNotFound)
 		return
 	}
 
 	// بررسی کنید آیا این چت در حال پردازش است
-	h.processingChatsMutex.Lock()
-	isProcessing := h.processingChats[chatID]
-	h.processingChatsMutex.Unlock()
-
-	if isProcessing {
+	if job := h.activeJob(r.Context(), chatID); job != nil {
 		// اگر چت در حال پردازش است، یک پیام خطا برگردانید
-		response := map[string]interface{}{
-			"status":  "processing",
-			"message": "پیام قبلی شما در حال پردازش است. لطفا صبر کنید.",
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusAccepted)
-		json.NewEncoder(w).Encode(response)
+		writeProcessingResponse(w, job)
 		return
 	}
 
+	// Every user message gets an AI reply. Prescriptions use up an analysis
+	// of the subscription, which is reserved before anything is saved.
+	jobID, kind := "", models.AIJobKindChat
+	if requestBody.Role == "user" {
+		jobID = uuid.New().String()
+		kind = h.replyKind(r.Context(), requestBody.Content)
+		if kind.Billed() {
+			slog.InfoContext(r.Context(), "Detected prescription message", "chat_id", chatID, "content_length", len(requestBody.Content))
+			if !reserveAnalysis(r.Context(), w, h.plans, userID, jobUsageKey(jobID)) {
+				return
+			}
+		}
+	}
+
 	// Create the message
-	msg, err := db.CreateMessage(&msgCreate)
+	msg, err := h.chats.CreateMessage(r.Context(), &msgCreate)
 	if err != nil {
+		if jobID != "" {
+			releaseAnalysis(r.Context(), h.plans, jobUsageKey(jobID))
+		}
 		http.Error(w, "Error creating message", http.StatusInternalServerError)
 		return
 	}
 
+	if jobID != "" {
+		// Queue the reply so it survives restarts and runs on any replica
+		job, err := h.enqueueAnalysisJob(r.Context(), jobID, chatID, userID, kind, requestBody.Content)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Error queueing AI reply", "kind", kind, "error", err)
+		} else {
+			w.Header().Set("X-Job-ID", job.ID)
+		}
+	}
+
 	// Return the created message
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(msg)
-
-	// Check if this is a prescription message that needs AI analysis
-	if requestBody.Role == "user" && isPrescriptionMessage(requestBody.Content) {
-		log.Printf("Detected prescription message: %s", requestBody.Content)
-
-		// علامت بزنید که این چت در حال پردازش است
-		h.processingChatsMutex.Lock()
-		h.processingChats[chatID] = true
-		h.processingChatsMutex.Unlock()
-
-		// Process asynchronously to avoid blocking the response
-		go func() {
-			h.generateAIResponse(chatID, requestBody.Content, userID)
-
-			// پس از اتمام پردازش، علامت را بردارید
-			h.processingChatsMutex.Lock()
-			delete(h.processingChats, chatID)
-			h.processingChatsMutex.Unlock()
-		}()
-	}
 }
 
-// Helper method to generate AI responses for prescription messages
-func (h *ChatHandler) generateAIResponse(chatID int64, content string, userID int64) {
-	// Create a direct HTTP request to the AI analysis endpoint
-	aiURL := "https://api.avalai.ir/v1/completions"
-
-	// ایجاد یک شناسه منحصر به فرد برای این درخواست
-	requestID := fmt.Sprintf("%d-%d", chatID, time.Now().UnixNano())
-
-	// Prepare the AI prompt
-	promptText := fmt.Sprintf(`من مسئول فنی یک داروخانه شهری هستم
-
-خوب فکر کن و تمام جوانب رو بررسی کن و با استدلال جواب بده
-
-به این نسخه تصویری نگاه کن و به من کمک کن. تصویر نسخه در این آدرس قابل مشاهده است: %s
-
-با سلام همکار گرامی،
-
-با بررسی داروهای موجود در نسخه، اطلاعات زیر را خدمت شما ارائه می‌دهم:
-
-<داروها>
-لیست کامل داروها را بنویس و برای هر دارو یک توضیح کامل بنویس که شامل دسته دارویی، مکانیسم اثر و کاربرد اصلی آن باشد. حتما همه داروهای موجود در نسخه را بررسی کن و هیچ دارویی را از قلم نینداز.
-</داروها>
-
-<تشخیص>
-با توجه به ترکیب داروها، تشخیص احتمالی را با جزئیات کامل توضیح بده و دلیل استفاده از هر دارو را در درمان این عارضه شرح بده.
-</تشخیص>
-
-<تداخلات>
-تمام تداخلات بین داروهای نسخه را با جزئیات بررسی کن. برای هر تداخل، شدت آن، مکانیسم تداخل و راهکارهای مدیریت آن را توضیح بده. اگر تداخل مهمی وجود ندارد، به صراحت ذکر کن.
-</تداخلات>
+// Helper method to generate AI replies to text messages. The reply is built
+// from the chat history; prescriptions get a full analysis and other messages
+// a conversational answer. It returns the ID of the saved assistant message.
+// When the reply fails and this is not the final attempt, nothing is saved
+// so the job can retry.
+func (h *ChatHandler) generateAIResponse(ctx context.Context, job *models.AIJob, final bool) (int64, error) {
+	chatID := job.ChatID
 
-<عوارض>
-عوارض شایع و مهم هر دارو را به تفکیک بنویس و توضیح بده که بیمار چگونه باید این عوارض را مدیریت کند. عوارض خطرناک که نیاز به مراجعه فوری به پزشک دارند را مشخص کن.
-</عوارض>
+	// شناسه کار به عنوان شناسه منحصر به فرد این درخواست استفاده می‌شود
+	requestID := job.ID
 
-<زمان_مصرف>
-برای هر دارو، بهترین زمان مصرف را با دلیل آن توضیح بده. مثلا صبح، شب، قبل از خواب، یا در زمان‌های خاص دیگر.
-</زمان_مصرف>
-
-<مصرف_با_غذا>
-برای هر دارو مشخص کن که آیا باید با غذا، با معده خالی، یا با فاصله از غذا مصرف شود و دلیل این توصیه را توضیح بده.
-</مصرف_با_غذا>
-
-<دوز_مصرف>
-دوز و تعداد دفعات مصرف هر دارو را به صورت دقیق بنویس و در صورت نیاز، توضیح بده که چرا این دوز توصیه شده است.
-</دوز_مصرف>
-
-<مدیریت_عارضه>
-توصیه‌های تکمیلی برای مدیریت بیماری یا عارضه را بنویس، مانند رژیم غذایی خاص، فعالیت‌های فیزیکی توصیه شده یا منع شده، و سایر نکات مهم برای بهبود اثربخشی درمان.
-</مدیریت_عارضه>`, content)
-
-	// Define request payload - using the correct format with a "prompt" field
-	requestData := map[string]interface{}{
-		"model":       "gemini-2.0-flash-thinking-exp-01-21", // Use the most advanced model for image understanding
-		"prompt":      promptText,
-		"max_tokens":  2000,
-		"temperature": 0.7,
-	}
-
-	// Convert request to JSON
-	requestBody, err := json.Marshal(requestData)
+	conv, err := h.buildConversation(ctx, job)
 	if err != nil {
-		log.Printf("Error marshaling AI request: %v", err)
-		return
+		return 0, err
 	}
 
-	// API key should be set in environment
-	apiKey := os.Getenv("OPENAI_API_KEY")
-	if apiKey == "" {
-		log.Printf("No API key found for AI service")
-		return
+	systemPrompt := ai.ChatSystemPrompt
+	failureContent := "عذر می‌خواهم، در پاسخ به این پیام خطایی رخ داد. لطفا دوباره تلاش کنید."
+	if job.Kind == models.AIJobKindText {
+		systemPrompt = ai.PrescriptionSystemPrompt
+		failureContent = "عذر می‌خواهم، در تحلیل این نسخه خطایی رخ داد. لطفا دوباره تلاش کنید."
 	}
 
-	// Create an HTTP client with timeout
-	client := &http.Client{
-		Timeout: 45 * time.Second, // Increase timeout for large responses
-	}
+	ctx, cancel := context.WithTimeout(ctx, 60*time.Second)
+	defer cancel()
 
-	// Try multiple endpoints in case the primary one fails
-	endpoints := []string{
-		aiURL,
-		"https://api.avalai.ir/v1/chat/completions", // Alternative endpoint
+	// Stream the reply to clients watching this chat while it is generated.
+	// A retried job sends a fresh start event so clients discard partial content.
+	h.streams.start(chatID, requestID)
+	analysisContent, err := h.analyzer.streamConversation(ctx, systemPrompt, conv, func(delta string) {
+		h.streams.delta(chatID, requestID, delta)
+	})
+	if err == nil && analysisContent == "" {
+		err = ai.ErrEmptyResponse
 	}
-
-	var analysisContent string
-	var responseReceived bool
-
-	for _, endpoint := range endpoints {
-		// Create the HTTP request
-		req, err := http.NewRequest("POST", endpoint, bytes.NewBuffer(requestBody))
-		if err != nil {
-			log.Printf("Error creating AI request to %s: %v", endpoint, err)
-			continue
-		}
-
-		// Set headers
-		req.Header.Set("Content-Type", "application/json")
-		req.Header.Set("Authorization", "Bearer "+apiKey)
-
-		// Log the request for debugging
-		log.Printf("Trying AI endpoint: %s", endpoint)
-
-		// Send the request
-		resp, err := client.Do(req)
-		if err != nil {
-			log.Printf("Error calling AI service %s: %v", endpoint, err)
-			continue
-		}
-
-		// Check response status
-		if resp.StatusCode != http.StatusOK {
-			bodyBytes, _ := io.ReadAll(resp.Body)
-			log.Printf("AI service %s returned status %d: %s",
-				endpoint, resp.StatusCode, string(bodyBytes))
-			resp.Body.Close()
-			continue
-		}
-
-		// Try to parse the response based on endpoint type
-		if strings.Contains(endpoint, "chat") {
-			// Parse chat completion format
-			var chatResponse struct {
-				Choices []struct {
-					Message struct {
-						Content string `json:"content"`
-					} `json:"message"`
-				} `json:"choices"`
-			}
-
-			if err := json.NewDecoder(resp.Body).Decode(&chatResponse); err != nil {
-				log.Printf("Error decoding chat response from %s: %v", endpoint, err)
-				resp.Body.Close()
-				continue
-			}
-
-			if len(chatResponse.Choices) > 0 {
-				analysisContent = chatResponse.Choices[0].Message.Content
-				responseReceived = true
-				resp.Body.Close()
-				break
-			}
-		} else {
-			// Parse standard completion format
-			var completionResponse struct {
-				Choices []struct {
-					Text string `json:"text"`
-				} `json:"choices"`
-			}
-
-			if err := json.NewDecoder(resp.Body).Decode(&completionResponse); err != nil {
-				log.Printf("Error decoding completion response from %s: %v", endpoint, err)
-				resp.Body.Close()
-				continue
-			}
-
-			if len(completionResponse.Choices) > 0 {
-				analysisContent = completionResponse.Choices[0].Text
-				responseReceived = true
-				resp.Body.Close()
-				break
-			}
+	analysisErr := err
+	if err != nil {
+		slog.ErrorContext(ctx, "Error generating chat reply", "kind", job.Kind, "error", err)
+		if !final {
+			return 0, err
 		}
-
-		resp.Body.Close()
 	}
 
-	// If all endpoints failed or returned empty results, use a default message
-	if !responseReceived || analysisContent == "" {
-		log.Printf("All AI service endpoints failed to provide analysis")
-		analysisContent = "عذر می‌خواهم، در تحلیل این نسخه خطایی رخ داد. لطفا دوباره تلاش کنید."
-	} else {
-		// Only update subscription usage if we got a successful response
-		// This is a prescription analysis, so we need to decrement the remaining uses
-		if err := h.updateSubscriptionUsage(userID); err != nil {
-			log.Printf("Error updating subscription usage: %v", err)
-			// Continue anyway, don't block the response
-		}
+	// If the provider failed or returned an empty result, use a default message
+	status := streamStatusCompleted
+	if analysisErr != nil {
+		slog.WarnContext(ctx, "AI provider failed to reply, saving the default message", "chat_id", chatID, "job_id", job.ID)
+		status = streamStatusFailed
+		analysisContent = failureContent
 	}
 
 	// اضافه کردن شناسه منحصر به فرد به پاسخ برای جلوگیری از کش شدن در سمت کلاینت
 	analysisContent = fmt.Sprintf("%s\n\n<!-- Response ID: %s -->", analysisContent, requestID)
 
-	// Log the full response for debugging
-	log.Printf("Full AI response content (length: %d):", len(analysisContent))
-
-	// Check if the content might be truncated
-	if len(analysisContent) > 10 {
-		lastRune := []rune(analysisContent)[len([]rune(analysisContent))-1]
-		if lastRune != '.' && lastRune != '?' && lastRune != '!' &&
-			lastRune != '،' && lastRune != '\n' && lastRune != ':' {
-			log.Printf("WARNING: Image analysis content may be truncated, doesn't end with sentence terminator")
-			log.Printf("Last 50 characters: %s", analysisContent[len(analysisContent)-min(50, len(analysisContent)):])
-		}
-	}
-
-	// Log sample of content
-	if len(analysisContent) > 200 {
-		log.Printf("First 100 chars: %s", analysisContent[:100])
-		log.Printf("Last 100 chars: %s", analysisContent[len(analysisContent)-100:])
-	} else {
-		log.Printf("%s", analysisContent)
-	}
+	// Only the length of the analysis is logged, never its content
+	slog.DebugContext(ctx, "AI analysis generated", "chat_id", chatID, "job_id", job.ID, "content_length", len(analysisContent))
 
 	// Create a new message with the AI analysis
 	aiMsg := models.MessageCreate{
@@ -737,55 +648,53 @@ func (h *ChatHandler) generateAIResponse(chatID int64, content string, userID in
 		ContentType: "text",
 		Metadata:    map[string]interface{}{"length": len(analysisContent), "request_id": requestID},
 	}
+	for key, value := range conv.metadata() {
+		aiMsg.Metadata[key] = value
+	}
 
 	// Save the AI message to the database
-	aiMessage, err := db.CreateMessage(&aiMsg)
+	aiMessage, err := h.chats.CreateMessage(ctx, &aiMsg)
 	if err != nil {
-		log.Printf("Error creating AI response message for image: %v", err)
-		return
+		slog.ErrorContext(ctx, "Error creating AI response message", "error", err)
+		return 0, err
 	}
 
+	h.streams.done(chatID, requestID, aiMessage.ID, aiMessage.Content, status)
+
 	// Verify the saved content length matches the original
 	if len(aiMessage.Content) != len(analysisContent) {
-		log.Printf("WARNING: Content length mismatch! Original: %d, Saved: %d",
-			len(analysisContent), len(aiMessage.Content))
-
-		// Log more details about the truncation, if it occurred
-		if len(aiMessage.Content) < len(analysisContent) {
-			truncatedAt := len(aiMessage.Content)
-			log.Printf("Content was truncated at position %d", truncatedAt)
-			log.Printf("Content before truncation point: %s", analysisContent[max(0, truncatedAt-30):truncatedAt])
-			log.Printf("Content after truncation point that was lost: %s", analysisContent[truncatedAt:min(len(analysisContent), truncatedAt+30)])
-		}
-	} else {
-		log.Printf("Content length verified: original and saved lengths match (%d characters)", len(analysisContent))
+		slog.WarnContext(ctx, "Saved AI message length does not match the analysis",
+			"message_id", aiMessage.ID, "original_length", len(analysisContent), "saved_length", len(aiMessage.Content))
 	}
 
-	log.Printf("Successfully added AI response for image to chat %d with message ID: %d", chatID, aiMessage.ID)
-}
-
-// Helper method to update subscription usage for prescription analysis
-func (h *ChatHandler) updateSubscriptionUsage(userID int64) error {
-	// Get the active subscription for the user
-	activeSubscription, err := db.GetCurrentUserSubscription(userID)
-	if err != nil {
-		return fmt.Errorf("error getting active subscription: %v", err)
+	// Keep a structured copy of successful analyses so the app can render cards
+	if analysisErr == nil && job.Kind == models.AIJobKindText {
+		h.saveStructuredAnalysis(ctx, aiMessage.ID, analysisContent)
+		h.saveChatPrescription(ctx, job, aiMessage.ID, analysisContent)
 	}
 
-	if activeSubscription == nil {
-		return fmt.Errorf("no active subscription found")
-	}
+	slog.InfoContext(ctx, "Added AI response to chat", "chat_id", chatID, "message_id", aiMessage.ID, "job_id", job.ID)
+	return aiMessage.ID, analysisErr
+}
 
-	// Record usage (1 prescription)
-	if err := db.RecordSubscriptionUsage(activeSubscription.ID, 1); err != nil {
+// updateSubscriptionUsage charges one prescription analysis to the user's
+// current subscription. The idempotency key identifies the analysis so that
+// retries never charge it twice.
+func updateSubscriptionUsage(ctx context.Context, plans db.PlanStore, userID int64, idempotencyKey string) error {
+	subscriptionID, err := plans.RecordUserUsage(ctx, userID, 1, idempotencyKey)
+	if err != nil {
 		return fmt.Errorf("error recording subscription usage: %v", err)
 	}
 
-	log.Printf("Successfully recorded subscription usage for user %d, subscription %d",
-		userID, activeSubscription.ID)
+	slog.Info("Recorded subscription usage", "key", idempotencyKey, "user_id", userID, "subscription_id", subscriptionID)
 	return nil
 }
 
+// jobUsageKey is the idempotency key under which an AI job is billed
+func jobUsageKey(jobID string) string {
+	return "ai_job:" + jobID
+}
+
 // UploadImageMessage handles image uploads for chat messages
 func (h *ChatHandler) UploadImageMessage(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
@@ -809,7 +718,7 @@ func (h *ChatHandler) UploadImageMessage(w http.ResponseWriter, r *http.Request)
 	}
 
 	// Verify chat ownership
-	_, err = db.GetChat(chatID, userID)
+	_, err = h.chats.GetChat(r.Context(), chatID, userID)
 	if err != nil {
 		http.Error(w, "Chat not found or unauthorized", http.StatusNotFound)
 		return
@@ -836,12 +745,18 @@ func (h *ChatHandler) UploadImageMessage(w http.ResponseWriter, r *http.Request)
 		role = "user"
 	}
 
+	// Reserve a use of the subscription before the image is stored
+	jobID := uuid.New().String()
+	if !reserveAnalysis(r.Context(), w, h.plans, userID, jobUsageKey(jobID)) {
+		return
+	}
+
 	// Initialize S3 client
-	s3Client, err := storage.NewS3Client()
+	s3Client, err := storage.NewS3Client(r.Context())
 	if err != nil {
-		log.Printf("Error initializing S3 client: %v", err)
+		slog.ErrorContext(r.Context(), "Error initializing S3 client", "error", err)
 		// Fallback to local storage if S3 client initialization fails
-		h.handleLocalImageUpload(w, r, chatID, userID, file, header, role)
+		h.handleLocalImageUpload(w, r, jobID, chatID, userID, file, header, role)
 		return
 	}
 
@@ -852,11 +767,11 @@ func (h *ChatHandler) UploadImageMessage(w http.ResponseWriter, r *http.Request)
 	}
 
 	// Upload the image to S3
-	imageURL, err := s3Client.UploadFile(file, header.Filename, contentType)
+	imageURL, err := s3Client.UploadFile(r.Context(), file, header.Filename, contentType)
 	if err != nil {
-		log.Printf("Error uploading image to S3: %v", err)
+		slog.ErrorContext(r.Context(), "Error uploading image to S3", "error", err)
 		// Fallback to local storage if S3 upload fails
-		h.handleLocalImageUpload(w, r, chatID, userID, file, header, role)
+		h.handleLocalImageUpload(w, r, jobID, chatID, userID, file, header, role)
 		return
 	}
 
@@ -868,15 +783,14 @@ func (h *ChatHandler) UploadImageMessage(w http.ResponseWriter, r *http.Request)
 
 	// Generate a pre-signed URL that will work with private bucket
 	// Set expiration time to 24 hours
-	presignedURL, err := s3Client.GetTemporaryURL(objectKey, 24*time.Hour)
+	presignedURL, err := s3Client.GetTemporaryURL(r.Context(), objectKey, 24*time.Hour)
 	if err != nil {
-		log.Printf("Error generating pre-signed URL: %v", err)
+		slog.ErrorContext(r.Context(), "Error generating pre-signed URL", "error", err)
+		releaseAnalysis(r.Context(), h.plans, jobUsageKey(jobID))
 		http.Error(w, "Error generating pre-signed URL", http.StatusInternalServerError)
 		return
 	}
 
-	log.Printf("Generated pre-signed URL for image: %s", presignedURL)
-
 	// Store the object key in the database for future reference
 	// This way we can generate new pre-signed URLs when needed
 	msgCreate := models.MessageCreate{
@@ -889,131 +803,61 @@ func (h *ChatHandler) UploadImageMessage(w http.ResponseWriter, r *http.Request)
 	}
 
 	// Save the message to the database
-	msg, err := db.CreateMessage(&msgCreate)
+	msg, err := h.chats.CreateMessage(r.Context(), &msgCreate)
 	if err != nil {
+		releaseAnalysis(r.Context(), h.plans, jobUsageKey(jobID))
 		http.Error(w, "Error creating message", http.StatusInternalServerError)
 		return
 	}
 
+	// Queue the image for AI prescription analysis
+	slog.InfoContext(r.Context(), "Processing prescription image", "chat_id", chatID, "object_key", objectKey)
+	job, err := h.enqueueAnalysisJob(r.Context(), jobID, chatID, userID, models.AIJobKindImage, presignedURL)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error queueing image analysis", "error", err)
+	} else {
+		w.Header().Set("X-Job-ID", job.ID)
+	}
+
 	// Return the created message
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(msg)
-
-	// Process image with AI for prescription analysis
-	log.Printf("Processing prescription image for chat ID: %d, image URL: %s", chatID, presignedURL)
-	// Run image analysis in a goroutine to avoid blocking
-	go func() {
-		// Add a delay to ensure the frontend can fetch the new message first
-		time.Sleep(1 * time.Second)
-
-		// Process the image
-		if err := h.generateImageAIResponse(chatID, presignedURL, userID); err != nil {
-			log.Printf("Error generating AI response for image: %v", err)
-
-			// Create an error message to inform the user
-			errorMsg := models.MessageCreate{
-				ChatID:      chatID,
-				Role:        "assistant",
-				Content:     "عذر می‌خواهم، در تحلیل این نسخه تصویری خطایی رخ داد. لطفا دوباره تلاش کنید یا نسخه را به صورت متنی وارد کنید.",
-				ContentType: "text",
-			}
-
-			// Save the error message to the database
-			_, err := db.CreateMessage(&errorMsg)
-			if err != nil {
-				log.Printf("Error creating error message: %v", err)
-			}
-		}
-	}()
 }
 
-// Helper method to generate AI responses for prescription images
-func (h *ChatHandler) generateImageAIResponse(chatID int64, imageURL string, userID int64) error {
-	log.Printf("Starting AI analysis for image at URL: %s", imageURL)
+// Helper method to generate AI responses for prescription images.
+// It behaves like generateAIResponse but sends the image to the provider.
+func (h *ChatHandler) generateImageAIResponse(ctx context.Context, job *models.AIJob, final bool) (int64, error) {
+	chatID, imageURL := job.ChatID, job.Input
+	slog.InfoContext(ctx, "Starting AI analysis of image", "chat_id", chatID, "job_id", job.ID)
 
-	// ایجاد یک شناسه منحصر به فرد برای این درخواست
-	requestID := fmt.Sprintf("%d-%d", chatID, time.Now().UnixNano())
+	// شناسه کار به عنوان شناسه منحصر به فرد این درخواست استفاده می‌شود
+	requestID := job.ID
 
-	// Get API key from environment variable
-	apiKey := os.Getenv("OPENAI_API_KEY")
-	if apiKey == "" {
-		log.Printf("No API key found for AI service")
-		return fmt.Errorf("no API key found")
-	}
-
-	// Try different approaches for image analysis in order of preference
-	var analysisContent string
-	var err error
-	var aiSuccessful bool = false
-
-	// First try with openai client and multimodal approach
-	log.Println("Attempting to analyze image with Gemini multimodal approach")
-	analysisContent, err = h.tryMultimodalImageAnalysis(apiKey, imageURL)
-	if err == nil && analysisContent != "" {
-		aiSuccessful = true
-	}
-
-	// If that fails, fall back to text prompt approach
-	if err != nil || analysisContent == "" {
-		log.Printf("Multimodal approach failed: %v. Trying with text prompt approach", err)
-		analysisContent, err = h.tryTextPromptImageAnalysis(apiKey, imageURL)
-		if err == nil && analysisContent != "" {
-			aiSuccessful = true
-		}
-
-		// If that also fails, try direct HTTP approach as final fallback
-		if err != nil || analysisContent == "" {
-			log.Printf("Text prompt approach failed: %v. Trying direct HTTP approach", err)
-			analysisContent, err = h.tryDirectHTTPForImageAnalysis(apiKey, imageURL)
-			if err == nil && analysisContent != "" {
-				aiSuccessful = true
-			}
+	ctx, cancel := context.WithTimeout(ctx, 90*time.Second)
+	defer cancel()
 
-			// If all approaches fail, provide a fallback error message
-			if err != nil || analysisContent == "" {
-				log.Printf("All image analysis approaches failed: %v", err)
-				analysisContent = "عذر می‌خواهم، در تحلیل این نسخه تصویری خطایی رخ داد. لطفا دوباره تلاش کنید یا نسخه را به صورت متنی وارد کنید."
-				aiSuccessful = false
-			}
+	// Image analyses are not streamed, but watchers still get start and done events
+	h.streams.start(chatID, requestID)
+	analysisContent, err := h.analyzer.analyzeImage(ctx, imageURL)
+	if err == nil && analysisContent == "" {
+		err = ai.ErrEmptyResponse
+	}
+	analysisErr := err
+	aiSuccessful := err == nil
+	if !aiSuccessful {
+		slog.ErrorContext(ctx, "All image analysis approaches failed", "error", err)
+		if !final {
+			return 0, err
 		}
-	}
-
-	// Only update subscription usage if we got a successful response
-	if aiSuccessful {
-		if err := h.updateSubscriptionUsage(userID); err != nil {
-			log.Printf("Error updating subscription usage: %v", err)
-			// Continue anyway, don't block the response
-		} else {
-			log.Printf("Successfully updated subscription usage for user %d", userID)
-		}
-	} else {
-		log.Printf("Not updating subscription usage due to AI service failure")
+		analysisContent = "عذر می‌خواهم، در تحلیل این نسخه تصویری خطایی رخ داد. لطفا دوباره تلاش کنید یا نسخه را به صورت متنی وارد کنید."
 	}
 
 	// اضافه کردن شناسه منحصر به فرد به پاسخ برای جلوگیری از کش شدن در سمت کلاینت
 	analysisContent = fmt.Sprintf("%s\n\n<!-- Response ID: %s -->", analysisContent, requestID)
 
-	// Log the full response for debugging
-	log.Printf("Full AI response content (length: %d):", len(analysisContent))
-
-	// Check if the content might be truncated
-	if len(analysisContent) > 10 {
-		lastRune := []rune(analysisContent)[len([]rune(analysisContent))-1]
-		if lastRune != '.' && lastRune != '?' && lastRune != '!' &&
-			lastRune != '،' && lastRune != '\n' && lastRune != ':' {
-			log.Printf("WARNING: Image analysis content may be truncated, doesn't end with sentence terminator")
-			log.Printf("Last 50 characters: %s", analysisContent[len(analysisContent)-min(50, len(analysisContent)):])
-		}
-	}
-
-	// Log sample of content
-	if len(analysisContent) > 200 {
-		log.Printf("First 100 chars: %s", analysisContent[:100])
-		log.Printf("Last 100 chars: %s", analysisContent[len(analysisContent)-100:])
-	} else {
-		log.Printf("%s", analysisContent)
-	}
+	// Only the length of the analysis is logged, never its content
+	slog.DebugContext(ctx, "AI analysis generated", "chat_id", chatID, "job_id", job.ID, "content_length", len(analysisContent))
 
 	// Create a new message with the AI analysis
 	aiMsg := models.MessageCreate{
@@ -1025,169 +869,32 @@ func (h *ChatHandler) generateImageAIResponse(chatID int64, imageURL string, use
 	}
 
 	// Save the AI message to the database
-	aiMessage, err := db.CreateMessage(&aiMsg)
-	if err != nil {
-		log.Printf("Error creating AI response message for image: %v", err)
-		return err
-	}
-
-	// Verify the saved content length matches the original
-	if len(aiMessage.Content) != len(analysisContent) {
-		log.Printf("WARNING: Content length mismatch! Original: %d, Saved: %d",
-			len(analysisContent), len(aiMessage.Content))
-
-		// Log more details about the truncation, if it occurred
-		if len(aiMessage.Content) < len(analysisContent) {
-			truncatedAt := len(aiMessage.Content)
-			log.Printf("Content was truncated at position %d", truncatedAt)
-			log.Printf("Content before truncation point: %s", analysisContent[max(0, truncatedAt-30):truncatedAt])
-			log.Printf("Content after truncation point that was lost: %s", analysisContent[truncatedAt:min(len(analysisContent), truncatedAt+30)])
-		}
-	} else {
-		log.Printf("Content length verified: original and saved lengths match (%d characters)", len(analysisContent))
-	}
-
-	log.Printf("Successfully added AI response for image to chat %d with message ID: %d", chatID, aiMessage.ID)
-	return nil
-}
-
-// tryMultimodalImageAnalysis attempts to analyze the image using multimodal API
-func (h *ChatHandler) tryMultimodalImageAnalysis(apiKey string, imageURL string) (string, error) {
-	// Create OpenAI client with custom base URL
-	config := openai.DefaultConfig(apiKey)
-	config.BaseURL = "https://api.avalai.ir/v1"
-
-	// Configure HTTP client with longer timeouts for image processing
-	transport := &http.Transport{
-		TLSHandshakeTimeout: 20 * time.Second,
-		DisableKeepAlives:   false,
-		MaxIdleConns:        10,
-		MaxIdleConnsPerHost: 5,
-		IdleConnTimeout:     90 * time.Second,
-		DialContext: (&net.Dialer{
-			Timeout:   30 * time.Second,
-			KeepAlive: 30 * time.Second,
-		}).DialContext,
-	}
-
-	httpClient := &http.Client{
-		Timeout:   60 * time.Second,
-		Transport: transport,
-	}
-	config.HTTPClient = httpClient
-
-	client := openai.NewClientWithConfig(config)
-	log.Println("OpenAI client initialized for multimodal image analysis")
-
-	// Create a context with timeout
-	ctx, cancel := context.WithTimeout(context.Background(), 45*time.Second)
-	defer cancel()
-
-	// First, download the image from the pre-signed URL
-	log.Printf("Downloading image from URL: %s", imageURL)
-
-	// Create HTTP request to download the image
-	req, err := http.NewRequestWithContext(ctx, "GET", imageURL, nil)
-	if err != nil {
-		log.Printf("Error creating download request: %v", err)
-		return "", err
-	}
-
-	// Send request to download the image
-	downloadResp, err := httpClient.Do(req)
+	aiMessage, err := h.chats.CreateMessage(ctx, &aiMsg)
 	if err != nil {
-		log.Printf("Error downloading image: %v", err)
-		return "", err
+		slog.ErrorContext(ctx, "Error creating AI response message for image", "error", err)
+		return 0, err
 	}
-	defer downloadResp.Body.Close()
 
-	if downloadResp.StatusCode != http.StatusOK {
-		log.Printf("Failed to download image, status code: %d", downloadResp.StatusCode)
-		return "", fmt.Errorf("failed to download image: status code %d", downloadResp.StatusCode)
+	status := streamStatusCompleted
+	if !aiSuccessful {
+		status = streamStatusFailed
 	}
+	h.streams.done(chatID, requestID, aiMessage.ID, aiMessage.Content, status)
 
-	// Read the image data
-	imageData, err := io.ReadAll(downloadResp.Body)
-	if err != nil {
-		log.Printf("Error reading image data: %v", err)
-		return "", err
-	}
-
-	log.Printf("Successfully downloaded image, size: %d bytes", len(imageData))
-
-	// Encode the image to base64
-	base64Image := base64.StdEncoding.EncodeToString(imageData)
-
-	// Create the image data URL with proper MIME type
-	mimeType := downloadResp.Header.Get("Content-Type")
-	if mimeType == "" || mimeType == "application/octet-stream" {
-		// Detect MIME type from file content based on image header bytes
-		mimeType = detectImageMimeType(imageData)
-	}
-	dataURI := fmt.Sprintf("data:%s;base64,%s", mimeType, base64Image)
-
-	log.Printf("Converted image to base64 data URI with MIME type: %s", mimeType)
-
-	// This is specifically for Gemini models which support multimodal in this format
-	aiResp, err := client.CreateChatCompletion(
-		ctx,
-		openai.ChatCompletionRequest{
-			Model: "gemini-2.0-flash-thinking-exp-01-21",
-			Messages: []openai.ChatCompletionMessage{
-				{
-					Role: openai.ChatMessageRoleSystem,
-					Content: "من مسئول فنی یک داروخانه شهری هستم. لطفا تصویر نسخه ارسالی را تحلیل کن و به صورت ساختار یافته پاسخ بده. پاسخ باید شامل این بخش‌ها باشد:\n\n" +
-						"<داروها>\nلیست کامل داروها را بنویس و برای هر دارو یک توضیح کامل بنویس که شامل دسته دارویی، مکانیسم اثر و کاربرد اصلی آن باشد. حتما همه داروهای موجود در نسخه را بررسی کن و هیچ دارویی را از قلم نینداز.\n</داروها>\n\n" +
-						"<تشخیص>\nبا توجه به ترکیب داروها، تشخیص احتمالی را با جزئیات کامل توضیح بده و دلیل استفاده از هر دارو را در درمان این عارضه شرح بده.\n</تشخیص>\n\n" +
-						"<تداخلات>\nتمام تداخلات بین داروهای نسخه را با جزئیات بررسی کن. برای هر تداخل، شدت آن، مکانیسم تداخل و راهکارهای مدیریت آن را توضیح بده. اگر تداخل مهمی وجود ندارد، به صراحت ذکر کن.\n</تداخلات>\n\n" +
-						"<عوارض>\nعوارض شایع و مهم هر دارو را به تفکیک بنویس و توضیح بده که بیمار چگونه باید این عوارض را مدیریت کند. عوارض خطرناک که نیاز به مراجعه فوری به پزشک دارند را مشخص کن.\n</عوارض>\n\n" +
-						"<زمان_مصرف>\nبرای هر دارو، بهترین زمان مصرف را با دلیل آن توضیح بده. مثلا صبح، شب، قبل از خواب، یا در زمان‌های خاص دیگر.\n</زمان_مصرف>\n\n" +
-						"<مصرف_با_غذا>\nبرای هر دارو مشخص کن که آیا باید با غذا، با معده خالی، یا با فاصله از غذا مصرف شود و دلیل این توصیه را توضیح بده.\n</مصرف_با_غذا>\n\n" +
-						"<دوز_مصرف>\nدوز و تعداد دفعات مصرف هر دارو را به صورت دقیق بنویس و در صورت نیاز، توضیح بده که چرا این دوز توصیه شده است.\n</دوز_مصرف>\n\n" +
-						"<مدیریت_عارضه>\nتوصیه‌های تکمیلی برای مدیریت بیماری یا عارضه را بنویس، مانند رژیم غذایی خاص، فعالیت‌های فیزیکی توصیه شده یا منع شده، و سایر نکات مهم برای بهبود اثربخشی درمان.\n</مدیریت_عارضه>",
-				},
-				{
-					Role: openai.ChatMessageRoleUser,
-					MultiContent: []openai.ChatMessagePart{
-						{
-							Type: openai.ChatMessagePartTypeText,
-							Text: "لطفا این نسخه تصویری را تحلیل کنید:",
-						},
-						{
-							Type: openai.ChatMessagePartTypeImageURL,
-							ImageURL: &openai.ChatMessageImageURL{
-								URL: dataURI,
-							},
-						},
-					},
-				},
-			},
-			MaxTokens:   2000,
-			Temperature: 0.7,
-		},
-	)
-
-	// Handle any errors
-	if err != nil {
-		log.Printf("Error calling AI service with multimodal approach: %v", err)
-
-		// Check for timeout
-		if ctx.Err() == context.DeadlineExceeded {
-			return "", fmt.Errorf("API request timed out")
-		}
-		return "", fmt.Errorf("failed to get AI analysis: %v", err)
+	// Verify the saved content length matches the original
+	if len(aiMessage.Content) != len(analysisContent) {
+		slog.WarnContext(ctx, "Saved AI message length does not match the analysis",
+			"message_id", aiMessage.ID, "original_length", len(analysisContent), "saved_length", len(aiMessage.Content))
 	}
 
-	// Extract the response content
-	if len(aiResp.Choices) > 0 {
-		analysisContent := aiResp.Choices[0].Message.Content
-		log.Printf("Multimodal image analysis received (sample): %s...", analysisContent[:min(100, len(analysisContent))])
-		log.Printf("Multimodal image analysis length: %d characters", len(analysisContent))
-		return analysisContent, nil
+	// Keep a structured copy of successful analyses so the app can render cards
+	if analysisErr == nil {
+		h.saveStructuredAnalysis(ctx, aiMessage.ID, analysisContent)
+		h.saveChatPrescription(ctx, job, aiMessage.ID, analysisContent)
 	}
 
-	log.Printf("Multimodal approach returned empty response")
-	return "", fmt.Errorf("empty response from multimodal analysis")
+	slog.InfoContext(ctx, "Added AI response to chat", "chat_id", chatID, "message_id", aiMessage.ID, "job_id", job.ID)
+	return aiMessage.ID, analysisErr
 }
 
 // Helper function to get the minimum of two integers
@@ -1198,8 +905,9 @@ func min(a, b int) int {
 	return b
 }
 
-// handleLocalImageUpload is a fallback method to save images locally if S3 upload fails
-func (h *ChatHandler) handleLocalImageUpload(w http.ResponseWriter, r *http.Request, chatID int64, userID int64, file multipart.File, header *multipart.FileHeader, role string) {
+// handleLocalImageUpload is a fallback method to save images locally if S3 upload fails.
+// The analysis job jobID must already hold a usage reservation.
+func (h *ChatHandler) handleLocalImageUpload(w http.ResponseWriter, r *http.Request, jobID string, chatID int64, userID int64, file multipart.File, header *multipart.FileHeader, role string) {
 	// Create uploads directory if it doesn't exist
 	uploadsDir := "./uploads"
 	if _, err := os.Stat(uploadsDir); os.IsNotExist(err) {
@@ -1214,7 +922,8 @@ func (h *ChatHandler) handleLocalImageUpload(w http.ResponseWriter, r *http.Requ
 	// Create new file
 	dst, err := os.Create(filePath)
 	if err != nil {
-		log.Printf("Error creating local file: %v", err)
+		slog.ErrorContext(r.Context(), "Error creating local file", "error", err)
+		releaseAnalysis(r.Context(), h.plans, jobUsageKey(jobID))
 		http.Error(w, "Error saving image", http.StatusInternalServerError)
 		return
 	}
@@ -1226,7 +935,8 @@ func (h *ChatHandler) handleLocalImageUpload(w http.ResponseWriter, r *http.Requ
 	// Copy uploaded file data to new file
 	_, err = io.Copy(dst, file)
 	if err != nil {
-		log.Printf("Error copying file data: %v", err)
+		slog.ErrorContext(r.Context(), "Error copying file data", "error", err)
+		releaseAnalysis(r.Context(), h.plans, jobUsageKey(jobID))
 		http.Error(w, "Error saving image", http.StatusInternalServerError)
 		return
 	}
@@ -1250,318 +960,32 @@ func (h *ChatHandler) handleLocalImageUpload(w http.ResponseWriter, r *http.Requ
 	}
 
 	// Save the message to the database
-	msg, err := db.CreateMessage(&msgCreate)
+	msg, err := h.chats.CreateMessage(r.Context(), &msgCreate)
 	if err != nil {
+		releaseAnalysis(r.Context(), h.plans, jobUsageKey(jobID))
 		http.Error(w, "Error creating message", http.StatusInternalServerError)
 		return
 	}
 
-	// Return the created message
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(msg)
-
-	// Process image with AI in a goroutine
-	go func() {
-		time.Sleep(1 * time.Second)
-
-		// Use the absolute URL for AI processing
-		serverBaseURL := os.Getenv("SERVER_BASE_URL")
-		if serverBaseURL == "" {
-			serverBaseURL = "http://localhost:8080"
-		}
-		absoluteImageURL := fmt.Sprintf("%s%s", serverBaseURL, imageURL)
-
-		if err := h.generateImageAIResponse(chatID, absoluteImageURL, userID); err != nil {
-			log.Printf("Error generating AI response for local image: %v", err)
-
-			// Create an error message if AI processing fails
-			errorMsg := models.MessageCreate{
-				ChatID:      chatID,
-				Role:        "assistant",
-				Content:     "عذر می‌خواهم، در تحلیل این نسخه تصویری خطایی رخ داد. لطفا دوباره تلاش کنید یا نسخه را به صورت متنی وارد کنید.",
-				ContentType: "text",
-			}
-
-			// Save the error message
-			_, err := db.CreateMessage(&errorMsg)
-			if err != nil {
-				log.Printf("Error creating error message: %v", err)
-			}
-		}
-	}()
-}
-
-// tryTextPromptImageAnalysis attempts to analyze the image using a text prompt with the URL
-func (h *ChatHandler) tryTextPromptImageAnalysis(apiKey string, imageURL string) (string, error) {
-	// Create OpenAI client with custom base URL
-	config := openai.DefaultConfig(apiKey)
-	config.BaseURL = "https://api.avalai.ir/v1"
-
-	// Configure HTTP client with longer timeouts for image processing
-	transport := &http.Transport{
-		TLSHandshakeTimeout: 20 * time.Second,
-		DisableKeepAlives:   false,
-		MaxIdleConns:        10,
-		MaxIdleConnsPerHost: 5,
-		IdleConnTimeout:     90 * time.Second,
-		DialContext: (&net.Dialer{
-			Timeout:   30 * time.Second,
-			KeepAlive: 30 * time.Second,
-		}).DialContext,
-	}
-
-	httpClient := &http.Client{
-		Timeout:   60 * time.Second,
-		Transport: transport,
-	}
-	config.HTTPClient = httpClient
-
-	client := openai.NewClientWithConfig(config)
-	log.Println("OpenAI client initialized for text prompt image analysis")
-
-	// Create a context with timeout
-	ctx, cancel := context.WithTimeout(context.Background(), 45*time.Second)
-	defer cancel()
-
-	// Create a text prompt that includes the image URL
-	promptText := fmt.Sprintf(`من مسئول فنی یک داروخانه شهری هستم
-
-خوب فکر کن و تمام جوانب رو بررسی کن و با استدلال جواب بده
-
-به این نسخه تصویری نگاه کن و به من کمک کن. تصویر نسخه در این آدرس قابل مشاهده است: %s
-
-با سلام همکار گرامی،
-
-با بررسی داروهای موجود در نسخه، اطلاعات زیر را خدمت شما ارائه می‌دهم:
-
-<داروها>
-لیست کامل داروها را بنویس و برای هر دارو یک توضیح کامل بنویس که شامل دسته دارویی، مکانیسم اثر و کاربرد اصلی آن باشد. حتما همه داروهای موجود در نسخه را بررسی کن و هیچ دارویی را از قلم نینداز.
-</داروها>
-
-<تشخیص>
-با توجه به ترکیب داروها، تشخیص احتمالی را با جزئیات کامل توضیح بده و دلیل استفاده از هر دارو را در درمان این عارضه شرح بده.
-</تشخیص>
-
-<تداخلات>
-تمام تداخلات بین داروهای نسخه را با جزئیات بررسی کن. برای هر تداخل، شدت آن، مکانیسم تداخل و راهکارهای مدیریت آن را توضیح بده. اگر تداخل مهمی وجود ندارد، به صراحت ذکر کن.
-</تداخلات>
-
-<عوارض>
-عوارض شایع و مهم هر دارو را به تفکیک بنویس و توضیح بده که بیمار چگونه باید این عوارض را مدیریت کند. عوارض خطرناک که نیاز به مراجعه فوری به پزشک دارند را مشخص کن.
-</عوارض>
-
-<زمان_مصرف>
-برای هر دارو، بهترین زمان مصرف را با دلیل آن توضیح بده. مثلا صبح، شب، قبل از خواب، یا در زمان‌های خاص دیگر.
-</زمان_مصرف>
-
-<مصرف_با_غذا>
-برای هر دارو مشخص کن که آیا باید با غذا، با معده خالی، یا با فاصله از غذا مصرف شود و دلیل این توصیه را توضیح بده.
-</مصرف_با_غذا>
-
-<دوز_مصرف>
-دوز و تعداد دفعات مصرف هر دارو را به صورت دقیق بنویس و در صورت نیاز، توضیح بده که چرا این دوز توصیه شده است.
-</دوز_مصرف>
-
-<مدیریت_عارضه>
-توصیه‌های تکمیلی برای مدیریت بیماری یا عارضه را بنویس، مانند رژیم غذایی خاص، فعالیت‌های فیزیکی توصیه شده یا منع شده، و سایر نکات مهم برای بهبود اثربخشی درمان.
-</مدیریت_عارضه>`, imageURL)
-
-	// Use the ChatCompletion API with just the text prompt
-	resp, err := client.CreateChatCompletion(
-		ctx,
-		openai.ChatCompletionRequest{
-			Model: "gemini-2.0-flash-thinking-exp-01-21",
-			Messages: []openai.ChatCompletionMessage{
-				{
-					Role:    openai.ChatMessageRoleUser,
-					Content: promptText,
-				},
-			},
-			MaxTokens:   2000,
-			Temperature: 0.7,
-		},
-	)
-
-	// Handle any errors
-	if err != nil {
-		log.Printf("Error calling AI service with text prompt approach: %v", err)
-		return "", err
-	}
-
-	// Extract the response content
-	if len(resp.Choices) > 0 {
-		analysisContent := resp.Choices[0].Message.Content
-		log.Printf("Text prompt image analysis received (sample): %s...", analysisContent[:min(100, len(analysisContent))])
-		log.Printf("Text prompt image analysis length: %d characters", len(analysisContent))
-		return analysisContent, nil
-	}
-
-	log.Printf("Text prompt approach returned empty response")
-	return "", fmt.Errorf("empty response from text prompt analysis")
-}
-
-// tryDirectHTTPForImageAnalysis attempts to analyze the image using direct HTTP requests
-func (h *ChatHandler) tryDirectHTTPForImageAnalysis(apiKey string, imageURL string) (string, error) {
-	// Define the AI service URL
-	aiURL := "https://api.avalai.ir/v1/chat/completions"
-
-	// Create an HTTP client with appropriate timeout
-	client := &http.Client{
-		Timeout: 60 * time.Second,
-		Transport: &http.Transport{
-			TLSHandshakeTimeout: 20 * time.Second,
-			DisableKeepAlives:   false,
-			MaxIdleConns:        10,
-			MaxIdleConnsPerHost: 5,
-			IdleConnTimeout:     90 * time.Second,
-			DialContext: (&net.Dialer{
-				Timeout:   30 * time.Second,
-				KeepAlive: 30 * time.Second,
-			}).DialContext,
-		},
-	}
-
-	// First, download the image from the pre-signed URL
-	log.Printf("Downloading image from URL for direct HTTP approach: %s", imageURL)
-
-	// Create HTTP request to download the image
-	downloadReq, err := http.NewRequest("GET", imageURL, nil)
-	if err != nil {
-		log.Printf("Error creating download request: %v", err)
-		return "", err
-	}
-
-	// Send request to download the image
-	downloadResp, err := client.Do(downloadReq)
-	if err != nil {
-		log.Printf("Error downloading image: %v", err)
-		return "", err
-	}
-	defer downloadResp.Body.Close()
-
-	if downloadResp.StatusCode != http.StatusOK {
-		log.Printf("Failed to download image, status code: %d", downloadResp.StatusCode)
-		return "", fmt.Errorf("failed to download image: status code %d", downloadResp.StatusCode)
-	}
-
-	// Read the image data
-	imageData, err := io.ReadAll(downloadResp.Body)
-	if err != nil {
-		log.Printf("Error reading image data: %v", err)
-		return "", err
-	}
-
-	log.Printf("Successfully downloaded image for direct HTTP approach, size: %d bytes", len(imageData))
-
-	// Encode the image to base64
-	base64Image := base64.StdEncoding.EncodeToString(imageData)
-
-	// Create the image data URL with proper MIME type
-	mimeType := downloadResp.Header.Get("Content-Type")
-	if mimeType == "" || mimeType == "application/octet-stream" {
-		// Detect MIME type from file content based on image header bytes
-		mimeType = detectImageMimeType(imageData)
-	}
-	dataURI := fmt.Sprintf("data:%s;base64,%s", mimeType, base64Image)
-
-	log.Printf("Converted image to base64 data URI with MIME type: %s", mimeType)
-
-	// Create a text prompt that includes the image URL
-	requestData := map[string]interface{}{
-		"model": "gemini-2.0-flash-thinking-exp-01-21",
-		"messages": []map[string]interface{}{
-			{
-				"role": "system",
-				"content": "من مسئول فنی یک داروخانه شهری هستم. لطفا تصویر نسخه ارسالی را تحلیل کن و به صورت ساختار یافته پاسخ بده. پاسخ باید شامل این بخش‌ها باشد:\n\n" +
-					"<داروها>\nلیست کامل داروها را بنویس و برای هر دارو یک توضیح کامل بنویس که شامل دسته دارویی، مکانیسم اثر و کاربرد اصلی آن باشد. حتما همه داروهای موجود در نسخه را بررسی کن و هیچ دارویی را از قلم نینداز.\n</داروها>\n\n" +
-					"<تشخیص>\nبا توجه به ترکیب داروها، تشخیص احتمالی را با جزئیات کامل توضیح بده و دلیل استفاده از هر دارو را در درمان این عارضه شرح بده.\n</تشخیص>\n\n" +
-					"<تداخلات>\nتمام تداخلات بین داروهای نسخه را با جزئیات بررسی کن. برای هر تداخل، شدت آن، مکانیسم تداخل و راهکارهای مدیریت آن را توضیح بده. اگر تداخل مهمی وجود ندارد، به صراحت ذکر کن.\n</تداخلات>\n\n" +
-					"<عوارض>\nعوارض شایع و مهم هر دارو را به تفکیک بنویس و توضیح بده که بیمار چگونه باید این عوارض را مدیریت کند. عوارض خطرناک که نیاز به مراجعه فوری به پزشک دارند را مشخص کن.\n</عوارض>\n\n" +
-					"<زمان_مصرف>\nبرای هر دارو، بهترین زمان مصرف را با دلیل آن توضیح بده. مثلا صبح، شب، قبل از خواب، یا در زمان‌های خاص دیگر.\n</زمان_مصرف>\n\n" +
-					"<مصرف_با_غذا>\nبرای هر دارو مشخص کن که آیا باید با غذا، با معده خالی، یا با فاصله از غذا مصرف شود و دلیل این توصیه را توضیح بده.\n</مصرف_با_غذا>\n\n" +
-					"<دوز_مصرف>\nدوز و تعداد دفعات مصرف هر دارو را به صورت دقیق بنویس و در صورت نیاز، توضیح بده که چرا این دوز توصیه شده است.\n</دوز_مصرف>\n\n" +
-					"<مدیریت_عارضه>\nتوصیه‌های تکمیلی برای مدیریت بیماری یا عارضه را بنویس، مانند رژیم غذایی خاص، فعالیت‌های فیزیکی توصیه شده یا منع شده، و سایر نکات مهم برای بهبود اثربخشی درمان.\n</مدیریت_عارضه>",
-			},
-			{
-				"role": "user",
-				"content": []map[string]interface{}{
-					{
-						"type": "text",
-						"text": "لطفا این نسخه تصویری را تحلیل کنید:",
-					},
-					{
-						"type": "image_url",
-						"image_url": map[string]string{
-							"url": dataURI,
-						},
-					},
-				},
-			},
-		},
-		"max_tokens":  2000,
-		"temperature": 0.7,
-	}
-
-	// Convert request to JSON
-	requestBody, err := json.Marshal(requestData)
-	if err != nil {
-		log.Printf("Error marshaling AI request: %v", err)
-		return "", err
+	// Use the absolute URL for AI processing
+	serverBaseURL := os.Getenv("SERVER_BASE_URL")
+	if serverBaseURL == "" {
+		serverBaseURL = "http://localhost:8080"
 	}
+	absoluteImageURL := fmt.Sprintf("%s%s", serverBaseURL, imageURL)
 
-	// Create the HTTP request
-	req, err := http.NewRequest("POST", aiURL, bytes.NewBuffer(requestBody))
+	// Queue the image for AI prescription analysis
+	job, err := h.enqueueAnalysisJob(r.Context(), jobID, chatID, userID, models.AIJobKindImage, absoluteImageURL)
 	if err != nil {
-		log.Printf("Error creating AI request: %v", err)
-		return "", err
-	}
-
-	// Set headers
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+apiKey)
-
-	// Log the request for debugging
-	log.Printf("Sending direct HTTP request to %s for image analysis", aiURL)
-
-	// Send the request
-	resp, err := client.Do(req)
-	if err != nil {
-		log.Printf("Error calling AI service: %v", err)
-		return "", err
-	}
-	defer resp.Body.Close()
-
-	// Check response status
-	if resp.StatusCode != http.StatusOK {
-		bodyBytes, _ := io.ReadAll(resp.Body)
-		log.Printf("AI service returned status %d: %s", resp.StatusCode, string(bodyBytes))
-		return "", fmt.Errorf("AI service returned status %d", resp.StatusCode)
-	}
-
-	// Parse chat completion format
-	var chatResponse struct {
-		Choices []struct {
-			Message struct {
-				Content string `json:"content"`
-			} `json:"message"`
-		} `json:"choices"`
-	}
-
-	if err := json.NewDecoder(resp.Body).Decode(&chatResponse); err != nil {
-		log.Printf("Error decoding chat response: %v", err)
-		return "", err
-	}
-
-	if len(chatResponse.Choices) > 0 {
-		analysisContent := chatResponse.Choices[0].Message.Content
-		// Log a sample of the analysis
-		log.Printf("Direct HTTP image analysis received (sample): %s...", analysisContent[:min(100, len(analysisContent))])
-		log.Printf("Direct HTTP image analysis length: %d characters", len(analysisContent))
-		return analysisContent, nil
+		slog.ErrorContext(r.Context(), "Error queueing local image analysis", "error", err)
+	} else {
+		w.Header().Set("X-Job-ID", job.ID)
 	}
 
-	return "", fmt.Errorf("empty response from direct HTTP approach")
+	// Return the created message
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(msg)
 }
 
 // detectImageMimeType attempts to determine the MIME type of an image based on its header bytes
@@ -1598,14 +1022,6 @@ func detectImageMimeType(data []byte) string {
 	}
 
 	// If we can't determine the type, default to JPEG (most common for prescriptions)
-	log.Println("Could not determine image MIME type from content, defaulting to image/jpeg")
+	slog.Warn("Could not determine image MIME type from content, defaulting to image/jpeg")
 	return "image/jpeg"
 }
-
-// max returns the larger of x or y.
-func max(x, y int) int {
-	if x > y {
-		return x
-	}
-	return y
-}
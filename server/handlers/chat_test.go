@@ -0,0 +1,114 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/darooyar/server/db/memory"
+	"github.com/darooyar/server/models"
+)
+
+func TestChatOwnership(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		pattern    string
+		handler    func(h *ChatHandler) http.HandlerFunc
+		body       interface{}
+		asOwner    bool
+		wantStatus int
+	}{
+		{name: "owner gets chat", method: http.MethodGet, pattern: "GET /api/chats/{id}", handler: func(h *ChatHandler) http.HandlerFunc { return h.GetChat }, asOwner: true, wantStatus: http.StatusOK},
+		{name: "other user gets chat", method: http.MethodGet, pattern: "GET /api/chats/{id}", handler: func(h *ChatHandler) http.HandlerFunc { return h.GetChat }, wantStatus: http.StatusNotFound},
+		{name: "owner renames chat", method: http.MethodPut, pattern: "PUT /api/chats/{id}", handler: func(h *ChatHandler) http.HandlerFunc { return h.UpdateChat }, body: models.ChatUpdate{Title: "renamed"}, asOwner: true, wantStatus: http.StatusOK},
+		{name: "other user renames chat", method: http.MethodPut, pattern: "PUT /api/chats/{id}", handler: func(h *ChatHandler) http.HandlerFunc { return h.UpdateChat }, body: models.ChatUpdate{Title: "renamed"}, wantStatus: http.StatusNotFound},
+		{name: "owner deletes chat", method: http.MethodDelete, pattern: "DELETE /api/chats/{id}", handler: func(h *ChatHandler) http.HandlerFunc { return h.DeleteChat }, asOwner: true, wantStatus: http.StatusOK},
+		{name: "other user deletes chat", method: http.MethodDelete, pattern: "DELETE /api/chats/{id}", handler: func(h *ChatHandler) http.HandlerFunc { return h.DeleteChat }, wantStatus: http.StatusNotFound},
+		{name: "other user posts message", method: http.MethodPost, pattern: "POST /api/chats/{id}/messages", handler: func(h *ChatHandler) http.HandlerFunc { return h.CreateChatMessage }, body: map[string]string{"role": "assistant", "content": "hello"}, wantStatus: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := memory.New()
+			owner := createTestUser(t, store, "owner@example.com")
+			other := createTestUser(t, store, "other@example.com")
+			h := newTestChatHandler(t, store)
+
+			rec := serve(t, "POST /api/chats", h.CreateChat, http.MethodPost, "/api/chats", owner.ID, models.ChatCreate{Title: "headache"})
+			if rec.Code != http.StatusOK {
+				t.Fatalf("creating chat: status = %d: %s", rec.Code, rec.Body.String())
+			}
+			var chat models.Chat
+			decode(t, rec, &chat)
+			if chat.UserID != owner.ID || chat.Title != "headache" {
+				t.Fatalf("created chat = %+v", chat)
+			}
+
+			userID := other.ID
+			if tt.asOwner {
+				userID = owner.ID
+			}
+			target := fmt.Sprintf("/api/chats/%d", chat.ID)
+			if tt.pattern == "POST /api/chats/{id}/messages" {
+				target += "/messages"
+			}
+			rec = serve(t, tt.pattern, tt.handler(h), tt.method, target, userID, tt.body)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+
+			// The chat is only changed by its owner
+			stored, err := store.GetChat(context.Background(), chat.ID, owner.ID)
+			switch {
+			case tt.asOwner && tt.method == http.MethodDelete:
+				if err == nil {
+					t.Error("chat was not deleted")
+				}
+			case err != nil:
+				t.Fatalf("getting chat: %v", err)
+			case tt.asOwner && tt.method == http.MethodPut:
+				if stored.Title != "renamed" {
+					t.Errorf("title = %q, want renamed", stored.Title)
+				}
+			default:
+				if stored.Title != "headache" || len(stored.Messages) != 0 {
+					t.Errorf("chat was changed by another user: %+v", stored)
+				}
+			}
+		})
+	}
+}
+
+func TestGetUserChatsListsOnlyOwnChats(t *testing.T) {
+	store := memory.New()
+	owner := createTestUser(t, store, "owner@example.com")
+	other := createTestUser(t, store, "other@example.com")
+	h := newTestChatHandler(t, store)
+
+	serve(t, "POST /api/chats", h.CreateChat, http.MethodPost, "/api/chats", owner.ID, models.ChatCreate{Title: "mine"})
+
+	tests := []struct {
+		name   string
+		userID int64
+		want   int
+	}{
+		{name: "owner", userID: owner.ID, want: 1},
+		{name: "other user", userID: other.ID, want: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := serve(t, "GET /api/chats", h.GetUserChats, http.MethodGet, "/api/chats", tt.userID, nil)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", rec.Code, rec.Body.String())
+			}
+			var chats []models.Chat
+			decode(t, rec, &chats)
+			if len(chats) != tt.want {
+				t.Errorf("got %d chats, want %d", len(chats), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,249 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/darooyar/server/ai"
+	"github.com/darooyar/server/models"
+)
+
+const (
+	// historyTokenBudget bounds the estimated tokens of the chat turns sent with a reply
+	historyTokenBudget = 6000
+	// summaryInputTokenBudget bounds the estimated tokens of the turns summarized at once
+	summaryInputTokenBudget = 12000
+	// summaryMaxTokens bounds the length of a history summary
+	summaryMaxTokens = 600
+	// summaryTemperature keeps summaries close to what was said
+	summaryTemperature = 0.2
+	// summaryTimeout bounds how long summarizing the history may take
+	summaryTimeout = 30 * time.Second
+	// charsPerToken is a rough average for the mixed Persian and English text of chats
+	charsPerToken = 3
+)
+
+// Metadata keys under which a reply stores the history summary it was built with
+const (
+	summaryMetadataKey        = "history_summary"
+	summaryThroughMetadataKey = "summary_through"
+)
+
+// historyTurn is a chat message as it is sent to the provider
+type historyTurn struct {
+	messageID int64
+	message   ai.Message
+}
+
+// conversation is the chat history sent with a reply
+type conversation struct {
+	// turns are the latest turns of the chat, ending with the user's message
+	turns []ai.Message
+	// summary covers the turns that did not fit in the budget, if any
+	summary string
+	// summaryThrough is the ID of the last message the summary covers
+	summaryThrough int64
+	// newSummary is set when the summary was made for this reply
+	newSummary bool
+}
+
+// prompt returns the messages of a completion request answering the conversation
+func (c *conversation) prompt(systemPrompt string) []ai.Message {
+	messages := []ai.Message{{Role: ai.RoleSystem, Content: systemPrompt}}
+	if c.summary != "" {
+		messages = append(messages, ai.Message{Role: ai.RoleSystem, Content: ai.HistorySummaryPrompt(c.summary)})
+	}
+	return append(messages, c.turns...)
+}
+
+// metadata returns what the reply stores so that later replies can reuse the summary
+func (c *conversation) metadata() map[string]interface{} {
+	if !c.newSummary {
+		return nil
+	}
+	return map[string]interface{}{
+		summaryMetadataKey:        c.summary,
+		summaryThroughMetadataKey: c.summaryThrough,
+	}
+}
+
+// buildConversation loads the chat of a job and fits its history into the
+// token budget. The latest turns are sent as they are; older turns are
+// summarized, extending the summary stored with an earlier reply when there
+// is one. If summarizing fails, the older turns are left out.
+func (h *ChatHandler) buildConversation(ctx context.Context, job *models.AIJob) (*conversation, error) {
+	messages, err := h.chats.GetChatMessages(ctx, job.ChatID)
+	if err != nil {
+		return nil, fmt.Errorf("error loading chat history: %v", err)
+	}
+
+	var turns []historyTurn
+	var previousSummary string
+	var previousThrough int64
+	for _, msg := range messages {
+		// Messages sent after the job belong to later replies
+		if msg.CreatedAt.After(job.CreatedAt) {
+			break
+		}
+		if summary, through, ok := storedSummary(msg); ok {
+			previousSummary, previousThrough = summary, through
+		}
+		if turn, ok := toHistoryTurn(msg); ok {
+			turns = append(turns, turn)
+		}
+	}
+
+	// The job's own message is always the last turn
+	if len(turns) == 0 || turns[len(turns)-1].message.Role != ai.RoleUser {
+		turns = append(turns, historyTurn{message: ai.Message{Role: ai.RoleUser, Content: job.Input}})
+	}
+
+	start := newestFitting(turns, historyTokenBudget)
+
+	conv := &conversation{}
+	for _, turn := range turns[start:] {
+		conv.turns = append(conv.turns, turn.message)
+	}
+	if start == 0 {
+		return conv, nil
+	}
+
+	// Only the turns left out since the stored summary need summarizing
+	var unsummarized []historyTurn
+	for _, turn := range turns[:start] {
+		if turn.messageID > previousThrough {
+			unsummarized = append(unsummarized, turn)
+		}
+	}
+	conv.summary, conv.summaryThrough = previousSummary, previousThrough
+	if len(unsummarized) == 0 {
+		return conv, nil
+	}
+
+	summary, err := h.analyzer.summarize(ctx, previousSummary, unsummarized)
+	if err != nil {
+		slog.WarnContext(ctx, "Error summarizing chat history, leaving older turns out", "chat_id", job.ChatID, "turns", len(unsummarized), "error", err)
+		return conv, nil
+	}
+	conv.summary = summary
+	conv.summaryThrough = unsummarized[len(unsummarized)-1].messageID
+	conv.newSummary = true
+	slog.InfoContext(ctx, "Summarized chat history", "chat_id", job.ChatID, "turns", len(unsummarized), "through", conv.summaryThrough)
+	return conv, nil
+}
+
+// summarize folds turns into the previous summary of a chat. When the turns
+// exceed the summary input budget, only the newest ones are summarized.
+func (a *prescriptionAnalyzer) summarize(ctx context.Context, previousSummary string, turns []historyTurn) (string, error) {
+	if a.provider == nil {
+		return "", errProviderUnavailable
+	}
+
+	start := newestFitting(turns, summaryInputTokenBudget-estimateTokens(previousSummary))
+
+	var transcript strings.Builder
+	if previousSummary != "" {
+		transcript.WriteString("خلاصه قبلی:\n")
+		transcript.WriteString(previousSummary)
+		transcript.WriteString("\n\nادامه گفتگو:\n")
+	}
+	for _, turn := range turns[start:] {
+		speaker := "مسئول فنی"
+		if turn.message.Role == ai.RoleAssistant {
+			speaker = "دستیار"
+		}
+		fmt.Fprintf(&transcript, "%s: %s\n\n", speaker, turn.message.Content)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, summaryTimeout)
+	defer cancel()
+
+	resp, err := a.provider.Complete(ctx, ai.CompletionRequest{
+		Messages: []ai.Message{
+			{Role: ai.RoleSystem, Content: ai.SummarySystemPrompt},
+			{Role: ai.RoleUser, Content: transcript.String()},
+		},
+		MaxTokens:   summaryMaxTokens,
+		Temperature: summaryTemperature,
+	})
+	if err != nil {
+		return "", err
+	}
+	summary := strings.TrimSpace(resp.Content)
+	if summary == "" {
+		return "", ai.ErrEmptyResponse
+	}
+	return summary, nil
+}
+
+// newestFitting returns the index of the first of the newest turns whose
+// estimated tokens fit in budget. The last turn is kept even if it does not fit.
+func newestFitting(turns []historyTurn, budget int) int {
+	start := len(turns)
+	for start > 0 {
+		cost := estimateTokens(turns[start-1].message.Content)
+		if start < len(turns) && cost > budget {
+			break
+		}
+		budget -= cost
+		start--
+	}
+	return start
+}
+
+// toHistoryTurn converts a chat message for the provider. Images are replaced
+// by a placeholder, since their analysis follows them as an assistant reply.
+func toHistoryTurn(msg models.Message) (historyTurn, bool) {
+	var role string
+	switch msg.Role {
+	case "user":
+		role = ai.RoleUser
+	case "assistant":
+		role = ai.RoleAssistant
+	default:
+		return historyTurn{}, false
+	}
+
+	content := strings.TrimSpace(stripResponseID(msg.Content))
+	if msg.ContentType == "image" {
+		content = ai.ImageMessagePlaceholder
+	}
+	if content == "" {
+		return historyTurn{}, false
+	}
+
+	return historyTurn{messageID: msg.ID, message: ai.Message{Role: role, Content: content}}, true
+}
+
+// storedSummary returns the history summary stored with a reply, if any
+func storedSummary(msg models.Message) (string, int64, bool) {
+	summary, _ := msg.Metadata[summaryMetadataKey].(string)
+	if summary == "" {
+		return "", 0, false
+	}
+
+	// Metadata read back from the database holds numbers as float64
+	var through int64
+	switch value := msg.Metadata[summaryThroughMetadataKey].(type) {
+	case float64:
+		through = int64(value)
+	case int64:
+		through = value
+	case json.Number:
+		through, _ = value.Int64()
+	}
+	if through == 0 {
+		return "", 0, false
+	}
+	return summary, through, true
+}
+
+// estimateTokens approximates the tokens of a text, since no tokenizer is at hand
+func estimateTokens(text string) int {
+	return utf8.RuneCountInString(text)/charsPerToken + 1
+}
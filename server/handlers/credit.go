@@ -2,20 +2,30 @@ package handlers
 
 import (
 	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
+	"log/slog"
 	"net/http"
 	"strconv"
+	"strings"
 
 	"github.com/darooyar/server/db"
 )
 
-type CreditHandler struct{}
+type CreditHandler struct {
+	users  db.UserStore
+	credit db.CreditStore
+}
 
-func NewCreditHandler() *CreditHandler {
-	return &CreditHandler{}
+func NewCreditHandler(users db.UserStore, credit db.CreditStore) *CreditHandler {
+	return &CreditHandler{
+		users:  users,
+		credit: credit,
+	}
 }
 
 // GetUserCredit returns the current credit balance of the authenticated user
+// and, for members of a pharmacy, the pharmacy's shared credit
 func (h *CreditHandler) GetUserCredit(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -30,25 +40,36 @@ func (h *CreditHandler) GetUserCredit(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Get user by ID
-	user, err := db.GetUserByID(userID)
+	user, err := h.users.GetUserByID(r.Context(), userID)
 	if err != nil {
-		log.Printf("Error getting user by ID: %v", err)
+		slog.ErrorContext(r.Context(), "Error getting user by ID", "error", err)
 		sendErrorResponse(w, "User not found", http.StatusNotFound)
 		return
 	}
 
+	pharmacy, err := h.users.GetUserPharmacy(r.Context(), userID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error getting pharmacy of user", "user_id", userID, "error", err)
+		sendErrorResponse(w, "Error retrieving credit", http.StatusInternalServerError)
+		return
+	}
+
 	// Return credit info
 	response := struct {
-		Credit float64 `json:"credit"`
+		Credit         float64  `json:"credit"`
+		PharmacyCredit *float64 `json:"pharmacy_credit,omitempty"`
 	}{
 		Credit: user.Credit,
 	}
+	if pharmacy != nil {
+		response.PharmacyCredit = &pharmacy.Credit
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
 
-// AddCredit adds credit to a user's account (admin only)
+// AddCredit adds credit to a user's account (requires credit:write)
 func (h *CreditHandler) AddCredit(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -62,14 +83,11 @@ func (h *CreditHandler) AddCredit(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// TODO: Add proper admin check here
-	// For now, we'll assume all users can add credit to any account
-	// In a real application, you would check if the user has admin privileges
-
 	// Parse request body
 	var req struct {
 		UserID int64   `json:"user_id"`
 		Amount float64 `json:"amount"`
+		Reason string  `json:"reason"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -84,17 +102,18 @@ func (h *CreditHandler) AddCredit(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Add credit to user
-	err := db.AddUserCredit(req.UserID, req.Amount)
+	description := creditAdjustmentDescription("Credit added", adminID, req.Reason)
+	err := h.credit.AddUserCredit(r.Context(), req.UserID, req.Amount, adminID, description)
 	if err != nil {
-		log.Printf("Error adding credit: %v", err)
+		slog.ErrorContext(r.Context(), "Error adding credit", "error", err)
 		sendErrorResponse(w, "Error adding credit", http.StatusInternalServerError)
 		return
 	}
 
 	// Get updated user
-	user, err := db.GetUserByID(req.UserID)
+	user, err := h.users.GetUserByID(r.Context(), req.UserID)
 	if err != nil {
-		log.Printf("Error getting updated user: %v", err)
+		slog.ErrorContext(r.Context(), "Error getting updated user", "error", err)
 		sendErrorResponse(w, "Error getting updated user", http.StatusInternalServerError)
 		return
 	}
@@ -116,7 +135,7 @@ func (h *CreditHandler) AddCredit(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
-// SubtractCredit subtracts credit from a user's account (admin only)
+// SubtractCredit subtracts credit from a user's account (requires credit:write)
 func (h *CreditHandler) SubtractCredit(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -130,14 +149,11 @@ func (h *CreditHandler) SubtractCredit(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// TODO: Add proper admin check here
-	// For now, we'll assume all users can subtract credit from any account
-	// In a real application, you would check if the user has admin privileges
-
 	// Parse request body
 	var req struct {
 		UserID int64   `json:"user_id"`
 		Amount float64 `json:"amount"`
+		Reason string  `json:"reason"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -152,17 +168,22 @@ func (h *CreditHandler) SubtractCredit(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Subtract credit from user
-	err := db.SubtractUserCredit(req.UserID, req.Amount)
+	description := creditAdjustmentDescription("Credit subtracted", adminID, req.Reason)
+	err := h.credit.SubtractUserCredit(r.Context(), req.UserID, req.Amount, adminID, description)
+	if errors.Is(err, db.ErrInsufficientCredit) {
+		sendErrorResponse(w, "Insufficient credit", http.StatusConflict)
+		return
+	}
 	if err != nil {
-		log.Printf("Error subtracting credit: %v", err)
+		slog.ErrorContext(r.Context(), "Error subtracting credit", "error", err)
 		sendErrorResponse(w, "Error subtracting credit", http.StatusInternalServerError)
 		return
 	}
 
 	// Get updated user
-	user, err := db.GetUserByID(req.UserID)
+	user, err := h.users.GetUserByID(r.Context(), req.UserID)
 	if err != nil {
-		log.Printf("Error getting updated user: %v", err)
+		slog.ErrorContext(r.Context(), "Error getting updated user", "error", err)
 		sendErrorResponse(w, "Error getting updated user", http.StatusInternalServerError)
 		return
 	}
@@ -184,7 +205,7 @@ func (h *CreditHandler) SubtractCredit(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
-// GetUserCreditByID returns the credit balance of a specific user (admin only)
+// GetUserCreditByID returns the credit balance of a specific user (requires credit:read)
 func (h *CreditHandler) GetUserCreditByID(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -198,10 +219,6 @@ func (h *CreditHandler) GetUserCreditByID(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	// TODO: Add proper admin check here
-	// For now, we'll assume all users can view any account's credit
-	// In a real application, you would check if the user has admin privileges
-
 	// Get user ID from query parameter
 	userIDStr := r.URL.Query().Get("user_id")
 	if userIDStr == "" {
@@ -216,9 +233,9 @@ func (h *CreditHandler) GetUserCreditByID(w http.ResponseWriter, r *http.Request
 	}
 
 	// Get user by ID
-	user, err := db.GetUserByID(userID)
+	user, err := h.users.GetUserByID(r.Context(), userID)
 	if err != nil {
-		log.Printf("Error getting user by ID: %v", err)
+		slog.ErrorContext(r.Context(), "Error getting user by ID", "error", err)
 		sendErrorResponse(w, "User not found", http.StatusNotFound)
 		return
 	}
@@ -235,3 +252,13 @@ func (h *CreditHandler) GetUserCreditByID(w http.ResponseWriter, r *http.Request
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
+
+// creditAdjustmentDescription describes a manual credit change for the
+// credit_transactions audit trail
+func creditAdjustmentDescription(action string, actorID int64, reason string) string {
+	description := fmt.Sprintf("%s by user %d", action, actorID)
+	if reason = strings.TrimSpace(reason); reason != "" {
+		description += ": " + reason
+	}
+	return description
+}
@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/darooyar/server/formulary"
+)
+
+const (
+	// defaultDrugSearchLimit is the number of suggestions returned when no limit is given
+	defaultDrugSearchLimit = 10
+	// maxDrugSearchLimit bounds the number of suggestions of a single search
+	maxDrugSearchLimit = 50
+)
+
+// DrugHandler handles formulary endpoints
+type DrugHandler struct {
+	catalog formulary.Catalog
+}
+
+// NewDrugHandler creates a new drug handler
+func NewDrugHandler(catalog formulary.Catalog) *DrugHandler {
+	return &DrugHandler{
+		catalog: catalog,
+	}
+}
+
+// Search suggests formulary drugs matching a partial name for autocomplete
+func (h *DrugHandler) Search(w http.ResponseWriter, r *http.Request) {
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	if query == "" {
+		sendErrorResponse(w, "Query parameter q is required", http.StatusBadRequest)
+		return
+	}
+
+	limit := defaultDrugSearchLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			sendErrorResponse(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, maxDrugSearchLimit)
+	}
+
+	matches, err := h.catalog.Search(r.Context(), query, limit)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error searching formulary", "error", err)
+		sendErrorResponse(w, "Error searching drugs", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(matches)
+}
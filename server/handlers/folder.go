@@ -9,10 +9,14 @@ import (
 	"github.com/darooyar/server/models"
 )
 
-type FolderHandler struct{}
+type FolderHandler struct {
+	folders db.FolderStore
+}
 
-func NewFolderHandler() *FolderHandler {
-	return &FolderHandler{}
+func NewFolderHandler(folders db.FolderStore) *FolderHandler {
+	return &FolderHandler{
+		folders: folders,
+	}
 }
 
 // CreateFolder creates a new folder
@@ -35,7 +39,7 @@ func (h *FolderHandler) CreateFolder(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	folder, err := db.CreateFolder(&folderCreate, userID)
+	folder, err := h.folders.CreateFolder(r.Context(), &folderCreate, userID)
 	if err != nil {
 		http.Error(w, "Error creating folder", http.StatusInternalServerError)
 		return
@@ -67,7 +71,7 @@ func (h *FolderHandler) GetFolder(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	folder, err := db.GetFolder(folderID, userID)
+	folder, err := h.folders.GetFolder(r.Context(), folderID, userID)
 	if err != nil {
 		http.Error(w, "Error retrieving folder", http.StatusInternalServerError)
 		return
@@ -91,7 +95,7 @@ func (h *FolderHandler) GetUserFolders(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	folders, err := db.GetUserFolders(userID)
+	folders, err := h.folders.GetUserFolders(r.Context(), userID)
 	if err != nil {
 		// Return an empty array instead of an error
 		w.Header().Set("Content-Type", "application/json")
@@ -136,7 +140,7 @@ func (h *FolderHandler) UpdateFolder(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	folder, err := db.UpdateFolder(folderID, userID, &folderUpdate)
+	folder, err := h.folders.UpdateFolder(r.Context(), folderID, userID, &folderUpdate)
 	if err != nil {
 		http.Error(w, "Error updating folder", http.StatusInternalServerError)
 		return
@@ -168,7 +172,7 @@ func (h *FolderHandler) DeleteFolder(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = db.DeleteFolder(folderID, userID)
+	err = h.folders.DeleteFolder(r.Context(), folderID, userID)
 	if err != nil {
 		http.Error(w, "Error deleting folder", http.StatusInternalServerError)
 		return
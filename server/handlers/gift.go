@@ -2,7 +2,7 @@ package handlers
 
 import (
 	"encoding/json"
-	"log"
+	"log/slog"
 	"net/http"
 	"strconv"
 
@@ -11,10 +11,18 @@ import (
 	"github.com/gorilla/mux"
 )
 
-type GiftHandler struct{}
+type GiftHandler struct {
+	users db.UserStore
+	plans db.PlanStore
+	gifts db.GiftStore
+}
 
-func NewGiftHandler() *GiftHandler {
-	return &GiftHandler{}
+func NewGiftHandler(users db.UserStore, plans db.PlanStore, gifts db.GiftStore) *GiftHandler {
+	return &GiftHandler{
+		users: users,
+		plans: plans,
+		gifts: gifts,
+	}
 }
 
 // GiftPlanToUser handles an admin gifting a plan to a user
@@ -44,14 +52,14 @@ func (h *GiftHandler) GiftPlanToUser(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Check if user exists
-	user, err := db.GetUserByID(req.UserID)
+	user, err := h.users.GetUserByID(r.Context(), req.UserID)
 	if err != nil {
 		sendErrorResponse(w, "User not found", http.StatusNotFound)
 		return
 	}
 
 	// Check if plan exists
-	plan, err := db.GetPlanByID(req.PlanID)
+	plan, err := h.plans.GetPlanByID(r.Context(), req.PlanID)
 	if err != nil {
 		sendErrorResponse(w, "Error retrieving plan", http.StatusInternalServerError)
 		return
@@ -62,9 +70,9 @@ func (h *GiftHandler) GiftPlanToUser(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Gift the plan to the user
-	err = db.GiftPlanToUser(adminID, req.UserID, req.PlanID, req.Message)
+	err = h.gifts.GiftPlanToUser(r.Context(), adminID, req.UserID, req.PlanID, req.Message)
 	if err != nil {
-		log.Printf("Error gifting plan: %v", err)
+		slog.ErrorContext(r.Context(), "Error gifting plan", "error", err)
 		sendErrorResponse(w, "Error gifting plan: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -109,24 +117,24 @@ func (h *GiftHandler) GiftCreditToUser(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Check if user exists
-	user, err := db.GetUserByID(req.UserID)
+	user, err := h.users.GetUserByID(r.Context(), req.UserID)
 	if err != nil {
 		sendErrorResponse(w, "User not found", http.StatusNotFound)
 		return
 	}
 
 	// Gift credit to the user
-	err = db.GiftCreditToUser(adminID, req.UserID, req.Amount, req.Message)
+	err = h.gifts.GiftCreditToUser(r.Context(), adminID, req.UserID, req.Amount, req.Message)
 	if err != nil {
-		log.Printf("Error gifting credit: %v", err)
+		slog.ErrorContext(r.Context(), "Error gifting credit", "error", err)
 		sendErrorResponse(w, "Error gifting credit: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	// Get updated user credit
-	updatedUser, err := db.GetUserByID(req.UserID)
+	updatedUser, err := h.users.GetUserByID(r.Context(), req.UserID)
 	if err != nil {
-		log.Printf("Error getting updated user: %v", err)
+		slog.ErrorContext(r.Context(), "Error getting updated user", "error", err)
 	}
 
 	// Return success response
@@ -154,9 +162,9 @@ func (h *GiftHandler) GetUserGiftTransactions(w http.ResponseWriter, r *http.Req
 	}
 
 	// Get gift transactions
-	gifts, err := db.GetUserGiftTransactions(userID)
+	gifts, err := h.gifts.GetUserGiftTransactions(r.Context(), userID)
 	if err != nil {
-		log.Printf("Error getting gift transactions: %v", err)
+		slog.ErrorContext(r.Context(), "Error getting gift transactions", "error", err)
 		sendErrorResponse(w, "Error retrieving gift transactions", http.StatusInternalServerError)
 		return
 	}
@@ -182,9 +190,9 @@ func (h *GiftHandler) GetAdminGiftTransactions(w http.ResponseWriter, r *http.Re
 	}
 
 	// Get gift transactions
-	gifts, err := db.GetAdminGiftTransactions(adminID)
+	gifts, err := h.gifts.GetAdminGiftTransactions(r.Context(), adminID)
 	if err != nil {
-		log.Printf("Error getting gift transactions: %v", err)
+		slog.ErrorContext(r.Context(), "Error getting gift transactions", "error", err)
 		sendErrorResponse(w, "Error retrieving gift transactions", http.StatusInternalServerError)
 		return
 	}
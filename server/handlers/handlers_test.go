@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/darooyar/server/ai"
+	"github.com/darooyar/server/auth"
+	"github.com/darooyar/server/db/memory"
+	"github.com/darooyar/server/models"
+)
+
+// fakeCatalog is an empty formulary, so messages are classified by their wording
+type fakeCatalog struct{}
+
+func (fakeCatalog) Available(ctx context.Context) bool { return false }
+
+func (fakeCatalog) Search(ctx context.Context, query string, limit int) ([]models.FormularyMatch, error) {
+	return nil, nil
+}
+
+func (fakeCatalog) FindDrugs(ctx context.Context, text string) ([]models.FormularyMatch, error) {
+	return nil, nil
+}
+
+// fakeInteractions is a knowledge base that knows no interactions
+type fakeInteractions struct{}
+
+func (fakeInteractions) Check(ctx context.Context, names []string) (*models.InteractionCheckResult, error) {
+	return &models.InteractionCheckResult{}, nil
+}
+
+func (fakeInteractions) Reconcile(ctx context.Context, aiInteractions []models.DrugInteraction, drugNames []string) ([]models.KnownInteraction, []models.InteractionContradiction, error) {
+	return []models.KnownInteraction{}, []models.InteractionContradiction{}, nil
+}
+
+// newTestChatHandler creates a chat handler on the store that replies with a
+// fake provider. Its background jobs stop when the test ends.
+func newTestChatHandler(t *testing.T, store *memory.Store) *ChatHandler {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	return NewChatHandler(ctx, ai.NewFakeProvider(), store, store, store, store, fakeCatalog{}, fakeInteractions{})
+}
+
+// createTestUser registers a user with the password "secret123"
+func createTestUser(t *testing.T, store *memory.Store, email string) *models.User {
+	t.Helper()
+
+	hashed, err := auth.HashPassword("secret123")
+	if err != nil {
+		t.Fatalf("hashing password: %v", err)
+	}
+	user, err := store.CreateUser(context.Background(), &models.UserCreate{
+		Username: strings.Split(email, "@")[0],
+		Email:    email,
+		Password: hashed,
+	})
+	if err != nil {
+		t.Fatalf("creating user: %v", err)
+	}
+	return user
+}
+
+// serve sends a request to a handler registered under pattern, as userID
+// when it is not zero, and returns the recorded response
+func serve(t *testing.T, pattern string, handler http.HandlerFunc, method, target string, userID int64, body interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			t.Fatalf("encoding request body: %v", err)
+		}
+		reader = strings.NewReader(string(encoded))
+	}
+
+	req := httptest.NewRequest(method, target, reader)
+	req.Header.Set("Content-Type", "application/json")
+	if userID != 0 {
+		req = req.WithContext(context.WithValue(req.Context(), "user_id", userID))
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(pattern, handler)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	return rec
+}
+
+// decode reads the JSON body of a response into v
+func decode(t *testing.T, rec *httptest.ResponseRecorder, v interface{}) {
+	t.Helper()
+
+	if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+		t.Fatalf("decoding response %q: %v", rec.Body.String(), err)
+	}
+}
+
+// waitForJob waits until an AI job succeeded or failed and returns it
+func waitForJob(t *testing.T, store *memory.Store, jobID string) *models.AIJob {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		job, err := store.GetAIJob(context.Background(), jobID)
+		if err != nil {
+			t.Fatalf("getting job: %v", err)
+		}
+		if job != nil && (job.Status == models.AIJobStatusSucceeded || job.Status == models.AIJobStatusFailed) {
+			return job
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("job %s did not finish", jobID)
+	return nil
+}
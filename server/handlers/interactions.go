@@ -0,0 +1,61 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/darooyar/server/druginteractions"
+	"github.com/darooyar/server/models"
+)
+
+// maxInteractionCheckDrugs bounds the number of drugs in a single check
+const maxInteractionCheckDrugs = 50
+
+// InteractionHandler handles drug interaction endpoints
+type InteractionHandler struct {
+	interactions druginteractions.KnowledgeBase
+}
+
+// NewInteractionHandler creates a new interaction handler
+func NewInteractionHandler(interactions druginteractions.KnowledgeBase) *InteractionHandler {
+	return &InteractionHandler{
+		interactions: interactions,
+	}
+}
+
+// Check returns the interactions between the given drugs found in the local
+// knowledge base. The result only depends on the knowledge base, not on AI.
+func (h *InteractionHandler) Check(w http.ResponseWriter, r *http.Request) {
+	var req models.InteractionCheckRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendErrorResponse(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	drugs := make([]string, 0, len(req.Drugs))
+	for _, drug := range req.Drugs {
+		if drug = strings.TrimSpace(drug); drug != "" {
+			drugs = append(drugs, drug)
+		}
+	}
+	if len(drugs) == 0 {
+		sendErrorResponse(w, "At least one drug is required", http.StatusBadRequest)
+		return
+	}
+	if len(drugs) > maxInteractionCheckDrugs {
+		sendErrorResponse(w, "Too many drugs", http.StatusBadRequest)
+		return
+	}
+
+	result, err := h.interactions.Check(r.Context(), drugs)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error checking drug interactions", "error", err)
+		sendErrorResponse(w, "Error checking drug interactions", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
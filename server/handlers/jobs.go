@@ -0,0 +1,285 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/darooyar/server/db"
+	"github.com/darooyar/server/logging"
+	"github.com/darooyar/server/models"
+	"github.com/darooyar/server/nats"
+)
+
+const (
+	// jobHeartbeatInterval is how often a running job records that it is alive
+	jobHeartbeatInterval = 30 * time.Second
+	// jobStaleAfter is how long a job may go without a heartbeat before it is
+	// considered abandoned by a crashed worker
+	jobStaleAfter = 3 * time.Minute
+)
+
+// errJobStalled is recorded for jobs whose worker stopped sending heartbeats
+var errJobStalled = errors.New("job stalled: worker stopped responding")
+
+// JobHandler handles AI job status endpoints
+type JobHandler struct {
+	aiJobs db.AIJobStore
+	plans  db.PlanStore
+}
+
+// NewJobHandler creates a new job handler
+func NewJobHandler(aiJobs db.AIJobStore, plans db.PlanStore) *JobHandler {
+	return &JobHandler{
+		aiJobs: aiJobs,
+		plans:  plans,
+	}
+}
+
+// GetJob returns the status of an AI job owned by the current user
+func (h *JobHandler) GetJob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Get user ID from context
+	userID, ok := r.Context().Value("user_id").(int64)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	job, err := h.aiJobs.GetUserAIJob(r.Context(), r.PathValue("id"), userID)
+	if err != nil {
+		http.Error(w, "Job not found or unauthorized", http.StatusNotFound)
+		return
+	}
+
+	// A job that stopped reporting progress will never finish, so report it as failed
+	if isStaleJob(job) {
+		if err := h.aiJobs.FailAIJobAttempt(r.Context(), job.ID, errJobStalled, true, 0); err != nil {
+			slog.ErrorContext(r.Context(), "Error marking stalled job as failed", "job_id", job.ID, "error", err)
+		} else {
+			releaseAnalysis(r.Context(), h.plans, jobUsageKey(job.ID))
+			if refreshed, err := h.aiJobs.GetUserAIJob(r.Context(), job.ID, userID); err == nil {
+				job = refreshed
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job)
+}
+
+// isStaleJob reports whether an active job has gone too long without a
+// heartbeat. Interrupted jobs send none while they wait to be resumed, so
+// they never go stale.
+func isStaleJob(job *models.AIJob) bool {
+	active := job.Status == models.AIJobStatusQueued || job.Status == models.AIJobStatusRunning
+	return active && job.InterruptedAt == nil && time.Since(job.UpdatedAt) > jobStaleAfter
+}
+
+// activeJob returns the analysis job still queued or running for the chat, if any
+func (h *ChatHandler) activeJob(ctx context.Context, chatID int64) *models.AIJob {
+	job, err := h.aiJobs.GetActiveAIJob(ctx, chatID, jobStaleAfter)
+	if err != nil {
+		slog.Error("Error checking active jobs of chat", "chat_id", chatID, "error", err)
+		return nil
+	}
+	return job
+}
+
+// writeProcessingResponse tells the client that a previous analysis is still running
+func writeProcessingResponse(w http.ResponseWriter, job *models.AIJob) {
+	response := map[string]interface{}{
+		"status":  "processing",
+		"message": "پیام قبلی شما در حال پردازش است. لطفا صبر کنید.",
+		"job_id":  job.ID,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Job-ID", job.ID)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(response)
+}
+
+// enqueueAnalysisJob records an AI job and hands it to the JetStream worker,
+// or runs it in-process when the queue is unavailable. For billed kinds, a use
+// of the user's subscription must have been reserved for the job ID
+// beforehand; it is given back if the job cannot be created.
+func (h *ChatHandler) enqueueAnalysisJob(ctx context.Context, jobID string, chatID int64, userID int64, kind models.AIJobKind, input string) (*models.AIJob, error) {
+	job, err := h.aiJobs.CreateAIJob(ctx, jobID, chatID, userID, kind, input)
+	if err != nil {
+		releaseAnalysis(ctx, h.plans, jobUsageKey(jobID))
+		return nil, fmt.Errorf("error creating AI job: %v", err)
+	}
+
+	if nats.AIJobQueueAvailable() {
+		err := nats.PublishAIJob(ctx, job.ID)
+		if err == nil {
+			slog.InfoContext(ctx, "Queued AI job", "job_id", job.ID, "kind", kind, "chat_id", chatID)
+			return job, nil
+		}
+		slog.ErrorContext(ctx, "Error publishing AI job, running it in-process", "job_id", job.ID, "error", err)
+	}
+
+	// The job outlives the request but keeps its request ID, and is canceled
+	// when the server stops
+	go nats.RunAIJobInProcess(logging.WithRequestID(h.jobs, logging.RequestID(ctx)), h.ProcessAIJob, job.ID)
+	return job, nil
+}
+
+// ResumeAIJobs queues the AI jobs that a previous server stopped before they
+// finished. It is called once at startup.
+func (h *ChatHandler) ResumeAIJobs(ctx context.Context) error {
+	jobs, err := h.aiJobs.ClaimInterruptedAIJobs(ctx)
+	if err != nil {
+		return fmt.Errorf("error claiming interrupted AI jobs: %v", err)
+	}
+
+	for _, job := range jobs {
+		slog.InfoContext(ctx, "Resuming interrupted AI job", "job_id", job.ID, "kind", job.Kind, "chat_id", job.ChatID)
+		if nats.AIJobQueueAvailable() {
+			err := nats.RepublishAIJob(ctx, job.ID)
+			if err == nil {
+				continue
+			}
+			slog.ErrorContext(ctx, "Error publishing resumed AI job, running it in-process", "job_id", job.ID, "error", err)
+		}
+		go nats.RunAIJobInProcess(h.jobs, h.ProcessAIJob, job.ID)
+	}
+	return nil
+}
+
+// interruptAIJob records a job that the server stopped, so that it is resumed
+// after restart unless a server that is still running picks it up first
+func (h *ChatHandler) interruptAIJob(ctx context.Context, jobID string) error {
+	if err := h.aiJobs.InterruptAIJob(context.WithoutCancel(ctx), jobID); err != nil {
+		return fmt.Errorf("error recording interrupted AI job: %v", err)
+	}
+	slog.InfoContext(ctx, "AI job interrupted by shutdown, it will be resumed by another server or after restart", "job_id", jobID)
+	return nats.ErrAIJobInterrupted
+}
+
+// ProcessAIJob runs one attempt of an AI analysis job. It is safe to call more
+// than once for the same job since JetStream delivers at least once.
+func (h *ChatHandler) ProcessAIJob(ctx context.Context, jobID string, attempt int, final bool) error {
+	// Jobs that arrive while the server is stopping are kept for the next start
+	if ctx.Err() != nil {
+		return h.interruptAIJob(ctx, jobID)
+	}
+
+	job, err := h.aiJobs.GetAIJob(ctx, jobID)
+	if err != nil {
+		return fmt.Errorf("error loading AI job: %v", err)
+	}
+	if job == nil {
+		slog.WarnContext(ctx, "AI job no longer exists, skipping", "job_id", jobID)
+		return nil
+	}
+	if job.Status == models.AIJobStatusSucceeded {
+		slog.InfoContext(ctx, "AI job already succeeded, skipping duplicate delivery", "job_id", jobID)
+		return nil
+	}
+
+	if err := h.aiJobs.StartAIJobAttempt(ctx, jobID); err != nil {
+		return fmt.Errorf("error starting AI job: %v", err)
+	}
+	slog.InfoContext(ctx, "Running AI job", "job_id", jobID, "kind", job.Kind, "chat_id", job.ChatID, "attempt", attempt)
+
+	// Keep the job fresh so the chat is not treated as abandoned while we work
+	heartbeatCtx, stopHeartbeat := context.WithCancel(ctx)
+	defer stopHeartbeat()
+	go func() {
+		ticker := time.NewTicker(jobHeartbeatInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-heartbeatCtx.Done():
+				return
+			case <-ticker.C:
+				if err := h.aiJobs.TouchAIJob(ctx, jobID); err != nil {
+					slog.ErrorContext(ctx, "Error updating heartbeat of AI job", "job_id", jobID, "error", err)
+				}
+			}
+		}
+	}()
+
+	var messageID int64
+	switch job.Kind {
+	case models.AIJobKindText, models.AIJobKindChat:
+		messageID, err = h.generateAIResponse(ctx, job, final)
+	case models.AIJobKindImage:
+		messageID, err = h.generateImageAIResponse(ctx, job, final)
+	default:
+		// Retrying cannot fix an unknown job kind
+		err = fmt.Errorf("unknown AI job kind %q", job.Kind)
+		final = true
+	}
+	stopHeartbeat()
+
+	// The server is stopping before the analysis finished. The reserved use
+	// stays with the job, which is resumed after restart.
+	if err != nil && ctx.Err() != nil {
+		return h.interruptAIJob(ctx, jobID)
+	}
+
+	// Record the outcome even when the server is stopping
+	ctx = context.WithoutCancel(ctx)
+
+	if err == nil {
+		if job.Kind.Billed() {
+			commitAnalysis(ctx, h.plans, job.UserID, jobUsageKey(jobID))
+		}
+		if err := h.aiJobs.CompleteAIJob(ctx, jobID, messageID); err != nil {
+			slog.ErrorContext(ctx, "Error marking AI job as succeeded", "job_id", jobID, "error", err)
+		}
+		return nil
+	}
+
+	// Make sure the user is never left without a reply once we give up, and
+	// is not charged for it
+	if final {
+		if messageID == 0 {
+			messageID = h.saveAnalysisFailureMessage(ctx, job)
+		}
+		releaseAnalysis(ctx, h.plans, jobUsageKey(jobID))
+	}
+
+	if dbErr := h.aiJobs.FailAIJobAttempt(ctx, jobID, err, final, messageID); dbErr != nil {
+		slog.ErrorContext(ctx, "Error recording failure of AI job", "job_id", jobID, "error", dbErr)
+	}
+	return err
+}
+
+// saveAnalysisFailureMessage stores an apology in the chat after a job failed for good
+func (h *ChatHandler) saveAnalysisFailureMessage(ctx context.Context, job *models.AIJob) int64 {
+	content := "عذر می‌خواهم، در تحلیل این نسخه خطایی رخ داد. لطفا دوباره تلاش کنید."
+	switch job.Kind {
+	case models.AIJobKindImage:
+		content = "عذر می‌خواهم، در تحلیل این نسخه تصویری خطایی رخ داد. لطفا دوباره تلاش کنید یا نسخه را به صورت متنی وارد کنید."
+	case models.AIJobKindChat:
+		content = "عذر می‌خواهم، در پاسخ به این پیام خطایی رخ داد. لطفا دوباره تلاش کنید."
+	}
+
+	errorMsg := models.MessageCreate{
+		ChatID:      job.ChatID,
+		Role:        "assistant",
+		Content:     content,
+		ContentType: "text",
+	}
+
+	msg, err := h.chats.CreateMessage(ctx, &errorMsg)
+	if err != nil {
+		slog.Error("Error creating error message", "error", err)
+		h.streams.done(job.ChatID, job.ID, 0, "", streamStatusFailed)
+		return 0
+	}
+
+	h.streams.done(job.ChatID, job.ID, msg.ID, msg.Content, streamStatusFailed)
+	return msg.ID
+}
@@ -0,0 +1,84 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/darooyar/server/db/memory"
+	"github.com/darooyar/server/models"
+	"github.com/darooyar/server/nats"
+)
+
+func TestIsStaleJob(t *testing.T) {
+	old := time.Now().Add(-2 * jobStaleAfter)
+	interrupted := old
+
+	tests := []struct {
+		name string
+		job  models.AIJob
+		want bool
+	}{
+		{name: "fresh running job", job: models.AIJob{Status: models.AIJobStatusRunning, UpdatedAt: time.Now()}, want: false},
+		{name: "running job without heartbeat", job: models.AIJob{Status: models.AIJobStatusRunning, UpdatedAt: old}, want: true},
+		{name: "queued job without heartbeat", job: models.AIJob{Status: models.AIJobStatusQueued, UpdatedAt: old}, want: true},
+		{name: "interrupted job waiting for restart", job: models.AIJob{Status: models.AIJobStatusQueued, UpdatedAt: old, InterruptedAt: &interrupted}, want: false},
+		{name: "finished job", job: models.AIJob{Status: models.AIJobStatusSucceeded, UpdatedAt: old}, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isStaleJob(&tt.job); got != tt.want {
+				t.Errorf("isStaleJob() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInterruptedJobIsResumedByAnotherServer(t *testing.T) {
+	ctx := context.Background()
+	store := memory.New()
+	user := createTestUser(t, store, "user@example.com")
+	h := newTestChatHandler(t, store)
+
+	chat, err := store.CreateChat(ctx, &models.ChatCreate{Title: "chat"}, user.ID)
+	if err != nil {
+		t.Fatalf("creating chat: %v", err)
+	}
+	if _, err := store.CreateMessage(ctx, &models.MessageCreate{ChatID: chat.ID, Role: "user", Content: "سلام"}); err != nil {
+		t.Fatalf("creating message: %v", err)
+	}
+	if _, err := store.CreateAIJob(ctx, "job", chat.ID, user.ID, models.AIJobKindChat, "سلام"); err != nil {
+		t.Fatalf("creating job: %v", err)
+	}
+
+	// The job is delivered to a server that is stopping
+	stopping, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := h.ProcessAIJob(stopping, "job", 1, false); !errors.Is(err, nats.ErrAIJobInterrupted) {
+		t.Fatalf("ProcessAIJob() on a stopping server = %v, want ErrAIJobInterrupted", err)
+	}
+	job, _ := store.GetAIJob(ctx, "job")
+	if job.Status != models.AIJobStatusQueued || job.InterruptedAt == nil {
+		t.Fatalf("interrupted job = %s, interrupted at %v", job.Status, job.InterruptedAt)
+	}
+
+	// A server that is still running gets it redelivered
+	if err := h.ProcessAIJob(ctx, "job", 2, false); err != nil {
+		t.Fatalf("ProcessAIJob() = %v", err)
+	}
+	job, _ = store.GetAIJob(ctx, "job")
+	if job.Status != models.AIJobStatusSucceeded || job.InterruptedAt != nil {
+		t.Fatalf("resumed job = %s, interrupted at %v", job.Status, job.InterruptedAt)
+	}
+
+	// and no server resumes it again after restart
+	claimed, err := store.ClaimInterruptedAIJobs(ctx)
+	if err != nil {
+		t.Fatalf("claiming interrupted jobs: %v", err)
+	}
+	if len(claimed) != 0 {
+		t.Errorf("claimed %d jobs that already ran", len(claimed))
+	}
+}
@@ -0,0 +1,154 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/darooyar/server/analysis"
+	"github.com/darooyar/server/models"
+)
+
+const (
+	// metadataFilterPrefix marks query parameters that filter on message metadata
+	metadataFilterPrefix = "meta."
+	defaultMessageLimit  = 50
+	maxMessageLimit      = 200
+)
+
+// FindMessages returns the current user's messages whose metadata matches the
+// query, e.g. GET /api/messages?meta.request_id=<id>. Every meta.<key>
+// parameter must match; chat_id and limit narrow the result further.
+func (h *ChatHandler) FindMessages(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Get user ID from context
+	userID, ok := r.Context().Value("user_id").(int64)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	query := r.URL.Query()
+
+	filter := make(map[string]interface{})
+	for key, values := range query {
+		if !strings.HasPrefix(key, metadataFilterPrefix) || len(values) == 0 {
+			continue
+		}
+		name := strings.TrimPrefix(key, metadataFilterPrefix)
+		if name == "" {
+			http.Error(w, "Invalid metadata filter", http.StatusBadRequest)
+			return
+		}
+		filter[name] = parseMetadataValue(values[0])
+	}
+	if len(filter) == 0 {
+		http.Error(w, "At least one meta.<key> filter is required", http.StatusBadRequest)
+		return
+	}
+
+	var chatID int64
+	if chatIDStr := query.Get("chat_id"); chatIDStr != "" {
+		var err error
+		chatID, err = strconv.ParseInt(chatIDStr, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid chat ID", http.StatusBadRequest)
+			return
+		}
+	}
+
+	limit := defaultMessageLimit
+	if limitStr := query.Get("limit"); limitStr != "" {
+		parsed, err := strconv.Atoi(limitStr)
+		if err != nil || parsed <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(parsed, maxMessageLimit)
+	}
+
+	messages, err := h.chats.FindMessagesByMetadata(r.Context(), userID, chatID, filter, limit)
+	if err != nil {
+		http.Error(w, "Error retrieving messages", http.StatusInternalServerError)
+		return
+	}
+
+	// If messages is nil, return an empty array
+	if messages == nil {
+		messages = []models.Message{}
+	}
+
+	// Make sure image links are still valid
+	refreshImageURLs(r.Context(), messages)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(messages)
+}
+
+// GetMessageAnalysis returns the structured prescription analysis of an
+// assistant message. Replies saved before structured analyses existed are
+// parsed on first request.
+func (h *ChatHandler) GetMessageAnalysis(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Get user ID from context
+	userID, ok := r.Context().Value("user_id").(int64)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// Get message ID from URL
+	messageID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid message ID", http.StatusBadRequest)
+		return
+	}
+
+	// Verify message ownership
+	msg, err := h.chats.GetUserMessage(r.Context(), messageID, userID)
+	if err != nil {
+		http.Error(w, "Message not found or unauthorized", http.StatusNotFound)
+		return
+	}
+
+	result, err := h.chats.GetPrescriptionAnalysis(r.Context(), msg.ID)
+	if err != nil {
+		http.Error(w, "Error retrieving analysis", http.StatusInternalServerError)
+		return
+	}
+
+	if result == nil {
+		if msg.Role != "assistant" || len(analysis.Sections(msg.Content)) == 0 {
+			http.Error(w, "No analysis for this message", http.StatusNotFound)
+			return
+		}
+		result = h.saveStructuredAnalysis(r.Context(), msg.ID, msg.Content)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// parseMetadataValue converts a query value to the JSON type it is stored as.
+// Numbers and booleans are matched as such; everything else as a string.
+func parseMetadataValue(value string) interface{} {
+	switch value {
+	case "true":
+		return true
+	case "false":
+		return false
+	}
+	if n, err := strconv.ParseFloat(value, 64); err == nil {
+		return n
+	}
+	return value
+}
@@ -0,0 +1,180 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/darooyar/server/auth"
+	"github.com/darooyar/server/db"
+	"github.com/darooyar/server/middleware"
+	"github.com/darooyar/server/models"
+	"github.com/darooyar/server/sms"
+)
+
+const (
+	// otpCodeTTL is how long a sent code can be used
+	otpCodeTTL = 2 * time.Minute
+	// otpMaxAttempts is how many wrong guesses a code survives
+	otpMaxAttempts = 5
+)
+
+// otpLimits bounds how often codes are sent, so that the SMS line cannot be
+// used to flood a phone or run up costs
+var otpLimits = db.OTPLimits{
+	Cooldown: time.Minute,
+	Window:   time.Hour,
+	PerPhone: 5,
+	PerIP:    20,
+}
+
+// OTPHandler handles phone-number registration and login with one-time codes
+type OTPHandler struct {
+	users    db.UserStore
+	sessions db.SessionStore
+	tokens   db.TokenStore
+	sender   sms.Sender
+}
+
+// NewOTPHandler creates a new OTP handler that sends codes through the sender
+func NewOTPHandler(users db.UserStore, sessions db.SessionStore, tokens db.TokenStore, sender sms.Sender) *OTPHandler {
+	return &OTPHandler{
+		users:    users,
+		sessions: sessions,
+		tokens:   tokens,
+		sender:   sender,
+	}
+}
+
+// RequestCode sends a one-time code to a phone number. The response is the
+// same whether or not a user has the number.
+func (h *OTPHandler) RequestCode(w http.ResponseWriter, r *http.Request) {
+	if h.sender == nil {
+		sendErrorResponse(w, "Phone login is not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	var req models.OTPRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendErrorResponse(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	phone, err := sms.NormalizePhone(req.Phone)
+	if err != nil {
+		sendErrorResponse(w, "Invalid mobile number", http.StatusBadRequest)
+		return
+	}
+
+	code, err := auth.GenerateOTPCode()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error generating OTP code", "error", err)
+		sendErrorResponse(w, "Error generating code", http.StatusInternalServerError)
+		return
+	}
+
+	otp, retryAfter, err := h.tokens.CreateOTPCode(r.Context(), phone, auth.HashOTPCode(phone, code), middleware.ClientIP(r),
+		time.Now().Add(otpCodeTTL), otpLimits)
+	if err == db.ErrOTPRateLimited {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		sendErrorResponse(w, "Too many codes requested, please try again later", http.StatusTooManyRequests)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error storing OTP code", "error", err)
+		sendErrorResponse(w, "Error generating code", http.StatusInternalServerError)
+		return
+	}
+
+	if err := h.sender.SendCode(r.Context(), phone, code); err != nil {
+		slog.ErrorContext(r.Context(), "Error sending OTP code", "sender", h.sender.Name(), "error", err)
+		sendErrorResponse(w, "Error sending code", http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(models.OTPResponse{
+		Phone:       phone,
+		ExpiresAt:   otp.ExpiresAt,
+		ResendAfter: otp.CreatedAt.Add(otpLimits.Cooldown),
+	})
+}
+
+// VerifyCode logs in with a one-time code, registering a user for the phone
+// number first if there is none. It starts a session like Login does.
+func (h *OTPHandler) VerifyCode(w http.ResponseWriter, r *http.Request) {
+	var req models.OTPVerify
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendErrorResponse(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	phone, err := sms.NormalizePhone(req.Phone)
+	if err != nil {
+		sendErrorResponse(w, "Invalid mobile number", http.StatusBadRequest)
+		return
+	}
+	req.Phone = phone
+
+	codeID, err := h.tokens.VerifyOTPCode(r.Context(), phone, auth.HashOTPCode(phone, strings.TrimSpace(req.Code)), otpMaxAttempts)
+	if err == db.ErrInvalidOTPCode || err == db.ErrOTPAttemptsExceeded {
+		sendErrorResponse(w, "Invalid or expired code", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error verifying OTP code", "error", err)
+		sendErrorResponse(w, "Error verifying code", http.StatusInternalServerError)
+		return
+	}
+
+	user, err := h.users.GetUserByPhone(r.Context(), phone)
+	if err != nil && err != db.ErrUserNotFound {
+		slog.ErrorContext(r.Context(), "Error getting user by phone", "error", err)
+		sendErrorResponse(w, "Error verifying code", http.StatusInternalServerError)
+		return
+	}
+
+	// New numbers need a name to register. The code stays valid meanwhile.
+	req.FirstName = strings.TrimSpace(req.FirstName)
+	req.LastName = strings.TrimSpace(req.LastName)
+	if user == nil && (req.FirstName == "" || req.LastName == "") {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":  "error",
+			"code":    "registration_required",
+			"message": "First name and last name are required to register",
+		})
+		return
+	}
+
+	if err := h.tokens.ConsumeOTPCode(r.Context(), codeID); err != nil {
+		sendErrorResponse(w, "Invalid or expired code", http.StatusUnauthorized)
+		return
+	}
+
+	if user != nil {
+		writeNewSession(w, r, h.sessions, user, http.StatusOK)
+		return
+	}
+
+	req.Username = strings.TrimSpace(req.Username)
+	if req.Username == "" {
+		req.Username = strings.TrimPrefix(phone, "+")
+	}
+
+	user, err = h.users.CreatePhoneUser(r.Context(), &req)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error creating phone user", "error", err)
+		sendErrorResponse(w, "Error creating user, the username may be taken", http.StatusConflict)
+		return
+	}
+	slog.InfoContext(r.Context(), "Registered user by phone", "user_id", user.ID)
+
+	writeNewSession(w, r, h.sessions, user, http.StatusCreated)
+}
@@ -0,0 +1,281 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/darooyar/server/config"
+	"github.com/darooyar/server/db"
+	"github.com/darooyar/server/models"
+	"github.com/darooyar/server/payments"
+)
+
+const (
+	// minPaymentAmount is the smallest top-up in Tomans that gateways accept
+	minPaymentAmount = 1_000
+	// maxPaymentAmount bounds a single top-up in Tomans
+	maxPaymentAmount = 5_000_000
+	// defaultPaymentPageSize is the number of payments listed when no limit is given
+	defaultPaymentPageSize = 20
+)
+
+// PaymentHandler handles credit top-ups paid through a payment gateway
+type PaymentHandler struct {
+	gateway     payments.Gateway
+	users       db.UserStore
+	payments    db.PaymentStore
+	callbackURL string
+	returnURL   string
+}
+
+// NewPaymentHandler creates a new payment handler. Without a gateway, the
+// payment endpoints answer 503 Service Unavailable.
+func NewPaymentHandler(gateway payments.Gateway, users db.UserStore, paymentStore db.PaymentStore, cfg *config.Config) *PaymentHandler {
+	return &PaymentHandler{
+		gateway:     gateway,
+		users:       users,
+		payments:    paymentStore,
+		callbackURL: cfg.PaymentCallbackURL,
+		returnURL:   cfg.PaymentReturnURL,
+	}
+}
+
+// CreatePayment starts a credit top-up and returns the gateway page where the user pays
+func (h *PaymentHandler) CreatePayment(w http.ResponseWriter, r *http.Request) {
+	// Get user ID from context
+	userID, ok := r.Context().Value("user_id").(int64)
+	if !ok {
+		sendErrorResponse(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if h.gateway == nil {
+		sendErrorResponse(w, "Payment gateway is not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	var req models.PaymentCreate
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendErrorResponse(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if req.Amount < minPaymentAmount || req.Amount > maxPaymentAmount {
+		sendErrorResponse(w, "Amount must be between 1000 and 5000000 Tomans", http.StatusBadRequest)
+		return
+	}
+
+	email, _ := r.Context().Value("email").(string)
+	description := "افزایش اعتبار دارویار"
+
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+
+	result, err := h.gateway.Request(ctx, payments.PaymentRequest{
+		Amount:      req.Amount,
+		Description: description,
+		CallbackURL: h.callbackURL,
+		Email:       email,
+	})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error requesting payment", "user_id", userID, "error", err)
+		sendErrorResponse(w, "Error contacting payment gateway", http.StatusBadGateway)
+		return
+	}
+
+	// Top-ups of a pharmacy member go to the pharmacy's shared credit
+	pharmacy, err := h.users.GetUserPharmacy(ctx, userID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error getting pharmacy of user", "user_id", userID, "error", err)
+		sendErrorResponse(w, "Error creating payment", http.StatusInternalServerError)
+		return
+	}
+	var pharmacyID *int64
+	if pharmacy != nil {
+		pharmacyID = &pharmacy.ID
+	}
+
+	payment, err := h.payments.CreatePayment(ctx, &models.Payment{
+		UserID:      userID,
+		PharmacyID:  pharmacyID,
+		Gateway:     h.gateway.Name(),
+		Authority:   result.Authority,
+		Amount:      req.Amount,
+		Description: description,
+	})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error saving payment", "authority", result.Authority, "user_id", userID, "error", err)
+		sendErrorResponse(w, "Error creating payment", http.StatusInternalServerError)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Created payment", "payment_id", payment.ID, "authority", payment.Authority, "amount", payment.Amount, "user_id", userID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"payment":      payment,
+		"redirect_url": result.RedirectURL,
+	})
+}
+
+// PaymentCallback is where the gateway sends the user back after paying. The
+// payment is verified with the gateway and only then credited to the user,
+// or marked as failed once the gateway rejects it.
+func (h *PaymentHandler) PaymentCallback(w http.ResponseWriter, r *http.Request) {
+	authority := r.URL.Query().Get("Authority")
+	status := r.URL.Query().Get("Status")
+	if authority == "" {
+		sendErrorResponse(w, "Authority is required", http.StatusBadRequest)
+		return
+	}
+
+	if h.gateway == nil {
+		sendErrorResponse(w, "Payment gateway is not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	payment, err := h.payments.GetPaymentByAuthority(r.Context(), authority)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error getting payment", "authority", authority, "error", err)
+		sendErrorResponse(w, "Payment not found", http.StatusNotFound)
+		return
+	}
+
+	// Repeated callbacks report the payment as it was settled
+	if payment.Status != models.PaymentStatusPending {
+		h.writePaymentResult(w, r, payment)
+		return
+	}
+
+	// The status in the callback URL can be forged or lost, so it is never
+	// trusted to fail a payment. Only the gateway decides whether it was paid.
+	if status != "OK" {
+		slog.InfoContext(r.Context(), "Payment callback reports it was not paid", "payment_id", payment.ID, "authority", authority, "status", status)
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+
+	receipt, err := h.gateway.Verify(ctx, payments.VerifyRequest{
+		Authority: authority,
+		Amount:    payment.Amount,
+	})
+	if errors.Is(err, payments.ErrVerificationFailed) {
+		slog.WarnContext(r.Context(), "Payment was not verified", "payment_id", payment.ID, "authority", authority, "error", err)
+		if payment, err = h.payments.FailPayment(r.Context(), authority); err != nil {
+			slog.ErrorContext(r.Context(), "Error failing payment", "authority", authority, "error", err)
+			sendErrorResponse(w, "Error updating payment", http.StatusInternalServerError)
+			return
+		}
+		h.writePaymentResult(w, r, payment)
+		return
+	}
+	if err != nil {
+		// The payment stays pending so that the callback can be retried
+		slog.ErrorContext(r.Context(), "Error verifying payment", "payment_id", payment.ID, "authority", authority, "error", err)
+		sendErrorResponse(w, "Error contacting payment gateway", http.StatusBadGateway)
+		return
+	}
+
+	payment, credited, err := h.payments.CompletePayment(r.Context(), authority, receipt.RefID, receipt.CardPAN)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error completing payment", "authority", authority, "error", err)
+		sendErrorResponse(w, "Error updating payment", http.StatusInternalServerError)
+		return
+	}
+	if credited {
+		slog.InfoContext(r.Context(), "Credited payment", "payment_id", payment.ID, "amount", payment.Amount, "user_id", payment.UserID, "ref_id", receipt.RefID)
+	}
+
+	h.writePaymentResult(w, r, payment)
+}
+
+// GetUserPayments returns the current user's payments, newest first
+func (h *PaymentHandler) GetUserPayments(w http.ResponseWriter, r *http.Request) {
+	// Get user ID from context
+	userID, ok := r.Context().Value("user_id").(int64)
+	if !ok {
+		sendErrorResponse(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	limit := defaultPaymentPageSize
+	offset := 0
+	if parsed, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && parsed > 0 {
+		limit = min(parsed, 100)
+	}
+	if parsed, err := strconv.Atoi(r.URL.Query().Get("offset")); err == nil && parsed >= 0 {
+		offset = parsed
+	}
+
+	userPayments, err := h.payments.GetUserPayments(r.Context(), userID, limit, offset)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error getting payments of user", "user_id", userID, "error", err)
+		sendErrorResponse(w, "Error retrieving payments", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"payments": userPayments,
+	})
+}
+
+// GetPayment returns one of the current user's payments
+func (h *PaymentHandler) GetPayment(w http.ResponseWriter, r *http.Request) {
+	// Get user ID from context
+	userID, ok := r.Context().Value("user_id").(int64)
+	if !ok {
+		sendErrorResponse(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		sendErrorResponse(w, "Invalid payment ID", http.StatusBadRequest)
+		return
+	}
+
+	payment, err := h.payments.GetUserPayment(r.Context(), id, userID)
+	if err != nil {
+		sendErrorResponse(w, "Payment not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(payment)
+}
+
+// writePaymentResult sends the user back to the app when a return URL is
+// configured, and answers with the payment otherwise
+func (h *PaymentHandler) writePaymentResult(w http.ResponseWriter, r *http.Request, payment *models.Payment) {
+	if h.returnURL == "" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(payment)
+		return
+	}
+
+	target, err := url.Parse(h.returnURL)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Invalid payment return URL", "url", h.returnURL, "error", err)
+		sendErrorResponse(w, "Invalid payment return URL", http.StatusInternalServerError)
+		return
+	}
+
+	query := target.Query()
+	query.Set("payment_id", strconv.FormatInt(payment.ID, 10))
+	query.Set("status", string(payment.Status))
+	if payment.RefID != nil {
+		query.Set("ref_id", *payment.RefID)
+	}
+	target.RawQuery = query.Encode()
+
+	http.Redirect(w, r, target.String(), http.StatusSeeOther)
+}
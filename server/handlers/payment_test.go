@@ -0,0 +1,73 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/darooyar/server/config"
+	"github.com/darooyar/server/db/memory"
+	"github.com/darooyar/server/models"
+	"github.com/darooyar/server/payments"
+)
+
+func TestPaymentCallback(t *testing.T) {
+	const amount = 50_000
+
+	tests := []struct {
+		name       string
+		canceled   bool     // Whether the user canceled the payment at the gateway
+		callbacks  []string // Status of each callback the gateway sends
+		wantStatus models.PaymentStatus
+		wantCredit float64
+	}{
+		{name: "paid", callbacks: []string{"OK"}, wantStatus: models.PaymentStatusVerified, wantCredit: amount},
+		{name: "canceled", canceled: true, callbacks: []string{"NOK"}, wantStatus: models.PaymentStatusFailed},
+		{name: "paid with forged status", callbacks: []string{"NOK"}, wantStatus: models.PaymentStatusVerified, wantCredit: amount},
+		{name: "repeated callback", callbacks: []string{"OK", "OK"}, wantStatus: models.PaymentStatusVerified, wantCredit: amount},
+		{name: "callback after cancel", canceled: true, callbacks: []string{"NOK", "OK"}, wantStatus: models.PaymentStatusFailed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := memory.New()
+			user := createTestUser(t, store, "user@example.com")
+			gateway := payments.NewFakeGateway()
+			h := NewPaymentHandler(gateway, store, store, &config.Config{PaymentCallbackURL: "http://localhost/api/payments/callback"})
+
+			rec := serve(t, "POST /api/payments", h.CreatePayment, http.MethodPost, "/api/payments", user.ID, models.PaymentCreate{Amount: amount})
+			if rec.Code != http.StatusCreated {
+				t.Fatalf("creating payment: status = %d: %s", rec.Code, rec.Body.String())
+			}
+			var created struct {
+				Payment models.Payment `json:"payment"`
+			}
+			decode(t, rec, &created)
+			if tt.canceled {
+				gateway.Cancel(created.Payment.Authority)
+			}
+
+			var payment models.Payment
+			for _, status := range tt.callbacks {
+				query := url.Values{"Authority": {created.Payment.Authority}, "Status": {status}}
+				rec := serve(t, "GET /api/payments/callback", h.PaymentCallback, http.MethodGet, "/api/payments/callback?"+query.Encode(), 0, nil)
+				if rec.Code != http.StatusOK {
+					t.Fatalf("callback: status = %d: %s", rec.Code, rec.Body.String())
+				}
+				decode(t, rec, &payment)
+			}
+
+			if payment.Status != tt.wantStatus {
+				t.Errorf("payment status = %s, want %s", payment.Status, tt.wantStatus)
+			}
+			stored, err := store.GetUserByID(context.Background(), user.ID)
+			if err != nil {
+				t.Fatalf("getting user: %v", err)
+			}
+			if stored.Credit != tt.wantCredit {
+				t.Errorf("credit = %v, want %v", stored.Credit, tt.wantCredit)
+			}
+		})
+	}
+}
@@ -0,0 +1,517 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/darooyar/server/db"
+	"github.com/darooyar/server/models"
+	"github.com/darooyar/server/sms"
+)
+
+const (
+	// pharmacyInvitationTTL is how long an invitation can be accepted
+	pharmacyInvitationTTL = 7 * 24 * time.Hour
+	// defaultPharmacyTransactionPageSize is the number of transactions listed when no limit is given
+	defaultPharmacyTransactionPageSize = 20
+)
+
+// PharmacyHandler handles pharmacies, their members and invitations, and the
+// chats and folders shared with them
+type PharmacyHandler struct {
+	users      db.UserStore
+	pharmacies db.PharmacyStore
+}
+
+// NewPharmacyHandler creates a new pharmacy handler
+func NewPharmacyHandler(users db.UserStore, pharmacies db.PharmacyStore) *PharmacyHandler {
+	return &PharmacyHandler{
+		users:      users,
+		pharmacies: pharmacies,
+	}
+}
+
+// CreatePharmacy creates a pharmacy owned by the user
+func (h *PharmacyHandler) CreatePharmacy(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("user_id").(int64)
+	if !ok {
+		sendErrorResponse(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req models.PharmacyCreate
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendErrorResponse(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		sendErrorResponse(w, "Name is required", http.StatusBadRequest)
+		return
+	}
+
+	pharmacy, err := h.pharmacies.CreatePharmacy(r.Context(), userID, name)
+	if errors.Is(err, db.ErrAlreadyPharmacyMember) {
+		sendErrorResponse(w, "You already belong to a pharmacy", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error creating pharmacy", "user_id", userID, "error", err)
+		sendErrorResponse(w, "Error creating pharmacy", http.StatusInternalServerError)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "User created pharmacy", "user_id", userID, "pharmacy_id", pharmacy.ID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(pharmacy)
+}
+
+// GetPharmacy returns the user's pharmacy with its members
+func (h *PharmacyHandler) GetPharmacy(w http.ResponseWriter, r *http.Request) {
+	_, pharmacy, ok := h.userPharmacy(w, r)
+	if !ok {
+		return
+	}
+
+	members, err := h.pharmacies.GetPharmacyMembers(r.Context(), pharmacy.ID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error getting pharmacy members", "pharmacy_id", pharmacy.ID, "error", err)
+		sendErrorResponse(w, "Error retrieving pharmacy", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"pharmacy": pharmacy,
+		"members":  members,
+	})
+}
+
+// UpdateMember changes the role of a member (owners only)
+func (h *PharmacyHandler) UpdateMember(w http.ResponseWriter, r *http.Request) {
+	_, pharmacy, ok := h.userPharmacy(w, r)
+	if !ok {
+		return
+	}
+
+	if !pharmacy.Role.CanManageMembers() {
+		sendErrorResponse(w, "Only pharmacy owners can change members", http.StatusForbidden)
+		return
+	}
+
+	memberID, err := strconv.ParseInt(r.PathValue("user_id"), 10, 64)
+	if err != nil {
+		sendErrorResponse(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	var req models.PharmacyMemberUpdate
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendErrorResponse(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if !req.Role.IsValid() {
+		sendErrorResponse(w, "Role must be owner, pharmacist or technician", http.StatusBadRequest)
+		return
+	}
+
+	err = h.pharmacies.UpdatePharmacyMemberRole(r.Context(), pharmacy.ID, memberID, req.Role)
+	if !writeMemberError(w, err) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message": "Member role updated",
+		"user_id": memberID,
+		"role":    req.Role,
+	})
+}
+
+// RemoveMember removes a member from the pharmacy. Owners can remove anyone;
+// any member can remove themselves to leave the pharmacy.
+func (h *PharmacyHandler) RemoveMember(w http.ResponseWriter, r *http.Request) {
+	userID, pharmacy, ok := h.userPharmacy(w, r)
+	if !ok {
+		return
+	}
+
+	memberID, err := strconv.ParseInt(r.PathValue("user_id"), 10, 64)
+	if err != nil {
+		sendErrorResponse(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	if memberID != userID && !pharmacy.Role.CanManageMembers() {
+		sendErrorResponse(w, "Only pharmacy owners can remove members", http.StatusForbidden)
+		return
+	}
+
+	err = h.pharmacies.RemovePharmacyMember(r.Context(), pharmacy.ID, memberID)
+	if !writeMemberError(w, err) {
+		return
+	}
+
+	slog.InfoContext(r.Context(), "User removed pharmacy member", "user_id", userID, "member_id", memberID, "pharmacy_id", pharmacy.ID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message": "Member removed",
+		"user_id": memberID,
+	})
+}
+
+// CreateInvitation invites the owner of an email or phone number to the pharmacy (owners only)
+func (h *PharmacyHandler) CreateInvitation(w http.ResponseWriter, r *http.Request) {
+	userID, pharmacy, ok := h.userPharmacy(w, r)
+	if !ok {
+		return
+	}
+
+	if !pharmacy.Role.CanManageMembers() {
+		sendErrorResponse(w, "Only pharmacy owners can invite members", http.StatusForbidden)
+		return
+	}
+
+	var req models.PharmacyInvitationCreate
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendErrorResponse(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if !req.Role.IsValid() {
+		sendErrorResponse(w, "Role must be owner, pharmacist or technician", http.StatusBadRequest)
+		return
+	}
+
+	invitation := models.PharmacyInvitation{
+		PharmacyID: pharmacy.ID,
+		Role:       req.Role,
+		InvitedBy:  userID,
+		ExpiresAt:  time.Now().Add(pharmacyInvitationTTL),
+	}
+
+	if email := strings.TrimSpace(req.Email); email != "" {
+		invitation.Email = &email
+	}
+	if req.Phone != "" {
+		phone, err := sms.NormalizePhone(req.Phone)
+		if err != nil {
+			sendErrorResponse(w, "Invalid mobile number", http.StatusBadRequest)
+			return
+		}
+		invitation.Phone = &phone
+	}
+	if invitation.Email == nil && invitation.Phone == nil {
+		sendErrorResponse(w, "Email or phone is required", http.StatusBadRequest)
+		return
+	}
+
+	created, err := h.pharmacies.CreatePharmacyInvitation(r.Context(), &invitation)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error creating pharmacy invitation", "pharmacy_id", pharmacy.ID, "error", err)
+		sendErrorResponse(w, "Error creating invitation", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(created)
+}
+
+// GetInvitations lists the pending invitations of the pharmacy
+func (h *PharmacyHandler) GetInvitations(w http.ResponseWriter, r *http.Request) {
+	_, pharmacy, ok := h.userPharmacy(w, r)
+	if !ok {
+		return
+	}
+
+	invitations, err := h.pharmacies.GetPharmacyInvitations(r.Context(), pharmacy.ID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error getting pharmacy invitations", "pharmacy_id", pharmacy.ID, "error", err)
+		sendErrorResponse(w, "Error retrieving invitations", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"invitations": invitations,
+	})
+}
+
+// RevokeInvitation withdraws a pending invitation (owners only)
+func (h *PharmacyHandler) RevokeInvitation(w http.ResponseWriter, r *http.Request) {
+	_, pharmacy, ok := h.userPharmacy(w, r)
+	if !ok {
+		return
+	}
+
+	if !pharmacy.Role.CanManageMembers() {
+		sendErrorResponse(w, "Only pharmacy owners can revoke invitations", http.StatusForbidden)
+		return
+	}
+
+	invitationID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		sendErrorResponse(w, "Invalid invitation ID", http.StatusBadRequest)
+		return
+	}
+
+	err = h.pharmacies.RevokePharmacyInvitation(r.Context(), invitationID, pharmacy.ID)
+	if errors.Is(err, db.ErrInvitationNotFound) {
+		sendErrorResponse(w, "Invitation not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error revoking invitation", "invitation_id", invitationID, "error", err)
+		sendErrorResponse(w, "Error revoking invitation", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Invitation revoked",
+	})
+}
+
+// GetMyInvitations lists the pending invitations addressed to the user's
+// verified email or phone number
+func (h *PharmacyHandler) GetMyInvitations(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("user_id").(int64)
+	if !ok {
+		sendErrorResponse(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	invitations, err := h.pharmacies.GetUserInvitations(r.Context(), userID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error getting user invitations", "user_id", userID, "error", err)
+		sendErrorResponse(w, "Error retrieving invitations", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"invitations": invitations,
+	})
+}
+
+// AcceptInvitation joins the pharmacy of an invitation addressed to the user
+func (h *PharmacyHandler) AcceptInvitation(w http.ResponseWriter, r *http.Request) {
+	h.respondToInvitation(w, r, true)
+}
+
+// DeclineInvitation declines an invitation addressed to the user
+func (h *PharmacyHandler) DeclineInvitation(w http.ResponseWriter, r *http.Request) {
+	h.respondToInvitation(w, r, false)
+}
+
+// respondToInvitation accepts or declines the invitation in the URL
+func (h *PharmacyHandler) respondToInvitation(w http.ResponseWriter, r *http.Request, accept bool) {
+	userID, ok := r.Context().Value("user_id").(int64)
+	if !ok {
+		sendErrorResponse(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	invitationID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		sendErrorResponse(w, "Invalid invitation ID", http.StatusBadRequest)
+		return
+	}
+
+	invitation, err := h.pharmacies.RespondToInvitation(r.Context(), invitationID, userID, accept)
+	if errors.Is(err, db.ErrInvitationNotFound) {
+		sendErrorResponse(w, "Invitation not found", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, db.ErrAlreadyPharmacyMember) {
+		sendErrorResponse(w, "You already belong to a pharmacy", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error responding to invitation", "invitation_id", invitationID, "error", err)
+		sendErrorResponse(w, "Error responding to invitation", http.StatusInternalServerError)
+		return
+	}
+
+	if accept {
+		slog.InfoContext(r.Context(), "User joined pharmacy", "user_id", userID, "pharmacy_id", invitation.PharmacyID, "role", invitation.Role)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(invitation)
+}
+
+// GetSharedChats lists the chats shared with the user's pharmacy
+func (h *PharmacyHandler) GetSharedChats(w http.ResponseWriter, r *http.Request) {
+	_, pharmacy, ok := h.userPharmacy(w, r)
+	if !ok {
+		return
+	}
+
+	chats, err := h.pharmacies.GetPharmacyChats(r.Context(), pharmacy.ID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error getting pharmacy chats", "pharmacy_id", pharmacy.ID, "error", err)
+		sendErrorResponse(w, "Error retrieving chats", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"chats": chats,
+	})
+}
+
+// GetSharedFolders lists the folders shared with the user's pharmacy
+func (h *PharmacyHandler) GetSharedFolders(w http.ResponseWriter, r *http.Request) {
+	_, pharmacy, ok := h.userPharmacy(w, r)
+	if !ok {
+		return
+	}
+
+	folders, err := h.pharmacies.GetPharmacyFolders(r.Context(), pharmacy.ID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error getting pharmacy folders", "pharmacy_id", pharmacy.ID, "error", err)
+		sendErrorResponse(w, "Error retrieving folders", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"folders": folders,
+	})
+}
+
+// GetTransactions lists the transactions of the pharmacy's credit (owners and pharmacists only)
+func (h *PharmacyHandler) GetTransactions(w http.ResponseWriter, r *http.Request) {
+	_, pharmacy, ok := h.userPharmacy(w, r)
+	if !ok {
+		return
+	}
+
+	if !pharmacy.Role.CanManageBilling() {
+		sendErrorResponse(w, "Only pharmacy owners and pharmacists can see transactions", http.StatusForbidden)
+		return
+	}
+
+	limit := defaultPharmacyTransactionPageSize
+	offset := 0
+	if parsed, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && parsed > 0 {
+		limit = min(parsed, 100)
+	}
+	if parsed, err := strconv.Atoi(r.URL.Query().Get("offset")); err == nil && parsed >= 0 {
+		offset = parsed
+	}
+
+	transactions, err := h.pharmacies.GetPharmacyCreditTransactions(r.Context(), pharmacy.ID, limit, offset)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error getting pharmacy transactions", "pharmacy_id", pharmacy.ID, "error", err)
+		sendErrorResponse(w, "Error retrieving transactions", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"transactions": transactions,
+	})
+}
+
+// ShareChat shares one of the user's chats with their pharmacy
+func (h *PharmacyHandler) ShareChat(w http.ResponseWriter, r *http.Request) {
+	h.shareWithPharmacy(w, r, "chat", h.pharmacies.ShareChat, true)
+}
+
+// UnshareChat stops sharing one of the user's chats with their pharmacy
+func (h *PharmacyHandler) UnshareChat(w http.ResponseWriter, r *http.Request) {
+	h.shareWithPharmacy(w, r, "chat", h.pharmacies.ShareChat, false)
+}
+
+// ShareFolder shares one of the user's folders, with their chats in it, with their pharmacy
+func (h *PharmacyHandler) ShareFolder(w http.ResponseWriter, r *http.Request) {
+	h.shareWithPharmacy(w, r, "folder", h.pharmacies.ShareFolder, true)
+}
+
+// UnshareFolder stops sharing one of the user's folders with their pharmacy
+func (h *PharmacyHandler) UnshareFolder(w http.ResponseWriter, r *http.Request) {
+	h.shareWithPharmacy(w, r, "folder", h.pharmacies.ShareFolder, false)
+}
+
+// shareWithPharmacy shares or unshares the chat or folder in the URL with share
+func (h *PharmacyHandler) shareWithPharmacy(w http.ResponseWriter, r *http.Request, kind string, share func(ctx context.Context, id, userID int64, pharmacyID *int64) error, shared bool) {
+	userID, pharmacy, ok := h.userPharmacy(w, r)
+	if !ok {
+		return
+	}
+
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		sendErrorResponse(w, "Invalid "+kind+" ID", http.StatusBadRequest)
+		return
+	}
+
+	var pharmacyID *int64
+	if shared {
+		pharmacyID = &pharmacy.ID
+	}
+
+	if err := share(r.Context(), id, userID, pharmacyID); err != nil {
+		sendErrorResponse(w, strings.ToUpper(kind[:1])+kind[1:]+" not found or unauthorized", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":          id,
+		"pharmacy_id": pharmacyID,
+	})
+}
+
+// userPharmacy returns the user and the pharmacy they belong to, answering
+// 404 Not Found when they are not a member of any pharmacy
+func (h *PharmacyHandler) userPharmacy(w http.ResponseWriter, r *http.Request) (int64, *models.Pharmacy, bool) {
+	userID, ok := r.Context().Value("user_id").(int64)
+	if !ok {
+		sendErrorResponse(w, "Unauthorized", http.StatusUnauthorized)
+		return 0, nil, false
+	}
+
+	pharmacy, err := h.users.GetUserPharmacy(r.Context(), userID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error getting pharmacy of user", "user_id", userID, "error", err)
+		sendErrorResponse(w, "Error retrieving pharmacy", http.StatusInternalServerError)
+		return 0, nil, false
+	}
+	if pharmacy == nil {
+		sendErrorResponse(w, "You are not a member of a pharmacy", http.StatusNotFound)
+		return 0, nil, false
+	}
+
+	return userID, pharmacy, true
+}
+
+// writeMemberError answers the errors of a membership change and reports whether there was none
+func writeMemberError(w http.ResponseWriter, err error) bool {
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, db.ErrPharmacyMemberNotFound):
+		sendErrorResponse(w, "Member not found", http.StatusNotFound)
+	case errors.Is(err, db.ErrLastPharmacyOwner):
+		sendErrorResponse(w, "The pharmacy must keep at least one owner", http.StatusConflict)
+	default:
+		slog.Error("Error changing pharmacy member", "error", err)
+		sendErrorResponse(w, "Error changing member", http.StatusInternalServerError)
+	}
+	return false
+}
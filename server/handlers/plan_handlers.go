@@ -1,19 +1,39 @@
 package handlers
 
 import (
+	"database/sql"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
 
 	"github.com/darooyar/server/db"
 	"github.com/darooyar/server/models"
+	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 )
 
+// PlanHandler handles plans, subscriptions and the credit spent on them
+type PlanHandler struct {
+	users  db.UserStore
+	plans  db.PlanStore
+	credit db.CreditStore
+}
+
+// NewPlanHandler creates a new plan handler
+func NewPlanHandler(users db.UserStore, plans db.PlanStore, credit db.CreditStore) *PlanHandler {
+	return &PlanHandler{
+		users:  users,
+		plans:  plans,
+		credit: credit,
+	}
+}
+
 // GetAllPlans handles retrieving all available plans
-func GetAllPlans(w http.ResponseWriter, r *http.Request) {
+func (h *PlanHandler) GetAllPlans(w http.ResponseWriter, r *http.Request) {
 	// Get all plans from database
-	plans, err := db.GetAllPlans()
+	plans, err := h.plans.GetAllPlans(r.Context())
 	if err != nil {
 		http.Error(w, "Error retrieving plans: "+err.Error(), http.StatusInternalServerError)
 		return
@@ -27,7 +47,7 @@ func GetAllPlans(w http.ResponseWriter, r *http.Request) {
 }
 
 // GetPlanByID handles retrieving a specific plan
-func GetPlanByID(w http.ResponseWriter, r *http.Request) {
+func (h *PlanHandler) GetPlanByID(w http.ResponseWriter, r *http.Request) {
 	// Get plan ID from URL
 	vars := mux.Vars(r)
 	planID, err := strconv.ParseInt(vars["id"], 10, 64)
@@ -37,7 +57,7 @@ func GetPlanByID(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Get plan from database
-	plan, err := db.GetPlanByID(planID)
+	plan, err := h.plans.GetPlanByID(r.Context(), planID)
 	if err != nil {
 		http.Error(w, "Error retrieving plan: "+err.Error(), http.StatusInternalServerError)
 		return
@@ -54,7 +74,7 @@ func GetPlanByID(w http.ResponseWriter, r *http.Request) {
 }
 
 // CreatePlan handles creating a new plan (admin only)
-func CreatePlan(w http.ResponseWriter, r *http.Request) {
+func (h *PlanHandler) CreatePlan(w http.ResponseWriter, r *http.Request) {
 	// Parse request body
 	var planCreate models.PlanCreate
 	if err := json.NewDecoder(r.Body).Decode(&planCreate); err != nil {
@@ -63,7 +83,7 @@ func CreatePlan(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Create plan in database
-	plan, err := db.CreatePlan(&planCreate)
+	plan, err := h.plans.CreatePlan(r.Context(), &planCreate)
 	if err != nil {
 		http.Error(w, "Error creating plan: "+err.Error(), http.StatusInternalServerError)
 		return
@@ -75,8 +95,10 @@ func CreatePlan(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(plan)
 }
 
-// PurchasePlan handles user purchasing a plan
-func PurchasePlan(w http.ResponseWriter, r *http.Request) {
+// PurchasePlan handles user purchasing a plan. Members of a pharmacy buy the
+// plan for the whole pharmacy with its credit, which only owners and
+// pharmacists may spend.
+func (h *PlanHandler) PurchasePlan(w http.ResponseWriter, r *http.Request) {
 	// Get user ID from context (set during authentication)
 	userID := r.Context().Value("user_id").(int64)
 
@@ -89,20 +111,36 @@ func PurchasePlan(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Check if user already has an active subscription
-	activeSubscription, err := db.GetCurrentUserSubscription(userID)
+	pharmacy, err := h.users.GetUserPharmacy(r.Context(), userID)
+	if err != nil {
+		http.Error(w, "Error retrieving pharmacy: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var pharmacyID *int64
+	if pharmacy != nil {
+		if !pharmacy.Role.CanManageBilling() {
+			http.Error(w, "Only pharmacy owners and pharmacists can purchase plans", http.StatusForbidden)
+			return
+		}
+		pharmacyID = &pharmacy.ID
+	}
+
+	// Check if user already has an active subscription. A subscription the
+	// member bought for themselves does not stop them buying one for their pharmacy.
+	activeSubscription, err := h.plans.GetCurrentUserSubscription(r.Context(), userID)
 	if err != nil {
 		http.Error(w, "Error checking current subscription: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	if activeSubscription != nil {
+	if activeSubscription != nil && (pharmacyID == nil || activeSubscription.PharmacyID != nil) {
 		http.Error(w, "You already have an active subscription. Please wait until it expires before purchasing a new one.", http.StatusConflict)
 		return
 	}
 
 	// Verify plan exists
-	plan, err := db.GetPlanByID(request.PlanID)
+	plan, err := h.plans.GetPlanByID(r.Context(), request.PlanID)
 	if err != nil {
 		http.Error(w, "Error retrieving plan: "+err.Error(), http.StatusInternalServerError)
 		return
@@ -112,19 +150,27 @@ func PurchasePlan(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Verify user has enough credit
-	user, err := db.GetUserByID(userID)
+	// Verify user, or their pharmacy, has enough credit
+	user, err := h.users.GetUserByID(r.Context(), userID)
 	if err != nil {
 		http.Error(w, "Error retrieving user: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
-	if user.Credit < plan.Price {
+	credit := user.Credit
+	if pharmacy != nil {
+		credit = pharmacy.Credit
+	}
+	if credit < plan.Price {
 		http.Error(w, "Insufficient credit to purchase this plan", http.StatusPaymentRequired)
 		return
 	}
 
 	// Create subscription
-	subscription, err := db.CreateUserSubscription(userID, request.PlanID)
+	subscription, err := h.plans.CreateUserSubscription(r.Context(), userID, request.PlanID, pharmacyID)
+	if errors.Is(err, db.ErrInsufficientCredit) {
+		http.Error(w, "Insufficient credit to purchase this plan", http.StatusPaymentRequired)
+		return
+	}
 	if err != nil {
 		http.Error(w, "Error creating subscription: "+err.Error(), http.StatusInternalServerError)
 		return
@@ -135,17 +181,17 @@ func PurchasePlan(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"message":          "Plan purchased successfully",
 		"subscription":     subscription,
-		"remaining_credit": user.Credit - plan.Price,
+		"remaining_credit": credit - plan.Price,
 	})
 }
 
 // GetUserSubscriptions handles retrieving all subscriptions for a user
-func GetUserSubscriptions(w http.ResponseWriter, r *http.Request) {
+func (h *PlanHandler) GetUserSubscriptions(w http.ResponseWriter, r *http.Request) {
 	// Get user ID from context (set during authentication)
 	userID := r.Context().Value("user_id").(int64)
 
 	// Get all subscriptions from database
-	subscriptions, err := db.GetUserSubscriptions(userID)
+	subscriptions, err := h.plans.GetUserSubscriptions(r.Context(), userID)
 	if err != nil {
 		http.Error(w, "Error retrieving subscriptions: "+err.Error(), http.StatusInternalServerError)
 		return
@@ -159,12 +205,12 @@ func GetUserSubscriptions(w http.ResponseWriter, r *http.Request) {
 }
 
 // GetActiveUserSubscriptions handles retrieving active subscriptions for a user
-func GetActiveUserSubscriptions(w http.ResponseWriter, r *http.Request) {
+func (h *PlanHandler) GetActiveUserSubscriptions(w http.ResponseWriter, r *http.Request) {
 	// Get user ID from context (set during authentication)
 	userID := r.Context().Value("user_id").(int64)
 
 	// Get active subscriptions from database
-	subscriptions, err := db.GetActiveUserSubscriptions(userID)
+	subscriptions, err := h.plans.GetActiveUserSubscriptions(r.Context(), userID)
 	if err != nil {
 		http.Error(w, "Error retrieving subscriptions: "+err.Error(), http.StatusInternalServerError)
 		return
@@ -178,32 +224,42 @@ func GetActiveUserSubscriptions(w http.ResponseWriter, r *http.Request) {
 }
 
 // UseSubscription handles recording usage of a subscription
-func UseSubscription(w http.ResponseWriter, r *http.Request) {
+func (h *PlanHandler) UseSubscription(w http.ResponseWriter, r *http.Request) {
 	// Get user ID from context (set during authentication)
 	userID := r.Context().Value("user_id").(int64)
 
 	// Parse request body
 	var request struct {
-		SubscriptionID int64 `json:"subscription_id"`
-		Count          int   `json:"count"`
+		SubscriptionID int64  `json:"subscription_id"`
+		Count          int    `json:"count"`
+		IdempotencyKey string `json:"idempotency_key"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
 		http.Error(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
 		return
 	}
+	if request.Count <= 0 {
+		http.Error(w, "Count must be positive", http.StatusBadRequest)
+		return
+	}
 
-	// Verify user owns the subscription
-	// This is a security check to prevent users from using others' subscriptions
-	query := `SELECT id FROM user_subscriptions WHERE id = $1 AND user_id = $2`
-	var id int64
-	err := db.DB.QueryRow(query, request.SubscriptionID, userID).Scan(&id)
-	if err != nil {
+	// Clients that retry should send the same key so the usage is recorded once
+	idempotencyKey := "manual:" + uuid.New().String()
+	if request.IdempotencyKey != "" {
+		idempotencyKey = fmt.Sprintf("manual:%d:%s", userID, request.IdempotencyKey)
+	}
+
+	// Record usage. Only the user's own subscriptions and those of their
+	// pharmacy can be used, so others' subscriptions are not found.
+	err := h.plans.RecordSubscriptionUsage(r.Context(), request.SubscriptionID, userID, request.Count, idempotencyKey)
+	if errors.Is(err, sql.ErrNoRows) {
 		http.Error(w, "Subscription not found or does not belong to user", http.StatusNotFound)
 		return
 	}
-
-	// Record usage
-	err = db.RecordSubscriptionUsage(request.SubscriptionID, request.Count)
+	if errors.Is(err, db.ErrSubscriptionInactive) || errors.Is(err, db.ErrNotEnoughUses) {
+		http.Error(w, "Error recording usage: "+err.Error(), http.StatusConflict)
+		return
+	}
 	if err != nil {
 		http.Error(w, "Error recording usage: "+err.Error(), http.StatusInternalServerError)
 		return
@@ -217,7 +273,7 @@ func UseSubscription(w http.ResponseWriter, r *http.Request) {
 }
 
 // GetCreditTransactions handles retrieving credit transactions for a user
-func GetCreditTransactions(w http.ResponseWriter, r *http.Request) {
+func (h *PlanHandler) GetCreditTransactions(w http.ResponseWriter, r *http.Request) {
 	// Get user ID from context (set during authentication)
 	userID := r.Context().Value("user_id").(int64)
 
@@ -242,7 +298,7 @@ func GetCreditTransactions(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Get transactions from database
-	transactions, err := db.GetCreditTransactions(userID, limit, offset)
+	transactions, err := h.credit.GetCreditTransactions(r.Context(), userID, limit, offset)
 	if err != nil {
 		http.Error(w, "Error retrieving transactions: "+err.Error(), http.StatusInternalServerError)
 		return
@@ -256,12 +312,12 @@ func GetCreditTransactions(w http.ResponseWriter, r *http.Request) {
 }
 
 // GetCurrentUserSubscription handles retrieving the current active subscription for a user
-func GetCurrentUserSubscription(w http.ResponseWriter, r *http.Request) {
+func (h *PlanHandler) GetCurrentUserSubscription(w http.ResponseWriter, r *http.Request) {
 	// Get user ID from context (set during authentication)
 	userID := r.Context().Value("user_id").(int64)
 
 	// Get current subscription from database
-	subscription, err := db.GetCurrentUserSubscription(userID)
+	subscription, err := h.plans.GetCurrentUserSubscription(r.Context(), userID)
 	if err != nil {
 		http.Error(w, "Error retrieving current subscription: "+err.Error(), http.StatusInternalServerError)
 		return
@@ -288,6 +344,7 @@ func GetCurrentUserSubscription(w http.ResponseWriter, r *http.Request) {
 		Status:        subscription.Status,
 		UsesCount:     subscription.UsesCount,
 		RemainingUses: subscription.RemainingUses,
+		PharmacyID:    subscription.PharmacyID,
 	}
 
 	json.NewEncoder(w).Encode(response)
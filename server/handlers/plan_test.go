@@ -0,0 +1,57 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/darooyar/server/db/memory"
+	"github.com/darooyar/server/models"
+)
+
+func TestUseSubscriptionRetry(t *testing.T) {
+	ctx := context.Background()
+	store := memory.New()
+	user := createTestUser(t, store, "user@example.com")
+	h := NewPlanHandler(store, store, store)
+
+	maxUses := 1
+	plan, err := store.CreatePlan(ctx, &models.PlanCreate{Title: "trial", MaxUses: &maxUses, PlanType: models.PlanTypeUsageBased})
+	if err != nil {
+		t.Fatalf("creating plan: %v", err)
+	}
+	sub, err := store.CreateUserSubscription(ctx, user.ID, plan.ID, nil)
+	if err != nil {
+		t.Fatalf("subscribing: %v", err)
+	}
+
+	// The first request takes the last use and expires the subscription.
+	// Retrying it is still answered as recorded, but a new usage is refused.
+	tests := []struct {
+		name       string
+		key        string
+		wantStatus int
+	}{
+		{name: "first usage", key: "retry", wantStatus: http.StatusOK},
+		{name: "retry with the same key", key: "retry", wantStatus: http.StatusOK},
+		{name: "new usage", key: "other", wantStatus: http.StatusConflict},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := serve(t, "POST /api/subscriptions/use", h.UseSubscription, http.MethodPost, "/api/subscriptions/use", user.ID,
+				map[string]interface{}{"subscription_id": sub.ID, "count": 1, "idempotency_key": tt.key})
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+		})
+	}
+
+	subs, err := store.GetUserSubscriptions(ctx, user.ID)
+	if err != nil {
+		t.Fatalf("getting subscriptions: %v", err)
+	}
+	if subs[0].UsesCount != 1 || *subs[0].RemainingUses != 0 {
+		t.Errorf("uses = %d, remaining = %d, want 1 and 0", subs[0].UsesCount, *subs[0].RemainingUses)
+	}
+}
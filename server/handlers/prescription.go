@@ -1,26 +1,50 @@
 package handlers
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
-	"os"
-	"path/filepath"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/darooyar/server/ai"
+	"github.com/darooyar/server/db"
 	"github.com/darooyar/server/models"
+	"github.com/darooyar/server/storage"
 	"github.com/google/uuid"
 )
 
+const (
+	// prescriptionTitleLength is the number of characters of the text used as a default title
+	prescriptionTitleLength = 60
+	// imagePrescriptionTitle is the default title of prescriptions sent as images
+	imagePrescriptionTitle = "نسخه تصویری"
+	// defaultPrescriptionPageSize is the number of prescriptions listed when no limit is given
+	defaultPrescriptionPageSize = 20
+	// maxPrescriptionPageSize bounds the number of prescriptions listed at once
+	maxPrescriptionPageSize = 100
+)
+
 // PrescriptionHandler handles prescription-related API endpoints
 type PrescriptionHandler struct {
-	// In a real implementation, you would have a database connection here
-	// For now, we'll just use mock responses
+	plans         db.PlanStore
+	prescriptions db.PrescriptionStore
+	analyzer      *prescriptionAnalyzer
 }
 
 // NewPrescriptionHandler creates a new prescription handler
-func NewPrescriptionHandler() *PrescriptionHandler {
-	return &PrescriptionHandler{}
+func NewPrescriptionHandler(provider ai.Provider, plans db.PlanStore, prescriptions db.PrescriptionStore) *PrescriptionHandler {
+	return &PrescriptionHandler{
+		plans:         plans,
+		prescriptions: prescriptions,
+		analyzer:      newPrescriptionAnalyzer(provider),
+	}
 }
 
 // AnalyzePrescriptionText handles text-based prescription analysis
@@ -28,6 +52,13 @@ func (h *PrescriptionHandler) AnalyzePrescriptionText(w http.ResponseWriter, r *
 	// Set content type
 	w.Header().Set("Content-Type", "application/json")
 
+	// Get user ID from context
+	userID, ok := r.Context().Value("user_id").(int64)
+	if !ok {
+		writeErrorResponse(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
 	// Parse the request body
 	var request models.TextAnalysisRequest
 	err := json.NewDecoder(r.Body).Decode(&request)
@@ -37,25 +68,44 @@ func (h *PrescriptionHandler) AnalyzePrescriptionText(w http.ResponseWriter, r *
 	}
 
 	// Validate the request
+	request.Text = strings.TrimSpace(request.Text)
 	if request.Text == "" {
 		writeErrorResponse(w, "Text field is required", http.StatusBadRequest)
 		return
 	}
 
-	// Log the request (in a real app, you might want to sanitize sensitive data)
-	log.Printf("Received text analysis request: %s", request.Text)
+	usageKey := prescriptionUsageKey()
+	if !reserveAnalysis(r.Context(), w, h.plans, userID, usageKey) {
+		return
+	}
 
-	// For now, return a mock analysis
-	// In a real implementation, you would call an AI service or your own analysis logic
-	analysis := h.analyzeText(request.Text)
+	slog.InfoContext(r.Context(), "Received text analysis request", "user_id", userID, "length", len(request.Text))
 
-	// Write the response
-	response := models.AnalysisResponse{
-		Status:   "success",
-		Analysis: analysis,
+	ctx, cancel := context.WithTimeout(r.Context(), 60*time.Second)
+	defer cancel()
+
+	analysis, err := h.analyzer.analyzeText(ctx, request.Text)
+	if err == nil && analysis == "" {
+		err = ai.ErrEmptyResponse
 	}
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(response)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error analyzing prescription text", "error", err)
+		releaseAnalysis(r.Context(), h.plans, usageKey)
+		writeErrorResponse(w, "Error analyzing prescription", http.StatusBadGateway)
+		return
+	}
+
+	title := strings.TrimSpace(request.Title)
+	if title == "" {
+		title = defaultPrescriptionTitle(request.Text)
+	}
+
+	h.saveAndRespond(r.Context(), w, usageKey, &models.Prescription{
+		UserID:   userID,
+		Title:    title,
+		Text:     request.Text,
+		Analysis: analysis,
+	})
 }
 
 // AnalyzePrescriptionImage handles image-based prescription analysis
@@ -63,6 +113,13 @@ func (h *PrescriptionHandler) AnalyzePrescriptionImage(w http.ResponseWriter, r
 	// Set content type
 	w.Header().Set("Content-Type", "application/json")
 
+	// Get user ID from context
+	userID, ok := r.Context().Value("user_id").(int64)
+	if !ok {
+		writeErrorResponse(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
 	// Parse the multipart form
 	err := r.ParseMultipartForm(10 << 20) // 10 MB max
 	if err != nil {
@@ -78,49 +135,375 @@ func (h *PrescriptionHandler) AnalyzePrescriptionImage(w http.ResponseWriter, r
 	}
 	defer file.Close()
 
+	imageData, err := io.ReadAll(file)
+	if err != nil {
+		writeErrorResponse(w, "Failed to read image", http.StatusBadRequest)
+		return
+	}
+
+	usageKey := prescriptionUsageKey()
+	if !reserveAnalysis(r.Context(), w, h.plans, userID, usageKey) {
+		return
+	}
+
 	// Log the request
-	log.Printf("Received image analysis request: %s", header.Filename)
+	slog.InfoContext(r.Context(), "Received image analysis request", "user_id", userID, "size", len(imageData))
 
-	// In a real implementation, you would:
-	// 1. Save the file to disk
-	// 2. Process the image to extract text
-	// 3. Analyze the extracted text
+	mimeType := header.Header.Get("Content-Type")
+	if mimeType == "" || mimeType == "application/octet-stream" {
+		mimeType = detectImageMimeType(imageData)
+	}
 
-	// Generate a unique filename
-	filename := uuid.New().String() + filepath.Ext(header.Filename)
+	// The image is sent inline so the analysis does not depend on storage
+	ctx, cancel := context.WithTimeout(r.Context(), 90*time.Second)
+	defer cancel()
 
-	// For demonstration purposes, we'll save the file to a temporary directory
-	// In a real implementation, you would save it to a proper storage location
-	tempDir := os.TempDir()
-	filePath := filepath.Join(tempDir, filename)
+	analysis, err := h.analyzer.analyzeImageData(ctx, imageDataURI(imageData, mimeType))
+	if err == nil && analysis == "" {
+		err = ai.ErrEmptyResponse
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error analyzing prescription image", "error", err)
+		releaseAnalysis(r.Context(), h.plans, usageKey)
+		writeErrorResponse(w, "Error analyzing prescription", http.StatusBadGateway)
+		return
+	}
+
+	title := strings.TrimSpace(r.FormValue("title"))
+	if title == "" {
+		title = imagePrescriptionTitle
+	}
 
-	// Create a new file
-	dst, err := os.Create(filePath)
+	h.saveAndRespond(r.Context(), w, usageKey, &models.Prescription{
+		UserID:    userID,
+		Title:     title,
+		ImagePath: uploadPrescriptionImage(r.Context(), imageData, header.Filename, mimeType),
+		Analysis:  analysis,
+	})
+}
+
+// ListPrescriptions returns a page of the prescription history of the current
+// user, optionally filtered by date range, chat and full-text search
+func (h *PrescriptionHandler) ListPrescriptions(w http.ResponseWriter, r *http.Request) {
+	// Get user ID from context
+	userID, ok := r.Context().Value("user_id").(int64)
+	if !ok {
+		sendErrorResponse(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	params := r.URL.Query()
+	filter := models.PrescriptionFilter{
+		UserID: userID,
+		Query:  strings.TrimSpace(params.Get("q")),
+		Limit:  defaultPrescriptionPageSize,
+	}
+
+	if value := params.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit <= 0 {
+			sendErrorResponse(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		filter.Limit = min(limit, maxPrescriptionPageSize)
+	}
+	if value := params.Get("offset"); value != "" {
+		offset, err := strconv.Atoi(value)
+		if err != nil || offset < 0 {
+			sendErrorResponse(w, "Invalid offset", http.StatusBadRequest)
+			return
+		}
+		filter.Offset = offset
+	}
+	if value := params.Get("chat_id"); value != "" {
+		chatID, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			sendErrorResponse(w, "Invalid chat ID", http.StatusBadRequest)
+			return
+		}
+		filter.ChatID = &chatID
+	}
+	if value := params.Get("from"); value != "" {
+		from, _, err := parseDateParam(value)
+		if err != nil {
+			sendErrorResponse(w, "Invalid from date, expected YYYY-MM-DD or RFC 3339", http.StatusBadRequest)
+			return
+		}
+		filter.From = &from
+	}
+	if value := params.Get("to"); value != "" {
+		to, dateOnly, err := parseDateParam(value)
+		if err != nil {
+			sendErrorResponse(w, "Invalid to date, expected YYYY-MM-DD or RFC 3339", http.StatusBadRequest)
+			return
+		}
+		// A plain date includes the whole day
+		if dateOnly {
+			to = to.AddDate(0, 0, 1)
+		}
+		filter.To = &to
+	}
+
+	prescriptions, total, err := h.prescriptions.ListPrescriptions(r.Context(), filter)
 	if err != nil {
-		writeErrorResponse(w, "Failed to save image", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error listing prescriptions", "error", err)
+		sendErrorResponse(w, "Error retrieving prescriptions", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(models.PrescriptionPage{
+		Prescriptions: prescriptions,
+		Total:         total,
+		Limit:         filter.Limit,
+		Offset:        filter.Offset,
+	})
+}
+
+// CreatePrescription saves a prescription and its analysis to the history
+// of the current user without running a new analysis
+func (h *PrescriptionHandler) CreatePrescription(w http.ResponseWriter, r *http.Request) {
+	// Get user ID from context
+	userID, ok := r.Context().Value("user_id").(int64)
+	if !ok {
+		sendErrorResponse(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
-	defer dst.Close()
 
-	// Copy the uploaded file to the destination file
-	_, err = io.Copy(dst, file)
+	var req models.PrescriptionCreate
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendErrorResponse(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	req.Text = strings.TrimSpace(req.Text)
+	req.Analysis = strings.TrimSpace(req.Analysis)
+	if req.Text == "" || req.Analysis == "" {
+		sendErrorResponse(w, "Text and analysis are required", http.StatusBadRequest)
+		return
+	}
+
+	title := strings.TrimSpace(req.Title)
+	if title == "" {
+		title = defaultPrescriptionTitle(req.Text)
+	}
+
+	prescription, err := h.prescriptions.CreatePrescription(r.Context(), &models.Prescription{
+		UserID:   userID,
+		Title:    title,
+		Text:     req.Text,
+		Analysis: req.Analysis,
+	})
 	if err != nil {
-		writeErrorResponse(w, "Failed to save image", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error creating prescription", "error", err)
+		sendErrorResponse(w, "Error creating prescription", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(prescription)
+}
+
+// UpdatePrescription renames a prescription of the current user
+func (h *PrescriptionHandler) UpdatePrescription(w http.ResponseWriter, r *http.Request) {
+	// Get user ID from context
+	userID, ok := r.Context().Value("user_id").(int64)
+	if !ok {
+		sendErrorResponse(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
-	// For now, return a mock analysis
-	analysis := h.analyzeImage(filePath)
+	var req models.PrescriptionUpdate
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendErrorResponse(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	req.Title = strings.TrimSpace(req.Title)
+	if req.Title == "" {
+		sendErrorResponse(w, "Title is required", http.StatusBadRequest)
+		return
+	}
+
+	prescription, err := h.prescriptions.UpdatePrescription(r.Context(), r.PathValue("id"), userID, &req)
+	if err != nil {
+		sendErrorResponse(w, "Prescription not found or unauthorized", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(prescription)
+}
+
+// GetPrescription returns a prescription of the current user
+func (h *PrescriptionHandler) GetPrescription(w http.ResponseWriter, r *http.Request) {
+	// Get user ID from context
+	userID, ok := r.Context().Value("user_id").(int64)
+	if !ok {
+		sendErrorResponse(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	prescription, err := h.prescriptions.GetPrescription(r.Context(), r.PathValue("id"), userID)
+	if err != nil {
+		sendErrorResponse(w, "Prescription not found or unauthorized", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(prescription)
+}
+
+// DeletePrescription deletes a prescription of the current user and its image
+func (h *PrescriptionHandler) DeletePrescription(w http.ResponseWriter, r *http.Request) {
+	// Get user ID from context
+	userID, ok := r.Context().Value("user_id").(int64)
+	if !ok {
+		sendErrorResponse(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	prescription, err := h.prescriptions.GetPrescription(r.Context(), r.PathValue("id"), userID)
+	if err != nil {
+		sendErrorResponse(w, "Prescription not found or unauthorized", http.StatusNotFound)
+		return
+	}
+
+	if err := h.prescriptions.DeletePrescription(r.Context(), prescription.ID, userID); err != nil {
+		slog.ErrorContext(r.Context(), "Error deleting prescription", "prescription_id", prescription.ID, "error", err)
+		sendErrorResponse(w, "Error deleting prescription", http.StatusInternalServerError)
+		return
+	}
+
+	// The record is gone either way, so a leftover image is only logged
+	if prescription.ImagePath != "" {
+		if s3Client, err := storage.NewS3Client(r.Context()); err != nil {
+			slog.ErrorContext(r.Context(), "Error initializing S3 client to delete prescription image", "path", prescription.ImagePath, "error", err)
+		} else if err := s3Client.DeleteFile(r.Context(), prescription.ImagePath); err != nil {
+			slog.ErrorContext(r.Context(), "Error deleting prescription image", "path", prescription.ImagePath, "error", err)
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// prescriptionUsageKey returns a new idempotency key for the usage of one analysis
+func prescriptionUsageKey() string {
+	return "prescription:" + uuid.New().String()
+}
+
+// saveAndRespond commits the reserved usage, stores the prescription in the
+// user's history and writes the analysis response
+func (h *PrescriptionHandler) saveAndRespond(ctx context.Context, w http.ResponseWriter, usageKey string, prescription *models.Prescription) {
+	commitAnalysis(ctx, h.plans, prescription.UserID, usageKey)
 
-	// Write the response
 	response := models.AnalysisResponse{
 		Status:   "success",
-		Analysis: analysis,
+		Analysis: prescription.Analysis,
+	}
+
+	saved, err := h.prescriptions.CreatePrescription(ctx, prescription)
+	if err != nil {
+		// The user still gets the analysis they were charged for
+		slog.Error("Error saving prescription", "user_id", prescription.UserID, "error", err)
+	} else {
+		response.PrescriptionID = saved.ID
 	}
+
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(response)
 }
 
+// uploadPrescriptionImage stores a prescription image and returns its object
+// key, or an empty string if storage is unavailable
+func uploadPrescriptionImage(ctx context.Context, imageData []byte, filename, contentType string) string {
+	s3Client, err := storage.NewS3Client(ctx)
+	if err != nil {
+		slog.Error("Error initializing S3 client, prescription image not stored", "error", err)
+		return ""
+	}
+
+	imageURL, err := s3Client.UploadFile(ctx, bytes.NewReader(imageData), filename, contentType)
+	if err != nil {
+		slog.Error("Error uploading prescription image, image not stored", "error", err)
+		return ""
+	}
+
+	// Full URL format: https://storage.c2.liara.space/darooyar/uploads/image.jpg
+	urlParts := strings.Split(imageURL, "/")
+	if len(urlParts) < 5 {
+		slog.Warn("Unexpected storage URL format")
+		return ""
+	}
+	return strings.Join(urlParts[4:], "/")
+}
+
+// saveChatPrescription records an analysis made in a chat in the user's
+// prescription history, linked to the chat and the reply message
+func (h *ChatHandler) saveChatPrescription(ctx context.Context, job *models.AIJob, messageID int64, content string) {
+	prescription := &models.Prescription{
+		UserID:    job.UserID,
+		Analysis:  stripResponseID(content),
+		ChatID:    &job.ChatID,
+		MessageID: &messageID,
+	}
+
+	switch job.Kind {
+	case models.AIJobKindImage:
+		prescription.Title = imagePrescriptionTitle
+		prescription.ImagePath = objectKeyFromURL(job.Input)
+	default:
+		prescription.Title = defaultPrescriptionTitle(job.Input)
+		prescription.Text = job.Input
+	}
+
+	if _, err := h.prescriptions.CreatePrescription(ctx, prescription); err != nil {
+		slog.Error("Error saving chat analysis to prescription history", "chat_id", job.ChatID, "error", err)
+	}
+}
+
+// stripResponseID removes the response ID comment added to chat replies
+func stripResponseID(content string) string {
+	content, _, _ = strings.Cut(content, "\n\n<!-- Response ID:")
+	return content
+}
+
+// objectKeyFromURL extracts the storage object key from a possibly pre-signed
+// URL of the form https://host/bucket/key
+func objectKeyFromURL(rawURL string) string {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(parsed.Path, "/"), "/", 2)
+	if len(parts) < 2 {
+		return ""
+	}
+	return parts[1]
+}
+
+// parseDateParam parses a date given as YYYY-MM-DD or in RFC 3339 format and
+// reports whether it was a plain date
+func parseDateParam(value string) (time.Time, bool, error) {
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return t, true, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	return t, false, err
+}
+
+// defaultPrescriptionTitle uses the start of the first line of the text as a title
+func defaultPrescriptionTitle(text string) string {
+	line := strings.TrimSpace(strings.SplitN(text, "\n", 2)[0])
+	runes := []rune(line)
+	if len(runes) > prescriptionTitleLength {
+		return fmt.Sprintf("%s…", strings.TrimSpace(string(runes[:prescriptionTitleLength])))
+	}
+	return line
+}
+
 // Helper function to write error responses
 func writeErrorResponse(w http.ResponseWriter, message string, statusCode int) {
 	response := models.ErrorResponse{
@@ -130,21 +513,3 @@ func writeErrorResponse(w http.ResponseWriter, message string, statusCode int) {
 	w.WriteHeader(statusCode)
 	json.NewEncoder(w).Encode(response)
 }
-
-// analyzeText provides a mock analysis of prescription text
-func (h *PrescriptionHandler) analyzeText(text string) string {
-	// In a real implementation, this would call an AI service or your own analysis logic
-	return "\u062A\u062D\u0644\u06CC\u0644 \u0645\u062A\u0646 \u0646\u0633\u062E\u0647: \u0627\u06CC\u0646 \u0646\u0633\u062E\u0647 \u0634\u0627\u0645\u0644 \u062F\u0627\u0631\u0648\u0647\u0627\u06CC " +
-		"\u0622\u0645\u0648\u06A9\u0633\u06CC\u0633\u06CC\u0644\u06CC\u0646 (500 \u0645\u06CC\u0644\u06CC\u06AF\u0631\u0645\u060C 3 \u0628\u0627\u0631 \u062F\u0631 \u0631\u0648\u0632)\u060C " +
-		"\u0627\u0633\u062A\u0627\u0645\u06CC\u0646\u0648\u0641\u0646 (500 \u0645\u06CC\u0644\u06CC\u06AF\u0631\u0645\u060C \u0647\u0631 6 \u0633\u0627\u0639\u062A \u062F\u0631 \u0635\u0648\u0631\u062A \u062F\u0631\u062F) " +
-		"\u0645\u06CC\u0628\u0627\u0634\u062F. \u062A\u0648\u0635\u06CC\u0647 \u0645\u06CC\u0634\u0648\u062F \u062F\u0627\u0631\u0648 \u0631\u0627 \u0628\u0627 \u063A\u0630\u0627 \u0645\u0635\u0631\u0641 \u06A9\u0646\u06CC\u062F \u0648 \u062F\u0648\u0631\u0647 \u062F\u0631\u0645\u0627\u0646 \u0631\u0627 \u06A9\u0627\u0645\u0644 \u06A9\u0646\u06CC\u062F."
-}
-
-// analyzeImage provides a mock analysis of a prescription image
-func (h *PrescriptionHandler) analyzeImage(imagePath string) string {
-	// In a real implementation, this would process the image and extract text
-	return "\u062A\u062D\u0644\u06CC\u0644 \u062A\u0635\u0648\u06CC\u0631 \u0646\u0633\u062E\u0647: \u0627\u06CC\u0646 \u0646\u0633\u062E\u0647 \u0634\u0627\u0645\u0644 \u062F\u0627\u0631\u0648\u0647\u0627\u06CC \u0622\u0646\u062A\u06CC\u0628\u06CC\u0648\u062A\u06CC\u06A9 \u0648 \u0645\u0633\u06A9\u0646 \u0627\u0633\u062A. " +
-		"\u062A\u0648\u0635\u06CC\u0647 \u0645\u06CC\u0634\u0648\u062F \u062F\u0627\u0631\u0648 \u0631\u0627 \u0637\u0628\u0642 \u062F\u0633\u062A\u0648\u0631 \u067E\u0632\u0634\u06A9 \u0645\u0635\u0631\u0641 \u06A9\u0646\u06CC\u062F. " +
-		"\u062F\u0627\u0631\u0648\u0647\u0627\u06CC \u062A\u062C\u0648\u06CC\u0632 \u0634\u062F\u0647: \u0622\u0632\u06CC\u062A\u0631\u0648\u0645\u0627\u06CC\u0633\u06CC\u0646 (250 \u0645\u06CC\u0644\u06CC\u06AF\u0631\u0645\u060C \u0631\u0648\u0632\u06CC \u06CC\u06A9 \u0639\u062F\u062F)\u060C " +
-		"\u0627\u06CC\u0628\u0648\u067E\u0631\u0648\u0641\u0646 (400 \u0645\u06CC\u0644\u06CC\u06AF\u0631\u0645\u060C \u0647\u0631 8 \u0633\u0627\u0639\u062A \u062F\u0631 \u0635\u0648\u0631\u062A \u062F\u0631\u062F)."
-}
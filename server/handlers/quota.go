@@ -0,0 +1,71 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/darooyar/server/db"
+)
+
+// quotaExhaustedCode identifies the error returned when the user has no uses left
+const quotaExhaustedCode = "quota_exhausted"
+
+// reserveAnalysis reserves one use of the user's subscription for an analysis
+// identified by the idempotency key. When the user has no uses left it writes
+// a 402 response and returns false.
+func reserveAnalysis(ctx context.Context, w http.ResponseWriter, plans db.PlanStore, userID int64, idempotencyKey string) bool {
+	subscriptionID, err := plans.ReserveUsage(ctx, userID, 1, idempotencyKey)
+	if errors.Is(err, db.ErrNoActiveSubscription) {
+		slog.Info("User has no subscription uses left", "user_id", userID)
+		writeQuotaExhaustedResponse(w)
+		return false
+	}
+	if err != nil {
+		slog.Error("Error reserving subscription usage", "user_id", userID, "error", err)
+		sendErrorResponse(w, "Error checking subscription", http.StatusInternalServerError)
+		return false
+	}
+
+	slog.Info("Reserved subscription usage", "key", idempotencyKey, "user_id", userID, "subscription_id", subscriptionID)
+	return true
+}
+
+// commitAnalysis charges the reserved use once the analysis succeeded
+func commitAnalysis(ctx context.Context, plans db.PlanStore, userID int64, idempotencyKey string) {
+	err := plans.CommitUsage(ctx, idempotencyKey)
+	if errors.Is(err, db.ErrUsageNotFound) {
+		// Analyses queued before reservations existed are charged afterwards
+		err = updateSubscriptionUsage(ctx, plans, userID, idempotencyKey)
+	}
+	if err != nil {
+		slog.Error("Error committing subscription usage", "key", idempotencyKey, "error", err)
+	}
+}
+
+// releaseAnalysis gives the reserved use back after the analysis failed. It
+// runs even when ctx is already canceled, so that a client hanging up never
+// leaves the user charged for an analysis they did not get.
+func releaseAnalysis(ctx context.Context, plans db.PlanStore, idempotencyKey string) {
+	err := plans.ReleaseUsage(context.WithoutCancel(ctx), idempotencyKey)
+	if err != nil && !errors.Is(err, db.ErrUsageNotFound) {
+		slog.Error("Error releasing subscription usage", "key", idempotencyKey, "error", err)
+	}
+}
+
+// writeQuotaExhaustedResponse tells the client that the user has to buy a plan
+// before analyzing more prescriptions
+func writeQuotaExhaustedResponse(w http.ResponseWriter) {
+	response := map[string]interface{}{
+		"status":    "error",
+		"code":      quotaExhaustedCode,
+		"message":   "اعتبار اشتراک شما به پایان رسیده است. لطفا برای ادامه یک طرح خریداری کنید.",
+		"plans_url": "/api/plans",
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusPaymentRequired)
+	json.NewEncoder(w).Encode(response)
+}
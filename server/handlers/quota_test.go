@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/darooyar/server/db/memory"
+	"github.com/darooyar/server/models"
+)
+
+func TestChatMessageReservesAnalysis(t *testing.T) {
+	const prescription = "نسخه: قرص استامینوفن ۵۰۰ هر ۸ ساعت"
+
+	tests := []struct {
+		name          string
+		content       string
+		maxUses       int // Uses of the user's plan, or 0 for no subscription
+		wantStatus    int
+		wantRemaining int
+	}{
+		{name: "prescription without subscription", content: prescription, wantStatus: http.StatusPaymentRequired},
+		{name: "prescription with subscription", content: prescription, maxUses: 2, wantStatus: http.StatusOK, wantRemaining: 1},
+		{name: "prescription with last use", content: prescription, maxUses: 1, wantStatus: http.StatusOK, wantRemaining: 0},
+		{name: "question with subscription", content: "سردرد دارم چه کنم؟", maxUses: 2, wantStatus: http.StatusOK, wantRemaining: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			store := memory.New()
+			user := createTestUser(t, store, "user@example.com")
+			h := newTestChatHandler(t, store)
+
+			if tt.maxUses > 0 {
+				maxUses := tt.maxUses
+				plan, err := store.CreatePlan(ctx, &models.PlanCreate{Title: "trial", MaxUses: &maxUses, PlanType: models.PlanTypeUsageBased})
+				if err != nil {
+					t.Fatalf("creating plan: %v", err)
+				}
+				if _, err := store.CreateUserSubscription(ctx, user.ID, plan.ID, nil); err != nil {
+					t.Fatalf("subscribing: %v", err)
+				}
+			}
+
+			chat, err := store.CreateChat(ctx, &models.ChatCreate{Title: "chat"}, user.ID)
+			if err != nil {
+				t.Fatalf("creating chat: %v", err)
+			}
+
+			target := fmt.Sprintf("/api/chats/%d/messages", chat.ID)
+			rec := serve(t, "POST /api/chats/{id}/messages", h.CreateChatMessage, http.MethodPost, target, user.ID,
+				map[string]string{"role": "user", "content": tt.content})
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+
+			if tt.wantStatus == http.StatusPaymentRequired {
+				var resp map[string]interface{}
+				decode(t, rec, &resp)
+				if resp["code"] != quotaExhaustedCode {
+					t.Errorf("code = %v, want %s", resp["code"], quotaExhaustedCode)
+				}
+				messages, _ := store.GetChatMessages(ctx, chat.ID)
+				if len(messages) != 0 {
+					t.Errorf("saved %d messages without a subscription", len(messages))
+				}
+				return
+			}
+
+			jobID := rec.Header().Get("X-Job-ID")
+			if jobID == "" {
+				t.Fatal("no AI reply was queued")
+			}
+			if job := waitForJob(t, store, jobID); job.Status != models.AIJobStatusSucceeded {
+				t.Fatalf("job status = %s", job.Status)
+			}
+
+			// A successful reply keeps the reserved use
+			subs, err := store.GetUserSubscriptions(ctx, user.ID)
+			if err != nil {
+				t.Fatalf("getting subscriptions: %v", err)
+			}
+			if len(subs) != 1 || subs[0].RemainingUses == nil {
+				t.Fatalf("subscriptions = %+v, want one with remaining uses", subs)
+			}
+			sub := subs[0]
+			if *sub.RemainingUses != tt.wantRemaining {
+				t.Errorf("remaining uses = %d, want %d", *sub.RemainingUses, tt.wantRemaining)
+			}
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/darooyar/server/db"
+	"github.com/darooyar/server/models"
+)
+
+// RoleHandler handles role and permission management endpoints
+type RoleHandler struct {
+	users db.UserStore
+	roles db.RoleStore
+}
+
+// NewRoleHandler creates a new role handler
+func NewRoleHandler(users db.UserStore, roles db.RoleStore) *RoleHandler {
+	return &RoleHandler{
+		users: users,
+		roles: roles,
+	}
+}
+
+// GetRoles returns every role with its permissions (requires roles:read)
+func (h *RoleHandler) GetRoles(w http.ResponseWriter, r *http.Request) {
+	roles, err := h.roles.GetRoles(r.Context())
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error getting roles", "error", err)
+		sendErrorResponse(w, "Error retrieving roles", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"roles": roles,
+	})
+}
+
+// GetUserRoles returns the roles and permissions of a user (requires roles:read)
+func (h *RoleHandler) GetUserRoles(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		sendErrorResponse(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	user, err := h.users.GetUserByID(r.Context(), userID)
+	if err != nil {
+		sendErrorResponse(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	writeUserRoles(w, user)
+}
+
+// GrantUserRole gives a user a role (requires roles:write)
+func (h *RoleHandler) GrantUserRole(w http.ResponseWriter, r *http.Request) {
+	actorID, ok := r.Context().Value("user_id").(int64)
+	if !ok {
+		sendErrorResponse(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	userID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		sendErrorResponse(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	var req models.UserRoleGrant
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendErrorResponse(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	role := strings.TrimSpace(req.Role)
+	if role == "" {
+		sendErrorResponse(w, "Role is required", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := h.users.GetUserByID(r.Context(), userID); err != nil {
+		sendErrorResponse(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	if err := h.roles.GrantUserRole(r.Context(), userID, role, actorID); err != nil {
+		slog.ErrorContext(r.Context(), "Error granting role", "role", role, "user_id", userID, "error", err)
+		sendErrorResponse(w, "Error granting role: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	slog.InfoContext(r.Context(), "User granted role", "actor_id", actorID, "role", role, "user_id", userID)
+
+	h.GetUserRoles(w, r)
+}
+
+// RevokeUserRole takes a role away from a user (requires roles:write)
+func (h *RoleHandler) RevokeUserRole(w http.ResponseWriter, r *http.Request) {
+	actorID, ok := r.Context().Value("user_id").(int64)
+	if !ok {
+		sendErrorResponse(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	userID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		sendErrorResponse(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	role := r.PathValue("role")
+	if userID == actorID && role == models.RoleAdmin {
+		sendErrorResponse(w, "Admins cannot revoke their own admin role", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.roles.RevokeUserRole(r.Context(), userID, role); err != nil {
+		sendErrorResponse(w, "User role not found", http.StatusNotFound)
+		return
+	}
+	slog.InfoContext(r.Context(), "User revoked role", "actor_id", actorID, "role", role, "user_id", userID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeUserRoles writes the roles and permissions of a user
+func writeUserRoles(w http.ResponseWriter, user *models.User) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"user_id":     user.ID,
+		"roles":       user.Roles,
+		"permissions": user.Permissions,
+	})
+}
@@ -0,0 +1,431 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/darooyar/server/nats"
+	"github.com/google/uuid"
+)
+
+// Server-Sent Events emitted on a chat stream
+const (
+	streamEventStart = "start"
+	streamEventDelta = "delta"
+	streamEventDone  = "done"
+)
+
+// Status values carried by the done event
+const (
+	streamStatusCompleted = "completed"
+	streamStatusFailed    = "failed"
+)
+
+const (
+	// streamBufferSize is how many events a subscriber may fall behind before it is dropped
+	streamBufferSize = 256
+	// streamKeepAliveInterval keeps proxies from closing idle connections
+	streamKeepAliveInterval = 15 * time.Second
+	// streamIdleTimeout closes streams that never see an analysis start
+	streamIdleTimeout = 5 * time.Minute
+)
+
+// streamEvent is a single event delivered to stream subscribers
+type streamEvent struct {
+	Name string
+	Data map[string]interface{}
+}
+
+// chatStream holds the subscribers and the in-flight analysis of one chat
+type chatStream struct {
+	subscribers map[chan streamEvent]struct{}
+	active      bool
+	requestID   string
+	content     strings.Builder
+}
+
+// chatStreamHub fans out AI analysis events to every client watching a chat.
+// With a relay, the events are shared with the other servers, since the AI
+// job of a chat may run on another server than the one its client is
+// connected to.
+type chatStreamHub struct {
+	mu    sync.Mutex
+	chats map[int64]*chatStream
+	// closing is closed when the server shuts down
+	closing   chan struct{}
+	closeOnce sync.Once
+	// origin identifies this server in relayed events, so that it skips its own
+	origin string
+	// relay sends an event to every server, when set
+	relay func(chatID int64, data []byte) error
+}
+
+// relayedStreamEvent is a stream event as sent between servers
+type relayedStreamEvent struct {
+	Origin string                 `json:"origin"`
+	ChatID int64                  `json:"chat_id"`
+	Name   string                 `json:"name"`
+	Data   map[string]interface{} `json:"data"`
+}
+
+// newChatStreamHub creates an empty hub
+func newChatStreamHub() *chatStreamHub {
+	return &chatStreamHub{
+		chats:   make(map[int64]*chatStream),
+		closing: make(chan struct{}),
+		origin:  uuid.New().String(),
+	}
+}
+
+// close ends every open stream
+func (h *chatStreamHub) close() {
+	h.closeOnce.Do(func() { close(h.closing) })
+}
+
+// setRelay shares the events of this server with the others through relay
+func (h *chatStreamHub) setRelay(relay func(chatID int64, data []byte) error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.relay = relay
+}
+
+// receive delivers an event relayed by another server to the subscribers on
+// this one. Events this server relayed itself were delivered already.
+func (h *chatStreamHub) receive(data []byte) {
+	var relayed relayedStreamEvent
+	if err := json.Unmarshal(data, &relayed); err != nil {
+		slog.Error("Error decoding relayed stream event", "error", err)
+		return
+	}
+	if relayed.Origin == h.origin {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.applyLocked(relayed.ChatID, streamEvent{Name: relayed.Name, Data: relayed.Data})
+}
+
+// subscribe registers a new subscriber for the chat. If an analysis is already
+// in flight, the subscriber first receives a start event and the content
+// generated so far so it can catch up.
+func (h *chatStreamHub) subscribe(chatID int64) (<-chan streamEvent, func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	stream := h.streamLocked(chatID)
+	ch := make(chan streamEvent, streamBufferSize)
+	stream.subscribers[ch] = struct{}{}
+
+	if stream.active {
+		ch <- streamEvent{Name: streamEventStart, Data: map[string]interface{}{"request_id": stream.requestID}}
+		if stream.content.Len() > 0 {
+			ch <- streamEvent{Name: streamEventDelta, Data: map[string]interface{}{
+				"request_id": stream.requestID,
+				"content":    stream.content.String(),
+			}}
+		}
+	}
+
+	unsubscribe := func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		h.removeLocked(chatID, ch)
+	}
+
+	return ch, unsubscribe
+}
+
+// start marks the beginning of an analysis for the chat
+func (h *chatStreamHub) start(chatID int64, requestID string) {
+	h.emit(chatID, streamEvent{Name: streamEventStart, Data: map[string]interface{}{"request_id": requestID}})
+}
+
+// delta forwards a chunk of generated content to the chat's subscribers
+func (h *chatStreamHub) delta(chatID int64, requestID string, content string) {
+	h.emit(chatID, streamEvent{Name: streamEventDelta, Data: map[string]interface{}{
+		"request_id": requestID,
+		"content":    content,
+	}})
+}
+
+// done ends the analysis and tells subscribers which message was persisted
+func (h *chatStreamHub) done(chatID int64, requestID string, messageID int64, content string, status string) {
+	h.emit(chatID, streamEvent{Name: streamEventDone, Data: map[string]interface{}{
+		"request_id": requestID,
+		"message_id": messageID,
+		"content":    content,
+		"status":     status,
+	}})
+}
+
+// emit delivers an event of an analysis running on this server to the local
+// subscribers and relays it to the other servers
+func (h *chatStreamHub) emit(chatID int64, event streamEvent) {
+	h.mu.Lock()
+	h.applyLocked(chatID, event)
+	relay := h.relay
+	h.mu.Unlock()
+
+	if relay == nil {
+		return
+	}
+	data, err := json.Marshal(relayedStreamEvent{Origin: h.origin, ChatID: chatID, Name: event.Name, Data: event.Data})
+	if err == nil {
+		err = relay(chatID, data)
+	}
+	if err != nil {
+		slog.Error("Error relaying stream event", "chat_id", chatID, "event", event.Name, "error", err)
+	}
+}
+
+// applyLocked updates the in-flight analysis of the chat with an event and
+// sends the event to its subscribers
+func (h *chatStreamHub) applyLocked(chatID int64, event streamEvent) {
+	requestID, _ := event.Data["request_id"].(string)
+
+	switch event.Name {
+	case streamEventStart:
+		stream := h.streamLocked(chatID)
+		stream.active = true
+		stream.requestID = requestID
+		stream.content.Reset()
+
+	case streamEventDelta:
+		stream := h.chats[chatID]
+		if stream == nil || !stream.active || stream.requestID != requestID {
+			return
+		}
+		content, _ := event.Data["content"].(string)
+		stream.content.WriteString(content)
+
+	case streamEventDone:
+		stream := h.chats[chatID]
+		if stream == nil {
+			return
+		}
+		stream.active = false
+		stream.requestID = ""
+		stream.content.Reset()
+
+	default:
+		return
+	}
+
+	h.broadcastLocked(chatID, event)
+
+	if stream := h.chats[chatID]; stream != nil && !stream.active && len(stream.subscribers) == 0 {
+		delete(h.chats, chatID)
+	}
+}
+
+// streamLocked returns the stream of a chat, creating it if needed
+func (h *chatStreamHub) streamLocked(chatID int64) *chatStream {
+	stream := h.chats[chatID]
+	if stream == nil {
+		stream = &chatStream{subscribers: make(map[chan streamEvent]struct{})}
+		h.chats[chatID] = stream
+	}
+	return stream
+}
+
+// broadcastLocked sends the event to every subscriber without blocking.
+// Subscribers that cannot keep up are dropped; they can reconnect and catch up.
+func (h *chatStreamHub) broadcastLocked(chatID int64, event streamEvent) {
+	stream := h.chats[chatID]
+	for ch := range stream.subscribers {
+		select {
+		case ch <- event:
+		default:
+			slog.Warn("Dropping slow stream subscriber", "chat_id", chatID)
+			h.removeLocked(chatID, ch)
+		}
+	}
+}
+
+// removeLocked unregisters and closes a subscriber channel
+func (h *chatStreamHub) removeLocked(chatID int64, ch chan streamEvent) {
+	stream := h.chats[chatID]
+	if stream == nil {
+		return
+	}
+
+	if _, ok := stream.subscribers[ch]; !ok {
+		return
+	}
+	delete(stream.subscribers, ch)
+	close(ch)
+
+	if len(stream.subscribers) == 0 && !stream.active {
+		delete(h.chats, chatID)
+	}
+}
+
+// StreamChat streams AI analysis of a chat to the client as Server-Sent Events.
+// The stream emits a start event when an analysis begins, delta events with
+// generated content and a done event carrying the persisted message ID, after
+// which it is closed. Clients that may have missed the analysis can pass the ID
+// of their last message as ?since= to receive a done event for a reply that
+// was already saved.
+func (h *ChatHandler) StreamChat(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Get user ID from context
+	userID, ok := r.Context().Value("user_id").(int64)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// Get chat ID from URL
+	chatIDStr := r.PathValue("id")
+	chatID, err := strconv.ParseInt(chatIDStr, 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid chat ID", http.StatusBadRequest)
+		return
+	}
+
+	var sinceID int64
+	if since := r.URL.Query().Get("since"); since != "" {
+		sinceID, err = strconv.ParseInt(since, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid since message ID", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Verify chat ownership
+	_, err = h.chats.GetChat(r.Context(), chatID, userID)
+	if err != nil {
+		http.Error(w, "Chat not found or unauthorized", http.StatusNotFound)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	// The server write timeout would cut long analyses short
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil {
+		slog.ErrorContext(r.Context(), "Could not clear write deadline for chat stream", "error", err)
+	}
+
+	events, unsubscribe := h.streams.subscribe(chatID)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+
+	// A reply may already have been saved before the client subscribed
+	if sinceID > 0 {
+		if event, ok := h.savedReplyEvent(r.Context(), chatID, sinceID); ok {
+			writeStreamEvent(w, event)
+			flusher.Flush()
+			return
+		}
+	}
+
+	keepAlive := time.NewTicker(streamKeepAliveInterval)
+	defer keepAlive.Stop()
+	idle := time.NewTimer(streamIdleTimeout)
+	defer idle.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-h.streams.closing:
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case <-idle.C:
+			slog.InfoContext(r.Context(), "Closing idle stream", "chat_id", chatID)
+			return
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			if err := writeStreamEvent(w, event); err != nil {
+				slog.ErrorContext(r.Context(), "Error writing stream event", "chat_id", chatID, "error", err)
+				return
+			}
+			flusher.Flush()
+
+			if event.Name == streamEventDone {
+				return
+			}
+			idle.Reset(streamIdleTimeout)
+		}
+	}
+}
+
+// RelayStreams shares the chat stream events of this server with the others
+// through NATS, so that clients receive a reply as it is generated whichever
+// server runs its AI job
+func (h *ChatHandler) RelayStreams() error {
+	if _, err := nats.SubscribeChatStreams(h.streams.receive); err != nil {
+		return err
+	}
+	h.streams.setRelay(nats.PublishChatStreamEvent)
+	return nil
+}
+
+// CloseStreams ends every chat stream, so that open streams do not hold up a
+// server shutdown. Clients reconnect with ?since= to receive the reply.
+func (h *ChatHandler) CloseStreams() {
+	h.streams.close()
+}
+
+// savedReplyEvent builds a done event for an assistant reply newer than sinceID
+func (h *ChatHandler) savedReplyEvent(ctx context.Context, chatID int64, sinceID int64) (streamEvent, bool) {
+	messages, err := h.chats.GetChatMessages(ctx, chatID)
+	if err != nil {
+		slog.Error("Error checking saved replies of chat", "chat_id", chatID, "error", err)
+		return streamEvent{}, false
+	}
+
+	for i := len(messages) - 1; i >= 0; i-- {
+		msg := messages[i]
+		if msg.ID <= sinceID {
+			break
+		}
+		if msg.Role == "assistant" {
+			return streamEvent{Name: streamEventDone, Data: map[string]interface{}{
+				"message_id": msg.ID,
+				"content":    msg.Content,
+				"status":     streamStatusCompleted,
+			}}, true
+		}
+	}
+
+	return streamEvent{}, false
+}
+
+// writeStreamEvent writes a single event in Server-Sent Events format
+func writeStreamEvent(w http.ResponseWriter, event streamEvent) error {
+	data, err := json.Marshal(event.Data)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Name, data)
+	return err
+}
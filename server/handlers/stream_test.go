@@ -0,0 +1,95 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+)
+
+// linkHubs relays the events of each hub to every hub, itself included, the
+// way NATS delivers a server's own events back to it
+func linkHubs(hubs ...*chatStreamHub) {
+	for _, hub := range hubs {
+		hub.setRelay(func(chatID int64, data []byte) error {
+			for _, other := range hubs {
+				other.receive(data)
+			}
+			return nil
+		})
+	}
+}
+
+// nextEvent waits for the next event of a subscription
+func nextEvent(t *testing.T, events <-chan streamEvent) streamEvent {
+	t.Helper()
+
+	select {
+	case event, ok := <-events:
+		if !ok {
+			t.Fatal("stream closed")
+		}
+		return event
+	case <-time.After(time.Second):
+		t.Fatal("no stream event")
+	}
+	return streamEvent{}
+}
+
+func TestChatStreamRelaysEventsBetweenServers(t *testing.T) {
+	worker, other := newChatStreamHub(), newChatStreamHub()
+	linkHubs(worker, other)
+
+	// One client watches the chat on the server running its job, and one on another server
+	local, unsubscribeLocal := worker.subscribe(1)
+	defer unsubscribeLocal()
+	remote, unsubscribeRemote := other.subscribe(1)
+	defer unsubscribeRemote()
+
+	worker.start(1, "job")
+	worker.delta(1, "job", "سلام")
+	worker.done(1, "job", 7, "سلام", streamStatusCompleted)
+
+	for name, events := range map[string]<-chan streamEvent{"local": local, "remote": remote} {
+		t.Run(name, func(t *testing.T) {
+			want := []string{streamEventStart, streamEventDelta, streamEventDone}
+			for _, wantName := range want {
+				event := nextEvent(t, events)
+				if event.Name != wantName {
+					t.Fatalf("event = %s, want %s", event.Name, wantName)
+				}
+				if event.Data["request_id"] != "job" {
+					t.Errorf("request ID = %v, want job", event.Data["request_id"])
+				}
+			}
+
+			// The server's own events are not delivered twice
+			select {
+			case event, ok := <-events:
+				if ok {
+					t.Errorf("unexpected event %s", event.Name)
+				}
+			default:
+			}
+		})
+	}
+}
+
+func TestChatStreamCatchesUpOnRelayedAnalysis(t *testing.T) {
+	worker, other := newChatStreamHub(), newChatStreamHub()
+	linkHubs(worker, other)
+
+	worker.start(1, "job")
+	worker.delta(1, "job", "first ")
+	worker.delta(1, "job", "second")
+
+	// A client joining another server mid-analysis gets the content so far
+	events, unsubscribe := other.subscribe(1)
+	defer unsubscribe()
+
+	if event := nextEvent(t, events); event.Name != streamEventStart {
+		t.Fatalf("event = %s, want start", event.Name)
+	}
+	event := nextEvent(t, events)
+	if event.Name != streamEventDelta || event.Data["content"] != "first second" {
+		t.Fatalf("event = %s %v, want the content so far", event.Name, event.Data["content"])
+	}
+}
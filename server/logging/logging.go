@@ -0,0 +1,95 @@
+// Package logging sets up structured logging with log/slog. Records written
+// with the context of a request carry its request ID, and attributes that may
+// hold patient data or AI output are redacted.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"unicode/utf8"
+
+	"github.com/darooyar/server/config"
+)
+
+// requestIDKey is the context key of the request ID
+type requestIDKey struct{}
+
+// redactedKeys are the attributes whose string values are replaced by their
+// length, so that prescriptions, messages and analyses never reach the logs
+var redactedKeys = map[string]bool{
+	"content":    true,
+	"prompt":     true,
+	"text":       true,
+	"completion": true,
+	"analysis":   true,
+}
+
+// Setup makes a JSON or text logger the default of log/slog. Calls to the log
+// package are written through it as well.
+func Setup(cfg *config.Config) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(cfg.LogLevel)); err != nil {
+		level = slog.LevelInfo
+	}
+
+	opts := &slog.HandlerOptions{
+		Level:       level,
+		ReplaceAttr: redact,
+	}
+
+	var handler slog.Handler
+	if cfg.LogFormat == "text" {
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	} else {
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	}
+
+	slog.SetDefault(slog.New(contextHandler{handler}))
+}
+
+// WithRequestID returns a copy of ctx carrying the request ID
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, requestID)
+}
+
+// RequestID returns the request ID carried by ctx, or "" if there is none
+func RequestID(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	requestID, _ := ctx.Value(requestIDKey{}).(string)
+	return requestID
+}
+
+// redact replaces the values of content attributes by their length
+func redact(groups []string, a slog.Attr) slog.Attr {
+	if !redactedKeys[a.Key] || a.Value.Kind() != slog.KindString {
+		return a
+	}
+	return slog.String(a.Key, fmt.Sprintf("[redacted %d characters]", utf8.RuneCountInString(a.Value.String())))
+}
+
+// contextHandler adds the request ID of the context to every record
+type contextHandler struct {
+	slog.Handler
+}
+
+// Handle adds the request ID and passes the record on
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if requestID := RequestID(ctx); requestID != "" {
+		r.AddAttrs(slog.String("request_id", requestID))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+// WithAttrs keeps adding request IDs to the handler with the attributes
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+// WithGroup keeps adding request IDs to the handler of the group
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
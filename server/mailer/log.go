@@ -0,0 +1,67 @@
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// LogSender keeps emails on the machine instead of sending them. It is meant
+// for local development and testing. With a directory, each email is written
+// there as an .eml file; without one, it is written to the server log.
+type LogSender struct {
+	dir  string
+	from string
+}
+
+// NewLogSender creates a sender that writes emails to the directory, or to the log when dir is empty
+func NewLogSender(dir, from string) *LogSender {
+	if from == "" {
+		from = "darooyar@localhost"
+	}
+
+	return &LogSender{
+		dir:  dir,
+		from: from,
+	}
+}
+
+// Name identifies the sender in logs
+func (s *LogSender) Name() string {
+	return "log"
+}
+
+// Send writes the message to a file or to the log
+func (s *LogSender) Send(ctx context.Context, msg Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if s.dir == "" {
+		slog.InfoContext(ctx, "Email", "to", msg.To, "subject", msg.Subject, "body", msg.Body)
+		return nil
+	}
+
+	data, err := msg.encode(s.from)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(s.dir, 0o755); err != nil {
+		return err
+	}
+
+	recipient := strings.NewReplacer("@", "_at_", "/", "_", "\\", "_").Replace(msg.To)
+	name := fmt.Sprintf("%s-%s.eml", time.Now().Format("20060102-150405.000000000"), recipient)
+	path := filepath.Join(s.dir, name)
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		return err
+	}
+
+	slog.InfoContext(ctx, "Email written to file", "to", msg.To, "path", path)
+	return nil
+}
@@ -0,0 +1,71 @@
+// Package mailer sends the emails with which users verify their address and
+// reset their password.
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"time"
+
+	"github.com/darooyar/server/config"
+)
+
+// ErrNotConfigured is returned when the selected sender is missing required settings
+var ErrNotConfigured = errors.New("mail sender not configured")
+
+// Message is a plain-text email to a single recipient
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Sender is implemented by every way the server can send email
+type Sender interface {
+	// Name identifies the sender in logs
+	Name() string
+	// Send delivers the message
+	Send(ctx context.Context, msg Message) error
+}
+
+// NewSender creates the sender selected in the configuration
+func NewSender(cfg *config.Config) (Sender, error) {
+	switch cfg.MailProvider {
+	case "", "smtp":
+		if cfg.SMTPHost == "" || cfg.MailFrom == "" {
+			return nil, fmt.Errorf("%w: SMTP_HOST and MAIL_FROM must be set", ErrNotConfigured)
+		}
+		return NewSMTPSender(cfg.SMTPHost, cfg.SMTPPort, cfg.SMTPUsername, cfg.SMTPPassword, cfg.MailFrom), nil
+	case "log":
+		return NewLogSender(cfg.MailDir, cfg.MailFrom), nil
+	default:
+		return nil, fmt.Errorf("unknown mail provider %q", cfg.MailProvider)
+	}
+}
+
+// encode formats the message as a MIME email from the sender address. The
+// subject and body are UTF-8, so Persian text survives every mail server.
+func (m Message) encode(from string) ([]byte, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", from)
+	fmt.Fprintf(&buf, "To: %s\r\n", m.To)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.BEncoding.Encode("UTF-8", m.Subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	buf.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+
+	body := quotedprintable.NewWriter(&buf)
+	if _, err := body.Write([]byte(m.Body)); err != nil {
+		return nil, err
+	}
+	if err := body.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
@@ -1,17 +1,33 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"log"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
+	"github.com/darooyar/server/ai"
 	"github.com/darooyar/server/config"
 	"github.com/darooyar/server/db"
 	"github.com/darooyar/server/db/migrations"
+	"github.com/darooyar/server/druginteractions"
+	"github.com/darooyar/server/formulary"
 	"github.com/darooyar/server/handlers"
+	"github.com/darooyar/server/logging"
+	"github.com/darooyar/server/mailer"
+	"github.com/darooyar/server/metrics"
 	"github.com/darooyar/server/middleware"
+	"github.com/darooyar/server/models"
 	"github.com/darooyar/server/nats"
+	"github.com/darooyar/server/payments"
+	"github.com/darooyar/server/ratelimit"
+	"github.com/darooyar/server/sms"
 	"github.com/joho/godotenv"
 )
 
@@ -24,56 +40,122 @@ func main() {
 	// Get configuration
 	cfg := config.GetConfig()
 
+	// Log structured records from here on
+	logging.Setup(cfg)
+
+	// Background work such as AI jobs runs until the server stops, or until the
+	// shutdown deadline passes
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+
 	// Initialize database
-	if err := db.InitDB(cfg); err != nil {
-		log.Fatalf("Failed to initialize database: %v", err)
+	if err := db.InitDB(ctx, cfg); err != nil {
+		fatal("Failed to initialize database", err)
 	}
 	defer db.CloseDB()
+	metrics.RegisterDB(db.DB)
+
+	// Apply the migrations this server's schema needs
+	if err := migrations.Up(ctx); err != nil {
+		fatal("Failed to migrate database", err)
+	}
 
-	// Run database migrations
-	if err := migrations.RunMigrations(); err != nil {
-		log.Fatalf("Failed to run SQL file database migrations: %v", err)
+	// Initialize AI provider
+	aiProvider, err := ai.NewProvider(cfg)
+	if err != nil {
+		slog.Warn("Failed to initialize AI provider. The server will continue without AI support. AI requests will fail until it is configured.", "error", err)
 	}
 
-	// Run SQL migrations
-	if err := migrations.RunSQLMigrations(); err != nil {
-		log.Fatalf("Failed to run SQL migrations: %v", err)
+	// Initialize payment gateway
+	paymentGateway, err := payments.NewGateway(cfg)
+	if err != nil {
+		slog.Warn("Failed to initialize payment gateway. The server will continue without online payments. Top-ups will fail until it is configured.", "error", err)
 	}
 
-	// Run in-memory migrations
-	if err := migrations.RunInMemoryMigrations(); err != nil {
-		log.Fatalf("Failed to run in-memory database migrations: %v", err)
+	// Initialize SMS sender
+	smsSender, err := sms.NewSender(cfg)
+	if err != nil {
+		slog.Warn("Failed to initialize SMS sender. The server will continue without phone login. OTP requests will fail until it is configured.", "error", err)
+	}
+
+	// Initialize mail sender
+	mailSender, err := mailer.NewSender(cfg)
+	if err != nil {
+		slog.Warn("Failed to initialize mail sender. The server will continue without email. Verification and password reset emails will not be sent.", "error", err)
 	}
 
 	// Initialize NATS
 	if err := nats.InitNATS(); err != nil {
-		log.Printf("Warning: Failed to initialize NATS: %v", err)
-		log.Println("The server will continue without NATS support. AI requests will be processed synchronously.")
+		slog.Warn("Failed to initialize NATS. The server will continue without NATS support. AI requests will be processed synchronously.", "error", err)
 	} else {
 		defer nats.CloseNATS()
 
 		// Initialize AI service for NATS
-		aiService, err := nats.NewAIService()
+		aiService, err := nats.NewAIService(ctx, aiProvider)
 		if err != nil {
-			log.Printf("Warning: Failed to initialize AI service for NATS: %v", err)
-			log.Println("The server will continue without NATS AI service. AI requests will be processed synchronously.")
+			slog.Warn("Failed to initialize AI service for NATS. The server will continue without NATS AI service. AI requests will be processed synchronously.", "error", err)
 		} else {
-			log.Println("AI service initialized for NATS")
+			slog.Info("AI service initialized for NATS")
 			_ = aiService // Use the service to avoid unused variable warning
 		}
 	}
 
+	// Initialize rate limit store
+	rateLimitStore, err := ratelimit.NewStore(cfg, nats.NatsConn)
+	if err != nil {
+		slog.Warn("Failed to initialize rate limit store. The server will continue with in-memory rate limits, counted separately by each replica.", "store", cfg.RateLimitStore, "error", err)
+		rateLimitStore = ratelimit.NewMemoryStore()
+	}
+	limiter := ratelimit.NewLimiter(rateLimitStore)
+
+	// Only the proxies in front of the server may say who the client is
+	if err := middleware.SetTrustedProxies(strings.Split(cfg.TrustedProxies, ",")); err != nil {
+		fatal("Invalid trusted proxies", err)
+	}
+
 	// Create a new ServeMux (router)
 	mux := http.NewServeMux()
 
-	// Initialize handlers
-	prescriptionHandler := handlers.NewPrescriptionHandler()
-	aiHandler := handlers.NewAIHandler()
-	authHandler := handlers.NewAuthHandler()
-	chatHandler := handlers.NewChatHandler()
-	folderHandler := handlers.NewFolderHandler()
-	creditHandler := handlers.NewCreditHandler()
-	giftHandler := handlers.NewGiftHandler()
+	// Initialize handlers, all backed by the Postgres stores
+	store := db.Postgres{}
+	aiRateLimit := middleware.RateLimitAI(limiter, store)
+	requireVerified := middleware.RequireVerified(store)
+	catalog := formulary.Postgres{}
+	interactions := druginteractions.Postgres{}
+	prescriptionHandler := handlers.NewPrescriptionHandler(aiProvider, store, store)
+	aiHandler := handlers.NewAIHandler(aiProvider)
+	authHandler := handlers.NewAuthHandler(store, store, store, mailSender, cfg)
+	chatHandler := handlers.NewChatHandler(ctx, aiProvider, store, store, store, store, catalog, interactions)
+	folderHandler := handlers.NewFolderHandler(store)
+	creditHandler := handlers.NewCreditHandler(store, store)
+	giftHandler := handlers.NewGiftHandler(store, store, store)
+	planHandler := handlers.NewPlanHandler(store, store, store)
+	jobHandler := handlers.NewJobHandler(store, store)
+	interactionHandler := handlers.NewInteractionHandler(interactions)
+	drugHandler := handlers.NewDrugHandler(catalog)
+	paymentHandler := handlers.NewPaymentHandler(paymentGateway, store, store, cfg)
+	roleHandler := handlers.NewRoleHandler(store, store)
+	otpHandler := handlers.NewOTPHandler(store, store, store, smsSender)
+	pharmacyHandler := handlers.NewPharmacyHandler(store, store)
+
+	// Start the durable AI job worker. Without JetStream, jobs run in-process.
+	// Stream events are relayed between servers, since a job may run on
+	// another server than the one its client is connected to.
+	if nats.NatsConn != nil {
+		if err := chatHandler.RelayStreams(); err != nil {
+			slog.Warn("Failed to relay chat streams through NATS. Clients only see replies generated on the server they are connected to as they stream.", "error", err)
+		}
+		if err := nats.InitAIJobStream(); err != nil {
+			slog.Warn("Failed to set up AI job stream. AI jobs will be processed in-process without retries across restarts.", "error", err)
+		} else if _, err := nats.StartAIJobWorker(ctx, chatHandler.ProcessAIJob); err != nil {
+			slog.Warn("Failed to start AI job worker", "error", err)
+		}
+	}
+
+	// Pick up the AI jobs that the last shutdown stopped before they finished
+	if err := chatHandler.ResumeAIJobs(ctx); err != nil {
+		slog.Error("Failed to resume interrupted AI jobs", "error", err)
+	}
 
 	// Define API routes
 
@@ -90,9 +172,19 @@ func main() {
 		json.NewEncoder(w).Encode(response)
 	})
 
+	// Prometheus metrics, protected by METRICS_TOKEN when it is set
+	mux.Handle("GET /metrics", metrics.Handler(cfg.MetricsToken))
+
 	// Public endpoints (no auth required)
-	mux.HandleFunc("POST /api/auth/register", authHandler.Register)
-	mux.HandleFunc("POST /api/auth/login", authHandler.Login)
+	mux.HandleFunc("POST /api/auth/register", middleware.RateLimit(limiter, middleware.RegisterRateLimit, middleware.ByIP)(authHandler.Register))
+	mux.HandleFunc("POST /api/auth/login", middleware.RateLimit(limiter, middleware.LoginRateLimit, middleware.ByIP)(authHandler.Login))
+	mux.HandleFunc("POST /api/auth/refresh", middleware.RateLimit(limiter, middleware.RefreshRateLimit, middleware.ByIP)(authHandler.Refresh))
+	mux.HandleFunc("POST /api/auth/otp/request", otpHandler.RequestCode)
+	mux.HandleFunc("POST /api/auth/otp/verify", otpHandler.VerifyCode)
+	mux.HandleFunc("POST /api/auth/forgot-password", middleware.RateLimit(limiter, middleware.PasswordResetRateLimit, middleware.ByIP)(authHandler.ForgotPassword))
+	mux.HandleFunc("POST /api/auth/reset-password", middleware.RateLimit(limiter, middleware.PasswordResetRateLimit, middleware.ByIP)(authHandler.ResetPassword))
+	mux.HandleFunc("POST /api/auth/verify-email", middleware.RateLimit(limiter, middleware.PasswordResetRateLimit, middleware.ByIP)(authHandler.VerifyEmail))
+	mux.HandleFunc("GET /api/payments/callback", paymentHandler.PaymentCallback)
 
 	// Protected routes (with auth middleware)
 	protected := http.NewServeMux()
@@ -104,18 +196,24 @@ func main() {
 	protected.HandleFunc("PUT /api/chats/{id}", chatHandler.UpdateChat)
 	protected.HandleFunc("DELETE /api/chats/{id}", chatHandler.DeleteChat)
 	protected.HandleFunc("GET /api/chats/{id}/messages", chatHandler.GetChatMessages)
-	protected.HandleFunc("POST /api/messages", chatHandler.CreateMessage)
+	protected.HandleFunc("GET /api/chats/{id}/stream", chatHandler.StreamChat)
+	protected.HandleFunc("GET /api/jobs/{id}", jobHandler.GetJob)
+	protected.HandleFunc("POST /api/messages", requireVerified(aiRateLimit(chatHandler.CreateMessage)))
+	protected.HandleFunc("GET /api/messages", chatHandler.FindMessages)
+	protected.HandleFunc("GET /api/messages/{id}/analysis", chatHandler.GetMessageAnalysis)
+	protected.HandleFunc("POST /api/interactions/check", interactionHandler.Check)
+	protected.HandleFunc("GET /api/drugs/search", drugHandler.Search)
 
 	// Additional chat routes with different path patterns for maximum compatibility
-	protected.HandleFunc("POST /api/chats/{id}/messages", chatHandler.CreateChatMessage)
-	protected.HandleFunc("POST /api/chat/{id}/messages", chatHandler.CreateChatMessage)
-	protected.HandleFunc("POST /messages", chatHandler.CreateMessage)
-	protected.HandleFunc("POST /chats/{id}/messages", chatHandler.CreateChatMessage)
-	protected.HandleFunc("POST /chat/{id}/messages", chatHandler.CreateChatMessage)
-	protected.HandleFunc("POST /api/chats/{id}/messages/image", chatHandler.UploadImageMessage)
-	protected.HandleFunc("POST /api/chat/{id}/messages/image", chatHandler.UploadImageMessage)
-	protected.HandleFunc("POST /chats/{id}/messages/image", chatHandler.UploadImageMessage)
-	protected.HandleFunc("POST /chat/{id}/messages/image", chatHandler.UploadImageMessage)
+	protected.HandleFunc("POST /api/chats/{id}/messages", requireVerified(aiRateLimit(chatHandler.CreateChatMessage)))
+	protected.HandleFunc("POST /api/chat/{id}/messages", requireVerified(aiRateLimit(chatHandler.CreateChatMessage)))
+	protected.HandleFunc("POST /messages", requireVerified(aiRateLimit(chatHandler.CreateMessage)))
+	protected.HandleFunc("POST /chats/{id}/messages", requireVerified(aiRateLimit(chatHandler.CreateChatMessage)))
+	protected.HandleFunc("POST /chat/{id}/messages", requireVerified(aiRateLimit(chatHandler.CreateChatMessage)))
+	protected.HandleFunc("POST /api/chats/{id}/messages/image", requireVerified(aiRateLimit(chatHandler.UploadImageMessage)))
+	protected.HandleFunc("POST /api/chat/{id}/messages/image", requireVerified(aiRateLimit(chatHandler.UploadImageMessage)))
+	protected.HandleFunc("POST /chats/{id}/messages/image", requireVerified(aiRateLimit(chatHandler.UploadImageMessage)))
+	protected.HandleFunc("POST /chat/{id}/messages/image", requireVerified(aiRateLimit(chatHandler.UploadImageMessage)))
 
 	// Folder routes
 	protected.HandleFunc("POST /api/folders", folderHandler.CreateFolder)
@@ -127,42 +225,94 @@ func main() {
 	// Auth and other routes
 	protected.HandleFunc("GET /api/auth/me", authHandler.GetMe)
 	protected.HandleFunc("GET /api/auth/verify", authHandler.VerifyToken)
-	protected.HandleFunc("POST /api/analyze-prescription/text", prescriptionHandler.AnalyzePrescriptionText)
-	protected.HandleFunc("POST /api/analyze-prescription/image", prescriptionHandler.AnalyzePrescriptionImage)
-	protected.HandleFunc("POST /api/ai/completion", aiHandler.GenerateCompletion)
-	protected.HandleFunc("POST /api/ai/analyze-prescription", aiHandler.AnalyzePrescriptionWithAI)
+	protected.HandleFunc("POST /api/auth/resend-verification", authHandler.ResendVerification)
+	protected.HandleFunc("POST /api/auth/logout", authHandler.Logout)
+	protected.HandleFunc("POST /api/auth/logout-all", authHandler.LogoutAll)
+	protected.HandleFunc("GET /api/auth/sessions", authHandler.GetSessions)
+	protected.HandleFunc("DELETE /api/auth/sessions/{id}", authHandler.RevokeSession)
+	protected.HandleFunc("POST /api/analyze-prescription/text", requireVerified(aiRateLimit(prescriptionHandler.AnalyzePrescriptionText)))
+	protected.HandleFunc("POST /api/analyze-prescription/image", requireVerified(aiRateLimit(prescriptionHandler.AnalyzePrescriptionImage)))
+	protected.HandleFunc("GET /api/prescriptions", prescriptionHandler.ListPrescriptions)
+	protected.HandleFunc("POST /api/prescriptions", prescriptionHandler.CreatePrescription)
+	protected.HandleFunc("GET /api/prescriptions/{id}", prescriptionHandler.GetPrescription)
+	protected.HandleFunc("PUT /api/prescriptions/{id}", prescriptionHandler.UpdatePrescription)
+	protected.HandleFunc("DELETE /api/prescriptions/{id}", prescriptionHandler.DeletePrescription)
+	protected.HandleFunc("POST /api/ai/completion", requireVerified(aiRateLimit(aiHandler.GenerateCompletion)))
+	protected.HandleFunc("POST /api/ai/analyze-prescription", requireVerified(aiRateLimit(aiHandler.AnalyzePrescriptionWithAI)))
 
 	// Credit routes
 	protected.HandleFunc("GET /api/credit", creditHandler.GetUserCredit)
-	protected.HandleFunc("POST /api/credit/add", creditHandler.AddCredit)
-	protected.HandleFunc("POST /api/credit/subtract", creditHandler.SubtractCredit)
-	protected.HandleFunc("GET /api/credit/user", creditHandler.GetUserCreditByID)
+	protected.HandleFunc("POST /api/credit/add", middleware.RequirePermission(models.PermissionCreditWrite)(creditHandler.AddCredit))
+	protected.HandleFunc("POST /api/credit/subtract", middleware.RequirePermission(models.PermissionCreditWrite)(creditHandler.SubtractCredit))
+	protected.HandleFunc("GET /api/credit/user", middleware.RequirePermission(models.PermissionCreditRead)(creditHandler.GetUserCreditByID))
+
+	// Payment routes
+	protected.HandleFunc("POST /api/payments", paymentHandler.CreatePayment)
+	protected.HandleFunc("GET /api/payments", paymentHandler.GetUserPayments)
+	protected.HandleFunc("GET /api/payments/{id}", paymentHandler.GetPayment)
 
 	// Plan and subscription routes
-	protected.HandleFunc("GET /api/plans", handlers.GetAllPlans)
-	protected.HandleFunc("GET /api/plans/{id}", handlers.GetPlanByID)
-	protected.HandleFunc("POST /api/plans", middleware.RequireAdmin(handlers.CreatePlan)) // Admin only
-	protected.HandleFunc("POST /api/subscriptions/purchase", handlers.PurchasePlan)
-	protected.HandleFunc("GET /api/subscriptions", handlers.GetUserSubscriptions)
-	protected.HandleFunc("GET /api/subscriptions/active", handlers.GetActiveUserSubscriptions)
-	protected.HandleFunc("GET /api/subscriptions/current", handlers.GetCurrentUserSubscription)
-	protected.HandleFunc("POST /api/subscriptions/use", handlers.UseSubscription)
-	protected.HandleFunc("GET /api/transactions", handlers.GetCreditTransactions)
-
-	// Gift routes (admin only)
-	protected.HandleFunc("POST /api/gifts/plan", middleware.RequireAdmin(giftHandler.GiftPlanToUser))
-	protected.HandleFunc("POST /api/gifts/credit", middleware.RequireAdmin(giftHandler.GiftCreditToUser))
-	protected.HandleFunc("GET /api/gifts/user/{id}", middleware.RequireAdmin(giftHandler.GetUserGiftTransactions))
-	protected.HandleFunc("GET /api/gifts/admin", middleware.RequireAdmin(giftHandler.GetAdminGiftTransactions))
+	protected.HandleFunc("GET /api/plans", planHandler.GetAllPlans)
+	protected.HandleFunc("GET /api/plans/{id}", planHandler.GetPlanByID)
+	protected.HandleFunc("POST /api/plans", middleware.RequirePermission(models.PermissionPlansWrite)(planHandler.CreatePlan))
+	protected.HandleFunc("POST /api/subscriptions/purchase", planHandler.PurchasePlan)
+	protected.HandleFunc("GET /api/subscriptions", planHandler.GetUserSubscriptions)
+	protected.HandleFunc("GET /api/subscriptions/active", planHandler.GetActiveUserSubscriptions)
+	protected.HandleFunc("GET /api/subscriptions/current", planHandler.GetCurrentUserSubscription)
+	protected.HandleFunc("POST /api/subscriptions/use", planHandler.UseSubscription)
+	protected.HandleFunc("GET /api/transactions", planHandler.GetCreditTransactions)
+
+	// Gift routes
+	protected.HandleFunc("POST /api/gifts/plan", middleware.RequirePermission(models.PermissionGiftsWrite)(giftHandler.GiftPlanToUser))
+	protected.HandleFunc("POST /api/gifts/credit", middleware.RequirePermission(models.PermissionGiftsWrite)(giftHandler.GiftCreditToUser))
+	protected.HandleFunc("GET /api/gifts/user/{id}", middleware.RequirePermission(models.PermissionGiftsRead)(giftHandler.GetUserGiftTransactions))
+	protected.HandleFunc("GET /api/gifts/admin", middleware.RequirePermission(models.PermissionGiftsRead)(giftHandler.GetAdminGiftTransactions))
+
+	// Role routes
+	protected.HandleFunc("GET /api/roles", middleware.RequirePermission(models.PermissionRolesRead)(roleHandler.GetRoles))
+	protected.HandleFunc("GET /api/users/{id}/roles", middleware.RequirePermission(models.PermissionRolesRead)(roleHandler.GetUserRoles))
+	protected.HandleFunc("POST /api/users/{id}/roles", middleware.RequirePermission(models.PermissionRolesWrite)(roleHandler.GrantUserRole))
+	protected.HandleFunc("DELETE /api/users/{id}/roles/{role}", middleware.RequirePermission(models.PermissionRolesWrite)(roleHandler.RevokeUserRole))
+
+	// Pharmacy routes
+	protected.HandleFunc("POST /api/pharmacy", pharmacyHandler.CreatePharmacy)
+	protected.HandleFunc("GET /api/pharmacy", pharmacyHandler.GetPharmacy)
+	protected.HandleFunc("PUT /api/pharmacy/members/{user_id}", pharmacyHandler.UpdateMember)
+	protected.HandleFunc("DELETE /api/pharmacy/members/{user_id}", pharmacyHandler.RemoveMember)
+	protected.HandleFunc("POST /api/pharmacy/invitations", pharmacyHandler.CreateInvitation)
+	protected.HandleFunc("GET /api/pharmacy/invitations", pharmacyHandler.GetInvitations)
+	protected.HandleFunc("DELETE /api/pharmacy/invitations/{id}", pharmacyHandler.RevokeInvitation)
+	protected.HandleFunc("GET /api/pharmacy/chats", pharmacyHandler.GetSharedChats)
+	protected.HandleFunc("GET /api/pharmacy/folders", pharmacyHandler.GetSharedFolders)
+	protected.HandleFunc("GET /api/pharmacy/transactions", pharmacyHandler.GetTransactions)
+	protected.HandleFunc("GET /api/invitations", pharmacyHandler.GetMyInvitations)
+	protected.HandleFunc("POST /api/invitations/{id}/accept", pharmacyHandler.AcceptInvitation)
+	protected.HandleFunc("POST /api/invitations/{id}/decline", pharmacyHandler.DeclineInvitation)
+	protected.HandleFunc("POST /api/chats/{id}/share", pharmacyHandler.ShareChat)
+	protected.HandleFunc("DELETE /api/chats/{id}/share", pharmacyHandler.UnshareChat)
+	protected.HandleFunc("POST /api/folders/{id}/share", pharmacyHandler.ShareFolder)
+	protected.HandleFunc("DELETE /api/folders/{id}/share", pharmacyHandler.UnshareFolder)
 
 	// Apply auth middleware to protected routes
-	mux.Handle("/api/", middleware.AuthMiddleware(protected))
+	mux.Handle("/api/", middleware.AuthMiddleware(store)(protected))
 
-	// Configure CORS middleware
-	handler := corsMiddleware(mux)
+	// Configure CORS and API rate limit middleware. Preflight requests are
+	// answered by the CORS middleware and are not counted.
+	handler := corsMiddleware(middleware.RateLimitHandler(limiter, middleware.APIRateLimit, middleware.ByIP, mux))
 
 	// Apply the auth check middleware to all routes
-	handler = middleware.AuthCheckMiddleware(handler)
+	handler = middleware.AuthCheckMiddleware(store)(handler)
+
+	// Observe and log every request by route pattern, under a request ID
+	route := func(r *http.Request) string {
+		_, pattern := mux.Handler(r)
+		if pattern == "/api/" {
+			_, pattern = protected.Handler(r)
+		}
+		return pattern
+	}
+	handler = middleware.Instrument(route, handler)
+	handler = middleware.RequestID(handler)
 
 	// Set up the server
 	server := &http.Server{
@@ -173,11 +323,42 @@ func main() {
 		IdleTimeout:  180 * time.Second,
 	}
 
+	// Open chat streams would hold up the shutdown until the deadline
+	server.RegisterOnShutdown(chatHandler.CloseStreams)
+
+	signals, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
+
 	// Start the server
-	log.Printf("Starting دارویار API server on %s", cfg.ServerAddr)
-	if err := server.ListenAndServe(); err != nil {
-		log.Fatalf("Failed to start server: %v", err)
+	slog.Info("Starting دارویار API server", "addr", cfg.ServerAddr)
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serverErr:
+		fatal("Failed to start server", err)
+	case <-signals.Done():
 	}
+	// A second signal stops the server right away
+	stopSignals()
+
+	slog.Info("Shutting down server", "timeout", cfg.ShutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+
+	// Stop accepting requests and wait for the ones in flight
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Error("Failed to finish requests before the shutdown deadline", "error", err)
+	}
+
+	// Stop starting AI jobs and wait for the running ones. Jobs still running
+	// at the deadline are canceled and resumed after restart.
+	if err := nats.DrainAIJobs(shutdownCtx, stop); err != nil {
+		slog.Warn("AI jobs were still running at the shutdown deadline and will be resumed after restart", "error", err)
+	}
+	slog.Info("Server stopped")
 }
 
 // corsMiddleware adds CORS headers to all responses
@@ -186,8 +367,8 @@ func corsMiddleware(next http.Handler) http.Handler {
 		// Set CORS headers
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Origin, Content-Type, Accept, Authorization")
-		w.Header().Set("Access-Control-Expose-Headers", "Content-Length")
+		w.Header().Set("Access-Control-Allow-Headers", "Origin, Content-Type, Accept, Authorization, X-Request-ID")
+		w.Header().Set("Access-Control-Expose-Headers", "Content-Length, X-Job-ID, X-Request-ID, X-RateLimit-Limit, X-RateLimit-Remaining, X-RateLimit-Reset, Retry-After")
 		w.Header().Set("Access-Control-Allow-Credentials", "true")
 		w.Header().Set("Access-Control-Max-Age", "86400") // 24 hours
 
@@ -201,3 +382,9 @@ func corsMiddleware(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
+
+// fatal logs an error that keeps the server from starting and exits
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
@@ -0,0 +1,83 @@
+// Package metrics defines the Prometheus metrics of the server and serves
+// them at /metrics.
+package metrics
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "darooyar"
+
+var (
+	// HTTPRequestDuration observes every HTTP request by route and status
+	HTTPRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "request_duration_seconds",
+		Help:      "Latency of HTTP requests by method, route pattern and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+
+	// AIRequestDuration observes every call to the AI provider
+	AIRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "ai",
+		Name:      "request_duration_seconds",
+		Help:      "Latency of AI provider calls by model and endpoint.",
+		Buckets:   []float64{0.5, 1, 2.5, 5, 10, 20, 30, 45, 60, 90, 120},
+	}, []string{"model", "endpoint"})
+
+	// AIRequestErrors counts the AI provider calls that failed
+	AIRequestErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "ai",
+		Name:      "request_errors_total",
+		Help:      "AI provider calls that failed, by model and endpoint.",
+	}, []string{"model", "endpoint"})
+
+	// AITokens counts the tokens the AI provider reported using
+	AITokens = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "ai",
+		Name:      "tokens_total",
+		Help:      "Tokens used by AI provider calls, by model, endpoint and type (prompt or completion).",
+	}, []string{"model", "endpoint", "type"})
+
+	// NATSRequestTimeouts counts the NATS requests that got no reply in time
+	NATSRequestTimeouts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "nats",
+		Name:      "request_timeouts_total",
+		Help:      "NATS requests that timed out waiting for a reply, by subject.",
+	}, []string{"subject"})
+)
+
+// RegisterDB exports the connection pool statistics of the database
+func RegisterDB(db *sql.DB) {
+	prometheus.MustRegister(collectors.NewDBStatsCollector(db, "postgres"))
+}
+
+// Handler serves the metrics. When token is set, scrapers must send it as a
+// bearer token.
+func Handler(token string) http.Handler {
+	handler := promhttp.Handler()
+	if token == "" {
+		return handler
+	}
+
+	expected := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
@@ -2,119 +2,117 @@ package middleware
 
 import (
 	"context"
+	"errors"
+	"log/slog"
 	"net/http"
 	"strings"
 
 	"github.com/darooyar/server/auth"
+	"github.com/darooyar/server/db"
+	"github.com/darooyar/server/models"
 )
 
-// AuthMiddleware checks for a valid JWT token in the Authorization header
-func AuthMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Get the Authorization header
-		authHeader := r.Header.Get("Authorization")
-		if authHeader == "" {
-			http.Error(w, "Authorization header required", http.StatusUnauthorized)
-			return
-		}
-
-		// Check if the header starts with "Bearer "
-		parts := strings.Split(authHeader, " ")
-		if len(parts) != 2 || parts[0] != "Bearer" {
-			http.Error(w, "Invalid authorization header format", http.StatusUnauthorized)
-			return
-		}
-
-		// Validate the token
-		claims, err := auth.ValidateToken(parts[1])
-		if err != nil {
-			http.Error(w, "Invalid token", http.StatusUnauthorized)
-			return
-		}
-
-		// Add the user ID to the request context
-		ctx := r.Context()
-		ctx = context.WithValue(ctx, "user_id", claims.UserID)
-		ctx = context.WithValue(ctx, "email", claims.Email)
-		next.ServeHTTP(w, r.WithContext(ctx))
-	})
+// AuthMiddleware checks for a valid JWT token in the Authorization header,
+// unless AuthCheckMiddleware already did for the request. Tokens are checked
+// against the revocation denylist and the sessions of the store.
+func AuthMiddleware(sessions db.SessionStore) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			claims, ok := requestClaims(w, r, sessions)
+			if !ok {
+				return
+			}
+
+			next.ServeHTTP(w, withClaims(r, claims))
+		})
+	}
 }
 
 // RequireAuth is a middleware that ensures a user is authenticated
 // It can be applied to individual handlers
-func RequireAuth(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		// Get the Authorization header
-		authHeader := r.Header.Get("Authorization")
-		if authHeader == "" {
-			http.Error(w, "Authorization header required", http.StatusUnauthorized)
-			return
+func RequireAuth(sessions db.SessionStore) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			claims, ok := requestClaims(w, r, sessions)
+			if !ok {
+				return
+			}
+
+			next.ServeHTTP(w, withClaims(r, claims))
 		}
+	}
+}
 
-		// Check if the header starts with "Bearer "
-		parts := strings.Split(authHeader, " ")
-		if len(parts) != 2 || parts[0] != "Bearer" {
-			http.Error(w, "Invalid authorization header format", http.StatusUnauthorized)
-			return
-		}
+// RequireAdmin is a middleware that ensures a user has the admin role. It
+// must run after AuthMiddleware or RequireAuth authenticated the request.
+func RequireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return authorize(next, "Admin privileges required", func(ctx context.Context, claims *auth.Claims) bool {
+		return claims.HasRole(models.RoleAdmin)
+	})
+}
 
-		// Validate the token
-		claims, err := auth.ValidateToken(parts[1])
-		if err != nil {
-			http.Error(w, "Invalid token", http.StatusUnauthorized)
-			return
-		}
+// RequirePermission returns a middleware that ensures one of the user's roles
+// grants the permission. Permissions are read from the token claims, so role
+// changes apply once the user gets a new token. It must run after
+// AuthMiddleware or RequireAuth authenticated the request.
+func RequirePermission(permission models.Permission) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return authorize(next, "Permission "+string(permission)+" required", func(ctx context.Context, claims *auth.Claims) bool {
+			return claims.HasPermission(permission)
+		})
+	}
+}
 
-		// Add the user ID to the request context
-		ctx := r.Context()
-		ctx = context.WithValue(ctx, "user_id", claims.UserID)
-		ctx = context.WithValue(ctx, "email", claims.Email)
-		next.ServeHTTP(w, r.WithContext(ctx))
+// RequireVerified returns a middleware that ensures the user proved they own
+// their account, by verifying their email or by registering with their phone.
+// It guards the AI analysis routes and must run after AuthMiddleware or
+// RequireAuth authenticated the request.
+func RequireVerified(users db.UserStore) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return authorize(next, "Email verification required", func(ctx context.Context, claims *auth.Claims) bool {
+			// Only users who were not verified when their token was issued are
+			// looked up, since they may have verified since
+			if claims.Verified {
+				return true
+			}
+			verified, err := users.IsUserVerified(ctx, claims.UserID)
+			if err != nil {
+				slog.ErrorContext(ctx, "Error checking verification of user", "user_id", claims.UserID, "error", err)
+				return false
+			}
+			return verified
+		})
 	}
 }
 
-// RequireAdmin is a middleware that ensures a user is authenticated and has admin privileges
-// It can be applied to individual handlers
-func RequireAdmin(next http.HandlerFunc) http.HandlerFunc {
+// authorize gets the claims that an outer middleware put on the request and
+// calls next only when allowed accepts them, answering 403 Forbidden with the
+// message otherwise. Requests that were not authenticated get 401 Unauthorized.
+func authorize(next http.HandlerFunc, forbiddenMessage string, allowed func(context.Context, *auth.Claims) bool) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		// Get the Authorization header
-		authHeader := r.Header.Get("Authorization")
-		if authHeader == "" {
-			http.Error(w, "Authorization header required", http.StatusUnauthorized)
+		claims, ok := r.Context().Value("claims").(*auth.Claims)
+		if !ok {
+			http.Error(w, "Authorization required", http.StatusUnauthorized)
 			return
 		}
 
-		// Check if the header starts with "Bearer "
-		parts := strings.Split(authHeader, " ")
-		if len(parts) != 2 || parts[0] != "Bearer" {
-			http.Error(w, "Invalid authorization header format", http.StatusUnauthorized)
+		// Check the privileges directly from the token claims
+		if !allowed(r.Context(), claims) {
+			http.Error(w, forbiddenMessage, http.StatusForbidden)
 			return
 		}
 
-		// Validate the token
-		claims, err := auth.ValidateToken(parts[1])
-		if err != nil {
-			http.Error(w, "Invalid token", http.StatusUnauthorized)
-			return
-		}
-
-		// Check if user is an admin directly from the token claims
-		if !claims.IsAdmin {
-			http.Error(w, "Admin privileges required", http.StatusForbidden)
-			return
-		}
-
-		// Add the user ID to the request context
-		ctx := r.Context()
-		ctx = context.WithValue(ctx, "user_id", claims.UserID)
-		ctx = context.WithValue(ctx, "email", claims.Email)
-		next.ServeHTTP(w, r.WithContext(ctx))
+		next.ServeHTTP(w, withClaims(r, claims))
 	}
 }
 
 // GetUserFromToken extracts user information from the token if present
 // Returns userID, email, and a boolean indicating if the user is authenticated
-func GetUserFromToken(r *http.Request) (int64, string, bool) {
+func GetUserFromToken(r *http.Request, sessions db.SessionStore) (int64, string, bool) {
+	if claims, ok := r.Context().Value("claims").(*auth.Claims); ok {
+		return claims.UserID, claims.Email, true
+	}
+
 	authHeader := r.Header.Get("Authorization")
 	if authHeader == "" {
 		return 0, "", false
@@ -125,10 +123,95 @@ func GetUserFromToken(r *http.Request) (int64, string, bool) {
 		return 0, "", false
 	}
 
-	claims, err := auth.ValidateToken(parts[1])
+	claims, err := validateToken(r.Context(), sessions, parts[1])
 	if err != nil {
 		return 0, "", false
 	}
 
 	return claims.UserID, claims.Email, true
 }
+
+// requestClaims returns the claims that an outer middleware put on the
+// request context, or else authenticates the request itself. It writes an
+// error response and returns false when the request is not authenticated.
+func requestClaims(w http.ResponseWriter, r *http.Request, sessions db.SessionStore) (*auth.Claims, bool) {
+	if claims, ok := r.Context().Value("claims").(*auth.Claims); ok {
+		return claims, true
+	}
+	return authenticate(w, r, sessions)
+}
+
+// withClaims adds the user of an authenticated request to its context
+func withClaims(r *http.Request, claims *auth.Claims) *http.Request {
+	ctx := r.Context()
+	ctx = context.WithValue(ctx, "user_id", claims.UserID)
+	ctx = context.WithValue(ctx, "email", claims.Email)
+	ctx = context.WithValue(ctx, "claims", claims)
+	return r.WithContext(ctx)
+}
+
+// authenticate validates the bearer token of the request and checks that it
+// was not revoked. It writes an error response and returns false when the
+// request is not authenticated.
+func authenticate(w http.ResponseWriter, r *http.Request, sessions db.SessionStore) (*auth.Claims, bool) {
+	// Get the Authorization header
+	authHeader := r.Header.Get("Authorization")
+	if authHeader == "" {
+		http.Error(w, "Authorization header required", http.StatusUnauthorized)
+		return nil, false
+	}
+
+	// Check if the header starts with "Bearer "
+	parts := strings.Split(authHeader, " ")
+	if len(parts) != 2 || parts[0] != "Bearer" {
+		http.Error(w, "Invalid authorization header format", http.StatusUnauthorized)
+		return nil, false
+	}
+
+	// Validate the token
+	claims, err := validateToken(r.Context(), sessions, parts[1])
+	if err == errTokenRevoked {
+		http.Error(w, "Token has been revoked", http.StatusUnauthorized)
+		return nil, false
+	}
+	if err == errRevocationCheckFailed {
+		http.Error(w, "Could not verify token", http.StatusServiceUnavailable)
+		return nil, false
+	}
+	if err != nil {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return nil, false
+	}
+
+	return claims, true
+}
+
+var (
+	errTokenRevoked          = errors.New("token revoked")
+	errRevocationCheckFailed = errors.New("revocation check failed")
+)
+
+// validateToken validates a token and checks it against the revocation
+// denylist and the state of its session. Tokens issued before sessions
+// existed carry neither an ID nor a session and stay valid until they expire.
+func validateToken(ctx context.Context, sessions db.SessionStore, tokenString string) (*auth.Claims, error) {
+	claims, err := auth.ValidateToken(tokenString)
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.ID == "" && claims.SessionID == "" {
+		return claims, nil
+	}
+
+	revoked, err := sessions.IsTokenRevoked(ctx, claims.ID, claims.SessionID)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error checking token revocation", "error", err)
+		return nil, errRevocationCheckFailed
+	}
+	if revoked {
+		return nil, errTokenRevoked
+	}
+
+	return claims, nil
+}
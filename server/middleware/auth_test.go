@@ -0,0 +1,117 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/darooyar/server/auth"
+	"github.com/darooyar/server/db/memory"
+	"github.com/darooyar/server/models"
+)
+
+func TestAuthMiddlewareChecksRevocation(t *testing.T) {
+	tests := []struct {
+		name       string
+		revoke     func(t *testing.T, store *memory.Store, claims *auth.Claims)
+		wantStatus int
+	}{
+		{name: "valid token", wantStatus: http.StatusOK},
+		{name: "revoked token", revoke: func(t *testing.T, store *memory.Store, claims *auth.Claims) {
+			if err := store.RevokeToken(context.Background(), claims.ID, claims.UserID, claims.ExpiresAt.Time); err != nil {
+				t.Fatalf("revoking token: %v", err)
+			}
+		}, wantStatus: http.StatusUnauthorized},
+		{name: "ended session", revoke: func(t *testing.T, store *memory.Store, claims *auth.Claims) {
+			if err := store.RevokeSession(context.Background(), claims.SessionID, claims.UserID); err != nil {
+				t.Fatalf("revoking session: %v", err)
+			}
+		}, wantStatus: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			store := memory.New()
+			user, err := store.CreateUser(ctx, &models.UserCreate{Username: "user", Email: "user@example.com"})
+			if err != nil {
+				t.Fatalf("creating user: %v", err)
+			}
+			session, err := store.CreateSession(ctx, user.ID, "test", "127.0.0.1", "hash", time.Now().Add(time.Hour))
+			if err != nil {
+				t.Fatalf("creating session: %v", err)
+			}
+			token, _, err := auth.GenerateToken(user, session.ID)
+			if err != nil {
+				t.Fatalf("generating token: %v", err)
+			}
+			claims, err := auth.ValidateToken(token)
+			if err != nil {
+				t.Fatalf("validating token: %v", err)
+			}
+			if tt.revoke != nil {
+				tt.revoke(t, store, claims)
+			}
+
+			handler := AuthMiddleware(store)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			r := httptest.NewRequest(http.MethodGet, "/api/chats", nil)
+			r.Header.Set("Authorization", "Bearer "+token)
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, r)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestRequireVerified(t *testing.T) {
+	tests := []struct {
+		name       string
+		claims     func(email, phone *models.User) *auth.Claims
+		wantStatus int
+	}{
+		{name: "verified when the token was issued", claims: func(email, phone *models.User) *auth.Claims {
+			return &auth.Claims{UserID: email.ID, Verified: true}
+		}, wantStatus: http.StatusOK},
+		{name: "registered by phone", claims: func(email, phone *models.User) *auth.Claims {
+			return &auth.Claims{UserID: phone.ID}
+		}, wantStatus: http.StatusOK},
+		{name: "unverified email", claims: func(email, phone *models.User) *auth.Claims {
+			return &auth.Claims{UserID: email.ID}
+		}, wantStatus: http.StatusForbidden},
+		{name: "not authenticated", claims: func(email, phone *models.User) *auth.Claims {
+			return nil
+		}, wantStatus: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			store := memory.New()
+			emailUser, err := store.CreateUser(ctx, &models.UserCreate{Username: "email", Email: "user@example.com"})
+			if err != nil {
+				t.Fatalf("creating user: %v", err)
+			}
+			phoneUser, err := store.CreatePhoneUser(ctx, &models.OTPVerify{Username: "phone", Phone: "+989120000000"})
+			if err != nil {
+				t.Fatalf("creating phone user: %v", err)
+			}
+
+			handler := RequireVerified(store)(func(w http.ResponseWriter, r *http.Request) {})
+			r := httptest.NewRequest(http.MethodPost, "/api/messages", nil)
+			if claims := tt.claims(emailUser, phoneUser); claims != nil {
+				r = withClaims(r, claims)
+			}
+			rec := httptest.NewRecorder()
+			handler(rec, r)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+		})
+	}
+}
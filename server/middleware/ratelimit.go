@@ -0,0 +1,206 @@
+package middleware
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/darooyar/server/db"
+	"github.com/darooyar/server/ratelimit"
+)
+
+// Rate limit policies of the routes. Each client has a bucket per policy.
+var (
+	// APIRateLimit applies to every request of an IP address
+	APIRateLimit = ratelimit.Policy{Name: "api", Limit: 300, Period: time.Minute, Burst: 100}
+	// LoginRateLimit slows down password guessing from an IP address
+	LoginRateLimit = ratelimit.Policy{Name: "login", Limit: 10, Period: 15 * time.Minute, Burst: 5}
+	// RegisterRateLimit bounds the accounts created from an IP address
+	RegisterRateLimit = ratelimit.Policy{Name: "register", Limit: 5, Period: time.Hour, Burst: 3}
+	// RefreshRateLimit bounds the token refreshes of an IP address, which
+	// replay stolen or guessed refresh tokens
+	RefreshRateLimit = ratelimit.Policy{Name: "refresh", Limit: 30, Period: time.Hour, Burst: 10}
+	// PasswordResetRateLimit bounds the reset and verification requests of an IP address
+	PasswordResetRateLimit = ratelimit.Policy{Name: "password_reset", Limit: 10, Period: time.Hour, Burst: 5}
+	// AIRateLimit bounds the AI requests of a user with an active subscription
+	AIRateLimit = ratelimit.Policy{Name: "ai", Limit: 20, Period: time.Minute, Burst: 5}
+	// AINoQuotaRateLimit applies to users without an active subscription,
+	// whose AI requests can only be refused with 402 Payment Required
+	AINoQuotaRateLimit = ratelimit.Policy{Name: "ai_no_quota", Limit: 5, Period: time.Minute, Burst: 2}
+)
+
+// RateLimitKey identifies the client a request is counted against
+type RateLimitKey func(r *http.Request) string
+
+// ByIP counts requests against the client's IP address
+func ByIP(r *http.Request) string {
+	return "ip:" + ClientIP(r)
+}
+
+// ByUser counts requests against the authenticated user, or against the IP
+// address of unauthenticated requests
+func ByUser(r *http.Request) string {
+	if userID, ok := r.Context().Value("user_id").(int64); ok {
+		return "user:" + strconv.FormatInt(userID, 10)
+	}
+	return ByIP(r)
+}
+
+// trustedProxies are the networks of the proxies in front of the server,
+// whose X-Forwarded-For header is believed
+var trustedProxies []*net.IPNet
+
+// SetTrustedProxies sets the IP addresses or CIDR ranges of the proxies in
+// front of the server. Without any, X-Forwarded-For is ignored.
+func SetTrustedProxies(proxies []string) error {
+	var networks []*net.IPNet
+	for _, proxy := range proxies {
+		proxy = strings.TrimSpace(proxy)
+		if proxy == "" {
+			continue
+		}
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return fmt.Errorf("invalid trusted proxy %q", proxy)
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return fmt.Errorf("invalid trusted proxy %q: %v", proxy, err)
+		}
+		networks = append(networks, network)
+	}
+
+	trustedProxies = networks
+	return nil
+}
+
+// ClientIP returns the IP address of the client. X-Forwarded-For is only
+// believed when the connection comes from a trusted proxy, and then only the
+// hops added by trusted proxies: the address is the rightmost hop that is not
+// a trusted proxy itself. Anything to its left was sent by the client.
+func ClientIP(r *http.Request) string {
+	remote := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		remote = host
+	}
+	if !isTrustedProxy(remote) {
+		return remote
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		if net.ParseIP(hop) == nil {
+			break // A malformed hop cannot be told apart from a spoofed one
+		}
+		if !isTrustedProxy(hop) {
+			return hop
+		}
+		remote = hop
+	}
+	return remote
+}
+
+// isTrustedProxy reports whether an address belongs to a trusted proxy
+func isTrustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// RateLimit returns a middleware that allows each client the requests of a
+// policy. Every response carries the X-RateLimit-* headers, and requests over
+// the limit are answered with 429 Too Many Requests and Retry-After.
+func RateLimit(limiter *ratelimit.Limiter, policy ratelimit.Policy, key RateLimitKey) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if allow(w, r, limiter, policy, key(r)) {
+				next(w, r)
+			}
+		}
+	}
+}
+
+// RateLimitHandler is RateLimit for a whole handler, such as the router
+func RateLimitHandler(limiter *ratelimit.Limiter, policy ratelimit.Policy, key RateLimitKey, next http.Handler) http.Handler {
+	return RateLimit(limiter, policy, key)(next.ServeHTTP)
+}
+
+// RateLimitAI returns a middleware for the AI routes that counts requests per
+// user. Users with an active subscription get AIRateLimit; those without one
+// get the stricter AINoQuotaRateLimit.
+func RateLimitAI(limiter *ratelimit.Limiter, plans db.PlanStore) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			policy := AIRateLimit
+			if userID, ok := r.Context().Value("user_id").(int64); ok {
+				subscription, err := plans.GetCurrentUserSubscription(r.Context(), userID)
+				if err != nil {
+					slog.ErrorContext(r.Context(), "Error getting subscription of user for rate limiting", "user_id", userID, "error", err)
+				} else if subscription == nil {
+					policy = AINoQuotaRateLimit
+				}
+			}
+
+			if allow(w, r, limiter, policy, ByUser(r)) {
+				next(w, r)
+			}
+		}
+	}
+}
+
+// allow takes a request from the client's bucket, sets the rate limit headers
+// and answers 429 when the bucket is empty. When the store fails, requests
+// are let through rather than refusing every client.
+func allow(w http.ResponseWriter, r *http.Request, limiter *ratelimit.Limiter, policy ratelimit.Policy, client string) bool {
+	result, err := limiter.Allow(r.Context(), policy, client)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error checking rate limit", "policy", policy.Name, "store", limiter.Store().Name(), "error", err)
+		return true
+	}
+
+	w.Header().Set("X-RateLimit-Limit", strconv.Itoa(result.Limit))
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	w.Header().Set("X-RateLimit-Reset", strconv.Itoa(ceilSeconds(result.ResetAfter)))
+
+	if result.Allowed {
+		return true
+	}
+
+	retryAfter := ceilSeconds(result.RetryAfter)
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusTooManyRequests)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":      "error",
+		"code":        "rate_limited",
+		"message":     "Too many requests, please try again later",
+		"retry_after": retryAfter,
+	})
+	return false
+}
+
+// ceilSeconds rounds a duration up to whole seconds
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
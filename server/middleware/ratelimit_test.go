@@ -0,0 +1,112 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/darooyar/server/ratelimit"
+)
+
+// trustProxies sets the trusted proxies for the rest of a test
+func trustProxies(t *testing.T, proxies ...string) {
+	t.Helper()
+
+	if err := SetTrustedProxies(proxies); err != nil {
+		t.Fatalf("setting trusted proxies: %v", err)
+	}
+	t.Cleanup(func() { trustedProxies = nil })
+}
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name       string
+		proxies    []string
+		remoteAddr string
+		forwarded  []string
+		want       string
+	}{
+		{name: "direct connection", remoteAddr: "203.0.113.7:4000", want: "203.0.113.7"},
+		{name: "header from untrusted client", remoteAddr: "203.0.113.7:4000", forwarded: []string{"198.51.100.1"}, want: "203.0.113.7"},
+		{name: "header from trusted proxy", proxies: []string{"10.0.0.0/8"}, remoteAddr: "10.0.0.2:4000", forwarded: []string{"198.51.100.1"}, want: "198.51.100.1"},
+		{name: "spoofed hop before proxy hop", proxies: []string{"10.0.0.0/8"}, remoteAddr: "10.0.0.2:4000", forwarded: []string{"192.0.2.99, 198.51.100.1"}, want: "198.51.100.1"},
+		{name: "chain of trusted proxies", proxies: []string{"10.0.0.2", "10.0.0.3"}, remoteAddr: "10.0.0.2:4000", forwarded: []string{"192.0.2.99, 198.51.100.1, 10.0.0.3"}, want: "198.51.100.1"},
+		{name: "repeated header", proxies: []string{"10.0.0.0/8"}, remoteAddr: "10.0.0.2:4000", forwarded: []string{"192.0.2.99", "198.51.100.1"}, want: "198.51.100.1"},
+		{name: "malformed hop", proxies: []string{"10.0.0.0/8"}, remoteAddr: "10.0.0.2:4000", forwarded: []string{"198.51.100.1, garbage"}, want: "10.0.0.2"},
+		{name: "trusted proxy without header", proxies: []string{"10.0.0.0/8"}, remoteAddr: "10.0.0.2:4000", want: "10.0.0.2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			trustProxies(t, tt.proxies...)
+
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for _, forwarded := range tt.forwarded {
+				r.Header.Add("X-Forwarded-For", forwarded)
+			}
+
+			if got := ClientIP(r); got != tt.want {
+				t.Errorf("ClientIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetTrustedProxiesRejectsInvalidAddresses(t *testing.T) {
+	t.Cleanup(func() { trustedProxies = nil })
+
+	for _, proxy := range []string{"not-an-ip", "10.0.0.0/33"} {
+		if err := SetTrustedProxies([]string{proxy}); err == nil {
+			t.Errorf("SetTrustedProxies(%q) succeeded", proxy)
+		}
+	}
+}
+
+func TestRateLimitIgnoresSpoofedForwardedFor(t *testing.T) {
+	tests := []struct {
+		name    string
+		proxies []string
+	}{
+		{name: "without trusted proxies"},
+		{name: "behind trusted proxy", proxies: []string{"10.0.0.0/8"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			trustProxies(t, tt.proxies...)
+
+			limiter := ratelimit.NewLimiter(ratelimit.NewMemoryStore())
+			policy := ratelimit.Policy{Name: "test", Limit: 1, Period: time.Hour, Burst: 1}
+			handler := RateLimit(limiter, policy, ByIP)(func(w http.ResponseWriter, r *http.Request) {})
+
+			// Each request claims to come from another client, but all of
+			// them were forwarded for the same address
+			var keys []string
+			var codes []int
+			for _, spoofed := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"} {
+				r := httptest.NewRequest(http.MethodPost, "/api/auth/login", nil)
+				r.RemoteAddr = "10.0.0.2:4000"
+				if len(tt.proxies) == 0 {
+					r.RemoteAddr = "198.51.100.1:4000"
+				}
+				r.Header.Set("X-Forwarded-For", spoofed+", 198.51.100.1")
+
+				keys = append(keys, ByIP(r))
+				rec := httptest.NewRecorder()
+				handler(rec, r)
+				codes = append(codes, rec.Code)
+			}
+
+			for _, key := range keys {
+				if key != "ip:198.51.100.1" {
+					t.Errorf("limiter key = %q, want ip:198.51.100.1", key)
+				}
+			}
+			if codes[0] != http.StatusOK || codes[1] != http.StatusTooManyRequests || codes[2] != http.StatusTooManyRequests {
+				t.Errorf("status codes = %v, want the second and third request limited", codes)
+			}
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package models
+
+import (
+	"time"
+)
+
+// InteractionSeverity defines how serious a drug interaction is
+type InteractionSeverity string
+
+const (
+	InteractionSeverityMajor    InteractionSeverity = "major"
+	InteractionSeverityModerate InteractionSeverity = "moderate"
+	InteractionSeverityMinor    InteractionSeverity = "minor"
+	InteractionSeverityUnknown  InteractionSeverity = "unknown"
+)
+
+// PrescriptionAnalysis is the structured form of an AI prescription analysis
+type PrescriptionAnalysis struct {
+	MessageID    int64             `json:"message_id"`
+	Drugs        []DrugAnalysis    `json:"drugs"`
+	Interactions []DrugInteraction `json:"interactions"`
+	Diagnosis    string            `json:"diagnosis,omitempty"`
+	Management   string            `json:"management,omitempty"`
+	// KnownInteractions and Contradictions come from the local knowledge base
+	KnownInteractions []KnownInteraction         `json:"known_interactions"`
+	Contradictions    []InteractionContradiction `json:"contradictions"`
+	CreatedAt         time.Time                  `json:"created_at"`
+}
+
+// DrugAnalysis describes a single drug of an analyzed prescription
+type DrugAnalysis struct {
+	Name         string   `json:"name"`
+	Class        string   `json:"class,omitempty"`
+	Mechanism    string   `json:"mechanism,omitempty"`
+	Usage        string   `json:"usage,omitempty"`
+	Dose         string   `json:"dose,omitempty"`
+	Timing       string   `json:"timing,omitempty"`
+	FoodRelation string   `json:"food_relation,omitempty"`
+	SideEffects  []string `json:"side_effects,omitempty"`
+	Description  string   `json:"description,omitempty"`
+}
+
+// DrugInteraction describes an interaction between two drugs of a prescription
+type DrugInteraction struct {
+	DrugA       string              `json:"drug_a"`
+	DrugB       string              `json:"drug_b"`
+	Severity    InteractionSeverity `json:"severity"`
+	Description string              `json:"description,omitempty"`
+}
+
+// KnownInteraction is an interaction found in the local knowledge base
+type KnownInteraction struct {
+	DrugA       string              `json:"drug_a"`
+	DrugB       string              `json:"drug_b"`
+	Severity    InteractionSeverity `json:"severity"`
+	Description string              `json:"description,omitempty"`
+	Management  string              `json:"management,omitempty"`
+}
+
+// ResolvedDrug maps a drug name as written to a drug of the knowledge base
+type ResolvedDrug struct {
+	Input       string `json:"input"`
+	DrugID      int64  `json:"drug_id"`
+	GenericName string `json:"generic_name"`
+	NameFa      string `json:"name_fa,omitempty"`
+	NameEn      string `json:"name_en,omitempty"`
+}
+
+// InteractionCheckRequest is the body of an interaction check
+type InteractionCheckRequest struct {
+	Drugs []string `json:"drugs"`
+}
+
+// InteractionCheckResult is the deterministic result of an interaction check
+type InteractionCheckResult struct {
+	Drugs        []ResolvedDrug     `json:"drugs"`
+	Unresolved   []string           `json:"unresolved"`
+	Interactions []KnownInteraction `json:"interactions"`
+}
+
+// ContradictionKind defines how the AI analysis disagrees with the knowledge base
+type ContradictionKind string
+
+const (
+	ContradictionMissed           ContradictionKind = "missed"            // Known interaction the AI did not mention
+	ContradictionSeverityMismatch ContradictionKind = "severity_mismatch" // Both report it with different severities
+	ContradictionUnconfirmed      ContradictionKind = "unconfirmed"       // AI interaction between known drugs that is not in the knowledge base
+)
+
+// InteractionContradiction flags a disagreement between the AI analysis and the knowledge base
+type InteractionContradiction struct {
+	Kind          ContradictionKind   `json:"kind"`
+	DrugA         string              `json:"drug_a"`
+	DrugB         string              `json:"drug_b"`
+	AISeverity    InteractionSeverity `json:"ai_severity,omitempty"`
+	KnownSeverity InteractionSeverity `json:"known_severity,omitempty"`
+	Message       string              `json:"message"`
+}
@@ -0,0 +1,23 @@
+package models
+
+// Purposes of the single-use tokens sent by email
+const (
+	AuthTokenPurposePasswordReset     = "password_reset"
+	AuthTokenPurposeEmailVerification = "email_verification"
+)
+
+// ForgotPasswordRequest asks for a password reset link to be emailed
+type ForgotPasswordRequest struct {
+	Email string `json:"email"`
+}
+
+// ResetPasswordRequest sets a new password with the token from a reset link
+type ResetPasswordRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+// VerifyEmailRequest verifies an email address with the token from a verification link
+type VerifyEmailRequest struct {
+	Token string `json:"token"`
+}
@@ -5,12 +5,13 @@ import (
 )
 
 type Chat struct {
-	ID        int64     `json:"id"`
-	UserID    int64     `json:"user_id"`
-	Title     string    `json:"title"`
-	FolderID  *int64    `json:"folder_id,omitempty"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	ID         int64     `json:"id"`
+	UserID     int64     `json:"user_id"`
+	Title      string    `json:"title"`
+	FolderID   *int64    `json:"folder_id,omitempty"`
+	PharmacyID *int64    `json:"pharmacy_id,omitempty"` // Set when shared with a pharmacy
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
 }
 
 type Message struct {
@@ -37,13 +38,14 @@ type MessageCreate struct {
 }
 
 type ChatResponse struct {
-	ID        int64     `json:"id"`
-	UserID    int64     `json:"user_id"`
-	Title     string    `json:"title"`
-	FolderID  *int64    `json:"folder_id,omitempty"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
-	Messages  []Message `json:"messages,omitempty"`
+	ID         int64     `json:"id"`
+	UserID     int64     `json:"user_id"`
+	Title      string    `json:"title"`
+	FolderID   *int64    `json:"folder_id,omitempty"`
+	PharmacyID *int64    `json:"pharmacy_id,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+	Messages   []Message `json:"messages,omitempty"`
 }
 
 // ChatUpdate represents the fields that can be updated for a chat
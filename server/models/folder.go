@@ -6,14 +6,15 @@ import (
 
 // Folder represents a folder that contains chats
 type Folder struct {
-	ID        int64     `json:"id"`
-	Name      string    `json:"name"`
-	Color     string    `json:"color,omitempty"`
-	UserID    int64     `json:"user_id"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
-	Chats     []Chat    `json:"chats,omitempty"`
-	ChatCount int       `json:"chat_count,omitempty"`
+	ID         int64     `json:"id"`
+	Name       string    `json:"name"`
+	Color      string    `json:"color,omitempty"`
+	UserID     int64     `json:"user_id"`
+	PharmacyID *int64    `json:"pharmacy_id,omitempty"` // Set when shared with a pharmacy
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+	Chats      []Chat    `json:"chats,omitempty"`
+	ChatCount  int       `json:"chat_count,omitempty"`
 }
 
 // FolderCreate represents the data needed to create a new folder
@@ -30,12 +31,13 @@ type FolderUpdate struct {
 
 // FolderResponse represents the response data for a folder
 type FolderResponse struct {
-	ID        int64     `json:"id"`
-	Name      string    `json:"name"`
-	Color     string    `json:"color,omitempty"`
-	UserID    int64     `json:"user_id"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
-	ChatCount int       `json:"chat_count"`
-	Chats     []Chat    `json:"chats,omitempty"`
+	ID         int64     `json:"id"`
+	Name       string    `json:"name"`
+	Color      string    `json:"color,omitempty"`
+	UserID     int64     `json:"user_id"`
+	PharmacyID *int64    `json:"pharmacy_id,omitempty"` // Set when shared with a pharmacy
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+	ChatCount  int       `json:"chat_count"`
+	Chats      []Chat    `json:"chats,omitempty"`
 }
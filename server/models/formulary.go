@@ -0,0 +1,25 @@
+package models
+
+import (
+	"time"
+)
+
+// FormularyDrug is a product of the national drug list
+type FormularyDrug struct {
+	ID            int64     `json:"id"`
+	Code          string    `json:"code,omitempty"`
+	GenericName   string    `json:"generic_name"`
+	GenericNameFa string    `json:"generic_name_fa,omitempty"`
+	BrandName     string    `json:"brand_name,omitempty"`
+	DosageForm    string    `json:"dosage_form,omitempty"`
+	Strength      string    `json:"strength,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+// FormularyMatch is a formulary drug matched by a search or found in a text
+type FormularyMatch struct {
+	Drug        FormularyDrug `json:"drug"`
+	MatchedName string        `json:"matched_name"`
+	Score       float64       `json:"score"`
+}
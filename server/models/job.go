@@ -0,0 +1,48 @@
+package models
+
+import (
+	"time"
+)
+
+// AIJobKind defines what an AI job analyzes
+type AIJobKind string
+
+const (
+	AIJobKindText  AIJobKind = "text_analysis"  // Prescription text sent as a chat message
+	AIJobKindImage AIJobKind = "image_analysis" // Prescription image uploaded to a chat
+	AIJobKindChat  AIJobKind = "chat_reply"     // Any other chat message, such as a follow-up question
+)
+
+// Billed reports whether jobs of the kind use up an analysis of the user's subscription
+func (k AIJobKind) Billed() bool {
+	return k != AIJobKindChat
+}
+
+// AIJobStatus defines the status of an AI job
+type AIJobStatus string
+
+const (
+	AIJobStatusQueued    AIJobStatus = "queued"
+	AIJobStatusRunning   AIJobStatus = "running"
+	AIJobStatusSucceeded AIJobStatus = "succeeded"
+	AIJobStatusFailed    AIJobStatus = "failed"
+)
+
+// AIJob represents a background AI analysis of a chat message
+type AIJob struct {
+	ID              string      `json:"id"`
+	ChatID          int64       `json:"chat_id"`
+	UserID          int64       `json:"user_id"`
+	Kind            AIJobKind   `json:"kind"`
+	Input           string      `json:"-"` // Prescription text or image URL
+	Status          AIJobStatus `json:"status"`
+	Attempts        int         `json:"attempts"`
+	LastError       *string     `json:"last_error,omitempty"`
+	ResultMessageID *int64      `json:"result_message_id,omitempty"`
+	CreatedAt       time.Time   `json:"created_at"`
+	UpdatedAt       time.Time   `json:"updated_at"`
+	StartedAt       *time.Time  `json:"started_at,omitempty"`
+	FinishedAt      *time.Time  `json:"finished_at,omitempty"`
+	// InterruptedAt is set while a job stopped by a shutdown waits to be resumed
+	InterruptedAt *time.Time `json:"interrupted_at,omitempty"`
+}
@@ -0,0 +1,37 @@
+package models
+
+import (
+	"time"
+)
+
+// OTPRequest asks for a one-time login code to be sent to a phone number
+type OTPRequest struct {
+	Phone string `json:"phone"`
+}
+
+// OTPResponse tells the client when the sent code expires and when another can be requested
+type OTPResponse struct {
+	Phone       string    `json:"phone"` // The number in international format
+	ExpiresAt   time.Time `json:"expires_at"`
+	ResendAfter time.Time `json:"resend_after"`
+}
+
+// OTPVerify logs in with a one-time code. The names and username are only
+// used when no user has the phone number yet, to register one.
+type OTPVerify struct {
+	Phone     string `json:"phone"`
+	Code      string `json:"code"`
+	Username  string `json:"username"`
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+}
+
+// OTPCode is a one-time login code sent to a phone number
+type OTPCode struct {
+	ID         int64      `json:"id"`
+	Phone      string     `json:"phone"`
+	Attempts   int        `json:"attempts"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	ConsumedAt *time.Time `json:"consumed_at,omitempty"`
+}
@@ -0,0 +1,36 @@
+package models
+
+import (
+	"time"
+)
+
+// PaymentStatus defines the status of a gateway payment
+type PaymentStatus string
+
+const (
+	PaymentStatusPending  PaymentStatus = "pending"  // Waiting for the user to pay
+	PaymentStatusVerified PaymentStatus = "verified" // Verified by the gateway and credited
+	PaymentStatusFailed   PaymentStatus = "failed"   // Canceled by the user or rejected by the gateway
+)
+
+// Payment represents a credit top-up paid through a payment gateway
+type Payment struct {
+	ID          int64         `json:"id"`
+	UserID      int64         `json:"user_id"`
+	PharmacyID  *int64        `json:"pharmacy_id,omitempty"` // Pharmacy credited with the top-up
+	Gateway     string        `json:"gateway"`
+	Authority   string        `json:"authority"`
+	Amount      int64         `json:"amount"`
+	Description string        `json:"description"`
+	Status      PaymentStatus `json:"status"`
+	RefID       *string       `json:"ref_id,omitempty"`
+	CardPAN     *string       `json:"card_pan,omitempty"`
+	CreatedAt   time.Time     `json:"created_at"`
+	UpdatedAt   time.Time     `json:"updated_at"`
+	VerifiedAt  *time.Time    `json:"verified_at,omitempty"`
+}
+
+// PaymentCreate represents the data needed to start a credit top-up
+type PaymentCreate struct {
+	Amount int64 `json:"amount"`
+}
@@ -0,0 +1,97 @@
+package models
+
+import (
+	"time"
+)
+
+// PharmacyRole is the role of a member within their pharmacy
+type PharmacyRole string
+
+const (
+	PharmacyRoleOwner      PharmacyRole = "owner"      // Manages members and invitations
+	PharmacyRolePharmacist PharmacyRole = "pharmacist" // Buys plans and sees the pharmacy's credit
+	PharmacyRoleTechnician PharmacyRole = "technician" // Uses the pharmacy's subscription
+)
+
+// IsValid reports whether the role is one of the pharmacy roles
+func (r PharmacyRole) IsValid() bool {
+	switch r {
+	case PharmacyRoleOwner, PharmacyRolePharmacist, PharmacyRoleTechnician:
+		return true
+	}
+	return false
+}
+
+// CanManageMembers reports whether the role may invite, change and remove members
+func (r PharmacyRole) CanManageMembers() bool {
+	return r == PharmacyRoleOwner
+}
+
+// CanManageBilling reports whether the role may buy plans with the pharmacy's
+// credit and see its credit transactions
+func (r PharmacyRole) CanManageBilling() bool {
+	return r == PharmacyRoleOwner || r == PharmacyRolePharmacist
+}
+
+// InvitationStatus defines the state of a pharmacy invitation
+type InvitationStatus string
+
+const (
+	InvitationStatusPending  InvitationStatus = "pending"
+	InvitationStatusAccepted InvitationStatus = "accepted"
+	InvitationStatusDeclined InvitationStatus = "declined"
+	InvitationStatusRevoked  InvitationStatus = "revoked"
+)
+
+// Pharmacy represents a team of users sharing credit, subscriptions and cases
+type Pharmacy struct {
+	ID        int64        `json:"id"`
+	Name      string       `json:"name"`
+	Credit    float64      `json:"credit"`
+	Role      PharmacyRole `json:"role"` // Role of the requesting user
+	CreatedAt time.Time    `json:"created_at"`
+	UpdatedAt time.Time    `json:"updated_at"`
+}
+
+// PharmacyMember represents a user in a pharmacy
+type PharmacyMember struct {
+	UserID    int64        `json:"user_id"`
+	Username  string       `json:"username"`
+	FirstName string       `json:"first_name"`
+	LastName  string       `json:"last_name"`
+	Role      PharmacyRole `json:"role"`
+	JoinedAt  time.Time    `json:"joined_at"`
+}
+
+// PharmacyInvitation invites the owner of an email or phone number to a pharmacy
+type PharmacyInvitation struct {
+	ID           int64            `json:"id"`
+	PharmacyID   int64            `json:"pharmacy_id"`
+	PharmacyName string           `json:"pharmacy_name"`
+	Email        *string          `json:"email,omitempty"`
+	Phone        *string          `json:"phone,omitempty"`
+	Role         PharmacyRole     `json:"role"`
+	Status       InvitationStatus `json:"status"`
+	InvitedBy    int64            `json:"invited_by"`
+	CreatedAt    time.Time        `json:"created_at"`
+	ExpiresAt    time.Time        `json:"expires_at"`
+	RespondedAt  *time.Time       `json:"responded_at,omitempty"`
+}
+
+// PharmacyCreate represents the data needed to create a pharmacy
+type PharmacyCreate struct {
+	Name string `json:"name"`
+}
+
+// PharmacyInvitationCreate represents an invitation to send. Either the email
+// or the phone number is required.
+type PharmacyInvitationCreate struct {
+	Email string       `json:"email,omitempty"`
+	Phone string       `json:"phone,omitempty"`
+	Role  PharmacyRole `json:"role"`
+}
+
+// PharmacyMemberUpdate represents a change of a member's role
+type PharmacyMemberUpdate struct {
+	Role PharmacyRole `json:"role"`
+}
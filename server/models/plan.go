@@ -22,6 +22,15 @@ const (
 	SubscriptionStatusCancelled SubscriptionStatus = "cancelled"
 )
 
+// UsageStatus defines the state of a subscription usage in the ledger
+type UsageStatus string
+
+const (
+	UsageStatusReserved  UsageStatus = "reserved"  // Held while an analysis runs
+	UsageStatusCommitted UsageStatus = "committed" // Charged
+	UsageStatusReleased  UsageStatus = "released"  // Given back after a failed analysis
+)
+
 // GiftType defines the type of gift
 type GiftType string
 
@@ -47,6 +56,7 @@ type Plan struct {
 type UserSubscription struct {
 	ID            int64              `json:"id"`
 	UserID        int64              `json:"user_id"`
+	PharmacyID    *int64             `json:"pharmacy_id,omitempty"` // Set when the subscription belongs to a pharmacy
 	PlanID        int64              `json:"plan_id"`
 	Plan          *Plan              `json:"plan,omitempty"`
 	PurchaseDate  time.Time          `json:"purchase_date"`
@@ -58,17 +68,54 @@ type UserSubscription struct {
 	UpdatedAt     time.Time          `json:"updated_at"`
 }
 
-// CreditTransaction represents a transaction affecting user credit
+// Credit transaction types
+const (
+	CreditTransactionTypeSubscription   = "subscription"    // Plan purchase
+	CreditTransactionTypeGift           = "gift"            // Credit gifted by an admin
+	CreditTransactionTypeTopup          = "topup"           // Verified gateway payment
+	CreditTransactionTypeAdjustment     = "adjustment"      // Manual change by staff
+	CreditTransactionTypeOpeningBalance = "opening_balance" // Credit from before the ledger
+)
+
+// CreditTransaction represents a transaction affecting user credit. Together
+// the transactions of a user form the ledger of their credit. Transactions
+// with a pharmacy ID form the ledger of that pharmacy's credit instead.
 type CreditTransaction struct {
 	ID                    int64     `json:"id"`
 	UserID                int64     `json:"user_id"`
+	PharmacyID            *int64    `json:"pharmacy_id,omitempty"`
 	Amount                float64   `json:"amount"`
+	BalanceAfter          float64   `json:"balance_after"` // User or pharmacy credit after the transaction
 	Description           string    `json:"description"`
 	TransactionType       string    `json:"transaction_type"`
 	RelatedSubscriptionID *int64    `json:"related_subscription_id"`
+	ActorID               *int64    `json:"actor_id"` // User who made the change
 	CreatedAt             time.Time `json:"created_at"`
 }
 
+// CreditDrift reports a user or pharmacy whose credit does not match its ledger
+type CreditDrift struct {
+	UserID           int64    `json:"user_id,omitempty"`
+	PharmacyID       int64    `json:"pharmacy_id,omitempty"`
+	Credit           float64  `json:"credit"`             // users.credit or pharmacies.credit
+	LedgerBalance    float64  `json:"ledger_balance"`     // Sum of the ledger's transactions
+	LastBalanceAfter *float64 `json:"last_balance_after"` // Balance after the last transaction
+	Transactions     int      `json:"transactions"`       // Number of transactions
+}
+
+// CreditEntry describes a change of a user's credit to record in the ledger.
+// With a pharmacy ID, the pharmacy's credit changes instead and UserID is the
+// member it was changed for.
+type CreditEntry struct {
+	UserID                int64
+	PharmacyID            *int64
+	Amount                float64 // Positive for additions, negative for reductions
+	TransactionType       string
+	Description           string
+	ActorID               *int64
+	RelatedSubscriptionID *int64
+}
+
 // GiftTransaction represents a gift from an admin to a user
 type GiftTransaction struct {
 	ID           int64     `json:"id"`
@@ -155,4 +202,5 @@ type UserSubscriptionResponse struct {
 	Status        SubscriptionStatus `json:"status"`
 	UsesCount     int                `json:"uses_count"`
 	RemainingUses *int               `json:"remaining_uses"`
+	PharmacyID    *int64             `json:"pharmacy_id,omitempty"` // Set when the quota is pooled by a pharmacy
 }
@@ -4,7 +4,8 @@ import "time"
 
 // TextAnalysisRequest represents a request to analyze prescription text
 type TextAnalysisRequest struct {
-	Text string `json:"text" binding:"required"`
+	Title string `json:"title,omitempty"`
+	Text  string `json:"text" binding:"required"`
 }
 
 // ImageAnalysisRequest represents a request to analyze a prescription image
@@ -12,8 +13,9 @@ type TextAnalysisRequest struct {
 
 // AnalysisResponse represents the response from the prescription analysis
 type AnalysisResponse struct {
-	Status   string `json:"status"`
-	Analysis string `json:"analysis"`
+	Status         string `json:"status"`
+	Analysis       string `json:"analysis"`
+	PrescriptionID string `json:"prescription_id,omitempty"`
 }
 
 // ErrorResponse represents an error response
@@ -25,9 +27,43 @@ type ErrorResponse struct {
 // Prescription represents a prescription in the database
 type Prescription struct {
 	ID        string    `json:"id"`
+	UserID    int64     `json:"user_id"`
 	Title     string    `json:"title"`
 	Text      string    `json:"text,omitempty"`
 	ImagePath string    `json:"image_path,omitempty"`
 	Analysis  string    `json:"analysis"`
+	ChatID    *int64    `json:"chat_id,omitempty"`    // Chat the prescription was analyzed in
+	MessageID *int64    `json:"message_id,omitempty"` // Assistant reply holding the analysis
 	CreatedAt time.Time `json:"created_at"`
 }
+
+// PrescriptionCreate represents the data needed to save a prescription to the history
+type PrescriptionCreate struct {
+	Title    string `json:"title"`
+	Text     string `json:"text"`
+	Analysis string `json:"analysis"`
+}
+
+// PrescriptionUpdate represents the data needed to update a prescription
+type PrescriptionUpdate struct {
+	Title string `json:"title"`
+}
+
+// PrescriptionFilter selects a page of a user's prescription history
+type PrescriptionFilter struct {
+	UserID int64
+	Query  string     // Full-text search over title, text and analysis
+	From   *time.Time // Created at or after
+	To     *time.Time // Created before
+	ChatID *int64
+	Limit  int
+	Offset int
+}
+
+// PrescriptionPage is a page of a user's prescription history
+type PrescriptionPage struct {
+	Prescriptions []Prescription `json:"prescriptions"`
+	Total         int            `json:"total"`
+	Limit         int            `json:"limit"`
+	Offset        int            `json:"offset"`
+}
@@ -0,0 +1,39 @@
+package models
+
+import (
+	"time"
+)
+
+// Built-in roles
+const (
+	RoleAdmin   = "admin"
+	RoleSupport = "support"
+	RoleFinance = "finance"
+)
+
+// Permission names an action that a role allows
+type Permission string
+
+const (
+	PermissionCreditRead  Permission = "credit:read"  // View the credit of any user
+	PermissionCreditWrite Permission = "credit:write" // Add or subtract credit of any user
+	PermissionPlansWrite  Permission = "plans:write"  // Create subscription plans
+	PermissionGiftsRead   Permission = "gifts:read"   // View gift transactions
+	PermissionGiftsWrite  Permission = "gifts:write"  // Gift plans and credit to users
+	PermissionRolesRead   Permission = "roles:read"   // View roles and the roles of users
+	PermissionRolesWrite  Permission = "roles:write"  // Grant and revoke roles
+)
+
+// Role is a named set of permissions granted to users
+type Role struct {
+	ID          int64        `json:"id"`
+	Name        string       `json:"name"`
+	Description string       `json:"description"`
+	Permissions []Permission `json:"permissions"`
+	CreatedAt   time.Time    `json:"created_at"`
+}
+
+// UserRoleGrant represents a request to grant a role to a user
+type UserRoleGrant struct {
+	Role string `json:"role"`
+}
@@ -0,0 +1,31 @@
+package models
+
+import (
+	"time"
+)
+
+// Session represents a device where a user is logged in
+type Session struct {
+	ID         string     `json:"id"`
+	UserID     int64      `json:"user_id"`
+	UserAgent  string     `json:"user_agent"`
+	IPAddress  string     `json:"ip_address"`
+	Current    bool       `json:"current"` // Whether the request was made from this session
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt time.Time  `json:"last_used_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+// AuthResponse is returned when a user logs in or refreshes their tokens
+type AuthResponse struct {
+	User         UserResponse `json:"user"`
+	Token        string       `json:"token"`         // Short-lived access token
+	ExpiresAt    time.Time    `json:"expires_at"`    // Expiry of the access token
+	RefreshToken string       `json:"refresh_token"` // Single-use token for POST /api/auth/refresh
+}
+
+// RefreshRequest represents a request to refresh or revoke a refresh token
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
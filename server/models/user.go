@@ -5,16 +5,30 @@ import (
 )
 
 type User struct {
-	ID        int64     `json:"id"`
-	Username  string    `json:"username"`
-	Email     string    `json:"email"`
-	Password  string    `json:"-"` // Password will never be sent in JSON responses
-	FirstName string    `json:"first_name"`
-	LastName  string    `json:"last_name"`
-	Credit    float64   `json:"credit"`
-	IsAdmin   bool      `json:"is_admin"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	ID            int64        `json:"id"`
+	Username      string       `json:"username"`
+	Email         string       `json:"email"`
+	Phone         string       `json:"phone"`
+	Password      string       `json:"-"` // Password will never be sent in JSON responses
+	FirstName     string       `json:"first_name"`
+	LastName      string       `json:"last_name"`
+	Credit        float64      `json:"credit"`
+	EmailVerified bool         `json:"email_verified"` // Whether the user proved they own their email
+	IsAdmin       bool         `json:"is_admin"`       // Whether the user has the admin role
+	Roles         []string     `json:"roles"`          // Names of the user's roles
+	Permissions   []Permission `json:"permissions"`    // Every permission granted by the roles
+	CreatedAt     time.Time    `json:"created_at"`
+	UpdatedAt     time.Time    `json:"updated_at"`
+}
+
+// HasRole reports whether the user has the role
+func (u *User) HasRole(role string) bool {
+	for _, r := range u.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
 }
 
 type UserCreate struct {
@@ -31,12 +45,16 @@ type UserLogin struct {
 }
 
 type UserResponse struct {
-	ID        int64     `json:"id"`
-	Username  string    `json:"username"`
-	Email     string    `json:"email"`
-	FirstName string    `json:"first_name"`
-	LastName  string    `json:"last_name"`
-	Credit    float64   `json:"credit"`
-	IsAdmin   bool      `json:"is_admin"`
-	CreatedAt time.Time `json:"created_at"`
+	ID            int64        `json:"id"`
+	Username      string       `json:"username"`
+	Email         string       `json:"email"`
+	Phone         string       `json:"phone"`
+	FirstName     string       `json:"first_name"`
+	LastName      string       `json:"last_name"`
+	Credit        float64      `json:"credit"`
+	EmailVerified bool         `json:"email_verified"`
+	IsAdmin       bool         `json:"is_admin"`
+	Roles         []string     `json:"roles"`
+	Permissions   []Permission `json:"permissions"`
+	CreatedAt     time.Time    `json:"created_at"`
 }
@@ -0,0 +1,389 @@
+package nats
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/darooyar/server/logging"
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	// StreamAIJobs is the JetStream stream holding AI analysis jobs
+	StreamAIJobs = "AI_JOBS"
+	// SubjectAIJobAnalyze carries jobs waiting to be processed
+	SubjectAIJobAnalyze = "ai.jobs.analyze"
+	// SubjectAIJobDead receives jobs that failed every delivery attempt
+	SubjectAIJobDead = "ai.jobs.dead"
+
+	// aiJobConsumer is the durable consumer shared by all workers
+	aiJobConsumer = "ai-job-workers"
+	// aiJobDeliverSubject is where the consumer pushes jobs to the workers
+	aiJobDeliverSubject = "ai.jobs.deliver"
+)
+
+const (
+	// aiJobMaxAttempts is how many times a job is delivered before it is dead-lettered
+	aiJobMaxAttempts = 5
+	// aiJobAckWait is how long the server waits for an ack or progress signal before redelivering
+	aiJobAckWait = 2 * time.Minute
+	// aiJobConcurrency bounds the number of jobs a single worker runs at once
+	aiJobConcurrency = 4
+	// aiJobBaseBackoff is the delay before the first retry, doubled for each further attempt
+	aiJobBaseBackoff = 5 * time.Second
+	// aiJobMaxBackoff caps the retry delay
+	aiJobMaxBackoff = 2 * time.Minute
+	// aiJobInterruptGrace is how long canceled jobs get to record themselves for resuming
+	aiJobInterruptGrace = 10 * time.Second
+	// aiJobInterruptRedelay is how long an interrupted job waits before it is
+	// delivered to another worker
+	aiJobInterruptRedelay = time.Second
+)
+
+// ErrAIJobInterrupted is returned by an AIJobHandler when the server stopped
+// the job before it finished. The job is handed back to JetStream for a
+// server that is still running, and the handler has recorded it so that it
+// is resumed after restart if none is. It is not counted as a failure.
+var ErrAIJobInterrupted = errors.New("AI job interrupted by server shutdown")
+
+// AIJobHandler processes a single job attempt. final is true on the last
+// attempt, when the handler should record a permanent failure instead of
+// expecting a retry. When ctx is canceled because the server is stopping, the
+// handler records the job for resuming and returns ErrAIJobInterrupted.
+type AIJobHandler func(ctx context.Context, jobID string, attempt int, final bool) error
+
+// aiJobMessage is the payload published for every job
+type aiJobMessage struct {
+	JobID string `json:"job_id"`
+	// RequestID is the ID of the request that queued the job, for the logs of the worker
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// aiDeadJobMessage is published to the dead-letter subject
+type aiDeadJobMessage struct {
+	JobID    string `json:"job_id"`
+	Attempts int    `json:"attempts"`
+	Error    string `json:"error"`
+}
+
+// jetStream is the JetStream context used for AI jobs, nil until the stream is set up
+var jetStream nats.JetStreamContext
+
+var (
+	// aiJobsMu guards aiJobsDraining and aiJobSub
+	aiJobsMu sync.Mutex
+	// aiJobsDraining is set once the server stops starting AI jobs
+	aiJobsDraining bool
+	// aiJobSub is the subscription of the worker, nil until it is started
+	aiJobSub *nats.Subscription
+	// aiJobsRunning counts the AI jobs running in this process
+	aiJobsRunning sync.WaitGroup
+)
+
+// InitAIJobStream creates the AI job stream if it does not exist yet
+func InitAIJobStream() error {
+	if NatsConn == nil {
+		return errors.New("NATS connection not initialized")
+	}
+
+	js, err := NatsConn.JetStream()
+	if err != nil {
+		return fmt.Errorf("error getting JetStream context: %v", err)
+	}
+
+	_, err = js.StreamInfo(StreamAIJobs)
+	if errors.Is(err, nats.ErrStreamNotFound) {
+		_, err = js.AddStream(&nats.StreamConfig{
+			Name:      StreamAIJobs,
+			Subjects:  []string{SubjectAIJobAnalyze, SubjectAIJobDead},
+			Storage:   nats.FileStorage,
+			Retention: nats.LimitsPolicy,
+			MaxAge:    7 * 24 * time.Hour,
+		})
+	}
+	if err != nil {
+		return fmt.Errorf("error setting up %s stream: %v", StreamAIJobs, err)
+	}
+
+	jetStream = js
+	slog.Info("JetStream stream ready", "stream", StreamAIJobs)
+	return nil
+}
+
+// AIJobQueueAvailable reports whether jobs can be published to JetStream
+func AIJobQueueAvailable() bool {
+	return jetStream != nil
+}
+
+// PublishAIJob queues a job for processing by a worker. The request ID of ctx
+// is passed on to the worker.
+func PublishAIJob(ctx context.Context, jobID string) error {
+	// The job ID doubles as the message ID so duplicate publishes are dropped
+	return publishAIJob(ctx, jobID, jobID)
+}
+
+// RepublishAIJob queues a job that was interrupted by a server shutdown. It is
+// published under a new message ID, since JetStream drops a message with the
+// ID of the first publish while it is in the duplicate window.
+func RepublishAIJob(ctx context.Context, jobID string) error {
+	return publishAIJob(ctx, jobID, fmt.Sprintf("%s-resumed-%d", jobID, time.Now().UnixNano()))
+}
+
+// publishAIJob publishes a job to the stream under the given message ID
+func publishAIJob(ctx context.Context, jobID string, msgID string) error {
+	if jetStream == nil {
+		return errors.New("AI job stream not initialized")
+	}
+
+	data, err := json.Marshal(aiJobMessage{JobID: jobID, RequestID: logging.RequestID(ctx)})
+	if err != nil {
+		return err
+	}
+
+	_, err = jetStream.Publish(SubjectAIJobAnalyze, data, nats.MsgId(msgID), nats.Context(ctx))
+	return err
+}
+
+// StartAIJobWorker consumes AI jobs from JetStream. Each message is acked only
+// after the handler succeeds; failures are redelivered with exponential
+// backoff and moved to the dead-letter subject after the last attempt. Jobs
+// run under ctx, so they are canceled when it is done.
+func StartAIJobWorker(ctx context.Context, handler AIJobHandler) (*nats.Subscription, error) {
+	if jetStream == nil {
+		return nil, errors.New("AI job stream not initialized")
+	}
+
+	if err := ensureAIJobConsumer(); err != nil {
+		return nil, err
+	}
+
+	slots := make(chan struct{}, aiJobConcurrency)
+
+	// The subscription binds to the consumer rather than creating it, since a
+	// consumer created by a subscription is deleted when it is drained, and the
+	// consumer is shared by every replica
+	sub, err := jetStream.QueueSubscribe(SubjectAIJobAnalyze, aiJobConsumer, func(msg *nats.Msg) {
+		// Wait for a free slot so that unacked messages stay with the server
+		slots <- struct{}{}
+		go func() {
+			defer func() { <-slots }()
+			processAIJobMessage(ctx, msg, handler)
+		}()
+	},
+		nats.Bind(StreamAIJobs, aiJobConsumer),
+		nats.ManualAck(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error subscribing to %s: %v", SubjectAIJobAnalyze, err)
+	}
+
+	aiJobsMu.Lock()
+	aiJobSub = sub
+	aiJobsMu.Unlock()
+
+	slog.Info("AI job worker subscribed", "subject", SubjectAIJobAnalyze)
+	return sub, nil
+}
+
+// ensureAIJobConsumer creates the durable consumer of the AI job workers if it
+// does not exist yet
+func ensureAIJobConsumer() error {
+	_, err := jetStream.ConsumerInfo(StreamAIJobs, aiJobConsumer)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, nats.ErrConsumerNotFound) {
+		return fmt.Errorf("error looking up %s consumer: %v", aiJobConsumer, err)
+	}
+
+	_, err = jetStream.AddConsumer(StreamAIJobs, &nats.ConsumerConfig{
+		Durable:        aiJobConsumer,
+		DeliverSubject: aiJobDeliverSubject,
+		DeliverGroup:   aiJobConsumer,
+		FilterSubject:  SubjectAIJobAnalyze,
+		AckPolicy:      nats.AckExplicitPolicy,
+		AckWait:        aiJobAckWait,
+		MaxDeliver:     aiJobMaxAttempts,
+		MaxAckPending:  aiJobConcurrency,
+	})
+	if err != nil {
+		return fmt.Errorf("error creating %s consumer: %v", aiJobConsumer, err)
+	}
+	return nil
+}
+
+// processAIJobMessage runs the handler for one delivery and acks, naks or
+// dead-letters the message depending on the outcome
+func processAIJobMessage(ctx context.Context, msg *nats.Msg, handler AIJobHandler) {
+	var job aiJobMessage
+	if err := json.Unmarshal(msg.Data, &job); err != nil || job.JobID == "" {
+		slog.Error("Discarding malformed AI job message", "size", len(msg.Data))
+		msg.Term()
+		return
+	}
+
+	attempt := 1
+	if meta, err := msg.Metadata(); err == nil {
+		attempt = int(meta.NumDelivered)
+	}
+	final := attempt >= aiJobMaxAttempts
+
+	ctx, done := trackAIJob(logging.WithRequestID(ctx, job.RequestID))
+	defer done()
+
+	// Tell the server we are still working so the job is not redelivered mid-analysis
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		ticker := time.NewTicker(aiJobAckWait / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := msg.InProgress(); err != nil {
+					slog.ErrorContext(ctx, "Error extending AI job", "job_id", job.JobID, "error", err)
+				}
+			}
+		}
+	}()
+
+	err := handler(ctx, job.JobID, attempt, final)
+	cancel()
+
+	if err == nil {
+		if ackErr := msg.Ack(); ackErr != nil {
+			slog.ErrorContext(ctx, "Error acking AI job", "job_id", job.JobID, "error", ackErr)
+		}
+		return
+	}
+
+	// Another server that is still running picks the job up. When every
+	// server stops, the mark in the database resumes it after restart.
+	if errors.Is(err, ErrAIJobInterrupted) {
+		if nakErr := msg.NakWithDelay(aiJobInterruptRedelay); nakErr != nil {
+			slog.ErrorContext(ctx, "Error handing interrupted AI job back to the queue", "job_id", job.JobID, "error", nakErr)
+		}
+		return
+	}
+
+	if !final {
+		delay := aiJobBackoff(attempt)
+		slog.WarnContext(ctx, "AI job attempt failed, retrying", "job_id", job.JobID, "attempt", attempt, "delay", delay, "error", err)
+		if nakErr := msg.NakWithDelay(delay); nakErr != nil {
+			slog.ErrorContext(ctx, "Error scheduling retry of AI job", "job_id", job.JobID, "error", nakErr)
+		}
+		return
+	}
+
+	slog.ErrorContext(ctx, "AI job failed after the last attempt, moving it to the dead-letter subject", "job_id", job.JobID, "attempts", attempt, "subject", SubjectAIJobDead, "error", err)
+	data, _ := json.Marshal(aiDeadJobMessage{JobID: job.JobID, Attempts: attempt, Error: err.Error()})
+	if _, pubErr := jetStream.Publish(SubjectAIJobDead, data); pubErr != nil {
+		slog.ErrorContext(ctx, "Error publishing AI job to dead-letter subject", "job_id", job.JobID, "error", pubErr)
+	}
+	msg.Term()
+}
+
+// RunAIJobInProcess runs a job in the current process with the same retry
+// policy as the JetStream worker. It is used when NATS is unavailable.
+func RunAIJobInProcess(ctx context.Context, handler AIJobHandler, jobID string) {
+	ctx, done := trackAIJob(ctx)
+	defer done()
+
+	for attempt := 1; attempt <= aiJobMaxAttempts; attempt++ {
+		final := attempt == aiJobMaxAttempts
+		err := handler(ctx, jobID, attempt, final)
+		if err == nil || errors.Is(err, ErrAIJobInterrupted) {
+			return
+		}
+		if final {
+			slog.ErrorContext(ctx, "AI job failed after the last attempt", "job_id", jobID, "attempts", attempt, "error", err)
+			return
+		}
+
+		delay := aiJobBackoff(attempt)
+		slog.WarnContext(ctx, "AI job attempt failed, retrying", "job_id", jobID, "attempt", attempt, "delay", delay, "error", err)
+
+		// When ctx is canceled while waiting, the next attempt records the job for resuming
+		select {
+		case <-ctx.Done():
+		case <-time.After(delay):
+		}
+	}
+}
+
+// DrainAIJobs stops starting AI jobs and waits for the running ones to
+// finish. The worker stops taking deliveries, so that other replicas get the
+// queued jobs. Jobs it already received, and jobs run in-process from then
+// on, are handed to their handler with a canceled context, so that they are
+// recorded for resuming after restart.
+// If jobs are still running when ctx is done, cancelJobs is called to cancel
+// them, they get a short grace period to record themselves, and ctx.Err() is
+// returned.
+func DrainAIJobs(ctx context.Context, cancelJobs context.CancelFunc) error {
+	aiJobsMu.Lock()
+	aiJobsDraining = true
+	sub := aiJobSub
+	aiJobsMu.Unlock()
+
+	if sub != nil {
+		if err := sub.Drain(); err != nil {
+			slog.Error("Error draining AI job subscription", "error", err)
+		}
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		aiJobsRunning.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+	}
+
+	cancelJobs()
+	select {
+	case <-finished:
+	case <-time.After(aiJobInterruptGrace):
+		slog.Error("AI jobs did not stop after being canceled", "grace", aiJobInterruptGrace)
+	}
+	return ctx.Err()
+}
+
+// trackAIJob counts a job as running until done is called, so that draining
+// waits for it. Once the server is draining, the job is not counted and the
+// returned context is already canceled.
+func trackAIJob(ctx context.Context) (context.Context, func()) {
+	aiJobsMu.Lock()
+	defer aiJobsMu.Unlock()
+
+	if aiJobsDraining {
+		ctx, cancel := context.WithCancel(ctx)
+		cancel()
+		return ctx, func() {}
+	}
+
+	aiJobsRunning.Add(1)
+	return ctx, aiJobsRunning.Done
+}
+
+// aiJobBackoff returns the delay before retrying after the given attempt
+func aiJobBackoff(attempt int) time.Duration {
+	delay := aiJobBaseBackoff
+	for i := 1; i < attempt; i++ {
+		delay *= 2
+		if delay >= aiJobMaxBackoff {
+			return aiJobMaxBackoff
+		}
+	}
+	return delay
+}
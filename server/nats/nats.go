@@ -1,7 +1,7 @@
 package nats
 
 import (
-	"log"
+	"log/slog"
 	"os"
 	"time"
 
@@ -29,13 +29,13 @@ func InitNATS() error {
 		nats.ReconnectWait(5*time.Second),
 		nats.MaxReconnects(10),
 		nats.DisconnectErrHandler(func(nc *nats.Conn, err error) {
-			log.Printf("NATS disconnected: %v", err)
+			slog.Warn("NATS disconnected", "error", err)
 		}),
 		nats.ReconnectHandler(func(nc *nats.Conn) {
-			log.Printf("NATS reconnected to %s", nc.ConnectedUrl())
+			slog.Info("NATS reconnected", "url", nc.ConnectedUrl())
 		}),
 		nats.ClosedHandler(func(nc *nats.Conn) {
-			log.Printf("NATS connection closed")
+			slog.Info("NATS connection closed")
 		}),
 	)
 
@@ -43,7 +43,7 @@ func InitNATS() error {
 		return err
 	}
 
-	log.Printf("Connected to NATS server at %s", NatsConn.ConnectedUrl())
+	slog.Info("Connected to NATS server", "url", NatsConn.ConnectedUrl())
 	return nil
 }
 
@@ -51,6 +51,6 @@ func InitNATS() error {
 func CloseNATS() {
 	if NatsConn != nil {
 		NatsConn.Close()
-		log.Println("NATS connection closed")
+		slog.Info("NATS connection closed")
 	}
 }
@@ -0,0 +1,35 @@
+package nats
+
+import (
+	"fmt"
+
+	"github.com/nats-io/nats.go"
+)
+
+// subjectChatStreams matches the subjects of the stream events of every chat
+const subjectChatStreams = "chat.*.stream"
+
+// ChatStreamSubject is the subject the stream events of a chat are sent on
+func ChatStreamSubject(chatID int64) string {
+	return fmt.Sprintf("chat.%d.stream", chatID)
+}
+
+// PublishChatStreamEvent sends a stream event of a chat to every server
+func PublishChatStreamEvent(chatID int64, data []byte) error {
+	if NatsConn == nil {
+		return fmt.Errorf("NATS is not connected")
+	}
+	return NatsConn.Publish(ChatStreamSubject(chatID), data)
+}
+
+// SubscribeChatStreams calls handler with the stream events of every chat,
+// including those this server sent. Events of a chat arrive in the order
+// they were sent.
+func SubscribeChatStreams(handler func(data []byte)) (*nats.Subscription, error) {
+	if NatsConn == nil {
+		return nil, fmt.Errorf("NATS is not connected")
+	}
+	return NatsConn.Subscribe(subjectChatStreams, func(msg *nats.Msg) {
+		handler(msg.Data)
+	})
+}
@@ -0,0 +1,83 @@
+package payments
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// FakeGateway is an in-memory gateway for tests and local development. Its
+// redirect URL leads straight back to the callback as a successful payment,
+// so the whole top-up flow can run without a real gateway.
+type FakeGateway struct {
+	mu       sync.Mutex
+	payments map[string]int64
+}
+
+// NewFakeGateway creates a fake gateway that accepts every payment
+func NewFakeGateway() *FakeGateway {
+	return &FakeGateway{
+		payments: make(map[string]int64),
+	}
+}
+
+// Name identifies the gateway in stored payments
+func (g *FakeGateway) Name() string {
+	return "fake"
+}
+
+// Request records the payment and returns its callback URL as the payment page
+func (g *FakeGateway) Request(ctx context.Context, req PaymentRequest) (*PaymentResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	authority := "FAKE-" + uuid.New().String()
+
+	g.mu.Lock()
+	g.payments[authority] = req.Amount
+	g.mu.Unlock()
+
+	separator := "?"
+	if strings.Contains(req.CallbackURL, "?") {
+		separator = "&"
+	}
+	query := url.Values{"Authority": {authority}, "Status": {"OK"}}
+
+	return &PaymentResult{
+		Authority:   authority,
+		RedirectURL: req.CallbackURL + separator + query.Encode(),
+	}, nil
+}
+
+// Cancel makes the gateway reject a payment it created, as if the user
+// canceled it on the payment page
+func (g *FakeGateway) Cancel(authority string) {
+	g.mu.Lock()
+	delete(g.payments, authority)
+	g.mu.Unlock()
+}
+
+// Verify confirms payments it created for the same amount
+func (g *FakeGateway) Verify(ctx context.Context, req VerifyRequest) (*VerifyResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	g.mu.Lock()
+	amount, ok := g.payments[req.Authority]
+	g.mu.Unlock()
+
+	if !ok || amount != req.Amount {
+		return nil, fmt.Errorf("%w: unknown fake payment %s", ErrVerificationFailed, req.Authority)
+	}
+
+	return &VerifyResult{
+		RefID:   strings.TrimPrefix(req.Authority, "FAKE-"),
+		CardPAN: "6037-99**-****-0000",
+	}, nil
+}
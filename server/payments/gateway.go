@@ -0,0 +1,73 @@
+// Package payments talks to the payment gateways through which users buy
+// credit. A payment is created with the gateway, the user is redirected to
+// pay, and the gateway calls back so that the payment can be verified.
+package payments
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/darooyar/server/config"
+)
+
+// ErrNotConfigured is returned when the selected gateway is missing required settings
+var ErrNotConfigured = errors.New("payment gateway not configured")
+
+// ErrVerificationFailed is returned when the gateway does not confirm a payment
+var ErrVerificationFailed = errors.New("payment verification failed")
+
+// PaymentRequest describes a payment to create with the gateway
+type PaymentRequest struct {
+	// Amount is in Tomans, the unit of user credit
+	Amount      int64
+	Description string
+	CallbackURL string
+	Email       string
+}
+
+// PaymentResult is the gateway's answer to a payment request
+type PaymentResult struct {
+	// Authority identifies the payment in the gateway's callback
+	Authority string
+	// RedirectURL is the page where the user pays
+	RedirectURL string
+}
+
+// VerifyRequest asks the gateway to confirm a payment after its callback
+type VerifyRequest struct {
+	Authority string
+	Amount    int64
+}
+
+// VerifyResult holds the gateway's receipt of a confirmed payment
+type VerifyResult struct {
+	RefID   string
+	CardPAN string
+}
+
+// Gateway is implemented by every payment gateway the server can talk to
+type Gateway interface {
+	// Name identifies the gateway in stored payments
+	Name() string
+	// Request creates a payment and returns where the user pays it
+	Request(ctx context.Context, req PaymentRequest) (*PaymentResult, error)
+	// Verify confirms a payment after the user returned from the gateway.
+	// It returns ErrVerificationFailed when the payment was not made.
+	Verify(ctx context.Context, req VerifyRequest) (*VerifyResult, error)
+}
+
+// NewGateway creates the gateway selected in the configuration
+func NewGateway(cfg *config.Config) (Gateway, error) {
+	switch cfg.PaymentGateway {
+	case "", "zarinpal":
+		if cfg.ZarinpalMerchantID == "" {
+			return nil, fmt.Errorf("%w: ZARINPAL_MERCHANT_ID is not set", ErrNotConfigured)
+		}
+		return NewZarinpalGateway(cfg.ZarinpalMerchantID, cfg.ZarinpalSandbox), nil
+	case "fake":
+		return NewFakeGateway(), nil
+	default:
+		return nil, fmt.Errorf("unknown payment gateway %q", cfg.PaymentGateway)
+	}
+}
@@ -0,0 +1,170 @@
+package payments
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	zarinpalBaseURL        = "https://payment.zarinpal.com/pg"
+	zarinpalSandboxBaseURL = "https://sandbox.zarinpal.com/pg"
+
+	// zarinpalCurrency makes Zarinpal take amounts in Tomans
+	zarinpalCurrency = "IRT"
+
+	// zarinpalCodeSuccess is returned for successful requests and verifications
+	zarinpalCodeSuccess = 100
+	// zarinpalCodeAlreadyVerified is returned when a payment is verified again
+	zarinpalCodeAlreadyVerified = 101
+)
+
+// ZarinpalGateway talks to the Zarinpal REST API (version 4)
+type ZarinpalGateway struct {
+	merchantID string
+	baseURL    string
+	client     *http.Client
+}
+
+// NewZarinpalGateway creates a gateway for the merchant, using the sandbox when requested
+func NewZarinpalGateway(merchantID string, sandbox bool) *ZarinpalGateway {
+	baseURL := zarinpalBaseURL
+	if sandbox {
+		baseURL = zarinpalSandboxBaseURL
+	}
+
+	return &ZarinpalGateway{
+		merchantID: merchantID,
+		baseURL:    baseURL,
+		client:     &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// zarinpalResponse is the envelope of every Zarinpal API response. Data holds
+// an object on success, and Errors holds one on failure.
+type zarinpalResponse struct {
+	Data   json.RawMessage `json:"data"`
+	Errors json.RawMessage `json:"errors"`
+}
+
+// zarinpalError is the error object of a failed request
+type zarinpalError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *zarinpalError) Error() string {
+	return fmt.Sprintf("zarinpal code %d: %s", e.Code, e.Message)
+}
+
+// Name identifies the gateway in stored payments
+func (g *ZarinpalGateway) Name() string {
+	return "zarinpal"
+}
+
+// Request creates a payment and returns the StartPay page of its authority
+func (g *ZarinpalGateway) Request(ctx context.Context, req PaymentRequest) (*PaymentResult, error) {
+	body := map[string]interface{}{
+		"merchant_id":  g.merchantID,
+		"amount":       req.Amount,
+		"currency":     zarinpalCurrency,
+		"description":  req.Description,
+		"callback_url": req.CallbackURL,
+	}
+	if req.Email != "" {
+		body["metadata"] = map[string]string{"email": req.Email}
+	}
+
+	var data struct {
+		Code      int    `json:"code"`
+		Message   string `json:"message"`
+		Authority string `json:"authority"`
+	}
+	if err := g.post(ctx, "/v4/payment/request.json", body, &data); err != nil {
+		return nil, err
+	}
+	if data.Code != zarinpalCodeSuccess || data.Authority == "" {
+		return nil, fmt.Errorf("zarinpal payment request failed with code %d: %s", data.Code, data.Message)
+	}
+
+	return &PaymentResult{
+		Authority:   data.Authority,
+		RedirectURL: g.baseURL + "/StartPay/" + data.Authority,
+	}, nil
+}
+
+// Verify confirms a payment. Verifying a payment again succeeds with the same receipt.
+func (g *ZarinpalGateway) Verify(ctx context.Context, req VerifyRequest) (*VerifyResult, error) {
+	body := map[string]interface{}{
+		"merchant_id": g.merchantID,
+		"amount":      req.Amount,
+		"authority":   req.Authority,
+	}
+
+	var data struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+		RefID   int64  `json:"ref_id"`
+		CardPAN string `json:"card_pan"`
+	}
+	err := g.post(ctx, "/v4/payment/verify.json", body, &data)
+	var apiErr *zarinpalError
+	if errors.As(err, &apiErr) {
+		// Zarinpal rejects payments that were canceled, underpaid or unknown
+		return nil, fmt.Errorf("%w: %v", ErrVerificationFailed, apiErr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if data.Code != zarinpalCodeSuccess && data.Code != zarinpalCodeAlreadyVerified {
+		return nil, fmt.Errorf("%w: zarinpal code %d: %s", ErrVerificationFailed, data.Code, data.Message)
+	}
+
+	return &VerifyResult{
+		RefID:   strconv.FormatInt(data.RefID, 10),
+		CardPAN: data.CardPAN,
+	}, nil
+}
+
+// post sends a request to the API and decodes the data of its response.
+// Errors reported by Zarinpal are returned as *zarinpalError.
+func (g *ZarinpalGateway) post(ctx context.Context, path string, body interface{}, data interface{}) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, g.baseURL+path, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error calling zarinpal: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var envelope zarinpalResponse
+	if err := json.NewDecoder(resp.Body).Decode(&envelope); err != nil {
+		return fmt.Errorf("error decoding zarinpal response (status %d): %v", resp.StatusCode, err)
+	}
+
+	// Failed requests carry an error object, successful ones an empty array
+	var apiErr zarinpalError
+	if json.Unmarshal(envelope.Errors, &apiErr) == nil && apiErr.Code != 0 {
+		return &apiErr
+	}
+
+	if err := json.Unmarshal(envelope.Data, data); err != nil {
+		return fmt.Errorf("error decoding zarinpal data (status %d): %v", resp.StatusCode, err)
+	}
+	return nil
+}
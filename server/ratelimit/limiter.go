@@ -0,0 +1,121 @@
+// Package ratelimit throttles clients with token buckets kept in memory, in
+// Postgres or in a NATS key-value bucket.
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/darooyar/server/config"
+	"github.com/nats-io/nats.go"
+)
+
+// ErrNotConfigured is returned when the selected store is missing what it needs
+var ErrNotConfigured = errors.New("rate limit store not configured")
+
+// Policy is a token bucket holding up to Burst requests that refills at Limit
+// requests per Period
+type Policy struct {
+	Name   string // Keeps the buckets of different policies apart
+	Limit  int
+	Period time.Duration
+	Burst  int
+}
+
+// interval is the time in which the bucket regains one request
+func (p Policy) interval() time.Duration {
+	return p.Period / time.Duration(p.Limit)
+}
+
+// Result is the outcome of taking a request from a bucket
+type Result struct {
+	Allowed    bool
+	Limit      int           // Size of the bucket
+	Remaining  int           // Requests left in the bucket
+	RetryAfter time.Duration // Time until the next request is allowed, when it was not
+	ResetAfter time.Duration // Time until the bucket is full again
+}
+
+// Store keeps the state of every bucket. Stores shared by several servers
+// make limits hold across replicas.
+type Store interface {
+	// Name identifies the store in logs
+	Name() string
+	// Update atomically replaces the state of a bucket with the one returned
+	// by fn. The state is the zero time for a bucket that has none, and a
+	// state may be forgotten once it is in the past.
+	Update(ctx context.Context, key string, fn func(state time.Time) time.Time) error
+}
+
+// NewStore creates the store selected in the configuration. The NATS store
+// uses the connection nc, which may be nil for the other stores.
+func NewStore(cfg *config.Config, nc *nats.Conn) (Store, error) {
+	switch cfg.RateLimitStore {
+	case "", "memory":
+		return NewMemoryStore(), nil
+	case "postgres":
+		return NewPostgresStore()
+	case "nats":
+		return NewNATSStore(nc)
+	default:
+		return nil, fmt.Errorf("unknown rate limit store %q", cfg.RateLimitStore)
+	}
+}
+
+// Limiter takes requests from the buckets in a store
+type Limiter struct {
+	store Store
+	now   func() time.Time // Replaced in tests to move time forward
+}
+
+// NewLimiter creates a limiter keeping its buckets in the store
+func NewLimiter(store Store) *Limiter {
+	return &Limiter{store: store, now: time.Now}
+}
+
+// Store returns the store the limiter keeps its buckets in
+func (l *Limiter) Store() Store {
+	return l.store
+}
+
+// Allow takes one request from the client's bucket of the policy.
+//
+// The state of a bucket is the time at which it will be full again. Every
+// request moves that time one interval later, and a request is allowed while
+// the time stays within Burst intervals of now. This is the generic cell rate
+// algorithm, which behaves exactly like a token bucket but needs a single
+// value per bucket.
+func (l *Limiter) Allow(ctx context.Context, policy Policy, client string) (Result, error) {
+	interval := policy.interval()
+	capacity := interval * time.Duration(policy.Burst)
+	result := Result{Limit: policy.Burst}
+
+	err := l.store.Update(ctx, policy.Name+":"+client, func(fullAt time.Time) time.Time {
+		now := l.now()
+		if fullAt.Before(now) {
+			fullAt = now
+		}
+
+		next := fullAt.Add(interval)
+		if wait := next.Sub(now) - capacity; wait > 0 {
+			result.Allowed = false
+			result.RetryAfter = wait
+			result.Remaining = 0
+			result.ResetAfter = fullAt.Sub(now)
+			return fullAt
+		}
+
+		result.Allowed = true
+		result.RetryAfter = 0
+		result.Remaining = int((capacity - next.Sub(now)) / interval)
+		result.ResetAfter = next.Sub(now)
+		return next
+	})
+	if err != nil {
+		return Result{}, err
+	}
+
+	return result, nil
+}
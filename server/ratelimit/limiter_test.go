@@ -0,0 +1,168 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/darooyar/server/db/dbtest"
+)
+
+// testPolicy refills one request a second into a bucket of three
+var testPolicy = Policy{Name: "test", Limit: 60, Period: time.Minute, Burst: 3}
+
+// step takes a request after moving the clock forward
+type step struct {
+	advance       time.Duration
+	wantAllowed   bool
+	wantRemaining int
+	wantRetry     time.Duration
+}
+
+// testStore opens a store for a test
+type testStore struct {
+	name string
+	open func(t *testing.T) Store
+}
+
+// stores returns the stores to run the limiter tests against. The Postgres
+// store is only tested when a test database is configured.
+func stores() []testStore {
+	return []testStore{
+		{name: "memory", open: func(t *testing.T) Store {
+			return NewMemoryStore()
+		}},
+		{name: "postgres", open: func(t *testing.T) Store {
+			dbtest.Migrated(t)
+			store, err := NewPostgresStore()
+			if err != nil {
+				t.Fatalf("creating postgres store: %v", err)
+			}
+			return store
+		}},
+	}
+}
+
+// newTestLimiter creates a limiter whose clock only moves when the returned
+// function is called. The clock starts at a whole second, which Postgres
+// stores without rounding.
+func newTestLimiter(store Store) (*Limiter, func(time.Duration)) {
+	now := time.Now().Truncate(time.Second)
+	limiter := NewLimiter(store)
+	limiter.now = func() time.Time { return now }
+	return limiter, func(d time.Duration) { now = now.Add(d) }
+}
+
+func TestLimiterAllow(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{name: "burst", steps: []step{
+			{wantAllowed: true, wantRemaining: 2},
+			{wantAllowed: true, wantRemaining: 1},
+			{wantAllowed: true, wantRemaining: 0},
+			{wantAllowed: false, wantRetry: time.Second},
+			{advance: 500 * time.Millisecond, wantAllowed: false, wantRetry: 500 * time.Millisecond},
+		}},
+		{name: "refill", steps: []step{
+			{wantAllowed: true, wantRemaining: 2},
+			{wantAllowed: true, wantRemaining: 1},
+			{wantAllowed: true, wantRemaining: 0},
+			{advance: time.Second, wantAllowed: true, wantRemaining: 0},
+			{advance: 2 * time.Second, wantAllowed: true, wantRemaining: 1},
+			{wantAllowed: true, wantRemaining: 0},
+			{wantAllowed: false, wantRetry: time.Second},
+		}},
+		{name: "full after idle", steps: []step{
+			{wantAllowed: true, wantRemaining: 2},
+			{wantAllowed: true, wantRemaining: 1},
+			{wantAllowed: true, wantRemaining: 0},
+			{advance: time.Hour, wantAllowed: true, wantRemaining: 2},
+		}},
+		{name: "denied requests take nothing", steps: []step{
+			{wantAllowed: true, wantRemaining: 2},
+			{wantAllowed: true, wantRemaining: 1},
+			{wantAllowed: true, wantRemaining: 0},
+			{wantAllowed: false, wantRetry: time.Second},
+			{wantAllowed: false, wantRetry: time.Second},
+			{advance: time.Second, wantAllowed: true, wantRemaining: 0},
+		}},
+	}
+
+	for _, store := range stores() {
+		for _, tt := range tests {
+			t.Run(store.name+"/"+tt.name, func(t *testing.T) {
+				limiter, advance := newTestLimiter(store.open(t))
+
+				for i, s := range tt.steps {
+					advance(s.advance)
+					result, err := limiter.Allow(context.Background(), testPolicy, "client")
+					if err != nil {
+						t.Fatalf("request %d: %v", i+1, err)
+					}
+					if result.Allowed != s.wantAllowed {
+						t.Fatalf("request %d: allowed = %v, want %v", i+1, result.Allowed, s.wantAllowed)
+					}
+					if result.Remaining != s.wantRemaining {
+						t.Errorf("request %d: remaining = %d, want %d", i+1, result.Remaining, s.wantRemaining)
+					}
+					if result.RetryAfter != s.wantRetry {
+						t.Errorf("request %d: retry after = %v, want %v", i+1, result.RetryAfter, s.wantRetry)
+					}
+					if result.Limit != testPolicy.Burst {
+						t.Errorf("request %d: limit = %d, want %d", i+1, result.Limit, testPolicy.Burst)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestLimiterKeepsBucketsApart(t *testing.T) {
+	other := testPolicy
+	other.Name = "other"
+
+	for _, store := range stores() {
+		t.Run(store.name, func(t *testing.T) {
+			ctx := context.Background()
+			limiter, _ := newTestLimiter(store.open(t))
+
+			for i := 0; i < testPolicy.Burst; i++ {
+				if _, err := limiter.Allow(ctx, testPolicy, "client"); err != nil {
+					t.Fatalf("taking request: %v", err)
+				}
+			}
+
+			tests := []struct {
+				name        string
+				policy      Policy
+				client      string
+				wantAllowed bool
+			}{
+				{name: "same client and policy", policy: testPolicy, client: "client", wantAllowed: false},
+				{name: "other client", policy: testPolicy, client: "another", wantAllowed: true},
+				{name: "other policy", policy: other, client: "client", wantAllowed: true},
+			}
+			for _, tt := range tests {
+				result, err := limiter.Allow(ctx, tt.policy, tt.client)
+				if err != nil {
+					t.Fatalf("%s: %v", tt.name, err)
+				}
+				if result.Allowed != tt.wantAllowed {
+					t.Errorf("%s: allowed = %v, want %v", tt.name, result.Allowed, tt.wantAllowed)
+				}
+			}
+		})
+	}
+}
+
+func TestMemoryStoreRejectsCanceledContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	limiter := NewLimiter(NewMemoryStore())
+	if _, err := limiter.Allow(ctx, testPolicy, "client"); err == nil {
+		t.Error("Allow succeeded with a canceled context")
+	}
+}
@@ -0,0 +1,51 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// memoryPruneInterval is how often buckets that are full again are forgotten
+const memoryPruneInterval = time.Minute
+
+// MemoryStore keeps buckets in the memory of the server. Each replica counts
+// requests on its own, so it suits a single server or local development.
+type MemoryStore struct {
+	mu         sync.Mutex
+	buckets    map[string]time.Time
+	lastPruned time.Time
+}
+
+// NewMemoryStore creates an empty in-memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{buckets: make(map[string]time.Time)}
+}
+
+// Name identifies the store in logs
+func (s *MemoryStore) Name() string {
+	return "memory"
+}
+
+// Update replaces the state of a bucket while holding the store's lock
+func (s *MemoryStore) Update(ctx context.Context, key string, fn func(state time.Time) time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(s.lastPruned) > memoryPruneInterval {
+		for k, state := range s.buckets {
+			if state.Before(now) {
+				delete(s.buckets, k)
+			}
+		}
+		s.lastPruned = now
+	}
+
+	s.buckets[key] = fn(s.buckets[key])
+	return nil
+}
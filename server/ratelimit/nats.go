@@ -0,0 +1,108 @@
+package ratelimit
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	// natsBucket is the JetStream key-value bucket holding the buckets
+	natsBucket = "RATE_LIMITS"
+	// natsBucketTTL is how long a bucket is kept after its last request. It
+	// must be longer than any policy takes to refill a full bucket.
+	natsBucketTTL = time.Hour
+	// natsMaxAttempts bounds the retries when replicas update a bucket at the same time
+	natsMaxAttempts = 5
+)
+
+// NATSStore keeps buckets in a JetStream key-value bucket, so that every
+// replica connected to the NATS server shares them. Concurrent updates are
+// detected with the revision of each key and retried.
+type NATSStore struct {
+	kv nats.KeyValue
+}
+
+// NewNATSStore creates a store on the connection, creating the key-value
+// bucket if it does not exist yet
+func NewNATSStore(nc *nats.Conn) (*NATSStore, error) {
+	if nc == nil {
+		return nil, fmt.Errorf("%w: NATS is not connected", ErrNotConfigured)
+	}
+
+	js, err := nc.JetStream()
+	if err != nil {
+		return nil, fmt.Errorf("error getting JetStream context: %v", err)
+	}
+
+	kv, err := js.KeyValue(natsBucket)
+	if errors.Is(err, nats.ErrBucketNotFound) {
+		kv, err = js.CreateKeyValue(&nats.KeyValueConfig{
+			Bucket:  natsBucket,
+			History: 1,
+			TTL:     natsBucketTTL,
+			Storage: nats.MemoryStorage,
+		})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error setting up %s bucket: %v", natsBucket, err)
+	}
+
+	return &NATSStore{kv: kv}, nil
+}
+
+// Name identifies the store in logs
+func (s *NATSStore) Name() string {
+	return "nats"
+}
+
+// Update replaces the state of a bucket if no other replica changed it in the
+// meantime, and tries again otherwise
+func (s *NATSStore) Update(ctx context.Context, key string, fn func(state time.Time) time.Time) error {
+	// Keys may only contain letters, digits and a few symbols, unlike IP addresses
+	key = base64.RawURLEncoding.EncodeToString([]byte(key))
+
+	for attempt := 1; ; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		var state time.Time
+		var revision uint64
+		entry, err := s.kv.Get(key)
+		switch {
+		case err == nil:
+			revision = entry.Revision()
+			nanos, err := strconv.ParseInt(string(entry.Value()), 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid rate limit state %q: %v", entry.Value(), err)
+			}
+			state = time.Unix(0, nanos)
+		case errors.Is(err, nats.ErrKeyNotFound):
+			// A new bucket, created below with revision 0
+		default:
+			return err
+		}
+
+		next := fn(state)
+		if next.Equal(state) {
+			return nil
+		}
+
+		// Revision 0 only succeeds when the key does not exist
+		_, err = s.kv.Update(key, []byte(strconv.FormatInt(next.UnixNano(), 10)), revision)
+		if err == nil {
+			return nil
+		}
+
+		var apiErr *nats.APIError
+		if !errors.As(err, &apiErr) || apiErr.ErrorCode != nats.JSErrCodeStreamWrongLastSequence || attempt == natsMaxAttempts {
+			return err
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/darooyar/server/db"
+)
+
+// postgresPruneInterval is how often buckets that are full again are deleted
+const postgresPruneInterval = 10 * time.Minute
+
+// PostgresStore keeps buckets in the rate_limits table, so that every
+// replica using the database shares them
+type PostgresStore struct {
+	mu         sync.Mutex
+	lastPruned time.Time
+}
+
+// NewPostgresStore creates a store on the database opened by db.InitDB
+func NewPostgresStore() (*PostgresStore, error) {
+	if db.DB == nil {
+		return nil, fmt.Errorf("%w: the database is not initialized", ErrNotConfigured)
+	}
+	return &PostgresStore{}, nil
+}
+
+// Name identifies the store in logs
+func (s *PostgresStore) Name() string {
+	return "postgres"
+}
+
+// Update replaces the state of a bucket in a transaction that locks its row
+func (s *PostgresStore) Update(ctx context.Context, key string, fn func(state time.Time) time.Time) error {
+	if s.shouldPrune() {
+		if err := db.PruneRateLimits(ctx); err != nil {
+			slog.ErrorContext(ctx, "Error pruning rate limits", "error", err)
+		}
+	}
+
+	return db.UpdateRateLimit(ctx, key, fn)
+}
+
+// shouldPrune reports whether it is time to delete the buckets that are full again
+func (s *PostgresStore) shouldPrune() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if time.Since(s.lastPruned) < postgresPruneInterval {
+		return false
+	}
+	s.lastPruned = time.Now()
+	return true
+}
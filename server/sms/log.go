@@ -0,0 +1,30 @@
+package sms
+
+import (
+	"context"
+	"log/slog"
+)
+
+// LogSender writes codes to the server log instead of sending them. It is
+// meant for local development, where no SMS provider is available.
+type LogSender struct{}
+
+// NewLogSender creates a sender that only logs codes
+func NewLogSender() *LogSender {
+	return &LogSender{}
+}
+
+// Name identifies the provider in logs
+func (s *LogSender) Name() string {
+	return "log"
+}
+
+// SendCode logs the code for the phone number
+func (s *LogSender) SendCode(ctx context.Context, phone, code string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	slog.InfoContext(ctx, "SMS code", "phone", phone, "code", code)
+	return nil
+}
@@ -0,0 +1,71 @@
+// Package sms sends the one-time codes with which users log in by phone.
+package sms
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/darooyar/server/config"
+	"github.com/darooyar/server/textnorm"
+)
+
+// ErrNotConfigured is returned when the selected sender is missing required settings
+var ErrNotConfigured = errors.New("sms sender not configured")
+
+// ErrInvalidPhone is returned for numbers that are not Iranian mobile numbers
+var ErrInvalidPhone = errors.New("invalid mobile number")
+
+// Sender is implemented by every SMS provider the server can send codes through
+type Sender interface {
+	// Name identifies the provider in logs
+	Name() string
+	// SendCode sends a one-time login code to a phone number in the
+	// international format returned by NormalizePhone
+	SendCode(ctx context.Context, phone, code string) error
+}
+
+// NewSender creates the sender selected in the configuration
+func NewSender(cfg *config.Config) (Sender, error) {
+	switch cfg.SMSProvider {
+	case "", "kavenegar":
+		if cfg.KavenegarAPIKey == "" {
+			return nil, fmt.Errorf("%w: KAVENEGAR_API_KEY is not set", ErrNotConfigured)
+		}
+		return NewKavenegarSender(cfg.KavenegarAPIKey, cfg.KavenegarSender, cfg.KavenegarTemplate), nil
+	case "log":
+		return NewLogSender(), nil
+	default:
+		return nil, fmt.Errorf("unknown sms provider %q", cfg.SMSProvider)
+	}
+}
+
+// NormalizePhone converts an Iranian mobile number written as 09xxxxxxxxx,
+// 9xxxxxxxxx, 989xxxxxxxxx, 00989xxxxxxxxx or +989xxxxxxxxx, with Persian or
+// English digits, to +989xxxxxxxxx
+func NormalizePhone(phone string) (string, error) {
+	phone = strings.NewReplacer(" ", "", "-", "", "(", "", ")", "").Replace(textnorm.Normalize(phone))
+
+	switch {
+	case strings.HasPrefix(phone, "+98"):
+		phone = phone[3:]
+	case strings.HasPrefix(phone, "0098"):
+		phone = phone[4:]
+	case strings.HasPrefix(phone, "98") && len(phone) == 12:
+		phone = phone[2:]
+	case strings.HasPrefix(phone, "0"):
+		phone = phone[1:]
+	}
+
+	if len(phone) != 10 || phone[0] != '9' {
+		return "", ErrInvalidPhone
+	}
+	for _, r := range phone {
+		if r < '0' || r > '9' {
+			return "", ErrInvalidPhone
+		}
+	}
+
+	return "+98" + phone, nil
+}
@@ -4,7 +4,7 @@ import (
 	"context"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"path/filepath"
 	"strings"
 	"time"
@@ -26,7 +26,7 @@ type S3Client struct {
 }
 
 // NewS3Client creates a new S3 client using environment variables
-func NewS3Client() (*S3Client, error) {
+func NewS3Client(ctx context.Context) (*S3Client, error) {
 	// Get configuration
 	cfg := config.GetConfig()
 
@@ -36,7 +36,7 @@ func NewS3Client() (*S3Client, error) {
 	}
 
 	// Create AWS config
-	awsCfg, err := awsconfig.LoadDefaultConfig(context.TODO(), awsconfig.WithRegion("us-west-2"))
+	awsCfg, err := awsconfig.LoadDefaultConfig(ctx, awsconfig.WithRegion("us-west-2"))
 	if err != nil {
 		return nil, fmt.Errorf("failed to load AWS config: %w", err)
 	}
@@ -61,7 +61,7 @@ func NewS3Client() (*S3Client, error) {
 }
 
 // UploadFile uploads a file to S3 storage and returns the public URL
-func (s *S3Client) UploadFile(fileContent io.Reader, fileName string, contentType string) (string, error) {
+func (s *S3Client) UploadFile(ctx context.Context, fileContent io.Reader, fileName string, contentType string) (string, error) {
 	// Read the file content
 	fileBytes, err := io.ReadAll(fileContent)
 	if err != nil {
@@ -77,7 +77,7 @@ func (s *S3Client) UploadFile(fileContent io.Reader, fileName string, contentTyp
 			detectedType := detectMimeType(fileBytes)
 			if detectedType != "" {
 				contentType = detectedType
-				log.Printf("Detected image MIME type: %s for file %s", contentType, fileName)
+				slog.Debug("Detected image MIME type", "content_type", contentType)
 			} else {
 				// Fallback to extension-based detection
 				switch fileExt {
@@ -94,7 +94,7 @@ func (s *S3Client) UploadFile(fileContent io.Reader, fileName string, contentTyp
 				default:
 					contentType = "image/jpeg" // Default to JPEG for unknown image types
 				}
-				log.Printf("Set MIME type to %s based on extension for file %s", contentType, fileName)
+				slog.Debug("Set MIME type based on extension", "content_type", contentType)
 			}
 		}
 	}
@@ -105,7 +105,7 @@ func (s *S3Client) UploadFile(fileContent io.Reader, fileName string, contentTyp
 	destinationKey := fmt.Sprintf("prescriptions/%d%s", timestamp, fileExt)
 
 	// Upload the file to S3
-	_, err = s.client.PutObject(context.TODO(), &s3.PutObjectInput{
+	_, err = s.client.PutObject(ctx, &s3.PutObjectInput{
 		Bucket:      aws.String(s.bucketName),
 		Key:         aws.String(destinationKey),
 		Body:        bytes.NewReader(fileBytes),
@@ -118,7 +118,7 @@ func (s *S3Client) UploadFile(fileContent io.Reader, fileName string, contentTyp
 
 	// Generate the public URL
 	publicURL := fmt.Sprintf("%s/%s/%s", s.endpoint, s.bucketName, destinationKey)
-	log.Printf("File uploaded successfully to %s with content type: %s", publicURL, contentType)
+	slog.Info("File uploaded", "key", destinationKey, "content_type", contentType)
 
 	return publicURL, nil
 }
@@ -160,12 +160,12 @@ func detectMimeType(data []byte) string {
 }
 
 // GetTemporaryURL generates a temporary signed URL for the given object
-func (s *S3Client) GetTemporaryURL(objectKey string, expiration time.Duration) (string, error) {
+func (s *S3Client) GetTemporaryURL(ctx context.Context, objectKey string, expiration time.Duration) (string, error) {
 	// Create a presigner client
 	presignClient := s3.NewPresignClient(s.client)
 
 	// Generate a pre-signed URL
-	presignedReq, err := presignClient.PresignGetObject(context.TODO(), &s3.GetObjectInput{
+	presignedReq, err := presignClient.PresignGetObject(ctx, &s3.GetObjectInput{
 		Bucket: aws.String(s.bucketName),
 		Key:    aws.String(objectKey),
 	}, s3.WithPresignExpires(expiration))
@@ -177,8 +177,8 @@ func (s *S3Client) GetTemporaryURL(objectKey string, expiration time.Duration) (
 }
 
 // DeleteFile deletes a file from S3 storage
-func (s *S3Client) DeleteFile(objectKey string) error {
-	_, err := s.client.DeleteObject(context.TODO(), &s3.DeleteObjectInput{
+func (s *S3Client) DeleteFile(ctx context.Context, objectKey string) error {
+	_, err := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
 		Bucket: aws.String(s.bucketName),
 		Key:    aws.String(objectKey),
 	})
@@ -186,6 +186,6 @@ func (s *S3Client) DeleteFile(objectKey string) error {
 		return fmt.Errorf("failed to delete file from S3: %w", err)
 	}
 
-	log.Printf("File deleted successfully: %s", objectKey)
+	slog.Info("File deleted", "key", objectKey)
 	return nil
 }
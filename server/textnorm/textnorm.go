@@ -0,0 +1,59 @@
+// Package textnorm normalizes Persian and English text so that the same word
+// written with different keyboards or spellings compares equal.
+package textnorm
+
+import (
+	"strings"
+	"unicode"
+)
+
+// replacer unifies Arabic and Persian variants of the same letters and digits
+var replacer = strings.NewReplacer(
+	"ي", "ی", "ى", "ی", "ئ", "ی",
+	"ك", "ک",
+	"ة", "ه", "ۀ", "ه",
+	"أ", "ا", "إ", "ا", "ٱ", "ا",
+	"ؤ", "و",
+	"۰", "0", "۱", "1", "۲", "2", "۳", "3", "۴", "4",
+	"۵", "5", "۶", "6", "۷", "7", "۸", "8", "۹", "9",
+	"٠", "0", "١", "1", "٢", "2", "٣", "3", "٤", "4",
+	"٥", "5", "٦", "6", "٧", "7", "٨", "8", "٩", "9",
+)
+
+// Normalize lowercases the text, unifies letter and digit variants, drops
+// diacritics, zero-width characters and tatweel, and collapses whitespace
+func Normalize(text string) string {
+	text = replacer.Replace(text)
+
+	var b strings.Builder
+	b.Grow(len(text))
+	space := false
+	for _, r := range text {
+		switch {
+		case r == '‌' || r == '‍' || r == '‏' || r == '‎' || r == 'ـ':
+			// Zero-width joiners, direction marks and tatweel carry no meaning
+			continue
+		case unicode.Is(unicode.Mn, r):
+			// Harakat and other combining marks
+			continue
+		case unicode.IsSpace(r):
+			space = b.Len() > 0
+			continue
+		}
+
+		if space {
+			b.WriteByte(' ')
+			space = false
+		}
+		b.WriteRune(unicode.ToLower(r))
+	}
+
+	return b.String()
+}
+
+// Fields splits normalized text into words, treating punctuation as separators
+func Fields(text string) []string {
+	return strings.FieldsFunc(Normalize(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}